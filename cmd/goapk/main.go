@@ -0,0 +1,181 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command goapk is a small apk-like CLI built on the go-apk library. It exercises the library end to end,
+// and shows how its APIs fit together, rather than aiming to replace apk-tools.
+//
+// Usage:
+//
+//	goapk <command> [flags] [args]
+//
+// The commands are add, del, fix, index, sign, search, policy and fetch. Run goapk <command> -h for the
+// flags of each.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/clog"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// command is a subcommand of goapk. run gets the arguments after the name of the command, and writes its
+// output to stdout.
+type command struct {
+	summary string
+	run     func(ctx context.Context, args []string, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"add":    {"add packages to the world and install them", runAdd},
+	"del":    {"remove packages from the world", runDel},
+	"fix":    {"install the packages the world needs", runFix},
+	"index":  {"write an APKINDEX for .apk files", runIndex},
+	"sign":   {"sign an APKINDEX", runSign},
+	"search": {"search the repositories for packages", runSearch},
+	"policy": {"show the versions of packages in the repositories", runPolicy},
+	"fetch":  {"download packages from the repositories", runFetch},
+}
+
+func main() {
+	ctx := clog.WithLogger(context.Background(), clog.New(slog.NewTextHandler(os.Stderr, nil)))
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "goapk: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage(os.Stderr)
+		return flag.ErrHelp
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd.run(ctx, args[1:], stdout)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: goapk <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].summary)
+	}
+}
+
+// rootFlags are the flags of the commands that work with the apk database in a root, as apk-tools does.
+type rootFlags struct {
+	root              string
+	arch              string
+	cacheDir          string
+	configDir         string
+	configRoot        string
+	dbDir             string
+	offline           bool
+	allowUntrusted    bool
+	ignoreMknodErrors bool
+}
+
+func addRootFlags(fs *flag.FlagSet) *rootFlags {
+	f := &rootFlags{}
+	fs.StringVar(&f.root, "root", "/", "root of the filesystem to manage")
+	fs.StringVar(&f.arch, "arch", "", "architecture of the packages, by default that of the root, or of this host")
+	fs.StringVar(&f.cacheDir, "cache-dir", "", "directory to cache indexes and packages in, none by default")
+	fs.StringVar(&f.configDir, "config-dir", "etc/apk", "directory of the apk configuration in the root")
+	fs.StringVar(&f.configRoot, "config-root", "", "root to read the repositories and keys from instead, e.g. / for those of this host")
+	fs.StringVar(&f.dbDir, "db-dir", "lib/apk/db", "directory of the apk database in the root")
+	fs.BoolVar(&f.offline, "offline", false, "only use what is in the cache")
+	fs.BoolVar(&f.allowUntrusted, "allow-untrusted", false, "do not verify the signatures of the indexes, or of .apk files to add")
+	fs.BoolVar(&f.ignoreMknodErrors, "ignore-mknod-errors", false, "do not fail when device files cannot be created")
+	return f
+}
+
+// newAPK returns an APK for the root, with extra options. When untrusted indexes are allowed, the
+// repositories of the root are read first, so that their indexes are not verified.
+func (f *rootFlags) newAPK(ctx context.Context, extra ...apk.Option) (*apk.APK, error) {
+	opts := []apk.Option{
+		apk.WithFS(apkfs.DirFS(f.root)),
+		apk.WithIgnoreMknodErrors(f.ignoreMknodErrors),
+		apk.WithConfigDir(f.configDir),
+		apk.WithDatabaseDir(f.dbDir),
+		apk.WithAllowUntrusted(f.allowUntrusted),
+	}
+	if f.arch != "" {
+		opts = append(opts, apk.WithArch(f.arch))
+	} else if b, err := os.ReadFile(filepath.Join(f.root, f.configDir, "arch")); err == nil {
+		opts = append(opts, apk.WithArch(strings.TrimSpace(string(b))))
+	}
+	if f.configRoot != "" {
+		opts = append(opts, apk.WithHostConfig(os.DirFS(f.configRoot)))
+	}
+	if f.cacheDir != "" || f.offline {
+		opts = append(opts, apk.WithCache(f.cacheDir, f.offline))
+	}
+	opts = append(opts, extra...)
+
+	a, err := apk.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if !f.allowUntrusted {
+		return a, nil
+	}
+	repos, err := a.GetRepositories()
+	if err != nil {
+		clog.FromContext(ctx).Debugf("no repositories to allow untrusted indexes for: %v", err)
+		return a, nil
+	}
+	return apk.New(append(opts, apk.WithNoSignatureIndexes(repos...))...)
+}
+
+// stringsFlag is a flag that may be given more than once.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: goapk %s [flags] %s\n\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPackage = "../../pkg/apk/testdata/replaces/replaces-0.0.1-r0.apk"
+	testKey     = "../../pkg/signature/testdata/test.rsa"
+)
+
+func runGoapk(t *testing.T, args ...string) string {
+	t.Helper()
+	var stdout bytes.Buffer
+	require.NoError(t, run(context.Background(), args, &stdout), "goapk %s", strings.Join(args, " "))
+	return stdout.String()
+}
+
+func TestEndToEnd(t *testing.T) {
+	tmp := t.TempDir()
+	repo := filepath.Join(tmp, "repo")
+	root := filepath.Join(tmp, "root")
+	out := filepath.Join(tmp, "out")
+	for _, dir := range []string{filepath.Join(repo, "aarch64"), root, out} {
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+	}
+	b, err := os.ReadFile(testPackage)
+	require.NoError(t, err)
+	apkFile := filepath.Join(repo, "aarch64", filepath.Base(testPackage))
+	require.NoError(t, os.WriteFile(apkFile, b, 0o644))
+
+	index := filepath.Join(repo, "aarch64", "APKINDEX.tar.gz")
+	runGoapk(t, "index", "-o", index, apkFile)
+	runGoapk(t, "sign", "-k", testKey, index)
+
+	rootArgs := []string{"-root", root, "-arch", "aarch64"}
+	got := runGoapk(t, append([]string{"add", "-initdb", "-ignore-mknod-errors", "-repository", repo, "-keyring", testKey + ".pub"}, append(rootArgs, "replaces")...)...)
+	require.Equal(t, "installed replaces-0.0.1-r0\n", got)
+	world, err := os.ReadFile(filepath.Join(root, "etc/apk/world"))
+	require.NoError(t, err)
+	require.Equal(t, "replaces\n", string(world))
+
+	require.Equal(t, "replaces-0.0.1-r0\n", runGoapk(t, append([]string{"search"}, append(rootArgs, "plac")...)...))
+	require.Empty(t, runGoapk(t, append([]string{"search"}, append(rootArgs, "nothing")...)...))
+
+	got = runGoapk(t, append([]string{"policy"}, append(rootArgs, "replaces")...)...)
+	require.Contains(t, got, "0.0.1-r0 (installed):")
+
+	require.Equal(t, "fetched replaces-0.0.1-r0.apk\n", runGoapk(t, append([]string{"fetch", "-o", out}, append(rootArgs, "replaces")...)...))
+	fetched, err := os.ReadFile(filepath.Join(out, "replaces-0.0.1-r0.apk"))
+	require.NoError(t, err)
+	require.Equal(t, b, fetched)
+
+	got = runGoapk(t, append([]string{"del"}, append(rootArgs, "replaces")...)...)
+	require.Equal(t, "no longer needed: replaces-0.0.1-r0\n", got)
+
+	usrRoot := filepath.Join(tmp, "usr-root")
+	require.NoError(t, os.MkdirAll(usrRoot, 0o755))
+	usrArgs := []string{"-root", usrRoot, "-arch", "aarch64", "-db-dir", "usr/lib/apk/db"}
+	got = runGoapk(t, append([]string{"add", "-initdb", "-ignore-mknod-errors", "-repository", repo, "-keyring", testKey + ".pub"}, append(usrArgs, "replaces")...)...)
+	require.Equal(t, "installed replaces-0.0.1-r0\n", got)
+	installed, err := os.ReadFile(filepath.Join(usrRoot, "usr/lib/apk/db/installed"))
+	require.NoError(t, err)
+	require.Contains(t, string(installed), "P:replaces\n")
+
+	// the repositories and keys of the first root are used to install into another
+	hostRoot := filepath.Join(tmp, "host-root")
+	require.NoError(t, os.MkdirAll(hostRoot, 0o755))
+	hostArgs := []string{"-root", hostRoot, "-arch", "aarch64", "-config-root", root}
+	got = runGoapk(t, append([]string{"add", "-initdb", "-ignore-mknod-errors"}, append(hostArgs, "replaces")...)...)
+	require.Equal(t, "installed replaces-0.0.1-r0\n", got)
+}
@@ -0,0 +1,243 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// runIndex writes an APKINDEX for .apk files, as apk index does. The index is not signed, see runSign.
+func runIndex(ctx context.Context, args []string, _ io.Writer) error {
+	fs := newFlagSet("index", "<file.apk>...")
+	output := fs.String("o", "APKINDEX.tar.gz", "file to write the index to")
+	description := fs.String("description", "", "description of the index")
+	level := fs.Int("compression-level", gzip.DefaultCompression, "gzip level to compress the index at, from -2 for Huffman only to 9 for the best compression")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	index := &apk.APKIndex{Description: *description}
+	for _, name := range fs.Args() {
+		pkg, err := parsePackageFile(ctx, name)
+		if err != nil {
+			return err
+		}
+		index.Packages = append(index.Packages, pkg)
+	}
+
+	archive, err := apk.ArchiveFromIndex(index, apk.WithArchiveCompressionLevel(*level))
+	if err != nil {
+		return fmt.Errorf("archiving index: %w", err)
+	}
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, archive); err != nil {
+		return fmt.Errorf("writing index to %s: %w", *output, err)
+	}
+	return out.Close()
+}
+
+func parsePackageFile(ctx context.Context, name string) (*apk.Package, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pkg, err := apk.ParsePackage(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing package %s: %w", name, err)
+	}
+	return pkg, nil
+}
+
+// runSign signs an APKINDEX in place with an RSA private key.
+func runSign(ctx context.Context, args []string, _ io.Writer) error {
+	fs := newFlagSet("sign", "<APKINDEX.tar.gz>")
+	key := fs.String("k", "", "private key to sign with, named as the public key to verify with, e.g. me.rsa")
+	passphraseEnv := fs.String("passphrase-env", "", "environment variable with the passphrase of the key, if it is encrypted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("a key and one index are needed")
+	}
+
+	var opts []signature.SignerOption
+	if *passphraseEnv != "" {
+		opts = append(opts, signature.WithPassphrase(signature.EnvPassphrase(*passphraseEnv)))
+	}
+	signer, err := signature.NewKeySigner(*key, opts...)
+	if err != nil {
+		return err
+	}
+	return signature.SignIndexWithSigner(ctx, signer, fs.Arg(0))
+}
+
+// runSearch lists the packages in the repositories of the root with names that match any of the patterns,
+// as apk search does. A pattern is a glob, and one without any of *?[ matches names that contain it.
+func runSearch(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := newFlagSet("search", "<pattern>...")
+	f := addRootFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	patterns := fs.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	for i, pattern := range patterns {
+		if !strings.ContainsAny(pattern, "*?[") {
+			patterns[i] = "*" + pattern + "*"
+		}
+	}
+
+	_, indexes, err := f.indexes(ctx)
+	if err != nil {
+		return err
+	}
+	var found []string
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			for _, pattern := range patterns {
+				match, err := path.Match(pattern, pkg.Name)
+				if err != nil {
+					return fmt.Errorf("invalid pattern %s: %w", pattern, err)
+				}
+				if match {
+					found = append(found, pkg.Name+"-"+pkg.Version)
+					break
+				}
+			}
+		}
+	}
+	slices.Sort(found)
+	for _, pkg := range slices.Compact(found) {
+		fmt.Fprintln(stdout, pkg)
+	}
+	return nil
+}
+
+// runPolicy lists the versions of packages in each repository of the root, as apk policy does, and which
+// of them is installed.
+func runPolicy(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := newFlagSet("policy", "<package>...")
+	f := addRootFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, indexes, err := f.indexes(ctx)
+	if err != nil {
+		return err
+	}
+	installed := map[string]string{}
+	if pkgs, err := a.GetInstalled(); err == nil {
+		for _, pkg := range pkgs {
+			installed[pkg.Name] = pkg.Version
+		}
+	}
+
+	for _, name := range fs.Args() {
+		fmt.Fprintf(stdout, "%s policy:\n", name)
+		for _, index := range indexes {
+			for _, pkg := range index.Packages() {
+				if pkg.Name != name {
+					continue
+				}
+				var mark string
+				if installed[name] == pkg.Version {
+					mark = " (installed)"
+				}
+				fmt.Fprintf(stdout, "  %s%s:\n    %s\n", pkg.Version, mark, index.Source())
+			}
+		}
+	}
+	return nil
+}
+
+// runFetch downloads packages from the repositories of the root, without their dependencies, as apk fetch
+// does.
+func runFetch(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := newFlagSet("fetch", "<package>...")
+	f := addRootFlags(fs)
+	output := fs.String("o", ".", "directory to write the packages to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, indexes, err := f.indexes(ctx)
+	if err != nil {
+		return err
+	}
+	resolver := apk.NewPkgResolver(ctx, indexes)
+	for _, name := range fs.Args() {
+		pkgs, err := resolver.ResolvePackage(name, nil)
+		if err != nil {
+			return err
+		}
+		pkg := pkgs[0]
+		if err := fetchTo(ctx, a, pkg, filepath.Join(*output, pkg.Filename())); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "fetched %s\n", pkg.Filename())
+	}
+	return nil
+}
+
+func fetchTo(ctx context.Context, a *apk.APK, pkg *apk.RepositoryPackage, name string) error {
+	rc, err := a.FetchPackage(ctx, pkg)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", pkg.Filename(), err)
+	}
+	defer rc.Close()
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, rc); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	return out.Close()
+}
+
+// indexes returns an APK for the root, and the indexes of its repositories.
+func (f *rootFlags) indexes(ctx context.Context) (*apk.APK, []apk.NamedIndex, error) {
+	a, err := f.newAPK(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexes, err := a.GetRepositoryIndexes(ctx, f.allowUntrusted)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting repository indexes: %w", err)
+	}
+	return a, indexes, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+)
+
+// runAdd adds packages to the world of the root, and installs what the world needs, as apk add does.
+func runAdd(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := newFlagSet("add", "<package>...")
+	f := addRootFlags(fs)
+	initDB := fs.Bool("initdb", false, "initialize the apk database in the root first")
+	var repos, keys stringsFlag
+	fs.Var(&repos, "repository", "repository to write to the repositories of the config dir, replacing what it has; may be repeated")
+	fs.Var(&keys, "keyring", "public key file to install into the keys of the config dir; may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := f.newAPK(ctx, installer(stdout))
+	if err != nil {
+		return err
+	}
+	if *initDB {
+		if err := a.InitDB(ctx); err != nil {
+			return fmt.Errorf("initializing the apk database: %w", err)
+		}
+	}
+	if len(keys) > 0 {
+		if err := a.InitKeyring(ctx, keys, nil); err != nil {
+			return fmt.Errorf("installing keys: %w", err)
+		}
+	}
+	if len(repos) > 0 {
+		if err := a.SetRepositories(ctx, repos); err != nil {
+			return fmt.Errorf("setting repositories: %w", err)
+		}
+		// so that the new repositories are not verified with -allow-untrusted
+		if a, err = f.newAPK(ctx, installer(stdout)); err != nil {
+			return err
+		}
+	}
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("reading world: %w", err)
+	}
+	for _, pkg := range fs.Args() {
+		if !slices.Contains(world, pkg) {
+			world = append(world, pkg)
+		}
+	}
+	if err := a.SetWorld(ctx, world); err != nil {
+		return fmt.Errorf("writing world: %w", err)
+	}
+	if err := a.FixateWorld(ctx, nil); err != nil {
+		return fmt.Errorf("installing world: %w", err)
+	}
+	return nil
+}
+
+// runDel removes packages from the world of the root. Removing the files of installed packages is not
+// supported by the library, so del lists the installed packages that the world no longer needs instead.
+func runDel(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := newFlagSet("del", "<package>...")
+	f := addRootFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("no packages to remove")
+	}
+
+	a, err := f.newAPK(ctx)
+	if err != nil {
+		return err
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return fmt.Errorf("reading world: %w", err)
+	}
+	for _, pkg := range fs.Args() {
+		if !slices.Contains(world, pkg) {
+			return fmt.Errorf("%s is not in the world", pkg)
+		}
+	}
+	world = slices.DeleteFunc(world, func(pkg string) bool {
+		return slices.Contains(fs.Args(), pkg)
+	})
+	if err := a.SetWorld(ctx, world); err != nil {
+		return fmt.Errorf("writing world: %w", err)
+	}
+
+	orphans, err := a.GetOrphans()
+	if err != nil {
+		return fmt.Errorf("finding packages that are no longer needed: %w", err)
+	}
+	for _, pkg := range orphans {
+		fmt.Fprintf(stdout, "no longer needed: %s-%s\n", pkg.Name, pkg.Version)
+	}
+	return nil
+}
+
+// runFix installs what the world of the root needs, as apk fix does.
+func runFix(ctx context.Context, args []string, stdout io.Writer) error {
+	fs := newFlagSet("fix", "")
+	f := addRootFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	a, err := f.newAPK(ctx, installer(stdout))
+	if err != nil {
+		return err
+	}
+	if err := a.FixateWorld(ctx, nil); err != nil {
+		return fmt.Errorf("installing world: %w", err)
+	}
+	return nil
+}
+
+// installer returns an option for New that prints each package as it is installed.
+func installer(stdout io.Writer) apk.Option {
+	var mu sync.Mutex
+	return apk.WithEventHandler(func(_ context.Context, event apk.Event) {
+		if event.Type != apk.EventPackageInstalled {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(stdout, "installed %s-%s\n", event.Package, event.Version)
+	})
+}
@@ -7,11 +7,13 @@ require (
 	github.com/chainguard-dev/clog v1.3.1
 	github.com/google/go-cmp v0.6.0
 	github.com/klauspost/compress v1.17.8
+	github.com/klauspost/pgzip v1.2.6
 	github.com/psanford/memfs v0.0.0-20230130182539-4dbf7e3e865e
 	github.com/stretchr/testify v1.9.0
 	go.lsp.dev/uri v0.3.0
 	go.opentelemetry.io/otel v1.27.0
 	go.opentelemetry.io/otel/trace v1.27.0
+	golang.org/x/crypto v0.24.0
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63
 	golang.org/x/sync v0.7.0
 	golang.org/x/sys v0.21.0
@@ -0,0 +1,206 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gzindex
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testData returns data that compresses with all kinds of blocks: runs, text, and random bytes.
+func testData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for b.Len() < size {
+		switch rnd.Intn(3) {
+		case 0:
+			b.Write(bytes.Repeat([]byte{byte(rnd.Intn(256))}, rnd.Intn(1000)))
+		case 1:
+			fmt.Fprintf(&b, "line %d of some text that repeats itself\n", rnd.Intn(100))
+		default:
+			random := make([]byte, rnd.Intn(5000))
+			rnd.Read(random)
+			b.Write(random)
+		}
+	}
+	return b.Bytes()[:size]
+}
+
+func gzipped(t *testing.T, level int, parts ...[]byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	for _, part := range parts {
+		zw, err := gzip.NewWriterLevel(&b, level)
+		require.NoError(t, err)
+		zw.Name = "member"
+		_, err = zw.Write(part)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+	}
+	return b.Bytes()
+}
+
+func checkReads(t *testing.T, z *ReaderAt, want []byte) {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		off := rnd.Int63n(int64(len(want)))
+		p := make([]byte, rnd.Intn(100000))
+		n, err := z.ReadAt(p, off)
+		end := min(off+int64(len(p)), int64(len(want)))
+		require.Equal(t, want[off:end], p[:n], "reading %d bytes at %d", len(p), off)
+		if end < off+int64(len(p)) {
+			require.ErrorIs(t, err, io.EOF)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+	_, err := z.ReadAt(make([]byte, 1), int64(len(want)))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestReaderAt(t *testing.T) {
+	data := testData(3 << 20)
+	for _, level := range []int{gzip.NoCompression, gzip.HuffmanOnly, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		t.Run(fmt.Sprintf("level %d", level), func(t *testing.T) {
+			compressed := gzipped(t, level, data[:1<<20], data[1<<20:])
+			idx, err := Build(bytes.NewReader(compressed), 64<<10)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), idx.Size())
+			require.Greater(t, len(idx.checkpoints), 10)
+			checkReads(t, NewReaderAt(bytes.NewReader(compressed), idx), data)
+
+			b, err := idx.MarshalBinary()
+			require.NoError(t, err)
+			var decoded Index
+			require.NoError(t, decoded.UnmarshalBinary(b))
+			require.Equal(t, idx, &decoded)
+		})
+	}
+}
+
+func TestReaderAtPackage(t *testing.T) {
+	// a signed package is three gzip members, the signature, control and data sections
+	compressed, err := os.ReadFile("../../pkg/apk/testdata/alpine-316/alpine-baselayout-3.2.0-r23.apk")
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	want, err := io.ReadAll(zr)
+	require.NoError(t, err)
+
+	idx, err := Build(bytes.NewReader(compressed), 1024)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(want)), idx.Size())
+	checkReads(t, NewReaderAt(bytes.NewReader(compressed), idx), want)
+}
+
+func TestBuildCorrupt(t *testing.T) {
+	compressed := gzipped(t, gzip.DefaultCompression, testData(100000))
+	for name, b := range map[string][]byte{
+		"empty":     {},
+		"truncated": compressed[:len(compressed)/2],
+		"not gzip":  []byte("not a gzip stream"),
+		"checksum":  append(append([]byte{}, compressed[:len(compressed)-8]...), 0, 0, 0, 0, 0, 0, 0, 0),
+	} {
+		_, err := Build(bytes.NewReader(b), 0)
+		require.Error(t, err, name)
+	}
+
+	var idx Index
+	require.Error(t, idx.UnmarshalBinary([]byte("gzix\x01\x05")))
+}
+
+// gzipMember wraps the deflate stream raw in a gzip member, with a trailer for out, what it decompresses to.
+func gzipMember(raw, out []byte) []byte {
+	b := []byte{gzipID1, gzipID2, gzipDeflate, 0, 0, 0, 0, 0, 0, 0xff}
+	b = append(b, raw...)
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(out))
+	return binary.LittleEndian.AppendUint32(b, uint32(len(out)))
+}
+
+// FuzzReaderAt compares the inflater against compress/flate: on b as a deflate stream, and on b compressed
+// at some level, where reads at any offset have to be what compress/flate decompresses.
+func FuzzReaderAt(f *testing.F) {
+	for _, level := range []int{flate.NoCompression, flate.HuffmanOnly, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+		var b bytes.Buffer
+		zw, err := flate.NewWriter(&b, level)
+		require.NoError(f, err)
+		_, err = zw.Write(testData(20000))
+		require.NoError(f, err)
+		require.NoError(f, zw.Close())
+		f.Add(b.Bytes(), uint8(level+2), uint16(1000), uint32(5000), uint32(15000))
+	}
+	f.Add([]byte("some text that some text repeats"), uint8(8), uint16(1), uint32(3), uint32(0))
+
+	f.Fuzz(func(t *testing.T, b []byte, level uint8, extra uint16, off1, off2 uint32) {
+		// each checkpoint keeps a window, so there are no more of them than there are KB of output
+		span := int64(extra) + 1024
+		check := func(t *testing.T, compressed, want []byte) {
+			t.Helper()
+			idx, err := Build(bytes.NewReader(compressed), span)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(want)), idx.Size())
+			if len(want) == 0 {
+				return
+			}
+			z := NewReaderAt(bytes.NewReader(compressed), idx)
+			// the second read is before the first as often as after it
+			for _, off := range []int64{int64(off1) % int64(len(want)), int64(off2) % int64(len(want))} {
+				p := make([]byte, min(len(want), 3*int(span)))
+				n, err := z.ReadAt(p, off)
+				end := min(off+int64(len(p)), int64(len(want)))
+				require.Equal(t, want[off:end], p[:n], "reading %d bytes at %d", len(p), off)
+				if end < off+int64(len(p)) {
+					require.ErrorIs(t, err, io.EOF)
+				} else {
+					require.NoError(t, err)
+				}
+			}
+		}
+
+		t.Run("deflate", func(t *testing.T) {
+			br := bytes.NewReader(b)
+			want, err := io.ReadAll(flate.NewReader(br))
+			if err != nil {
+				// the trailer cannot be all a truncated stream is missing
+				_, err := Build(bytes.NewReader(gzipMember(b, nil)), span)
+				require.Error(t, err)
+				return
+			}
+			// compress/flate reads no further than the end of the stream from an io.ByteReader
+			check(t, gzipMember(b[:len(b)-br.Len()], want), want)
+		})
+
+		t.Run("compressed", func(t *testing.T) {
+			var compressed bytes.Buffer
+			zw, err := gzip.NewWriterLevel(&compressed, int(level%12)-2)
+			require.NoError(t, err)
+			_, err = zw.Write(b)
+			require.NoError(t, err)
+			require.NoError(t, zw.Close())
+			check(t, compressed.Bytes(), b)
+		})
+	})
+}
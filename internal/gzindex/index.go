@@ -0,0 +1,283 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gzindex serves random reads from gzip streams. An Index of a stream remembers where some of its
+// deflate blocks start, and the output before each of them, so that reading at an offset only decompresses
+// from the closest block before it, rather than from the beginning of the stream.
+package gzindex
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// DefaultSpan is how much output there is between the checkpoints of an Index, unless Build is told
+// otherwise. Each checkpoint holds on to 32KB, so this keeps the index at about 3% of the output, and a
+// read decompresses up to as much before what it reads.
+const DefaultSpan = 1 << 20
+
+const indexMagic = "gzix\x01"
+
+// checkpoint is the start of a deflate block: the byte of the stream it starts in, at bit bits of it,
+// the offset in the output it decompresses to, and the output before it that its matches can refer to.
+type checkpoint struct {
+	in     int64
+	bits   uint8
+	out    int64
+	window []byte
+}
+
+// Index is the checkpoints of a gzip stream.
+type Index struct {
+	size           int64
+	compressedSize int64
+	checkpoints    []checkpoint
+}
+
+var (
+	_ encoding.BinaryMarshaler   = (*Index)(nil)
+	_ encoding.BinaryUnmarshaler = (*Index)(nil)
+)
+
+// Build decompresses the gzip stream r, which may have several members, checking them, and returns an
+// index with a checkpoint about every span bytes of output. If span is 0 or less, it is DefaultSpan.
+func Build(r io.Reader, span int64) (*Index, error) {
+	if span <= 0 {
+		span = DefaultSpan
+	}
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReaderSize(r, chunkSize)
+	}
+
+	idx := &Index{}
+	f := &inflater{verify: true}
+	f.reset(br)
+	var last int64
+	f.onBlock = func() {
+		out := f.out()
+		if out-last < span {
+			return
+		}
+		pos := f.br.pos()
+		idx.checkpoints = append(idx.checkpoints, checkpoint{
+			in:     pos / 8,
+			bits:   uint8(pos % 8),
+			out:    out,
+			window: append([]byte(nil), f.hist[max(0, f.w-windowSize):f.w]...),
+		})
+		last = out
+	}
+	n, err := io.Copy(io.Discard, f)
+	if err != nil {
+		return nil, fmt.Errorf("indexing gzip stream: %w", err)
+	}
+	idx.size = n
+	idx.compressedSize = f.br.off - int64(f.br.nbits/8)
+	return idx, nil
+}
+
+// Size returns the size of the output of the stream.
+func (idx *Index) Size() int64 {
+	return idx.size
+}
+
+// checkpointFor returns the last checkpoint at or before off, or nil if there is none and the stream
+// has to be read from its beginning.
+func (idx *Index) checkpointFor(off int64) *checkpoint {
+	i := sort.Search(len(idx.checkpoints), func(i int) bool { return idx.checkpoints[i].out > off })
+	if i == 0 {
+		return nil
+	}
+	return &idx.checkpoints[i-1]
+}
+
+// MarshalBinary encodes the index, so that it can be kept next to the stream rather than built again.
+func (idx *Index) MarshalBinary() ([]byte, error) {
+	b := []byte(indexMagic)
+	b = binary.AppendUvarint(b, uint64(idx.size))
+	b = binary.AppendUvarint(b, uint64(idx.compressedSize))
+	b = binary.AppendUvarint(b, uint64(len(idx.checkpoints)))
+	for _, cp := range idx.checkpoints {
+		b = binary.AppendUvarint(b, uint64(cp.in))
+		b = append(b, cp.bits)
+		b = binary.AppendUvarint(b, uint64(cp.out))
+		b = binary.AppendUvarint(b, uint64(len(cp.window)))
+		b = append(b, cp.window...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes an index encoded by MarshalBinary.
+func (idx *Index) UnmarshalBinary(b []byte) error {
+	if len(b) < len(indexMagic) || string(b[:len(indexMagic)]) != indexMagic {
+		return errors.New("not a gzip index")
+	}
+	d := decoder{b: b[len(indexMagic):]}
+	size, compressedSize, n := d.int(), d.int(), d.int()
+	if d.err != nil || n > int64(len(d.b)) {
+		return errors.New("invalid gzip index")
+	}
+	checkpoints := make([]checkpoint, 0, n)
+	for i := int64(0); i < n; i++ {
+		var cp checkpoint
+		cp.in = d.int()
+		cp.bits = d.byte()
+		cp.out = d.int()
+		cp.window = d.bytes(d.int())
+		if d.err != nil || cp.bits > 7 || len(cp.window) > windowSize || cp.out < int64(len(cp.window)) || cp.in > compressedSize || cp.out > size {
+			return errors.New("invalid gzip index")
+		}
+		if i > 0 && cp.out <= checkpoints[i-1].out {
+			return errors.New("invalid gzip index: checkpoints out of order")
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	if len(d.b) != 0 {
+		return errors.New("invalid gzip index: trailing data")
+	}
+	idx.size, idx.compressedSize, idx.checkpoints = size, compressedSize, checkpoints
+	return nil
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) int() int64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 || v > 1<<62 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	d.b = d.b[n:]
+	return int64(v)
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) == 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	b := d.b[0]
+	d.b = d.b[1:]
+	return b
+}
+
+func (d *decoder) bytes(n int64) []byte {
+	if n < 0 || n > int64(len(d.b)) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	return b
+}
+
+// ReaderAt reads the output of a gzip stream at any offset, decompressing from the checkpoint of its
+// index before it. Reads that follow each other carry on from where the last one stopped. It is safe for
+// concurrent use, though concurrent reads of different parts of the stream take turns.
+type ReaderAt struct {
+	ra  io.ReaderAt
+	idx *Index
+
+	mu sync.Mutex
+	f  *inflater
+	br *bufio.Reader
+}
+
+var _ io.ReaderAt = (*ReaderAt)(nil)
+
+// NewReaderAt returns a ReaderAt for the gzip stream in ra, which idx is the index of.
+func NewReaderAt(ra io.ReaderAt, idx *Index) *ReaderAt {
+	return &ReaderAt{ra: ra, idx: idx}
+}
+
+// Size returns the size of the output of the stream.
+func (z *ReaderAt) Size() int64 {
+	return z.idx.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (z *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("gzindex: negative offset")
+	}
+	if off >= z.idx.size {
+		return 0, io.EOF
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	// carry on from where the last read stopped, unless a checkpoint is closer
+	cp := z.idx.checkpointFor(off)
+	if z.f == nil || z.f.pos() > off || (cp != nil && cp.out > z.f.pos()) {
+		if err := z.seek(cp); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.CopyN(io.Discard, z.f, off-z.f.pos()); err != nil {
+		z.f = nil
+		return 0, noEOF(err)
+	}
+	n, err := io.ReadFull(z.f, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) && off+int64(n) == z.idx.size {
+		err = io.EOF
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		z.f = nil
+	}
+	return n, err
+}
+
+// seek starts decompressing at cp, or at the beginning of the stream if cp is nil.
+func (z *ReaderAt) seek(cp *checkpoint) error {
+	var in int64
+	if cp != nil {
+		in = cp.in
+	}
+	sr := io.NewSectionReader(z.ra, in, z.idx.compressedSize-in)
+	if z.br == nil {
+		z.br = bufio.NewReaderSize(sr, chunkSize)
+	} else {
+		z.br.Reset(sr)
+	}
+	if z.f == nil {
+		z.f = &inflater{}
+	}
+	if cp == nil {
+		z.f.reset(z.br)
+		return nil
+	}
+	if err := z.f.resume(z.br, cp); err != nil {
+		z.f = nil
+		return fmt.Errorf("resuming gzip stream at %d: %w", cp.in, err)
+	}
+	return nil
+}
+
+// Close closes the stream, if it is an io.Closer.
+func (z *ReaderAt) Close() error {
+	if c, ok := z.ra.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
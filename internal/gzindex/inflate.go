@@ -0,0 +1,650 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gzindex
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+const (
+	// windowSize is how far back a deflate match can reach, and so how much output a checkpoint keeps.
+	windowSize = 1 << 15
+	// chunkSize is how much output the inflater decodes ahead of its reader at a time.
+	chunkSize = 1 << 16
+	// maxMatch is the longest a deflate match can be.
+	maxMatch = 258
+
+	maxCodeBits = 15
+	// tableBits is how many bits of a code are looked up in one step; longer codes are decoded bit by bit.
+	tableBits = 9
+
+	gzipID1     = 0x1f
+	gzipID2     = 0x8b
+	gzipDeflate = 8
+	flagHCRC    = 1 << 1
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+// ErrCorrupt is returned for a gzip stream that cannot be decompressed.
+var ErrCorrupt = errors.New("corrupt gzip stream")
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// codeLengthOrder is the order the lengths of the code length code are in, RFC 1951 section 3.2.7.
+	codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+func corrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// bitReader reads the bits of a deflate stream, least significant first, keeping track of how many bytes
+// it has read so that the position of the next bit is known.
+type bitReader struct {
+	r     io.ByteReader
+	off   int64
+	bits  uint32
+	nbits uint
+}
+
+// pos returns the position of the next bit in the stream, in bits.
+func (br *bitReader) pos() int64 {
+	return br.off*8 - int64(br.nbits)
+}
+
+func (br *bitReader) need(n uint) error {
+	for br.nbits < n {
+		b, err := br.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		br.off++
+		br.bits |= uint32(b) << br.nbits
+		br.nbits += 8
+	}
+	return nil
+}
+
+func (br *bitReader) readBits(n uint) (uint32, error) {
+	if err := br.need(n); err != nil {
+		return 0, err
+	}
+	v := br.bits & (1<<n - 1)
+	br.bits >>= n
+	br.nbits -= n
+	return v, nil
+}
+
+// align drops the bits up to the next byte boundary.
+func (br *bitReader) align() {
+	n := br.nbits % 8
+	br.bits >>= n
+	br.nbits -= n
+}
+
+// readByte reads a whole byte once the reader is aligned, from what it has already read first.
+func (br *bitReader) readByte() (byte, error) {
+	if br.nbits >= 8 {
+		b := byte(br.bits)
+		br.bits >>= 8
+		br.nbits -= 8
+		return b, nil
+	}
+	b, err := br.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	br.off++
+	return b, nil
+}
+
+func (br *bitReader) readUint32() (uint32, error) {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		b, err := br.readByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		v |= uint32(b) << (8 * i)
+	}
+	return v, nil
+}
+
+// decode reads a symbol of h, looking up the first tableBits bits, and falling back to reading the code
+// a bit at a time for longer codes or at the end of the stream.
+func (br *bitReader) decode(h *huffman) (int, error) {
+	for br.nbits < tableBits {
+		b, err := br.r.ReadByte()
+		if err != nil {
+			break
+		}
+		br.off++
+		br.bits |= uint32(b) << br.nbits
+		br.nbits += 8
+	}
+	if e := h.table[br.bits&(1<<tableBits-1)]; e != 0 {
+		if n := uint(e & 0xf); n <= br.nbits {
+			br.bits >>= n
+			br.nbits -= n
+			return int(e >> 4), nil
+		}
+	}
+
+	var code, first, index int
+	for n := 1; n <= maxCodeBits; n++ {
+		bit, err := br.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+		count := int(h.counts[n])
+		if code-first < count {
+			return int(h.symbols[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, corrupt("invalid huffman code")
+}
+
+// huffman is a canonical huffman code, as deflate has them.
+type huffman struct {
+	counts  [maxCodeBits + 1]uint16
+	symbols []uint16
+	// table has the symbol<<4 | length of each code of up to tableBits bits, indexed by its bits as read.
+	table [1 << tableBits]uint16
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	h.counts = [maxCodeBits + 1]uint16{}
+	for _, n := range lengths {
+		h.counts[n]++
+	}
+	h.counts[0] = 0
+	left := 1
+	for n := 1; n <= maxCodeBits; n++ {
+		left <<= 1
+		left -= int(h.counts[n])
+		if left < 0 {
+			return corrupt("over-subscribed huffman code")
+		}
+	}
+
+	var offs, next [maxCodeBits + 1]int
+	code := 0
+	for n := 1; n <= maxCodeBits; n++ {
+		if n < maxCodeBits {
+			offs[n+1] = offs[n] + int(h.counts[n])
+		}
+		code = (code + int(h.counts[n-1])) << 1
+		next[n] = code
+	}
+	if cap(h.symbols) < len(lengths) {
+		h.symbols = make([]uint16, len(lengths))
+	}
+	h.symbols = h.symbols[:len(lengths)]
+	h.table = [1 << tableBits]uint16{}
+	for sym, n := range lengths {
+		if n == 0 {
+			continue
+		}
+		h.symbols[offs[n]] = uint16(sym)
+		offs[n]++
+		c := next[n]
+		next[n]++
+		if n > tableBits {
+			continue
+		}
+		var rev int
+		for i := uint8(0); i < n; i++ {
+			rev |= (c >> i & 1) << (n - 1 - i)
+		}
+		for i := rev; i < 1<<tableBits; i += 1 << n {
+			h.table[i] = uint16(sym)<<4 | uint16(n)
+		}
+	}
+	return nil
+}
+
+var (
+	fixedOnce           sync.Once
+	fixedLit, fixedDist huffman
+)
+
+// fixedCodes returns the codes of the blocks compressed with fixed huffman codes, RFC 1951 section 3.2.6.
+func fixedCodes() (*huffman, *huffman) {
+	fixedOnce.Do(func() {
+		var lengths [288]uint8
+		for i := range lengths {
+			switch {
+			case i < 144:
+				lengths[i] = 8
+			case i < 256:
+				lengths[i] = 9
+			case i < 280:
+				lengths[i] = 7
+			default:
+				lengths[i] = 8
+			}
+		}
+		_ = fixedLit.init(lengths[:])
+		var dists [30]uint8
+		for i := range dists {
+			dists[i] = 5
+		}
+		_ = fixedDist.init(dists[:])
+	})
+	return &fixedLit, &fixedDist
+}
+
+// inflater decompresses a gzip stream, which may have several members, as io.Reader. It can start at the
+// beginning of any deflate block, given the output before it, which is what makes the checkpoints of an
+// Index work.
+type inflater struct {
+	br bitReader
+	// hist holds the output; hist[r:w] has not been read yet, and what is before w is the window that
+	// matches copy from.
+	hist []byte
+	r, w int
+	// base is the offset in the output of hist[0].
+	base int64
+	err  error
+
+	needHeader bool
+	// started is whether a member has been read, after which the end of the stream may follow a member.
+	started bool
+	inBlock bool
+	final   bool
+	stored  int
+	lit     *huffman
+	dist    *huffman
+	dynLit  huffman
+	dynDist huffman
+	lengths [288 + 32]uint8
+
+	// verify checks the CRC and size of each member, which can only be done when starting at its beginning.
+	verify   bool
+	crc      uint32
+	crcPos   int
+	isize    uint32
+	clenCode huffman
+
+	// onBlock is called before each block is read, when the inflater is where a checkpoint can be.
+	onBlock func()
+}
+
+// reset starts the inflater at the beginning of a gzip stream read from r.
+func (f *inflater) reset(r io.ByteReader) {
+	if f.hist == nil {
+		f.hist = make([]byte, windowSize+chunkSize)
+	}
+	f.br = bitReader{r: r}
+	f.r, f.w, f.base, f.err = 0, 0, 0, nil
+	f.needHeader, f.started, f.inBlock, f.final, f.stored = true, false, false, false, 0
+	f.crc, f.crcPos, f.isize = 0, 0, 0
+}
+
+// resume starts the inflater at the block of cp, reading the stream from r, which is positioned at the
+// byte the block starts in.
+func (f *inflater) resume(r io.ByteReader, cp *checkpoint) error {
+	f.reset(r)
+	f.needHeader, f.started, f.verify = false, true, false
+	if cp.bits != 0 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		f.br.off = 1
+		f.br.bits = uint32(b) >> cp.bits
+		f.br.nbits = 8 - uint(cp.bits)
+	}
+	f.w = copy(f.hist, cp.window)
+	f.r, f.crcPos = f.w, f.w
+	f.base = cp.out - int64(f.w)
+	return nil
+}
+
+// out returns the offset in the output of what is decoded next.
+func (f *inflater) out() int64 {
+	return f.base + int64(f.w)
+}
+
+// pos returns the offset in the output of what is read next.
+func (f *inflater) pos() int64 {
+	return f.base + int64(f.r)
+}
+
+func (f *inflater) Read(p []byte) (int, error) {
+	for f.r == f.w {
+		if f.err != nil {
+			return 0, f.err
+		}
+		f.fill()
+	}
+	n := copy(p, f.hist[f.r:f.w])
+	f.r += n
+	return n, nil
+}
+
+// fill decodes until hist is full, keeping the window before what it decodes.
+func (f *inflater) fill() {
+	if f.w > windowSize {
+		f.updateCRC()
+		n := copy(f.hist, f.hist[f.w-windowSize:f.w])
+		f.base += int64(f.w - n)
+		f.r, f.w, f.crcPos = n, n, n
+	}
+	for f.err == nil && f.w <= len(f.hist)-maxMatch {
+		f.err = f.step()
+	}
+}
+
+func (f *inflater) updateCRC() {
+	if f.verify {
+		f.crc = crc32.Update(f.crc, crc32.IEEETable, f.hist[f.crcPos:f.w])
+		f.isize += uint32(f.w - f.crcPos)
+	}
+	f.crcPos = f.w
+}
+
+func (f *inflater) step() error {
+	switch {
+	case f.needHeader:
+		return f.readHeader()
+	case f.stored > 0:
+		n := min(f.stored, len(f.hist)-f.w)
+		for i := 0; i < n; i++ {
+			b, err := f.br.readByte()
+			if err != nil {
+				return noEOF(err)
+			}
+			f.hist[f.w] = b
+			f.w++
+		}
+		if f.stored -= n; f.stored == 0 {
+			return f.endBlock()
+		}
+		return nil
+	case !f.inBlock:
+		if f.onBlock != nil {
+			f.onBlock()
+		}
+		return f.readBlockHeader()
+	}
+
+	sym, err := f.br.decode(f.lit)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sym < 256:
+		f.hist[f.w] = byte(sym)
+		f.w++
+		return nil
+	case sym == 256:
+		return f.endBlock()
+	case sym > 285:
+		return corrupt("invalid length symbol %d", sym)
+	}
+	sym -= 257
+	extra, err := f.br.readBits(uint(lengthExtra[sym]))
+	if err != nil {
+		return err
+	}
+	length := int(lengthBase[sym]) + int(extra)
+
+	sym, err = f.br.decode(f.dist)
+	if err != nil {
+		return err
+	}
+	if sym >= len(distBase) {
+		return corrupt("invalid distance symbol %d", sym)
+	}
+	extra, err = f.br.readBits(uint(distExtra[sym]))
+	if err != nil {
+		return err
+	}
+	dist := int(distBase[sym]) + int(extra)
+	if dist > f.w {
+		return corrupt("distance %d is too far back", dist)
+	}
+
+	if dist >= length {
+		f.w += copy(f.hist[f.w:f.w+length], f.hist[f.w-dist:])
+		return nil
+	}
+	for i := 0; i < length; i++ {
+		f.hist[f.w] = f.hist[f.w-dist]
+		f.w++
+	}
+	return nil
+}
+
+// readHeader reads the header of a gzip member, RFC 1952 section 2.3, or returns io.EOF at the end of a
+// stream that has a member.
+func (f *inflater) readHeader() error {
+	var header [10]byte
+	for i := range header {
+		b, err := f.br.readByte()
+		if err != nil {
+			if i == 0 && f.started && errors.Is(err, io.EOF) {
+				return io.EOF
+			}
+			return noEOF(err)
+		}
+		header[i] = b
+	}
+	if header[0] != gzipID1 || header[1] != gzipID2 || header[2] != gzipDeflate {
+		return corrupt("invalid gzip header")
+	}
+	flags := header[3]
+	if flags&flagExtra != 0 {
+		lo, err := f.br.readByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		hi, err := f.br.readByte()
+		if err != nil {
+			return noEOF(err)
+		}
+		if err := f.skip(int(lo) | int(hi)<<8); err != nil {
+			return err
+		}
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			b, err := f.br.readByte()
+			if err != nil {
+				return noEOF(err)
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+	if flags&flagHCRC != 0 {
+		if err := f.skip(2); err != nil {
+			return err
+		}
+	}
+	f.needHeader, f.started = false, true
+	f.crc, f.isize, f.crcPos = 0, 0, f.w
+	return nil
+}
+
+func (f *inflater) skip(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := f.br.readByte(); err != nil {
+			return noEOF(err)
+		}
+	}
+	return nil
+}
+
+func (f *inflater) readBlockHeader() error {
+	header, err := f.br.readBits(3)
+	if err != nil {
+		return err
+	}
+	f.final = header&1 != 0
+	f.inBlock = true
+	switch header >> 1 {
+	case 0:
+		f.br.align()
+		var lengths [4]byte
+		for i := range lengths {
+			if lengths[i], err = f.br.readByte(); err != nil {
+				return noEOF(err)
+			}
+		}
+		n := int(lengths[0]) | int(lengths[1])<<8
+		if nn := int(lengths[2]) | int(lengths[3])<<8; n != ^nn&0xffff {
+			return corrupt("invalid stored block length")
+		}
+		if f.stored = n; n == 0 {
+			return f.endBlock()
+		}
+		return nil
+	case 1:
+		f.lit, f.dist = fixedCodes()
+		return nil
+	case 2:
+		return f.readDynamic()
+	}
+	return corrupt("invalid block type")
+}
+
+// readDynamic reads the codes of a block compressed with dynamic huffman codes, RFC 1951 section 3.2.7.
+func (f *inflater) readDynamic() error {
+	counts, err := f.br.readBits(14)
+	if err != nil {
+		return err
+	}
+	nlit, ndist, nclen := int(counts&0x1f)+257, int(counts>>5&0x1f)+1, int(counts>>10)+4
+	if nlit > 286 || ndist > 30 {
+		return corrupt("too many length or distance codes")
+	}
+
+	var clens [19]uint8
+	for i := 0; i < nclen; i++ {
+		n, err := f.br.readBits(3)
+		if err != nil {
+			return err
+		}
+		clens[codeLengthOrder[i]] = uint8(n)
+	}
+	if err := f.clenCode.init(clens[:]); err != nil {
+		return err
+	}
+
+	lengths := f.lengths[:nlit+ndist]
+	for i := 0; i < len(lengths); {
+		sym, err := f.br.decode(&f.clenCode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var n uint32
+		var repeat uint8
+		switch sym {
+		case 16:
+			if i == 0 {
+				return corrupt("repeated length with no previous length")
+			}
+			repeat = lengths[i-1]
+			n, err = f.br.readBits(2)
+			n += 3
+		case 17:
+			n, err = f.br.readBits(3)
+			n += 3
+		default:
+			n, err = f.br.readBits(7)
+			n += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(n) > len(lengths) {
+			return corrupt("too many code lengths")
+		}
+		for ; n > 0; n-- {
+			lengths[i] = repeat
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return corrupt("no end of block code")
+	}
+	if err := f.dynLit.init(lengths[:nlit]); err != nil {
+		return err
+	}
+	if err := f.dynDist.init(lengths[nlit:]); err != nil {
+		return err
+	}
+	f.lit, f.dist = &f.dynLit, &f.dynDist
+	return nil
+}
+
+// endBlock finishes a block, and the member with its trailer after the final block.
+func (f *inflater) endBlock() error {
+	f.inBlock = false
+	if !f.final {
+		return nil
+	}
+	f.br.align()
+	crc, err := f.br.readUint32()
+	if err != nil {
+		return err
+	}
+	isize, err := f.br.readUint32()
+	if err != nil {
+		return err
+	}
+	if f.verify {
+		f.updateCRC()
+		if crc != f.crc || isize != f.isize {
+			return corrupt("checksum mismatch")
+		}
+	}
+	f.needHeader = true
+	return nil
+}
+
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gzpool pools the gzip readers that every package, index and control section we read needs.
+package gzpool
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+var readerPool sync.Pool
+
+// GetReader returns a gzip reader for r from the pool. It should be returned with PutReader, even if there
+// was an error reading the gzip header.
+func GetReader(r io.Reader) (*gzip.Reader, error) {
+	zr, ok := readerPool.Get().(*gzip.Reader)
+	if !ok {
+		zr = new(gzip.Reader)
+	}
+	return zr, zr.Reset(r)
+}
+
+// PutReader returns zr to the pool.
+func PutReader(zr *gzip.Reader) {
+	readerPool.Put(zr)
+}
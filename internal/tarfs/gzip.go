@@ -0,0 +1,47 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarfs
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/chainguard-dev/go-apk/internal/gzindex"
+)
+
+// NewGzip returns an FS for the gzipped tar in ra, such as the data section of a cached package, without
+// expanding it first. Reads of files decompress from the checkpoint of idx before them. If idx is nil,
+// it is built, which decompresses the tar once; the index of a previous NewGzip, or one from
+// gzindex.Build, can be passed to skip that.
+func NewGzip(ra io.ReaderAt, size int64, idx *gzindex.Index) (*FS, error) {
+	if idx == nil {
+		var err error
+		if idx, err = gzindex.Build(io.NewSectionReader(ra, 0, size), gzindex.DefaultSpan); err != nil {
+			return nil, err
+		}
+	}
+	fsys, err := New(gzindex.NewReaderAt(ra, idx), idx.Size())
+	if err != nil {
+		return nil, fmt.Errorf("indexing gzipped tar: %w", err)
+	}
+	fsys.gzindex = idx
+	return fsys, nil
+}
+
+// GzipIndex returns the index of the gzipped tar of an FS from NewGzip, which can be kept with the tar
+// for the next NewGzip of it, or nil for an FS of an uncompressed tar.
+func (fsys *FS) GzipIndex() *gzindex.Index {
+	return fsys.gzindex
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGzip(t *testing.T) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(zw)
+	files := map[string][]byte{}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dir", Typeflag: tar.TypeDir, Mode: 0o755}))
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("dir/file-%d", i)
+		files[name] = bytes.Repeat([]byte(name), 1000*i)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(files[name]))}))
+		_, err := tw.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+
+	fsys, err := NewGzip(bytes.NewReader(b.Bytes()), int64(b.Len()), nil)
+	require.NoError(t, err)
+	require.NotNil(t, fsys.GzipIndex())
+	for name, want := range files {
+		got, err := fs.ReadFile(fsys, name)
+		require.NoError(t, err)
+		require.Equal(t, want, got, name)
+	}
+	entries, err := fsys.ReadDir("dir")
+	require.NoError(t, err)
+	require.Len(t, entries, len(files))
+
+	// the index of the first FS is reused
+	again, err := NewGzip(bytes.NewReader(b.Bytes()), int64(b.Len()), fsys.GzipIndex())
+	require.NoError(t, err)
+	got, err := fs.ReadFile(again, "dir/file-99")
+	require.NoError(t, err)
+	require.Equal(t, files["dir/file-99"], got)
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxNameLen is the longest name of an entry, as PATH_MAX on linux.
+	maxNameLen = 4096
+	// maxElemLen is the longest element of the name of an entry, as NAME_MAX on linux.
+	maxElemLen = 255
+)
+
+// InvalidNameError is returned for a tar entry whose name, or hard link target, could
+// write outside of the directory the tar is extracted into, or could never be created.
+type InvalidNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e InvalidNameError) Error() string {
+	return fmt.Sprintf("invalid tar entry name %q: %s", e.Name, e.Reason)
+}
+
+// ValidateHeader checks that the name of hdr, and the target of a hard link, are relative paths
+// within the directory the tar is extracted into. Symlink targets are not checked, since they are
+// resolved when they are followed.
+func ValidateHeader(hdr *tar.Header) error {
+	if err := validateName(hdr.Name); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		return validateName(hdr.Linkname)
+	}
+	return nil
+}
+
+func validateName(name string) error {
+	switch {
+	case name == "":
+		return InvalidNameError{Name: name, Reason: "empty name"}
+	case len(name) > maxNameLen:
+		return InvalidNameError{Name: name, Reason: fmt.Sprintf("longer than %d bytes", maxNameLen)}
+	case strings.HasPrefix(name, "/"):
+		return InvalidNameError{Name: name, Reason: "absolute path"}
+	case strings.ContainsRune(name, 0):
+		return InvalidNameError{Name: name, Reason: "contains NUL"}
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return InvalidNameError{Name: name, Reason: "parent directory reference"}
+		}
+		if len(elem) > maxElemLen {
+			return InvalidNameError{Name: name, Reason: fmt.Sprintf("path element longer than %d bytes", maxElemLen)}
+		}
+	}
+	return nil
+}
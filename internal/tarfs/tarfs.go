@@ -24,7 +24,10 @@ import (
 	"io/fs"
 	"path"
 	"slices"
+	"sync"
 	"time"
+
+	"github.com/chainguard-dev/go-apk/internal/gzindex"
 )
 
 type Entry struct {
@@ -81,11 +84,15 @@ func (f *File) Close() error {
 	return nil
 }
 
+// FS is a read-only fs.FS of a tar, which is indexed once by New. It is safe for concurrent use, as long
+// as its io.ReaderAt is.
 type FS struct {
 	ra    io.ReaderAt
 	files []*Entry
 	index map[string]int
 	dirs  map[string][]fs.DirEntry
+	// gzindex is the index of the gzipped tar of an FS from NewGzip.
+	gzindex *gzindex.Index
 }
 
 func (fsys *FS) Readlink(name string) (string, error) {
@@ -120,13 +127,16 @@ func (fsys *FS) open(name string, hops int) (fs.File, error) {
 	e := fsys.files[i]
 
 	switch e.Header.Typeflag {
-	case tar.TypeSymlink, tar.TypeLink:
+	case tar.TypeSymlink:
 		link := e.Header.Linkname
 		if path.IsAbs(link) {
 			return fsys.open(link, hops+1)
 		}
 
 		return fsys.open(path.Join(e.dir, link), hops+1)
+	case tar.TypeLink:
+		// Unlike symlinks, hardlink names are relative to the root of the archive.
+		return fsys.open(path.Clean(e.Header.Linkname), hops+1)
 	}
 
 	f := &File{
@@ -144,6 +154,16 @@ func (fsys *FS) Open(name string) (fs.File, error) {
 	return fsys.open(name, 0)
 }
 
+// OpenEntry opens the entry name itself, without following it if it is a link.
+func (fsys *FS) OpenEntry(name string) (*File, error) {
+	i, ok := fsys.index[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	e := fsys.files[i]
+	return &File{fsys: fsys, Entry: e, sr: io.NewSectionReader(fsys.ra, e.Offset, e.Header.Size)}, nil
+}
+
 func (fsys *FS) Entries() []*Entry {
 	return fsys.files
 }
@@ -171,6 +191,7 @@ func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
 	return nil, fs.ErrNotExist
 }
 
+// ReadDir returns the entries of the directory name, which are shared by every call and must not be modified.
 func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
 	dirs, ok := fsys.dirs[name]
 	if !ok {
@@ -191,6 +212,9 @@ func (cr *countReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// readerPool holds the buffered readers used to index a tar, which are too large to allocate for every package.
+var readerPool = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, 1<<20) }}
+
 func New(ra io.ReaderAt, size int64) (*FS, error) {
 	fsys := &FS{
 		ra:    ra,
@@ -204,7 +228,13 @@ func New(ra io.ReaderAt, size int64) (*FS, error) {
 
 	// TODO: Consider caching this across builds.
 	r := io.NewSectionReader(ra, 0, size)
-	cr := &countReader{bufio.NewReaderSize(r, 1<<20), 0}
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	defer func() {
+		br.Reset(nil)
+		readerPool.Put(br)
+	}()
+	cr := &countReader{br, 0}
 	tr := tar.NewReader(cr)
 	for {
 		hdr, err := tr.Next()
@@ -214,6 +244,9 @@ func New(ra io.ReaderAt, size int64) (*FS, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := ValidateHeader(hdr); err != nil {
+			return nil, err
+		}
 		dir := path.Dir(hdr.Name)
 		fsys.index[hdr.Name] = len(fsys.files)
 		fsys.files = append(fsys.files, &Entry{
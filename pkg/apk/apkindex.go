@@ -11,10 +11,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
+
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
 )
 
 const apkIndexFilename = "APKINDEX"
@@ -77,20 +81,66 @@ type APKIndex struct { //nolint:revive
 	Signature   []byte
 	Description string
 	Packages    []*Package
-}
 
-// Splitting empty string results in single element array with one empty string, which would
-// be treated as package with empty name.
-func splitRepeatedField(val string) []string {
-	if val == "" {
-		return nil
-	}
-	return strings.Split(val, " ")
+	// lazy has the deferred fields of the packages of an index parsed lazily, see IndexFromArchiveLazy.
+	lazy map[*Package]*lazyFields
 }
 
 // ParsePackageIndex parses a plain (uncompressed) APKINDEX file. It returns an
 // ApkIndex struct
 func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
+	packages, _, err := parsePackageIndex(apkIndexUnpacked, false)
+	return packages, err
+}
+
+// lazyFields are the lines of an index entry that are not needed for resolution, which are only parsed when
+// the package is materialized.
+type lazyFields struct {
+	once  sync.Once
+	lines string
+	err   error
+}
+
+// isResolutionField returns whether the index field token is needed to resolve packages, and so is parsed
+// even when parsing lazily.
+func isResolutionField(token byte) bool {
+	switch token {
+	case 'P', 'V', 'A', 'o', 'C', 'D', 'p', 'i', 'k':
+		return true
+	}
+	return false
+}
+
+// Materialize parses the fields of pkg, a package of the index, that lazy parsing deferred, see
+// IndexFromArchiveLazy. It does nothing for a package that was parsed in full, and may be called
+// concurrently, but the deferred fields must not be read before it returns.
+func (a *APKIndex) Materialize(pkg *Package) error {
+	lazy, ok := a.lazy[pkg]
+	if !ok {
+		return nil
+	}
+	lazy.once.Do(func() {
+		for _, line := range strings.Split(lazy.lines, "\n") {
+			if line == "" {
+				continue
+			}
+			var val []byte
+			if len(line) > 2 {
+				val = []byte(line[2:])
+			}
+			if err := parseIndexField(pkg, line[0], val); err != nil {
+				lazy.err = fmt.Errorf("parsing index entry for %s: %w", pkg.Name, err)
+				return
+			}
+		}
+		lazy.lines = ""
+	})
+	return lazy.err
+}
+
+// parsePackageIndex parses a plain APKINDEX. If lazy is set, only the fields needed for resolution are parsed,
+// and it also returns the deferred lines of each package that has any.
+func parsePackageIndex(apkIndexUnpacked io.Reader, lazy bool) ([]*Package, map[*Package]*lazyFields, error) {
 	if closer, ok := apkIndexUnpacked.(io.Closer); ok {
 		defer closer.Close()
 	}
@@ -109,10 +159,26 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 	pkg := &Package{}
 	linenr := 1
 
+	// the deferred lines of pkg when parsing lazily, kept as one string per package
+	var (
+		deferred   []byte
+		deferredBy map[*Package]*lazyFields
+	)
+	if lazy {
+		deferredBy = map[*Package]*lazyFields{}
+	}
+	endPackage := func() {
+		if len(deferred) > 0 {
+			deferredBy[pkg] = &lazyFields{lines: string(deferred)}
+			deferred = deferred[:0]
+		}
+	}
+
 	packages := []*Package{}
 	for indexScanner.Scan() {
-		line := indexScanner.Text()
+		line := indexScanner.Bytes()
 		if len(line) == 0 {
+			endPackage()
 			if pkg.Name != "" {
 				packages = append(packages, pkg)
 			}
@@ -120,156 +186,231 @@ func ParsePackageIndex(apkIndexUnpacked io.Reader) ([]*Package, error) {
 			continue
 		}
 
-		if len(line) > 1 && line[1:2] != ":" {
-			return nil, fmt.Errorf("cannot parse line %d: expected \":\" in not found", linenr)
+		if len(line) > 1 && line[1] != ':' {
+			return nil, nil, fmt.Errorf("cannot parse line %d: expected \":\" in not found", linenr)
 		}
 
-		token := line[:1]
-		val := line[2:]
-
-		switch token {
-		case "P":
-			pkg.Name = val
-		case "V":
-			pkg.Version = val
-		case "A":
-			pkg.Arch = val
-		case "L":
-			pkg.License = val
-		case "T":
-			pkg.Description = val
-		case "o":
-			pkg.Origin = val
-		case "m":
-			pkg.Maintainer = val
-		case "U":
-			pkg.URL = val
-		case "D":
-			pkg.Dependencies = splitRepeatedField(val)
-		case "p":
-			pkg.Provides = splitRepeatedField(val)
-		case "c":
-			pkg.RepoCommit = val
-		case "t":
-			i, err := strconv.ParseInt(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse build time %s: %w", val, err)
-			}
-			pkg.BuildDate = i
-			pkg.BuildTime = time.Unix(i, 0).UTC()
-		case "i":
-			pkg.InstallIf = splitRepeatedField(val)
-		case "S":
-			size, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse size field %s: %w", val, err)
-			}
-			pkg.Size = size
-		case "I":
-			installedSize, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse installed size field %s: %w", val, err)
-			}
-			pkg.InstalledSize = installedSize
-		case "k":
-			priority, err := strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
-			}
-			pkg.ProviderPriority = priority
-		case "C":
-			// Handle SHA1 checksums:
-			if strings.HasPrefix(val, "Q1") {
-				checksum, err := base64.StdEncoding.DecodeString(val[2:])
-				if err != nil {
-					return nil, err
-				}
-				pkg.Checksum = checksum
-			}
+		token := line[0]
+		if lazy && !isResolutionField(token) {
+			deferred = append(append(deferred, line...), '\n')
+			linenr++
+			continue
+		}
+		var val []byte
+		if len(line) > 2 {
+			val = line[2:]
+		}
+		if err := parseIndexField(pkg, token, val); err != nil {
+			return nil, nil, err
 		}
 
 		linenr++
 	}
+	endPackage()
 
-	return packages, indexScanner.Err()
+	return packages, deferredBy, indexScanner.Err()
+}
+
+// parseIndexField sets the field of pkg for the index line with token and val. The strings that repeat across
+// packages are interned, see indexStrings.
+func parseIndexField(pkg *Package, token byte, val []byte) error {
+	switch token {
+	case 'P':
+		pkg.Name = indexStrings.intern(val)
+	case 'V':
+		pkg.Version = string(val)
+	case 'A':
+		pkg.Arch = indexStrings.intern(val)
+	case 'L':
+		pkg.License = indexStrings.intern(val)
+	case 'T':
+		pkg.Description = string(val)
+	case 'o':
+		pkg.Origin = indexStrings.intern(val)
+	case 'm':
+		pkg.Maintainer = indexStrings.intern(val)
+	case 'U':
+		pkg.URL = indexStrings.intern(val)
+	case 'D':
+		pkg.Dependencies = indexStrings.internFields(val)
+	case 'p':
+		pkg.Provides = indexStrings.internFields(val)
+	case 'c':
+		pkg.RepoCommit = indexStrings.intern(val)
+	case 't':
+		i, err := strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse build time %s: %w", val, err)
+		}
+		pkg.BuildDate = i
+		pkg.BuildTime = time.Unix(i, 0).UTC()
+	case 'i':
+		pkg.InstallIf = indexStrings.internFields(val)
+	case 'S':
+		size, err := strconv.ParseUint(string(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse size field %s: %w", val, err)
+		}
+		pkg.Size = size
+	case 'I':
+		installedSize, err := strconv.ParseUint(string(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse installed size field %s: %w", val, err)
+		}
+		pkg.InstalledSize = installedSize
+	case 'k':
+		priority, err := strconv.ParseUint(string(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse provider priority field %s: %w", val, err)
+		}
+		pkg.ProviderPriority = priority
+	case 'C':
+		// Handle SHA1 checksums:
+		if bytes.HasPrefix(val, []byte("Q1")) {
+			checksum := make([]byte, base64.StdEncoding.DecodedLen(len(val)-2))
+			n, err := base64.StdEncoding.Decode(checksum, val[2:])
+			if err != nil {
+				return err
+			}
+			pkg.Checksum = checksum[:n]
+		}
+	}
+	return nil
 }
 
 func IndexFromArchive(archive io.ReadCloser) (*APKIndex, error) {
-	gzipReader, err := gzip.NewReader(archive)
+	return indexFromArchive(archive, false)
+}
+
+// IndexFromArchiveLazy is IndexFromArchive, but only parses the fields of the packages needed to resolve
+// them: name, version, architecture, origin, checksum, dependencies, provides, install_if and provider
+// priority. The other fields are kept unparsed until the package is materialized, see Materialize, which
+// cuts the time it takes to parse large indexes of which only a few packages are used.
+func IndexFromArchiveLazy(archive io.ReadCloser) (*APKIndex, error) {
+	return indexFromArchive(archive, true)
+}
+
+func indexFromArchive(archive io.ReadCloser, lazy bool) (*APKIndex, error) {
+	gzipReader, err := gzpool.GetReader(archive)
+	defer gzpool.PutReader(gzipReader)
 	if err != nil {
 		return nil, err
 	}
 
 	defer gzipReader.Close()
 
-	tarReader := tar.NewReader(gzipReader)
 	apkindex := &APKIndex{}
+	if err := apkindex.readTar(tar.NewReader(gzipReader), lazy); err != nil {
+		return nil, err
+	}
+	return apkindex, nil
+}
 
+// readTar reads the files of an index archive from tarReader into a, parsing the packages lazily if lazy is set.
+func (a *APKIndex) readTar(tarReader *tar.Reader, lazy bool) error {
 	for {
 		hdr, err := tarReader.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		switch hdr.Name {
 		case apkIndexFilename:
-			apkindex.Packages, err = ParsePackageIndex(io.NopCloser(tarReader))
+			a.Packages, a.lazy, err = parsePackageIndex(io.NopCloser(tarReader), lazy)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		case descriptionFilename:
 			description, err := io.ReadAll(tarReader)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			apkindex.Description = string(description)
+			a.Description = string(description)
 		default:
 			if strings.HasPrefix(hdr.Name, ".SIGN.") {
 				var err error
-				apkindex.Signature, err = io.ReadAll(tarReader)
+				a.Signature, err = io.ReadAll(tarReader)
 				if err != nil {
-					return nil, err
+					return err
 				}
 			} else {
-				return nil, fmt.Errorf("unexpected file found in APKINDEX: %s", hdr.Name)
+				return fmt.Errorf("unexpected file found in APKINDEX: %s", hdr.Name)
 			}
 		}
 	}
+}
 
-	return apkindex, nil
+// ArchiveOption is an option for ArchiveFromIndex.
+type ArchiveOption func(*archiveOpts)
+
+type archiveOpts struct {
+	compressionLevel int
 }
 
-func ArchiveFromIndex(apkindex *APKIndex) (archive io.Reader, err error) {
+// WithArchiveCompressionLevel sets the gzip level the index is compressed at, from gzip.HuffmanOnly to
+// gzip.BestCompression. The default is gzip.DefaultCompression.
+func WithArchiveCompressionLevel(level int) ArchiveOption {
+	return func(o *archiveOpts) {
+		o.compressionLevel = level
+	}
+}
+
+func ArchiveFromIndex(apkindex *APKIndex, options ...ArchiveOption) (archive io.Reader, err error) {
+	entries, err := indexEntries(apkindex, apkindex.Packages)
+	if err != nil {
+		return nil, err
+	}
+	return archiveIndexFiles([]indexArchiveFile{
+		{apkIndexFilename, entries},
+		{descriptionFilename, []byte(apkindex.Description)},
+	}, options)
+}
+
+// indexEntries returns the entries of the APKINDEX file for pkgs, packages of apkindex.
+func indexEntries(apkindex *APKIndex, pkgs []*Package) ([]byte, error) {
 	// Execute the template and append output for each package in the index
 	var apkindexContents bytes.Buffer
-	for _, pkg := range apkindex.Packages {
+	for _, pkg := range pkgs {
 		if len(pkg.Name) == 0 {
 			continue
 		}
-		err = apkIndexTemplate.Execute(&apkindexContents, pkg)
-		if err != nil {
+		if err := apkindex.Materialize(pkg); err != nil {
+			return nil, err
+		}
+		if err := apkIndexTemplate.Execute(&apkindexContents, pkg); err != nil {
 			return nil, fmt.Errorf("failed to parse template for package %s: %w", pkg.Name, err)
 		}
 	}
+	return apkindexContents.Bytes(), nil
+}
+
+// indexArchiveFile is a file of the archive of an index.
+type indexArchiveFile struct {
+	filename string
+	contents []byte
+}
+
+// archiveIndexFiles returns the gzipped tarball of files, as the archive of an index.
+func archiveIndexFiles(files []indexArchiveFile, options []ArchiveOption) (io.Reader, error) {
+	opts := archiveOpts{compressionLevel: gzip.DefaultCompression}
+	for _, opt := range options {
+		opt(&opts)
+	}
 
 	// Create the tarball
 	var tarballContents bytes.Buffer
-	gw := gzip.NewWriter(&tarballContents)
+	gw, err := tarball.NewGzipWriterLevel(&tarballContents, opts.compressionLevel)
+	if err != nil {
+		return nil, err
+	}
 	defer gw.Close()
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
 
-	// Add APKINDEX and DESCRIPTION files to the tarball
-	for _, item := range []struct {
-		filename string
-		contents []byte
-	}{
-		{apkIndexFilename, apkindexContents.Bytes()},
-		{descriptionFilename, []byte(apkindex.Description)},
-	} {
+	for _, item := range files {
 		var info os.FileInfo = &tarballItemFileInfo{item.filename, int64(len(item.contents))}
 		header, err := tar.FileInfoHeader(info, item.filename)
 		if err != nil {
@@ -2,12 +2,15 @@ package apk
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/stretchr/testify/assert"
@@ -135,6 +138,111 @@ func TestParseFromArchive(t *testing.T) {
 	assert.Len(apkIndex.Packages, 2)
 }
 
+func BenchmarkIndexFromArchive(b *testing.B) {
+	data, err := os.ReadFile("testdata/APKINDEX.tar.gz")
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := IndexFromArchive(io.NopCloser(bytes.NewReader(data))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIndexFromArchiveLazy(b *testing.B) {
+	data, err := os.ReadFile("testdata/alpine-316/APKINDEX.tar.gz")
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := IndexFromArchiveLazy(io.NopCloser(bytes.NewReader(data))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseFromArchiveLazy(t *testing.T) {
+	data, err := os.ReadFile("testdata/alpine-316/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	full, err := IndexFromArchive(io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	lazy, err := IndexFromArchiveLazy(io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, full.Description, lazy.Description)
+	require.Len(t, lazy.Packages, len(full.Packages))
+
+	for i, pkg := range lazy.Packages {
+		want := full.Packages[i]
+		require.Equal(t, want.Name, pkg.Name)
+		require.Equal(t, want.Version, pkg.Version)
+		require.Equal(t, want.Checksum, pkg.Checksum)
+		require.Equal(t, want.Dependencies, pkg.Dependencies)
+		require.Equal(t, want.Provides, pkg.Provides)
+		require.Empty(t, pkg.Description, "%s is parsed in full", pkg.Name)
+		require.Zero(t, pkg.Size)
+	}
+
+	// the resolver hands out complete packages
+	repo := NewNamedRepositoryWithIndex("", (&Repository{URI: "testdata/alpine-316"}).WithIndex(lazy))
+	selected, err := NewPkgResolver(context.Background(), []NamedIndex{repo}).ResolvePackage("busybox", nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, selected[0].Description)
+	require.NotZero(t, selected[0].Size)
+
+	for i, pkg := range lazy.Packages {
+		require.NoError(t, lazy.Materialize(pkg))
+		require.Equal(t, full.Packages[i], pkg)
+	}
+}
+
+func TestMaterializeError(t *testing.T) {
+	packages, lazy, err := parsePackageIndex(strings.NewReader(heredoc.Doc(`
+		P:a-pkg
+		V:1.2.3-r1
+		S:big
+
+	`)), true)
+	require.NoError(t, err)
+	require.Len(t, packages, 1)
+	index := &APKIndex{Packages: packages, lazy: lazy}
+	require.ErrorContains(t, index.Materialize(packages[0]), "cannot parse size field big")
+}
+
+func TestParseInternsStrings(t *testing.T) {
+	index := heredoc.Doc(`
+		P:a-pkg
+		V:1.2.3-r1
+		A:x86_64
+		L:Apache-2.0
+		D:so:libc.musl-x86_64.so.1 b-pkg
+
+		P:b-pkg
+		V:1.0.0-r0
+		A:x86_64
+		L:Apache-2.0
+		D:so:libc.musl-x86_64.so.1
+
+	`)
+	first, err := ParsePackageIndex(strings.NewReader(index))
+	require.NoError(t, err)
+	second, err := ParsePackageIndex(strings.NewReader(index))
+	require.NoError(t, err)
+
+	same := func(a, b string) {
+		t.Helper()
+		require.Equal(t, a, b)
+		require.Same(t, unsafe.StringData(a), unsafe.StringData(b), "%s is not interned", a)
+	}
+	same(first[0].Arch, first[1].Arch)
+	same(first[0].License, second[1].License)
+	same(first[0].Dependencies[0], first[1].Dependencies[0])
+	same(first[0].Dependencies[1], second[1].Name)
+	require.Equal(t, []string{"so:libc.musl-x86_64.so.1", "b-pkg"}, first[0].Dependencies)
+}
+
 // Test reading from io.Reader that doesn't implement io.Closer
 func TestSinglePackageOnlyReader(t *testing.T) {
 	apkIndexFile := strings.NewReader(heredoc.Doc(`
@@ -171,6 +279,14 @@ func TestArchiveFromIndex(t *testing.T) {
 	// Attempt to convert index back to an archive
 	newArchive, err := ArchiveFromIndex(originalIndex)
 	require.Nil(t, err)
+	archived, err := io.ReadAll(newArchive)
+	require.Nil(t, err)
+	again, err := ArchiveFromIndex(originalIndex)
+	require.Nil(t, err)
+	againArchived, err := io.ReadAll(again)
+	require.Nil(t, err)
+	require.Equal(t, archived, againArchived, "archiving the same index again should give the same bytes")
+	newArchive = bytes.NewReader(archived)
 
 	// Ensure that we are able to extract APKINDEX and DESCRIPTION
 	// from the new archive and that the contents are correct
@@ -211,6 +327,27 @@ func TestArchiveFromIndex(t *testing.T) {
 	require.Truef(t, foundDescription, "Could not locate file %s in archive", descriptionFilename)
 }
 
+func TestArchiveFromIndexCompressionLevel(t *testing.T) {
+	f, err := os.Open("testdata/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	index, err := IndexFromArchive(f)
+	require.NoError(t, err)
+
+	var sizes []int
+	for _, level := range []int{gzip.NoCompression, gzip.BestCompression} {
+		archive, err := ArchiveFromIndex(index, WithArchiveCompressionLevel(level))
+		require.NoError(t, err)
+		b, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		sizes = append(sizes, len(b))
+	}
+	require.Less(t, sizes[1], sizes[0])
+
+	_, err = ArchiveFromIndex(index, WithArchiveCompressionLevel(42))
+	require.Error(t, err)
+}
+
 func TestEmptyRepeatedFields(t *testing.T) {
 	apkIndexFile := strings.NewReader(heredoc.Doc(`
 		C:Q1Deb0jNytkrjPW4N/eKLZ43BwOlw=
@@ -13,19 +13,51 @@
 // limitations under the License.
 package apk
 
+// NoArch is the architecture of packages that can be installed on any architecture.
+const NoArch = "noarch"
+
+// archAliases maps the names other tools give architectures, such as GOARCH and the
+// platforms of OCI images, to the name apk uses.
+var archAliases = map[string]string{
+	"i386":     "x86",
+	"i686":     "x86",
+	"386":      "x86",
+	"amd64":    "x86_64",
+	"x86-64":   "x86_64",
+	"arm64":    "aarch64",
+	"arm64/v8": "aarch64",
+	"arm/v6":   "armhf",
+	"arm/v7":   "armv7",
+}
+
+// apkToOCI maps the name apk uses for an architecture to the OCI platform.
+var apkToOCI = map[string]string{
+	"x86":     "386",
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armhf":   "arm/v6",
+	"armv7":   "arm/v7",
+}
+
+// ArchToAPK returns the name apk uses for the architecture in, which can be a GOARCH, an OCI
+// platform such as arm/v7, or already the apk name. Unknown architectures are returned as is.
 func ArchToAPK(in string) string {
-	switch in {
-	case "i386", "386":
-		return "x86"
-	case "amd64":
-		return "x86_64"
-	case "arm64":
-		return "aarch64"
-	case "arm/v6":
-		return "armhf"
-	case "arm/v7":
-		return "armv7"
-	default:
-		return in
+	if arch, ok := archAliases[in]; ok {
+		return arch
 	}
+	return in
+}
+
+// ArchToOCI returns the OCI platform architecture, e.g. amd64 or arm/v7, for the architecture in,
+// which can be any name ArchToAPK knows. Unknown architectures are returned as is.
+func ArchToOCI(in string) string {
+	if arch, ok := apkToOCI[ArchToAPK(in)]; ok {
+		return arch
+	}
+	return in
+}
+
+// ArchesEqual returns whether a and b are names of the same architecture, e.g. amd64 and x86_64.
+func ArchesEqual(a, b string) bool {
+	return ArchToAPK(a) == ArchToAPK(b)
 }
@@ -0,0 +1,96 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestArchNames(t *testing.T) {
+	for _, tt := range []struct {
+		names []string
+		apk   string
+		oci   string
+	}{
+		{[]string{"x86_64", "amd64", "x86-64"}, "x86_64", "amd64"},
+		{[]string{"aarch64", "arm64", "arm64/v8"}, "aarch64", "arm64"},
+		{[]string{"x86", "386", "i386", "i686"}, "x86", "386"},
+		{[]string{"armv7", "arm/v7"}, "armv7", "arm/v7"},
+		{[]string{"armhf", "arm/v6"}, "armhf", "arm/v6"},
+		{[]string{"riscv64"}, "riscv64", "riscv64"},
+	} {
+		for _, name := range tt.names {
+			require.Equal(t, tt.apk, ArchToAPK(name), name)
+			require.Equal(t, tt.oci, ArchToOCI(name), name)
+			require.True(t, ArchesEqual(name, tt.apk), name)
+		}
+	}
+	require.False(t, ArchesEqual("amd64", "aarch64"))
+
+	require.Equal(t, "https://example.com/main/x86_64/APKINDEX.tar.gz", IndexURL("https://example.com/main", "amd64"))
+	require.Equal(t, "https://example.com/main/aarch64", RepositoryURL(DefaultRepositoryLayout, "https://example.com/main", "arm64"))
+
+	for arch, matches := range map[string]bool{"": true, NoArch: true, "x86_64": true, "amd64": true, "aarch64": false} {
+		require.Equal(t, matches, (&Package{Arch: arch}).MatchesArch("amd64"), arch)
+	}
+}
+
+func TestResolveArch(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: "https://main.example.com"}
+	indexes := []NamedIndex{NewNamedRepositoryWithIndex("", repo.WithIndex(&APKIndex{
+		Packages: []*Package{
+			{Name: "foo", Version: "1.0-r0", Arch: "x86_64", Dependencies: []string{"bar"}},
+			// a stray build for another architecture, newer than the one for x86_64
+			{Name: "foo", Version: "1.1-r0", Arch: "aarch64", Dependencies: []string{"bar"}},
+			{Name: "bar", Version: "1.0-r0", Arch: NoArch},
+			{Name: "baz", Version: "1.0-r0", Arch: "aarch64"},
+		},
+	}))}
+
+	pkg, err := SelectCandidate(indexes, "foo", WithSelectArch("amd64"))
+	require.NoError(t, err)
+	require.Equal(t, "1.0-r0", pkg.Version)
+	pkg, err = SelectCandidate(indexes, "foo")
+	require.NoError(t, err)
+	require.Equal(t, "1.1-r0", pkg.Version, "without an architecture, any is selected")
+
+	p := NewPkgResolver(ctx, indexes)
+	p.SetArch("x86_64")
+	url, err := p.PackageURL("foo")
+	require.NoError(t, err)
+	require.Equal(t, "https://main.example.com/foo-1.0-r0.apk", url)
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch("x86_64"))
+	require.NoError(t, err)
+	pkgs, _, err := a.resolve(ctx, indexes, []string{"foo"})
+	require.NoError(t, err)
+	var got []string
+	for _, pkg := range pkgs {
+		got = append(got, pkg.Filename())
+	}
+	require.Equal(t, []string{"bar-1.0-r0.apk", "foo-1.0-r0.apk"}, got)
+
+	// nothing is installed when a package is only for another architecture
+	pkgs, conflicts, err := a.resolve(ctx, indexes, []string{"foo", "baz"})
+	require.ErrorContains(t, err, "for architecture aarch64, not x86_64")
+	require.Nil(t, pkgs)
+	require.Nil(t, conflicts)
+}
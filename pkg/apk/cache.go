@@ -15,16 +15,28 @@
 package apk
 
 import (
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
 )
 
+// freshnessExt is the extension of the file stored next to a cached URL, recording how long it is fresh for.
+const freshnessExt = ".fresh"
+
 // This is terrible but simpler than plumbing around a cache for now.
 // We will assume that for a given process, we want to reuse etag values.
 // Doing this cuts down on the number of requests we send for index and keys.
@@ -34,8 +46,14 @@ type etagResp struct {
 	resp      *http.Response
 	err       error
 	cacheFile string
+	etag      string
+	// fromCache is whether cacheFile was already in the cache, rather than just downloaded
+	fromCache bool
 }
 
+// cacheHitHeader is set on the responses the cache serves from files it already had.
+const cacheHitHeader = "X-Go-Apk-Cache-Hit"
+
 type etagCache struct {
 	// url -> *sync.Once
 	etags sync.Map
@@ -46,21 +64,60 @@ type etagCache struct {
 
 // get dedupes incoming etag-based requests by url (using a sync.Map[string]sync.Once) and stores the results
 // in a sync.Map[string]etagResp. If we request the same URL multiple times, we will only ever reach out to
-// the internet for the first once and reuse the results for all subsequent calls (unless the response does
-// not have an etag).
+// the internet for the first once and reuse the results for all subsequent calls. Responses without an etag
+// are cached by their last-modified time, or failing that by a digest of their body.
 func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile string) (*http.Response, error) {
-	url := request.URL.String()
+	url := t.keys.key(*request.URL)
 
 	// Do all the expensive things inside the once.
 	once, _ := e.etags.LoadOrStore(url, &sync.Once{})
 	once.(*sync.Once).Do(func() {
+		// If an earlier process told us how long the response is fresh for, we may not need to ask again.
+		fresh := readFreshness(cacheFile)
+		if fresh != nil {
+			etagFile := cacheFileFromEtag(cacheFile, fresh.Validator)
+			if _, err := os.Stat(etagFile); err != nil {
+				fresh = nil
+			} else if time.Now().Before(fresh.Expires) {
+				e.resps.Store(url, etagResp{
+					cacheFile: etagFile,
+					etag:      fresh.Validator,
+					fromCache: true,
+				})
+				return
+			}
+		}
+
 		req := request.Clone(request.Context())
 		req.Method = http.MethodHead
+		if fresh != nil {
+			// Revalidate what we have, rather than comparing validators ourselves.
+			if fresh.ETag != "" {
+				req.Header.Set("If-None-Match", `"`+fresh.ETag+`"`)
+			}
+			if fresh.LastModified != "" {
+				req.Header.Set("If-Modified-Since", fresh.LastModified)
+			}
+		}
 		resp, rerr := t.wrapped.Do(req)
 		if resp != nil {
 			// We don't expect any body from a HEAD so just always close it to appease the linter.
 			resp.Body.Close()
 		}
+		// Pre-signed URLs are only signed for a GET, so when the HEAD is refused, go on as for a HEAD
+		// without validators, which revalidates by downloading.
+		if rerr == nil && t.keys != nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusMethodNotAllowed) {
+			resp = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+		}
+		if rerr == nil && resp.StatusCode == http.StatusNotModified && fresh != nil {
+			writeFreshness(cacheFile, fresh.Validator, resp, fresh)
+			e.resps.Store(url, etagResp{
+				cacheFile: cacheFileFromEtag(cacheFile, fresh.Validator),
+				etag:      fresh.Validator,
+				fromCache: true,
+			})
+			return
+		}
 		if rerr != nil || resp.StatusCode != 200 {
 			e.resps.Store(url, etagResp{
 				resp: resp,
@@ -69,42 +126,47 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 			return
 		}
 
-		initialEtag, ok := etagFromResponse(resp)
-		if !ok {
-			return
-		}
-
 		// We simulate content-based addressing with the etag values using an .etag
-		// file extension.
-		etagFile := cacheFileFromEtag(cacheFile, initialEtag)
-		if _, err := os.Stat(etagFile); err == nil {
-			e.resps.Store(url, etagResp{
-				cacheFile: etagFile,
-			})
-			return
+		// file extension. Without a validator from the HEAD, we can only know what we
+		// have once we have downloaded it.
+		if initialEtag, ok := validatorFromResponse(resp); ok {
+			etagFile := cacheFileFromEtag(cacheFile, initialEtag)
+			if _, err := os.Stat(etagFile); err == nil {
+				writeFreshness(cacheFile, initialEtag, resp, nil)
+				e.resps.Store(url, etagResp{
+					cacheFile: etagFile,
+					etag:      initialEtag,
+					fromCache: true,
+				})
+				return
+			}
 		}
 
 		// Only download the index once.
-		etagFile, err := t.retrieveAndSaveFile(request, func(r *http.Response) (string, error) {
+		var finalEtag string
+		etagFile, err := t.retrieveAndSaveFile(request, cacheDirFromFile(cacheFile), func(r *http.Response, digest string) (string, error) {
 			// On the etag path, use the etag from the actual response to
-			// compute the final file name.
-			finalEtag, ok := etagFromResponse(r)
+			// compute the final file name. Misbehaving mirrors that send neither
+			// an etag nor a last-modified are addressed by the digest of the body.
+			var ok bool
+			finalEtag, ok = validatorFromResponse(r)
 			if !ok {
-				return "", fmt.Errorf("GET response did not contain an etag, but HEAD returned %q", initialEtag)
+				finalEtag = digest
 			}
 
+			writeFreshness(cacheFile, finalEtag, r, nil)
 			return cacheFileFromEtag(cacheFile, finalEtag), nil
 		})
 		e.resps.Store(url, etagResp{
 			err:       err,
 			cacheFile: etagFile,
+			etag:      finalEtag,
 		})
 	})
 
 	v, ok := e.resps.Load(url)
 	if !ok {
-		// If the server doesn't return etags, and we require them,
-		// then do not cache.
+		// We should always have a response, but if not, do not cache.
 		return t.wrapped.Do(request)
 	}
 	resp := v.(etagResp)
@@ -124,8 +186,19 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 		return nil, fmt.Errorf("stat(%q): %w", resp.cacheFile, err)
 	}
 
+	// Pass the validator along as what it is, so the parsed index can be cached by it if it is an etag.
+	header := http.Header{cacheFileHeader: []string{resp.cacheFile}}
+	if lastModified, ok := lastModifiedFromValidator(resp.etag); ok {
+		header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	} else {
+		header.Set("Etag", `"`+resp.etag+`"`)
+	}
+	if resp.fromCache {
+		header.Set(cacheHitHeader, "true")
+	}
 	return &http.Response{
 		StatusCode:    http.StatusOK,
+		Header:        header,
 		Body:          f,
 		ContentLength: fi.Size(),
 	}, nil
@@ -135,8 +208,58 @@ func (e *etagCache) get(t *cacheTransport, request *http.Request, cacheFile stri
 type cache struct {
 	dir     string
 	offline bool
+	keys    *cacheKeys
+}
+
+// cacheKeys normalizes the URLs that responses are cached by, see WithCacheKeyNormalization. A nil
+// cacheKeys caches by the URL as is.
+type cacheKeys struct {
+	// query is the query parameters that are kept in the keys, all others are dropped.
+	query []string
 }
 
+// key returns what the response for u is cached by: u without its fragment, and with only the query
+// parameters that are kept, in a stable order.
+func (k *cacheKeys) key(u url.URL) string {
+	if k == nil {
+		return u.String()
+	}
+	n := k.normalize(u)
+	return n.String()
+}
+
+func (k *cacheKeys) normalize(u url.URL) url.URL {
+	if k == nil {
+		return u
+	}
+	u.Fragment, u.RawFragment = "", ""
+	u.ForceQuery = false
+	q := u.Query()
+	kept := url.Values{}
+	for _, name := range k.query {
+		if v, ok := q[name]; ok {
+			kept[name] = v
+		}
+	}
+	// sorted by name
+	u.RawQuery = kept.Encode()
+	return u
+}
+
+// cachePath returns the file that the response for u is cached in. The query is never part of the path,
+// so with query parameters kept by keys the files are under a directory named by a digest of them.
+func cachePath(root string, keys *cacheKeys, u url.URL) (string, error) {
+	if k := keys.normalize(u); k.RawQuery != "" {
+		sum := sha256.Sum256([]byte(k.RawQuery))
+		root = filepath.Join(root, queryCacheDirPrefix+hex.EncodeToString(sum[:8]))
+	}
+	return cachePathFromURL(root, u)
+}
+
+// queryCacheDirPrefix is the prefix of the directories under the cache root for the responses of URLs with
+// query parameters kept by WithCacheKeyNormalization. Like packagesCacheDir, it cannot be an escaped URL.
+const queryCacheDirPrefix = "query-"
+
 // client return an http.Client that knows how to read from and write to the cache
 // key is in the implementation of https://pkg.go.dev/net/http#RoundTripper
 func (c cache) client(wrapped *http.Client, etagRequired bool) *http.Client {
@@ -146,6 +269,7 @@ func (c cache) client(wrapped *http.Client, etagRequired bool) *http.Client {
 			root:         c.dir,
 			offline:      c.offline,
 			etagRequired: etagRequired,
+			keys:         c.keys,
 		},
 	}
 }
@@ -155,6 +279,7 @@ type cacheTransport struct {
 	root         string
 	offline      bool
 	etagRequired bool
+	keys         *cacheKeys
 }
 
 func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -162,7 +287,7 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 	if request.URL == nil {
 		return nil, fmt.Errorf("no URL in request")
 	}
-	cacheFile, err := cachePathFromURL(t.root, *request.URL)
+	cacheFile, err := cachePath(t.root, t.keys, *request.URL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid cache path based on URL: %w", err)
 	}
@@ -175,13 +300,14 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 		f, err := os.Open(cacheFile)
 		if err != nil {
 			if t.offline {
-				return nil, fmt.Errorf("failed to read %q in offline cache: %w", cacheFile, err)
+				return nil, withKind(ErrOffline, fmt.Errorf("failed to read %q in offline cache: %w", cacheFile, err))
 			}
 			return t.wrapped.Do(request)
 		}
 
 		return &http.Response{
 			StatusCode: http.StatusOK,
+			Header:     http.Header{cacheHitHeader: []string{"true"}},
 			Body:       f,
 		}, nil
 	}
@@ -190,11 +316,14 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 		cacheDir := cacheDirFromFile(cacheFile)
 		des, err := os.ReadDir(cacheDir)
 		if err != nil {
-			return nil, fmt.Errorf("listing %q for offline cache: %w", cacheDir, err)
+			return nil, withKind(ErrOffline, fmt.Errorf("listing %q for offline cache: %w", cacheDir, err))
 		}
 
+		des = slices.DeleteFunc(des, func(de fs.DirEntry) bool {
+			return strings.HasSuffix(de.Name(), freshnessExt) || strings.HasSuffix(de.Name(), provenanceExt)
+		})
 		if len(des) == 0 {
-			return nil, fmt.Errorf("no offline cached entries for %s", cacheDir)
+			return nil, withKind(ErrOffline, fmt.Errorf("no offline cached entries for %s", cacheDir))
 		}
 
 		newest, err := des[0].Info()
@@ -213,13 +342,15 @@ func (t *cacheTransport) RoundTrip(request *http.Request) (*http.Response, error
 			}
 		}
 
-		f, err := os.Open(filepath.Join(cacheDir, newest.Name()))
+		newestFile := filepath.Join(cacheDir, newest.Name())
+		f, err := os.Open(newestFile)
 		if err != nil {
 			return nil, err
 		}
 
 		return &http.Response{
 			StatusCode:    http.StatusOK,
+			Header:        http.Header{cacheHitHeader: []string{"true"}, cacheFileHeader: []string{newestFile}},
 			Body:          f,
 			ContentLength: newest.Size(),
 		}, nil
@@ -246,7 +377,20 @@ func cacheFileFromEtag(cacheFile, etag string) string {
 		ext = ".tar.gz"
 	}
 
-	return filepath.Join(cacheDir, etag+ext)
+	return filepath.Join(cacheDir, etagFilename(etag)+ext)
+}
+
+// etagFilename returns etag as the name of a file, or its digest if it has anything other than letters, digits,
+// dots, dashes and underscores, as a weak etag such as W/"abc" does, or one with a path in it.
+func etagFilename(etag string) string {
+	safe := etag != "" && etag != "." && etag != ".." && strings.IndexFunc(etag, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r))
+	}) < 0
+	if safe {
+		return etag
+	}
+	sum := sha256.Sum256([]byte(etag))
+	return "etag-sha256-" + hex.EncodeToString(sum[:])
 }
 
 func etagFromResponse(resp *http.Response) (string, bool) {
@@ -254,28 +398,140 @@ func etagFromResponse(resp *http.Response) (string, bool) {
 	if !ok || len(remoteEtag) == 0 || remoteEtag[0] == "" {
 		return "", false
 	}
-	// When we get etags, they appear to be quoted.
-	etag := strings.Trim(remoteEtag[0], `"`)
+	etag := etagFromHeader(remoteEtag[0])
 	return etag, etag != ""
 }
 
-type cachePlacer func(*http.Response) (string, error)
+// etagFromHeader returns the etag of the value of an ETag header.
+func etagFromHeader(value string) string {
+	// When we get etags, they appear to be quoted.
+	return strings.Trim(value, `"`)
+}
+
+// validatorFromResponse returns a value that identifies the content of the response, for use
+// in place of an etag. If the response has no etag, its last-modified time is used.
+func validatorFromResponse(resp *http.Response) (string, bool) {
+	if etag, ok := etagFromResponse(resp); ok {
+		return etag, true
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s%d", lastModifiedValidatorPrefix, lastModified.Unix()), true
+}
 
-func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlacer) (string, error) {
+// lastModifiedValidatorPrefix is the prefix of the validators of validatorFromResponse that are a Last-Modified.
+const lastModifiedValidatorPrefix = "last-modified-"
+
+// lastModifiedFromValidator returns the time of a validator of validatorFromResponse, if it is a Last-Modified.
+func lastModifiedFromValidator(validator string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(validator, lastModifiedValidatorPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0).UTC(), true
+}
+
+// freshness is stored next to the cache file for a URL, so that other processes can reuse
+// the response without revalidating it until it expires, per its Cache-Control max-age.
+type freshness struct {
+	// Validator is what the cached response was stored under, see cacheFileFromEtag.
+	Validator    string    `json:"validator"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+func readFreshness(cacheFile string) *freshness {
+	b, err := os.ReadFile(cacheFile + freshnessExt)
+	if err != nil {
+		return nil
+	}
+	var f freshness
+	if err := json.Unmarshal(b, &f); err != nil || f.Validator == "" {
+		return nil
+	}
+	return &f
+}
+
+// writeFreshness records how long the response stored under validator is fresh for. If resp does not have
+// validators of its own, such as a 304 with only Cache-Control, the ones from prev are kept.
+// This is best effort, as the worst that happens without it is that we revalidate next time.
+func writeFreshness(cacheFile, validator string, resp *http.Response, prev *freshness) {
+	f := freshness{
+		Validator:    validator,
+		LastModified: resp.Header.Get("Last-Modified"),
+		Expires:      time.Now().Add(maxAgeFromResponse(resp)),
+	}
+	f.ETag, _ = etagFromResponse(resp)
+	if prev != nil {
+		if f.ETag == "" {
+			f.ETag = prev.ETag
+		}
+		if f.LastModified == "" {
+			f.LastModified = prev.LastModified
+		}
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return
+	}
+	_ = writeFileAtomic(cacheFile+freshnessExt, b)
+}
+
+// maxAgeFromResponse returns how long the response may be used without revalidating, per its
+// Cache-Control and Age headers. Responses that must always be revalidated return 0.
+func maxAgeFromResponse(resp *http.Response) time.Duration {
+	var maxAge time.Duration
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache", directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+			if err != nil || secs < 0 {
+				return 0
+			}
+			maxAge = time.Duration(secs) * time.Second
+		}
+	}
+	if age, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		maxAge -= time.Duration(age) * time.Second
+	}
+	if maxAge < 0 {
+		return 0
+	}
+	return maxAge
+}
+
+// cachePlacer returns the file to cache a response in, given the response and the digest of its body,
+// see bodyDigest. The file must be within the cacheDir given to retrieveAndSaveFile.
+type cachePlacer func(resp *http.Response, digest string) (string, error)
+
+// bodyDigest is the validator for a response body with the given sha256, for when the response has no etag.
+func bodyDigest(sum []byte) string {
+	return fmt.Sprintf("sha256-%x", sum)
+}
+
+func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cacheDir string, cp cachePlacer) (string, error) {
 	if t.wrapped == nil {
 		return "", fmt.Errorf("wrapped client is nil")
 	}
 	resp, err := t.wrapped.Do(request)
-	if err != nil || resp.StatusCode != 200 {
-		return "", err
-	}
-
-	// Determine the file we will caching stuff in based on the URL/response
-	cacheFile, err := cp(resp)
 	if err != nil {
 		return "", err
 	}
-	cacheDir := filepath.Dir(cacheFile)
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return "", fmt.Errorf("unable to get %s: %s", request.URL.Redacted(), resp.Status)
+	}
+
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
 		return "", fmt.Errorf("unable to create cache directory: %w", err)
 	}
@@ -286,10 +542,12 @@ func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlac
 	if err != nil {
 		return "", fmt.Errorf("unable to create a temporary cache file: %w", err)
 	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
 	if err := func() error {
 		defer tmp.Close()
 		defer resp.Body.Close()
-		if _, err := io.Copy(tmp, resp.Body); err != nil {
+		if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
 			return fmt.Errorf("unable to write to cache file: %w", err)
 		}
 		return nil
@@ -297,22 +555,41 @@ func (t *cacheTransport) retrieveAndSaveFile(request *http.Request, cp cachePlac
 		return "", err
 	}
 
+	// Determine the file we will caching stuff in based on the URL/response
+	cacheFile, err := cp(resp, bodyDigest(h.Sum(nil)))
+	if err != nil {
+		return "", err
+	}
+
 	// Now that we have the file has been written, rename to atomically populate
 	// the cache
 	if err := os.Rename(tmp.Name(), cacheFile); err != nil {
 		return "", fmt.Errorf("unable to populate cache: %v", err)
 	}
+	// This is best effort, as it does not change what is cached, only what we can tell about it.
+	_ = writeProvenance(cacheFile, provenanceFromResponse(request.URL.Redacted(), resp.Header))
 
 	return cacheFile, nil
 }
 
-func cacheDirForPackage(root string, pkg InstallablePackage) (string, error) {
+// packagesCacheDir is the directory under the cache root where packages are cached by their checksum.
+// Repositories are cached under their escaped URL, which always has a scheme, so it cannot be this.
+const packagesCacheDir = "packages"
+
+// cacheDirForPackage returns the directory to cache a package in. Packages with a Q1 checksum, as in an
+// APKINDEX, are cached by it, so that the same package from any mirror, or any URL, is cached once, and
+// can be found without asking the network. Others are cached by their URL.
+func cacheDirForPackage(root string, keys *cacheKeys, pkg InstallablePackage) (string, error) {
+	if checksum, err := packageChecksum(pkg); err == nil && len(checksum) == sha1.Size {
+		return filepath.Join(root, packagesCacheDir, hex.EncodeToString(checksum)), nil
+	}
+
 	u, err := packageAsURL(pkg)
 	if err != nil {
 		return "", err
 	}
 
-	p, err := cachePathFromURL(root, *u)
+	p, err := cachePath(root, keys, *u)
 	if err != nil {
 		return "", err
 	}
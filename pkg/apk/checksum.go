@@ -0,0 +1,119 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha1" //nolint:gosec // the checksums of packages are SHA1 digests
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// checksumPrefix marks a checksum as base64 of a SHA1 digest, rather than hex of an MD5 one.
+const checksumPrefix = "Q1"
+
+// FormatChecksum returns sum, a SHA1 digest, as apk writes it in the C: field of an index or the installed
+// database, e.g. Q1q+pN8DhSD7t8+L8J7yFlsQXM4g8=.
+func FormatChecksum(sum []byte) string {
+	return checksumPrefix + base64.StdEncoding.EncodeToString(sum)
+}
+
+// ParseChecksum returns the SHA1 digest of s, a checksum as FormatChecksum returns it.
+func ParseChecksum(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, checksumPrefix) {
+		return nil, fmt.Errorf("unexpected checksum: %q", s)
+	}
+	sum, err := base64.StdEncoding.DecodeString(s[len(checksumPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("decoding checksum %q: %w", s, err)
+	}
+	return sum, nil
+}
+
+// ControlChecksum returns the checksum that an index has for the package read from r, the SHA1 digest of the
+// gzip stream of its control section, after the signature if the package is signed. It reads r only up to the
+// end of the control section, so the data section does not need to be read at all. ParsePackage and the
+// checksum verification of downloaded packages compute checksums with it too. See FormatChecksum.
+func ControlChecksum(r io.Reader) ([]byte, error) {
+	// gzip reads exactly the bytes of each stream from a reader that is an io.ByteReader, so what it reads is
+	// the stream
+	hr := &hashingReader{r: bufio.NewReader(r), h: sha1.New()} //nolint:gosec
+	zr, err := gzpool.GetReader(hr)
+	defer gzpool.PutReader(zr)
+	if err != nil {
+		return nil, fmt.Errorf("reading first section of package: %w", err)
+	}
+	zr.Multistream(false)
+	hdr, err := tar.NewReader(zr).Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading first section of package: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, fmt.Errorf("reading first section of package: %w", err)
+	}
+	if !strings.HasPrefix(hdr.Name, ".SIGN.") {
+		// not signed, so the first section is the control section
+		return hr.h.Sum(nil), nil
+	}
+
+	hr.h = sha1.New() //nolint:gosec
+	if err := zr.Reset(hr); err != nil {
+		return nil, fmt.Errorf("reading control section of package: %w", err)
+	}
+	zr.Multistream(false)
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, fmt.Errorf("reading control section of package: %w", err)
+	}
+	return hr.h.Sum(nil), nil
+}
+
+// expandedChecksum returns the checksum of the package expanded as exp, with ControlChecksum over its control
+// section, so that packages that are parsed and packages that are verified get the same checksum as an index.
+func expandedChecksum(exp *expandapk.APKExpanded) ([]byte, error) {
+	f, err := os.Open(exp.ControlFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening control section: %w", err)
+	}
+	defer f.Close()
+	return ControlChecksum(f)
+}
+
+// hashingReader hashes what is read from r, as an io.ByteReader as well, so that gzip does not read ahead.
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *hashingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+	}
+	return b, err
+}
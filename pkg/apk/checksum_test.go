@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+func TestControlChecksum(t *testing.T) {
+	unsigned := fakePackage(t, &Package{Name: "unsigned", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+	}).(*testPackage)
+	for name, file := range map[string]string{
+		"signed":   filepath.Join(testPrimaryPkgDir, testPkgFilename),
+		"wolfi":    "testdata/hello-wolfi-2.12.1-r0.apk",
+		"unsigned": unsigned.file,
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, err := os.ReadFile(file)
+			require.NoError(t, err)
+			pkg, err := ParsePackage(context.Background(), bytes.NewReader(b))
+			require.NoError(t, err)
+
+			sum, err := ControlChecksum(bytes.NewReader(b))
+			require.NoError(t, err)
+			require.Equal(t, pkg.Checksum, sum)
+			sum, err = ControlChecksum(iotest.OneByteReader(bytes.NewReader(b)))
+			require.NoError(t, err)
+			require.Equal(t, pkg.Checksum, sum)
+
+			// the hash of the control section that expanding the package computes agrees
+			exp, err := expandapk.ExpandApk(context.Background(), bytes.NewReader(b), "")
+			require.NoError(t, err)
+			defer exp.Close()
+			require.Equal(t, exp.ControlHash, sum)
+		})
+	}
+	sum, err := ControlChecksum(bytes.NewReader(mustReadFile(t, filepath.Join(testPrimaryPkgDir, testPkgFilename))))
+	require.NoError(t, err)
+	require.Equal(t, testPkg.Checksum, sum)
+
+	_, err = ControlChecksum(bytes.NewReader([]byte("not a package")))
+	require.Error(t, err)
+}
+
+func TestFormatChecksum(t *testing.T) {
+	s := FormatChecksum(testPkg.Checksum)
+	require.Equal(t, "Q1LLq2qDNrS/qRnhxQ3hsY/sHbQnc=", s)
+	require.Equal(t, testPkg.ChecksumString(), s)
+	sum, err := ParseChecksum(s)
+	require.NoError(t, err)
+	require.Equal(t, testPkg.Checksum, sum)
+
+	for _, invalid := range []string{"", "2cbab6a8336b4bfa919e1c50de1b18fec1db4277", "Q1!"} {
+		_, err := ParseChecksum(invalid)
+		require.Error(t, err, "checksum %q", invalid)
+	}
+}
+
+func mustReadFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	return b
+}
@@ -19,6 +19,10 @@ const (
 	DefaultSystemKeyRingPath = "/usr/share/apk/keys/"
 	indexFilename            = "APKINDEX.tar.gz"
 	// we are using these for fs.FS so should omit the leading /
+	// the directories of the default layout, see WithConfigDir and WithDatabaseDir
+	defaultConfigDir   = "etc/apk"
+	defaultDatabaseDir = "lib/apk/db"
+	// the files of the default layout, see layoutPath
 	reposFilePath     = "etc/apk/repositories"
 	archFilePath      = "etc/apk/arch"
 	keysDirPath       = "etc/apk/keys"
@@ -27,6 +31,10 @@ const (
 	scriptsFilePath   = "lib/apk/db/scripts.tar"
 	scriptsTarPerms   = 0o644
 	triggersFilePath  = "lib/apk/db/triggers"
+	contentsFilePath  = "lib/apk/db/contents"
+	// protected_paths.d list files, and the suffix for new files written under protected paths
+	protectedPathsDirPath = "etc/apk/protected_paths.d"
+	apkNewSuffix          = ".apk-new"
 	// which PAX record we use in the tar header
 	paxRecordsChecksumKey = "APK-TOOLS.checksum.SHA1"
 
@@ -0,0 +1,95 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ContentsEntry is a file in the contents database, lib/apk/db/contents, see WithContentsDB.
+type ContentsEntry struct {
+	// Path is the path of the file within the root, without a leading /, e.g. usr/bin/foo.
+	Path string
+	// Package is the name of the package that installed the file.
+	Package string
+	// Checksum is the sha1 of the contents of the file, nil if the package did not have one.
+	Checksum []byte
+}
+
+// addContents adds the regular files of pkg to the contents database. Each file is a line of the package name,
+// the Q1 checksum of the file, if any, and its path, separated by tabs, with the path last so it may have tabs.
+func (a *APK) addContents(pkg *Package, files []tar.Header) error {
+	contents, err := a.fs.OpenFile(a.layoutPath(contentsFilePath), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open contents file at %s: %w", a.layoutPath(contentsFilePath), err)
+	}
+	defer contents.Close()
+
+	var b strings.Builder
+	for _, f := range files {
+		if f.Typeflag == tar.TypeDir {
+			continue
+		}
+		var checksum string
+		if sum := decodeFileChecksum(f.PAXRecords[paxRecordsChecksumKey]); sum != nil {
+			checksum = FormatChecksum(sum)
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\n", pkg.Name, checksum, strings.TrimPrefix(filepath.Clean(f.Name), "/"))
+	}
+	if _, err := contents.Write([]byte(b.String())); err != nil {
+		return fmt.Errorf("could not write contents file at %s: %w", a.layoutPath(contentsFilePath), err)
+	}
+	return nil
+}
+
+// GetContents returns the files in the contents database, lib/apk/db/contents, in the order they were installed.
+// The database is only written when installing with WithContentsDB.
+func (a *APK) GetContents() ([]ContentsEntry, error) {
+	contents, err := a.fs.Open(a.layoutPath(contentsFilePath))
+	if err != nil {
+		return nil, fmt.Errorf("could not open contents file in %s at %s: %w", a.fs, a.layoutPath(contentsFilePath), err)
+	}
+	defer contents.Close()
+	return ParseContents(contents)
+}
+
+// ParseContents parses a contents database, as written when installing with WithContentsDB.
+func ParseContents(contents io.Reader) ([]ContentsEntry, error) {
+	var entries []ContentsEntry
+	scanner := bufio.NewScanner(contents)
+	for linenr := 1; scanner.Scan(); linenr++ {
+		parts := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("cannot parse contents line %d: expected package, checksum and path", linenr)
+		}
+		entry := ContentsEntry{Package: parts[0], Path: parts[2]}
+		if parts[1] != "" {
+			if entry.Checksum = decodeFileChecksum(parts[1]); entry.Checksum == nil {
+				return nil, fmt.Errorf("cannot parse contents line %d: invalid checksum %s", linenr, parts[1])
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading contents: %w", err)
+	}
+	return entries, nil
+}
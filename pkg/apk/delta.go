@@ -0,0 +1,164 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+
+	"go.opentelemetry.io/otel"
+)
+
+// PackageChange is an installed package that is replaced by a different version.
+type PackageChange struct {
+	From *InstalledPackage
+	To   *RepositoryPackage
+}
+
+// Delta is the difference between the installed packages and the packages resolved for a world.
+type Delta struct {
+	Resolution
+
+	// Install are the packages that are not installed, in the order to install them.
+	Install []*RepositoryPackage
+	// Upgrade are the packages that are installed at a different version, in the order to install
+	// them. This usually is an upgrade, but is a downgrade if the installed version is no longer
+	// in the indexes, or does not satisfy the constraints. With WithUpgradeAvailable, it also has the
+	// packages that are reinstalled at the same version, as a different build of it.
+	Upgrade []PackageChange
+	// Remove are the installed packages that no longer are needed.
+	Remove []*InstalledPackage
+	// Keep are the installed packages that are resolved at the installed version.
+	Keep []*InstalledPackage
+}
+
+// ToInstall returns the packages to give InstallPackages to go from the installed packages to the resolved ones:
+// those in Install and Upgrade, in the order of the resolution. InstallPackages replaces the installed package of
+// each of Upgrade with its new version or build.
+func (d *Delta) ToInstall() []InstallablePackage {
+	changed := make(map[*RepositoryPackage]bool, len(d.Install)+len(d.Upgrade))
+	for _, pkg := range d.Install {
+		changed[pkg] = true
+	}
+	for _, change := range d.Upgrade {
+		changed[change.To] = true
+	}
+	pkgs := make([]InstallablePackage, 0, len(changed))
+	for _, pkg := range d.Packages {
+		if changed[pkg] {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+type deltaOpts struct {
+	available bool
+}
+
+// DeltaOption is an option for ResolveWithInstalled.
+type DeltaOption func(*deltaOpts)
+
+// WithUpgradeAvailable sets whether the installed packages are only kept when the same build of them is in the
+// indexes, as apk upgrade --available does. A build is identified by the checksum of the package, so a package
+// that a repository republished with the same version, rebuilt or from another repository, is reinstalled, and
+// one that no repository has any more is replaced by what the indexes have, even if that is a downgrade.
+// Installed packages without a checksum are only compared by version. InstallPackages, given Delta.ToInstall,
+// installs the new builds in place of the old ones.
+func WithUpgradeAvailable(available bool) DeltaOption {
+	return func(o *deltaOpts) {
+		o.available = available
+	}
+}
+
+// ResolveWithInstalled resolves the packages in world, treating the installed packages as soft constraints:
+// an installed version is kept as long as it is in the indexes and satisfies the constraints, even if a newer
+// version is available, except for packages in world asked for from a tagged repository. It returns the delta
+// from the installed packages to the resolved ones.
+func (p *PkgResolver) ResolveWithInstalled(ctx context.Context, world []string, installed []*InstalledPackage, options ...DeltaOption) (*Delta, error) {
+	_, span := otel.Tracer("go-apk").Start(ctx, "ResolveWithInstalled")
+	defer span.End()
+
+	var o deltaOpts
+	for _, opt := range options {
+		opt(&o)
+	}
+
+	installedByName := make(map[string]*InstalledPackage, len(installed))
+	preferred := make(map[string]*RepositoryPackage, len(installed))
+	for _, pkg := range installed {
+		installedByName[pkg.Name] = pkg
+		rp := p.installedRepositoryPackage(pkg)
+		if rp != nil && o.available && !sameBuild(pkg, rp) {
+			rp = nil
+		}
+		if rp != nil {
+			preferred[pkg.Name] = rp
+		}
+	}
+
+	resolution, err := p.resolve(world, preferred)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := &Delta{Resolution: *resolution}
+	resolved := make(map[string]bool, len(resolution.Packages))
+	for _, pkg := range resolution.Packages {
+		resolved[pkg.Name] = true
+		from, ok := installedByName[pkg.Name]
+		switch {
+		case !ok:
+			delta.Install = append(delta.Install, pkg)
+		case from.Version != pkg.Version, o.available && !sameBuild(from, pkg):
+			delta.Upgrade = append(delta.Upgrade, PackageChange{From: from, To: pkg})
+		default:
+			delta.Keep = append(delta.Keep, from)
+		}
+	}
+	for _, pkg := range installed {
+		if !resolved[pkg.Name] {
+			delta.Remove = append(delta.Remove, pkg)
+		}
+	}
+	return delta, nil
+}
+
+// installedRepositoryPackage finds the package in the indexes that is the installed package,
+// or nil if it is not in any of them.
+func (p *PkgResolver) installedRepositoryPackage(pkg *InstalledPackage) *RepositoryPackage {
+	var found *RepositoryPackage
+	for _, rp := range p.nameMap[pkg.Name] {
+		if rp.Name != pkg.Name || rp.Version != pkg.Version {
+			continue
+		}
+		// the same checksum is the same package, otherwise take the first
+		if len(pkg.Checksum) != 0 && bytes.Equal(rp.Checksum, pkg.Checksum) {
+			return rp.RepositoryPackage
+		}
+		if found == nil {
+			found = rp.RepositoryPackage
+		}
+	}
+	return found
+}
+
+// sameBuild returns whether pkg is the build of the installed package, by its checksum if both have one.
+func sameBuild(installed *InstalledPackage, pkg *RepositoryPackage) bool {
+	if len(installed.Checksum) == 0 || len(pkg.Checksum) == 0 {
+		return installed.Version == pkg.Version
+	}
+	return bytes.Equal(installed.Checksum, pkg.Checksum)
+}
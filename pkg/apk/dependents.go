@@ -0,0 +1,109 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WhoDependsOn returns the packages in the indexes with a dependency that any version of the package
+// name satisfies, either by its name or by one of the names it provides. Each package is returned once,
+// in the order of the indexes.
+func (p *PkgResolver) WhoDependsOn(name string) []*RepositoryPackage {
+	var targets []*Package
+	for _, pkg := range p.nameMap[name] {
+		if pkg.Name == name {
+			targets = append(targets, pkg.Package)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var dependents []*RepositoryPackage
+	for _, index := range p.indexes {
+		for _, pkg := range index.Packages() {
+			if pkg.Name == name {
+				continue
+			}
+			for _, target := range targets {
+				if p.dependsOn(pkg.Package, target) {
+					dependents = append(dependents, pkg)
+					break
+				}
+			}
+		}
+	}
+	return dependents
+}
+
+// WhoDependsOn returns the installed packages with a dependency that the installed package name
+// satisfies, either by its name or by one of the names it provides. These are the packages that could
+// break if name were removed or replaced.
+func (a *APK) WhoDependsOn(name string) ([]*InstalledPackage, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+
+	var target *Package
+	for _, pkg := range installed {
+		if pkg.Name == name {
+			target = &pkg.Package
+			break
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("package %s is not installed", name)
+	}
+
+	// the resolver is only used for its caches of parsed versions and constraints
+	p := newPkgResolver(nil, a.strictVersions)
+	var dependents []*InstalledPackage
+	for _, pkg := range installed {
+		if pkg.Name != name && p.dependsOn(&pkg.Package, target) {
+			dependents = append(dependents, pkg)
+		}
+	}
+	return dependents, nil
+}
+
+// dependsOn reports whether any of the dependencies of pkg are satisfied by target.
+func (p *PkgResolver) dependsOn(pkg, target *Package) bool {
+	for _, dep := range pkg.Dependencies {
+		if strings.HasPrefix(dep, "!") {
+			continue
+		}
+		constraint := p.resolvePackageNameVersionPin(dep)
+		if constraint.name == target.Name && p.satisfiesPackage(target, constraint) {
+			return true
+		}
+		for _, prov := range target.Provides {
+			provided := p.resolvePackageNameVersionPin(prov)
+			if provided.name != constraint.name {
+				continue
+			}
+			version := provided.version
+			if version == "" {
+				version = target.Version
+			}
+			if p.satisfiesVersion(version, constraint) {
+				return true
+			}
+		}
+	}
+	return false
+}
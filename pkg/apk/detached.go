@@ -0,0 +1,104 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// detachedSigRepository returns the repository of pkg, as passed to WithDetachedSignatures, if its
+// packages need a detached signature.
+func (a *APK) detachedSigRepository(pkg InstallablePackage) (string, bool) {
+	u := pkg.URL()
+	for _, repo := range a.detachedSigRepos {
+		layout, ok := a.repoLayouts[repo]
+		if !ok {
+			layout = DefaultRepositoryLayout
+		}
+		if strings.HasPrefix(u, RepositoryURL(layout, repo, a.arch)+"/") {
+			return repo, true
+		}
+	}
+	return "", false
+}
+
+// detachedSignature is the detached signature of a package, which is fetched as the package is.
+type detachedSignature struct {
+	InstallablePackage
+}
+
+func (s detachedSignature) URL() string {
+	return s.InstallablePackage.URL() + sign.DetachedSignatureExt
+}
+
+// verifyDetachedSignature verifies the detached signature of pkg, from repo, over digest, the SHA1 digest of
+// the whole package, with the keys of repo, returning which key verified it.
+func (a *APK) verifyDetachedSignature(ctx context.Context, pkg InstallablePackage, repo string, digest []byte) (*Verification, error) {
+	rc, _, err := a.fetchPackage(ctx, detachedSignature{pkg})
+	if err != nil {
+		return nil, withKind(ErrSignatureInvalid, fmt.Errorf("fetching detached signature of %s: %w", pkg.PackageName(), err))
+	}
+	defer rc.Close()
+	keyName, scheme, signature, err := readSignatureSection(rc)
+	if err != nil {
+		return nil, withKind(ErrSignatureInvalid, fmt.Errorf("reading detached signature of %s: %w", pkg.PackageName(), err))
+	}
+
+	keys, err := a.trustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys, err = a.repositoryKeys(repo, keys); err != nil {
+		return nil, err
+	}
+	verification, err := verifyIndexSignature(keyName, scheme, digest, signature, keys)
+	if err != nil {
+		return nil, fmt.Errorf("verifying detached signature of %s: %w", pkg.PackageName(), err)
+	}
+	return verification, nil
+}
+
+// readSignatureSection returns the key name, scheme and signature of the signature section read from r, a
+// detached signature, see sign.SignDetached, or that of a signed package, see sign.SignAPK.
+func readSignatureSection(r io.Reader) (string, sign.Scheme, []byte, error) {
+	gzipReader, err := gzpool.GetReader(r)
+	defer gzpool.PutReader(gzipReader)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	hdr, err := tarReader.Next()
+	if err != nil {
+		return "", 0, nil, err
+	}
+	keyName, scheme, ok := sign.ParseSignatureName(hdr.Name)
+	if !ok {
+		return "", 0, nil, fmt.Errorf("failed to find key name in signature file name: %s", hdr.Name)
+	}
+	signature, err := io.ReadAll(tarReader)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return keyName, scheme, signature, nil
+}
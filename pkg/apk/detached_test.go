@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func TestDetachedSignatures(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+	dir := t.TempDir()
+	keyFile, pub := testSigningKey(t, dir, "test.rsa")
+	otherKeyFile, _ := testSigningKey(t, dir, "other.rsa")
+	signer, err := sign.NewKeySigner(keyFile)
+	require.NoError(t, err)
+	otherSigner, err := sign.NewKeySigner(otherKeyFile)
+	require.NoError(t, err)
+
+	// newRepo returns a directory with the test package, and its detached signature by signer if any
+	newRepo := func(t *testing.T, signer *sign.Signer) string {
+		root := t.TempDir()
+		b, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
+		require.NoError(t, err)
+		packageFile := filepath.Join(root, testPkgFilename)
+		require.NoError(t, os.WriteFile(packageFile, b, 0o644))
+		if signer != nil {
+			require.NoError(t, sign.SignDetached(ctx, signer, packageFile))
+		}
+		return root
+	}
+	newAPK := func(t *testing.T, root string, repos ...string) *APK {
+		src := apkfs.NewMemFS()
+		require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+		require.NoError(t, src.WriteFile(filepath.Join(keysDirPath, "test.rsa.pub"), pub, 0o644))
+		a, err := New(WithFS(src), WithArch(testArch), WithDetachedSignatures(repos...))
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: root, basenameOnly: true},
+		})
+		return a
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		exp, err := newAPK(t, newRepo(t, signer), testAlpineRepos).expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer exp.Close()
+	})
+	t.Run("no signature", func(t *testing.T) {
+		_, err := newAPK(t, newRepo(t, nil), testAlpineRepos).expandPackage(ctx, pkg)
+		require.ErrorIs(t, err, ErrSignatureInvalid)
+	})
+	t.Run("untrusted key", func(t *testing.T) {
+		_, err := newAPK(t, newRepo(t, otherSigner), testAlpineRepos).expandPackage(ctx, pkg)
+		require.ErrorIs(t, err, ErrSignatureInvalid)
+	})
+	t.Run("other repository", func(t *testing.T) {
+		exp, err := newAPK(t, newRepo(t, nil), "https://example.com/alpine/main").expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer exp.Close()
+	})
+}
@@ -17,8 +17,56 @@ package apk
 import (
 	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// Errors that are wrapped by the errors returned for each failure mode, to check for with errors.Is.
+var (
+	// ErrPackageNotFound is when no package in the indexes has a name, or provides it, or satisfies
+	// a constraint on it.
+	ErrPackageNotFound = errors.New("package not found")
+	// ErrChecksumMismatch is when the contents of a package do not have the checksum they should.
+	ErrChecksumMismatch = expandapk.ErrChecksumMismatch
+	// ErrSignatureInvalid is when an index is not signed by any of the keys that can verify it.
+	ErrSignatureInvalid = errors.New("signature invalid")
+	// ErrFileConflict is when a package would overwrite a file of another package, with different contents,
+	// and the ConflictPolicy does not allow it.
+	ErrFileConflict = errors.New("file conflict")
+	// ErrOffline is when something is not in the cache, and the cache is offline.
+	ErrOffline = errors.New("not in offline cache")
+	// ErrPackageHeld is when the holds of PkgResolver.SetHolds or WithHolds leave no version of a package that
+	// the world needs.
+	ErrPackageHeld = errors.New("package held")
+	// ErrTimeout is when installing packages, or a phase of it, takes longer than the Timeouts of WithTimeouts.
+	ErrTimeout = errors.New("timed out")
+	// ErrFetchDenied is when a FetchPolicy of WithFetchPolicy or WithIndexFetchPolicy denies a URL.
+	ErrFetchDenied = errors.New("fetch denied")
+	// ErrInsufficientSpace is when there is not enough free space to expand a package, see WithTempDir.
+	ErrInsufficientSpace = expandapk.ErrInsufficientSpace
 )
 
+// kindError is err, which errors.Is also finds kind in, such as ErrPackageNotFound.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// withKind returns err with kind, without changing its message.
+func withKind(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
 type FileExistsError struct {
 	Path string
 	Sha1 []byte
@@ -32,3 +80,49 @@ func (f FileExistsError) Is(target error) bool {
 	var targetError FileExistsError
 	return errors.As(target, &targetError)
 }
+
+// InvalidNameError is returned when a package has a file whose name is an absolute path, has a ".."
+// element, or is too long to create, rather than writing it wherever the filesystem would put it.
+type InvalidNameError = tarfs.InvalidNameError
+
+// RepositoryIndexError is returned when the index of a repository cannot be fetched, parsed or verified.
+type RepositoryIndexError struct {
+	// Repository is the repository as it was passed, including any @tag.
+	Repository string
+	// URL is the URL of the index, without any credentials.
+	URL string
+	Err error
+}
+
+func (e *RepositoryIndexError) Error() string {
+	if e.URL == "" {
+		return fmt.Sprintf("repository %s: %v", e.Repository, e.Err)
+	}
+	return fmt.Sprintf("reading index %s: %v", e.URL, e.Err)
+}
+
+func (e *RepositoryIndexError) Unwrap() error {
+	return e.Err
+}
+
+// RepositoryIndexErrors is returned by GetRepositoryIndexes with WithIndexPartialResults, together with
+// the indexes of the other repositories, when one or more repositories failed.
+type RepositoryIndexErrors struct {
+	Errors []*RepositoryIndexError
+}
+
+func (e *RepositoryIndexErrors) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d of the repositories failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *RepositoryIndexErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+)
+
+// EventType is the kind of progress an Event reports.
+type EventType int
+
+const (
+	// EventResolved is emitted when ResolveWorld has resolved the packages to install.
+	EventResolved EventType = iota
+	// EventFetchStarted is emitted when a package starts being fetched and expanded, or read from the cache.
+	EventFetchStarted
+	// EventFetchFinished is emitted when a package has been fetched and expanded, successfully or not.
+	EventFetchFinished
+	// EventScriptsUpdated is emitted when the scripts and triggers of a package have been added to the
+	// installed database. go-apk does not run scripts itself.
+	EventScriptsUpdated
+	// EventPackageInstalled is emitted when all of the files of a package have been installed.
+	EventPackageInstalled
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventResolved:
+		return "resolved"
+	case EventFetchStarted:
+		return "fetch-started"
+	case EventFetchFinished:
+		return "fetch-finished"
+	case EventScriptsUpdated:
+		return "scripts-updated"
+	case EventPackageInstalled:
+		return "package-installed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports the progress of resolving and installing packages.
+type Event struct {
+	Type EventType
+	// Package and Version identify the package the event is about. Both are empty for EventResolved,
+	// and Version is only known once the package has been fetched.
+	Package string
+	Version string
+	// Count is the number of packages resolved, for EventResolved.
+	Count int
+	// Err is the error that ended the fetch, for EventFetchFinished.
+	Err error
+}
+
+// EventHandler receives events. Packages are fetched concurrently, so it may be called from
+// multiple goroutines at once, and should return quickly so as not to hold up the install.
+type EventHandler func(ctx context.Context, event Event)
+
+// emit sends the event to the event handler, if there is one.
+func (a *APK) emit(ctx context.Context, event Event) {
+	if a.eventHandler != nil {
+		a.eventHandler(ctx, event)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DependencyGraph is the graph of a set of resolved packages, with an edge for each dependency
+// of a package that another package in the set satisfies. It marshals to JSON as is.
+type DependencyGraph struct {
+	Nodes []DependencyNode `json:"nodes"`
+	Edges []DependencyEdge `json:"edges"`
+}
+
+// DependencyNode is a package in a DependencyGraph.
+type DependencyNode struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Repository string `json:"repository,omitempty"`
+}
+
+// DependencyEdge is a dependency of the package From on the package To. Constraint is the
+// dependency as the package declares it, e.g. "so:libc.musl-x86_64.so.1" or "busybox>=1.36".
+type DependencyEdge struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Constraint string `json:"constraint"`
+}
+
+// DependencyGraph builds the graph of pkgs, usually the result of GetPackagesWithDependencies.
+// A dependency is satisfied by the package with its name before any package that provides it.
+// Conflicts, dependencies a package satisfies itself, and dependencies on packages that are not
+// in pkgs do not have an edge.
+func (p *PkgResolver) DependencyGraph(pkgs []*RepositoryPackage) *DependencyGraph {
+	g := &DependencyGraph{
+		Nodes: make([]DependencyNode, 0, len(pkgs)),
+	}
+	for _, pkg := range pkgs {
+		node := DependencyNode{Name: pkg.Name, Version: pkg.Version}
+		if pkg.Repository() != nil {
+			node.Repository = pkg.Repository().URI
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+
+	for _, pkg := range pkgs {
+		for _, dep := range pkg.Dependencies {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			to := p.satisfiedBy(dep, pkgs)
+			if to == nil || to.Name == pkg.Name {
+				continue
+			}
+			g.Edges = append(g.Edges, DependencyEdge{From: pkg.Name, To: to.Name, Constraint: dep})
+		}
+	}
+	return g
+}
+
+// satisfiedBy returns the package in pkgs that satisfies the dependency dep, or nil.
+func (p *PkgResolver) satisfiedBy(dep string, pkgs []*RepositoryPackage) *RepositoryPackage {
+	constraint := p.resolvePackageNameVersionPin(dep)
+	for _, pkg := range pkgs {
+		if pkg.Name == constraint.name && p.satisfiesPackage(pkg.Package, constraint) {
+			return pkg
+		}
+	}
+	for _, pkg := range pkgs {
+		for _, prov := range pkg.Provides {
+			provided := p.resolvePackageNameVersionPin(prov)
+			if provided.name != constraint.name {
+				continue
+			}
+			version := provided.version
+			if version == "" {
+				version = pkg.Version
+			}
+			if p.satisfiesVersion(version, constraint) {
+				return pkg
+			}
+		}
+	}
+	return nil
+}
+
+// satisfiesPackage returns whether pkg, named as constraint, satisfies its version or checksum.
+func (p *PkgResolver) satisfiesPackage(pkg *Package, constraint parsedConstraint) bool {
+	if constraint.dep == versionChecksum {
+		return pkg.ChecksumString() == constraint.version
+	}
+	return p.satisfiesVersion(pkg.Version, constraint)
+}
+
+func (p *PkgResolver) satisfiesVersion(version string, constraint parsedConstraint) bool {
+	if constraint.dep == versionAny {
+		return true
+	}
+	actualVersion, err := p.parseVersion(version)
+	if err != nil {
+		return false
+	}
+	requiredVersion, err := p.parseVersion(constraint.version)
+	if err != nil {
+		return false
+	}
+	return constraint.dep.Satisfies(actualVersion, requiredVersion)
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language.
+func (g *DependencyGraph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph dependencies {")
+	for _, node := range g.Nodes {
+		fmt.Fprintf(bw, "\t%s [label=%s];\n", strconv.Quote(node.Name), strconv.Quote(node.Name+"\n"+node.Version))
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(bw, "\t%s -> %s [label=%s];\n", strconv.Quote(edge.From), strconv.Quote(edge.To), strconv.Quote(edge.Constraint))
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	providers := map[string][]string{
+		"ld-linux=2.38-r10": {"so:ld-linux-aarch64.so.1=1.0"},
+	}
+	dependers := map[string][]string{
+		"glibc=2.38-r10":    {"so:ld-linux-aarch64.so.1", "busybox>=1.36", "!musl"},
+		"busybox=1.36.1-r0": {"busybox"},
+	}
+
+	resolver := makeResolver(providers, dependers)
+	pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), []string{"glibc"})
+	require.NoError(t, err)
+
+	graph := resolver.DependencyGraph(pkgs)
+	require.Len(t, graph.Nodes, 3)
+	require.ElementsMatch(t, []DependencyEdge{
+		{From: "glibc", To: "ld-linux", Constraint: "so:ld-linux-aarch64.so.1"},
+		{From: "glibc", To: "busybox", Constraint: "busybox>=1.36"},
+	}, graph.Edges)
+
+	t.Run("json", func(t *testing.T) {
+		b, err := json.Marshal(graph)
+		require.NoError(t, err)
+		var got DependencyGraph
+		require.NoError(t, json.Unmarshal(b, &got))
+		require.Equal(t, *graph, got)
+		require.Contains(t, string(b), `{"from":"glibc","to":"ld-linux","constraint":"so:ld-linux-aarch64.so.1"}`)
+	})
+	t.Run("dot", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, graph.WriteDOT(&buf))
+		out := buf.String()
+		require.Contains(t, out, "digraph dependencies {\n")
+		require.Contains(t, out, "\t\"glibc\" [label=\"glibc\\n2.38-r10\"];\n")
+		require.Contains(t, out, "\t\"glibc\" -> \"busybox\" [label=\"busybox>=1.36\"];\n")
+	})
+}
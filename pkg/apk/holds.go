@@ -0,0 +1,82 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"strings"
+)
+
+// heldReason starts the reason that a package is disqualified for when a hold excludes it, so that
+// maybedqerror can tell holds apart.
+const heldReason = "held at "
+
+// hold is a parsed hold, see SetHolds.
+type hold struct {
+	constraint string
+	parsedConstraint
+	version Version
+}
+
+// parseHold parses constraint, a hold such as foo=1.2.3-r0 or foo<2.
+func parseHold(constraint string) (hold, error) {
+	parsed := resolvePackageNameVersionPin(constraint)
+	if strings.HasPrefix(constraint, "!") || parsed.dep == versionAny || parsed.pin != "" {
+		return hold{}, fmt.Errorf("invalid hold %q: must be a package name with a version constraint, e.g. foo=1.2.3-r0", constraint)
+	}
+	version, err := ParseVersion(parsed.version)
+	if err != nil {
+		return hold{}, fmt.Errorf("invalid hold %q: %w", constraint, err)
+	}
+	return hold{constraint: constraint, parsedConstraint: parsed, version: version}, nil
+}
+
+// SetHolds holds packages at versions, so that resolving never selects a version of a held package that does not
+// satisfy its hold, even when a newer one is available, as the holds of apk-tools do. Each hold is a package
+// name with a version constraint, such as foo=1.2.3-r0, or foo<2 to allow upgrades within a version. Unlike a
+// constraint in the world, a hold does not install the package, it only restricts the versions of it that are
+// installed if anything needs it. When holds leave no version of a package to install, the error is
+// ErrPackageHeld.
+func (p *PkgResolver) SetHolds(holds ...string) error {
+	parsed := make([]hold, 0, len(holds))
+	for _, constraint := range holds {
+		h, err := parseHold(constraint)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, h)
+	}
+	p.holds = parsed
+	return nil
+}
+
+// applyHolds disqualifies the versions of held packages that do not satisfy their holds.
+func (p *PkgResolver) applyHolds(dq map[*RepositoryPackage]string) {
+	for _, h := range p.holds {
+		for _, pkg := range p.nameMap[h.name] {
+			if pkg.Name != h.name {
+				// a package that provides the name is not the held package
+				continue
+			}
+			if _, dqed := dq[pkg.RepositoryPackage]; dqed {
+				continue
+			}
+			version, err := p.parseVersion(pkg.Version)
+			if err != nil || !h.dep.Satisfies(version, h.version) {
+				p.disqualify(dq, pkg.RepositoryPackage, fmt.Sprintf("%s%q", heldReason, h.constraint))
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHolds(t *testing.T) {
+	resolver := makeResolver(nil, map[string][]string{
+		"glibc=2.38-r10": nil,
+		"glibc=2.39-r0":  nil,
+		"glibc=2.40-r0":  nil,
+		"foo=1.0-r0":     {"glibc"},
+		"bar=1.0-r0":     nil,
+	})
+	resolve := func(world ...string) ([]string, error) {
+		pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), world)
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Filename())
+		}
+		return names, err
+	}
+
+	got, err := resolve("foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"glibc-2.40-r0.apk", "foo-1.0-r0.apk"}, got)
+
+	// a dependency is not upgraded past its hold
+	require.NoError(t, resolver.SetHolds("glibc=2.38-r10"))
+	got, err = resolve("foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"glibc-2.38-r10.apk", "foo-1.0-r0.apk"}, got)
+
+	// a hold allows the versions it is satisfied by
+	require.NoError(t, resolver.SetHolds("glibc<2.40"))
+	got, err = resolve("foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"glibc-2.39-r0.apk", "foo-1.0-r0.apk"}, got)
+
+	// a hold does not install the package
+	got, err = resolve("bar")
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar-1.0-r0.apk"}, got)
+
+	// the world cannot ask for more than the hold allows
+	_, err = resolve("glibc>=2.40")
+	require.ErrorIs(t, err, ErrPackageHeld)
+	require.ErrorContains(t, err, `glibc-2.40-r0.apk disqualified because held at "glibc<2.40"`)
+
+	for _, invalid := range []string{"glibc", "!glibc", "glibc=2.38-r10@edge", "glibc=not-a-version"} {
+		require.Error(t, resolver.SetHolds(invalid), "hold %q", invalid)
+		_, err := New(WithHolds(invalid))
+		require.Error(t, err, "hold %q", invalid)
+	}
+}
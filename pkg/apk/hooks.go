@@ -0,0 +1,50 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+)
+
+// ErrSkipPackage is returned by Hooks.BeforeInstall to skip installing a package without failing the install.
+var ErrSkipPackage = errors.New("skip package")
+
+// Hooks are called by InstallPackages at each step of the install. Packages are installed one at a time,
+// in order, so the hooks are never called concurrently for the same install. An error from any hook other
+// than ErrSkipPackage fails the install. Embed NoopHooks to implement only some of them.
+type Hooks interface {
+	// BeforeInstall is called before the files of pkg are installed. It may return ErrSkipPackage to skip it.
+	BeforeInstall(ctx context.Context, pkg *Package) error
+	// AfterInstall is called after the files of pkg are installed, with the headers of the files. The files
+	// may be changed in the filesystem; the headers are what is recorded in the installed database.
+	AfterInstall(ctx context.Context, pkg *Package, headers []tar.Header) error
+	// BeforeCommit is called once all of the packages are installed, before they are added to the
+	// installed database, with the packages that were installed.
+	BeforeCommit(ctx context.Context, pkgs []*Package) error
+	// AfterCommit is called once the installed database has been updated.
+	AfterCommit(ctx context.Context, pkgs []*Package) error
+}
+
+// NoopHooks implements Hooks by doing nothing.
+type NoopHooks struct{}
+
+func (NoopHooks) BeforeInstall(context.Context, *Package) error              { return nil }
+func (NoopHooks) AfterInstall(context.Context, *Package, []tar.Header) error { return nil }
+func (NoopHooks) BeforeCommit(context.Context, []*Package) error             { return nil }
+func (NoopHooks) AfterCommit(context.Context, []*Package) error              { return nil }
+
+var _ Hooks = NoopHooks{}
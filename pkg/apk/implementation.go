@@ -18,13 +18,14 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/sha1" //nolint:gosec // this is what apk tools is using
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -36,7 +37,6 @@ import (
 
 	"github.com/chainguard-dev/clog"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
-	"gopkg.in/ini.v1"
 
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
@@ -44,8 +44,9 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/sys/unix"
 
+	"github.com/chainguard-dev/go-apk/internal/gzindex"
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
@@ -66,9 +67,52 @@ type APK struct {
 	ignoreSignatures   bool
 	noSignatureIndexes []string
 	auth               map[string]auth
+	xattrAllow         []string
+	xattrDeny          []string
+	conflictPolicy     ConflictPolicy
+	protectedPaths     []protectedPath
+	eventHandler       EventHandler
+	parallelBlocks     int
+	parallelHash       bool
+	tempDir            string
+	timeouts           Timeouts
+	repoPriorities     map[string]int
+	repoLayouts        map[string]string
+	repoKeys           map[string][]string
+	partialIndexes     bool
+	hooks              Hooks
+	contentsDB         bool
+	strictVerification bool
+	checksums          bool
+	detachedSigRepos   []string
+	lazyIndexes        bool
+	indexDeltas        bool
+	indexVerifier      IndexVerifier
+	verifierOnly       bool
+	sigThreshold       int
+	transportWrappers  []func(http.RoundTripper) http.RoundTripper
+	proxy              func(*http.Request) (*url.URL, error)
+	dialContext        func(ctx context.Context, network, addr string) (net.Conn, error)
+	fetchPolicies      []FetchPolicy
+	strictVersions     bool
+	configDir          string
+	databaseDir        string
+	hostConfig         fs.FS
+	holds              []string
+	optionalPackages   []string
+	virtualPackages    []*Package
+	allowUntrusted     bool
 
 	// filename to owning package, last write wins
 	installedFiles map[string]*Package
+
+	// files in the installed database to owning package, for OwnerOf
+	ownerIndex ownerIndex
+	// the owners of the files in the installed database when InstallPackages started
+	dbOwners map[string]*InstalledPackage
+
+	// the package files of the world, by the entry they are written to the world as, see SetWorld
+	localFiles sync.Map
 }
 
 func New(options ...Option) (*APK, error) {
@@ -79,13 +123,26 @@ func New(options ...Option) (*APK, error) {
 		}
 	}
 
+	if opt.strictVerification && len(opt.noSignatureIndexes) > 0 {
+		return nil, withKind(ErrSignatureInvalid, errors.New("indexes without signatures are not permitted with strict verification"))
+	}
+	if opt.strictVerification && opt.allowUntrusted {
+		return nil, withKind(ErrSignatureInvalid, errors.New("untrusted package files are not permitted with strict verification"))
+	}
+	if opt.strictVerification && !opt.checksums {
+		return nil, withKind(ErrChecksumMismatch, errors.New("packages cannot skip checksum verification with strict verification"))
+	}
+
+	if opt.cache != nil {
+		opt.cache.keys = opt.cacheKeys
+	}
+
 	if opt.fs == nil {
 		// This is expensive so we only want to do it if we aren't passed WithFS.
 		opt.fs = apkfs.DirFS("/")
 	}
 
-	return &APK{
-		client:             http.DefaultClient,
+	a := &APK{
 		fs:                 opt.fs,
 		arch:               opt.arch,
 		executor:           opt.executor,
@@ -95,7 +152,43 @@ func New(options ...Option) (*APK, error) {
 		noSignatureIndexes: opt.noSignatureIndexes,
 		installedFiles:     map[string]*Package{},
 		auth:               opt.auth,
-	}, nil
+		xattrAllow:         opt.xattrAllow,
+		xattrDeny:          opt.xattrDeny,
+		conflictPolicy:     opt.conflictPolicy,
+		eventHandler:       opt.eventHandler,
+		parallelBlocks:     opt.parallelBlocks,
+		parallelHash:       opt.parallelHash,
+		tempDir:            opt.tempDir,
+		timeouts:           opt.timeouts,
+		repoPriorities:     opt.repoPriorities,
+		repoLayouts:        opt.repoLayouts,
+		repoKeys:           opt.repoKeys,
+		partialIndexes:     opt.partialIndexes,
+		hooks:              opt.hooks,
+		contentsDB:         opt.contentsDB,
+		strictVerification: opt.strictVerification,
+		checksums:          opt.checksums,
+		detachedSigRepos:   opt.detachedSigRepos,
+		lazyIndexes:        opt.lazyIndexes,
+		indexDeltas:        opt.indexDeltas,
+		indexVerifier:      opt.indexVerifier,
+		verifierOnly:       opt.verifierOnly,
+		sigThreshold:       opt.sigThreshold,
+		transportWrappers:  opt.transportWrappers,
+		proxy:              opt.proxy,
+		dialContext:        opt.dialContext,
+		fetchPolicies:      opt.fetchPolicies,
+		strictVersions:     opt.strictVersions,
+		configDir:          opt.configDir,
+		databaseDir:        opt.databaseDir,
+		hostConfig:         opt.hostConfig,
+		holds:              opt.holds,
+		optionalPackages:   opt.optionalPackages,
+		virtualPackages:    opt.virtualPackages,
+		allowUntrusted:     opt.allowUntrusted,
+	}
+	a.SetClient(http.DefaultClient)
+	return a, nil
 }
 
 type directory struct {
@@ -134,18 +227,18 @@ var baseDirectories = []directory{
 //		/dev
 //		/etc
 //	    /proc
+//
+// The directories of the apk configuration and database, and their parents, come before these, see
+// WithConfigDir and WithDatabaseDir.
 var initDirectories = []directory{
-	{"/etc/apk", 0o755},
-	{"/etc/apk/keys", 0o755},
-	{"/lib/apk", 0o755},
-	{"/lib/apk/db", 0o755},
 	{"/var/cache", 0o755},
 	{"/var/cache/apk", 0o755},
 	{"/var/cache/misc", 0o755},
 }
 
 // files is a list of files to create relative to the root, as well as optional content.
-// We will not do MkdirAll for the parent dir it is in, so it must exist.
+// We will not do MkdirAll for the parent dir it is in, so it must exist. The paths are those of the default
+// layout, see layoutPath.
 var initFiles = []file{
 	{"/etc/apk/world", 0o644, []byte("\n")},
 	{"/etc/apk/repositories", 0o644, []byte("\n")},
@@ -166,9 +259,11 @@ var initDeviceFiles = []deviceFile{
 // SetClient set the http client to use for downloading packages.
 // In general, you can leave this unset, and it will use the default http.Client.
 // It is useful for fine-grained control, for proxying, or for setting alternate
-// paths.
+// paths. The transport of client is wrapped by those of WithTransportWrapper, after
+// WithProxy and WithDialContext are applied to it, and requests that WithFetchPolicy
+// denies never reach it.
 func (a *APK) SetClient(client *http.Client) {
-	a.client = client
+	a.client = policyClient(wrapClient(dialClient(client, a.proxy, a.dialContext), a.transportWrappers), a.fetchPolicies)
 }
 
 // ListInitFiles list the files that are installed during the InitDB phase.
@@ -178,10 +273,10 @@ func (a *APK) ListInitFiles() []tar.Header {
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
 	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+		{"/" + archFilePath, 0o644, []byte(a.arch + "\n")},
 	}
 
-	for _, e := range initDirectories {
+	for _, e := range a.initDirectories() {
 		headers = append(headers, tar.Header{
 			Name:     e.path,
 			Mode:     int64(e.perms),
@@ -192,7 +287,7 @@ func (a *APK) ListInitFiles() []tar.Header {
 	}
 	for _, e := range append(initFiles, additionalFiles...) {
 		headers = append(headers, tar.Header{
-			Name:     e.path,
+			Name:     a.layoutPath(e.path),
 			Mode:     int64(e.perms),
 			Typeflag: tar.TypeReg,
 			Uid:      0,
@@ -211,7 +306,7 @@ func (a *APK) ListInitFiles() []tar.Header {
 
 	// add scripts.tar with nothing in it
 	headers = append(headers, tar.Header{
-		Name:     scriptsFilePath,
+		Name:     a.layoutPath(scriptsFilePath),
 		Mode:     int64(scriptsTarPerms),
 		Typeflag: tar.TypeReg,
 		Uid:      0,
@@ -220,12 +315,61 @@ func (a *APK) ListInitFiles() []tar.Header {
 	return headers
 }
 
+type initDBOpts struct {
+	repositories   []string
+	keyFiles       []string
+	alpineVersions []string
+}
+
+// InitDBOption is an option for InitDBWithOptions.
+type InitDBOption func(*initDBOpts)
+
+// WithInitRepositories writes repos as the lines of etc/apk/repositories, including pinned lines such as
+// "@edge https://dl-cdn.alpinelinux.org/alpine/edge/main", instead of leaving it empty.
+func WithInitRepositories(repos ...string) InitDBOption {
+	return func(o *initDBOpts) {
+		o.repositories = append(o.repositories, repos...)
+	}
+}
+
+// WithInitKeyring installs keyFiles, paths or URLs of public keys, into etc/apk/keys, as InitKeyring does.
+func WithInitKeyring(keyFiles ...string) InitDBOption {
+	return func(o *initDBOpts) {
+		o.keyFiles = append(o.keyFiles, keyFiles...)
+	}
+}
+
+// WithInitAlpineKeys fetches the alpine-keys of the given Alpine releases, e.g. "3.19", into etc/apk/keys.
+// Releases without keys for the architecture are logged and ignored.
+func WithInitAlpineKeys(alpineVersions ...string) InitDBOption {
+	return func(o *initDBOpts) {
+		o.alpineVersions = append(o.alpineVersions, alpineVersions...)
+	}
+}
+
 // Initialize the APK database for a given build context.
 // Assumes base directories are in place and checks them.
 // Returns the list of files and directories and files installed and permissions,
 // unless those files will be included in the installed database, in which case they can
 // be retrieved via GetInstalled().
 func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
+	return a.InitDBWithOptions(ctx, WithInitAlpineKeys(alpineVersions...))
+}
+
+// InitDBWithOptions initializes the APK database as InitDB does, and with the options also writes the
+// repositories and installs the keys, so that the root is ready for apk to use in one call. etc/apk/arch is
+// always written, with the architecture of WithArch.
+func (a *APK) InitDBWithOptions(ctx context.Context, options ...InitDBOption) error {
+	var o initDBOpts
+	for _, opt := range options {
+		opt(&o)
+	}
+	for _, repo := range o.repositories {
+		if _, _, err := parseRepositoryLine(repo); err != nil {
+			return err
+		}
+	}
+
 	log := clog.FromContext(ctx)
 	/*
 		equivalent of: "apk add --initdb --arch arch --root root"
@@ -238,7 +382,7 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 	// additionalFiles are files we need but can only be resolved in the context of
 	// this func, e.g. we need the architecture
 	additionalFiles := []file{
-		{"/etc/apk/arch", 0o644, []byte(a.arch + "\n")},
+		{"/" + archFilePath, 0o644, []byte(a.arch + "\n")},
 	}
 
 	for _, e := range baseDirectories {
@@ -257,7 +401,7 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 			return fmt.Errorf("base directory %s has incorrect permissions: %o", e.path, stat.Mode().Perm())
 		}
 	}
-	for _, e := range initDirectories {
+	for _, e := range a.initDirectories() {
 		err := a.fs.Mkdir(e.path, e.perms)
 		switch {
 		case err != nil && !errors.Is(err, fs.ErrExist):
@@ -273,13 +417,14 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 		}
 	}
 	for _, e := range append(initFiles, additionalFiles...) {
-		if err := a.fs.WriteFile(e.path, e.contents, e.perms); err != nil {
-			return fmt.Errorf("failed to create file %s: %w", e.path, err)
+		name := a.layoutPath(e.path)
+		if err := a.fs.WriteFile(name, e.contents, e.perms); err != nil {
+			return fmt.Errorf("failed to create file %s: %w", name, err)
 		}
 	}
 	for _, e := range initDeviceFiles {
 		perms := uint32(e.perms.Perm())
-		err := a.fs.Mknod(e.path, unix.S_IFCHR|perms, int(unix.Mkdev(e.major, e.minor)))
+		err := a.fs.Mknod(e.path, apkfs.ModeCharDev|perms, apkfs.Mkdev(e.major, e.minor))
 		if !a.ignoreMknodErrors && err != nil {
 			return fmt.Errorf("failed to create char device %s: %w", e.path, err)
 		}
@@ -287,9 +432,9 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 
 	// add scripts.tar with nothing in it
 	scriptsTarPerms := 0o644
-	TarFile, err := a.fs.OpenFile(scriptsFilePath, os.O_CREATE|os.O_WRONLY, fs.FileMode(scriptsTarPerms))
+	TarFile, err := a.fs.OpenFile(a.layoutPath(scriptsFilePath), os.O_CREATE|os.O_WRONLY, fs.FileMode(scriptsTarPerms))
 	if err != nil {
-		return fmt.Errorf("could not create tarball file '%s', got error '%w'", scriptsFilePath, err)
+		return fmt.Errorf("could not create tarball file '%s', got error '%w'", a.layoutPath(scriptsFilePath), err)
 	}
 	defer TarFile.Close()
 	tarWriter := tar.NewWriter(TarFile)
@@ -297,9 +442,20 @@ func (a *APK) InitDB(ctx context.Context, alpineVersions ...string) error {
 
 	// nothing to add to it; scripts.tar should be empty
 
+	if len(o.repositories) > 0 {
+		if err := a.SetRepositories(ctx, o.repositories); err != nil {
+			return err
+		}
+	}
+	if len(o.keyFiles) > 0 {
+		if err := a.InitKeyring(ctx, o.keyFiles, nil); err != nil {
+			return fmt.Errorf("failed to install keys: %w", err)
+		}
+	}
+
 	// get the alpine-keys base keys for our usage
-	if len(alpineVersions) > 0 {
-		if err := a.fetchAlpineKeys(ctx, alpineVersions); err != nil {
+	if len(o.alpineVersions) > 0 {
+		if err := a.fetchAlpineKeys(ctx, o.alpineVersions); err != nil {
 			var nokeysErr *NoKeysFoundError
 			if !errors.As(err, &nokeysErr) {
 				return fmt.Errorf("failed to fetch alpine-keys: %w", err)
@@ -361,7 +517,7 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "InitKeyring")
 	defer span.End()
 
-	if err := a.fs.MkdirAll(DefaultKeyRingPath, 0o755); err != nil {
+	if err := a.fs.MkdirAll(a.layoutPath(DefaultKeyRingPath), 0o755); err != nil {
 		return fmt.Errorf("failed to make keys dir: %w", err)
 	}
 
@@ -398,6 +554,9 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 					return fmt.Errorf("failed to read apk key: %w", err)
 				}
 			case "https", "http": //nolint:goconst
+				if err := checkFetch(a.fetchPolicies, asURL); err != nil {
+					return err
+				}
 				client := a.client
 				if a.cache != nil {
 					client = a.cache.client(client, true)
@@ -436,7 +595,7 @@ func (a *APK) InitKeyring(ctx context.Context, keyFiles, extraKeyFiles []string)
 			}
 
 			// #nosec G306 -- apk keyring must be publicly readable
-			if err := a.fs.WriteFile(filepath.Join("etc", "apk", "keys", filepath.Base(element)), data,
+			if err := a.fs.WriteFile(filepath.Join(a.layoutPath(keysDirPath), filepath.Base(element)), data,
 				0o644); err != nil {
 				return fmt.Errorf("failed to write apk key: %w", err)
 			}
@@ -458,27 +617,64 @@ func (a *APK) ResolveWorld(ctx context.Context) (toInstall []*RepositoryPackage,
 
 	// to fix the world, we need to:
 	// 1. Get the apkIndexes for each repository for the target arch
-	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	indexes, err := a.worldIndexes(ctx)
 	if err != nil {
-		return toInstall, conflicts, fmt.Errorf("error getting repository indexes: %w", err)
+		return toInstall, conflicts, err
 	}
-	// debugging info, if requested
-	log.Debugf("got %d indexes:\n%s", len(indexes), strings.Join(indexNames(indexes), "\n"))
 
 	// 2. Get the dependency tree for each package from the world file
 	directPkgs, err := a.GetWorld()
 	if err != nil {
 		return toInstall, conflicts, fmt.Errorf("error getting world packages: %w", err)
 	}
+	return a.resolve(ctx, indexes, directPkgs)
+}
+
+// worldIndexes returns the indexes to resolve the world from, without the repositories that failed with
+// WithRepositoryPartialResults.
+func (a *APK) worldIndexes(ctx context.Context) ([]NamedIndex, error) {
+	log := clog.FromContext(ctx)
+	indexes, err := a.GetRepositoryIndexes(ctx, a.ignoreSignatures)
+	if err != nil {
+		return nil, fmt.Errorf("error getting repository indexes: %w", err)
+	}
+	// debugging info, if requested
+	log.Debugf("got %d indexes:\n%s", len(indexes), strings.Join(indexNames(indexes), "\n"))
+	return indexes, nil
+}
+
+// resolve resolves the packages that the world needs from indexes, for the architecture of the root.
+func (a *APK) resolve(ctx context.Context, indexes []NamedIndex, directPkgs []string) (toInstall []*RepositoryPackage, conflicts []string, err error) {
+	log := clog.FromContext(ctx)
+	indexes, directPkgs, err = a.localPackages(ctx, indexes, directPkgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(a.virtualPackages) > 0 {
+		indexes = append(indexes[:len(indexes):len(indexes)], VirtualIndex(a.virtualPackages...))
+	}
 	resolver := NewPkgResolver(ctx, indexes)
-	toInstall, conflicts, err = resolver.GetPackagesWithDependencies(ctx, directPkgs)
+	resolver.SetStrictVersions(a.strictVersions)
+	resolver.SetArch(a.arch)
+	if err := resolver.SetHolds(a.holds...); err != nil {
+		return nil, nil, err
+	}
+	resolver.SetOptional(a.optionalPackages...)
+	resolution, err := resolver.Resolve(ctx, directPkgs)
 	if err != nil {
-		return
+		return nil, nil, err
+	}
+	toInstall, conflicts = resolution.Packages, resolution.Conflicts
+	for _, cycle := range resolution.Cycles {
+		log.Debugf("dependency cycle: %s", strings.Join(cycle, " -> "))
 	}
 	log.Debugf("got %d packages to install:\n%s", len(toInstall), strings.Join(packageRefs(toInstall), "\n"))
+	a.emit(ctx, Event{Type: EventResolved, Count: len(toInstall)})
 	return
 }
 
+// CalculateWorld fetches allpkgs and returns the sizes and hashes of their sections. Virtual packages, see
+// NewVirtualPackage, have nothing to fetch, and are returned only with their Package.
 func (a *APK) CalculateWorld(ctx context.Context, allpkgs []*RepositoryPackage) ([]*APKResolved, error) {
 	// TODO: Consider making this configurable option.
 	jobs := runtime.GOMAXPROCS(0)
@@ -499,6 +695,12 @@ func (a *APK) CalculateWorld(ctx context.Context, allpkgs []*RepositoryPackage)
 	for i, pkg := range allpkgs {
 		i, pkg := i, pkg
 
+		if _, ok := isVirtual(pkg); ok {
+			resolved[i] = &APKResolved{Package: pkg}
+			close(done[i])
+			continue
+		}
+
 		g.Go(func() error {
 			r, err := a.FetchPackage(gctx, pkg)
 			if err != nil {
@@ -541,7 +743,11 @@ func (a *APK) ResolveAndCalculateWorld(ctx context.Context) ([]*APKResolved, err
 }
 
 // FixateWorld force apk's resolver to re-resolve the requested dependencies in /etc/apk/world.
-func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error {
+func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) (err error) {
+	ctx, cancel := withTimeout(ctx, a.timeouts.Total, "installing the world")
+	defer cancel()
+	defer func() { err = timedOut(ctx, err) }()
+
 	log := clog.FromContext(ctx)
 	/*
 		equivalent of: "apk fix --arch arch --root root"
@@ -586,7 +792,94 @@ func (a *APK) FixateWorld(ctx context.Context, sourceDateEpoch *time.Time) error
 	return a.InstallPackages(ctx, sourceDateEpoch, allInstPkgs)
 }
 
-func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage) error {
+// Prefetch fills the cache with the indexes of the repositories of the root, and with every package that world,
+// as it would be written by SetWorld, needs, without installing anything. It is meant for a warm-up job, so that
+// later builds sharing the cache, even offline ones, find everything they need in it. It needs WithCache, and
+// does not change the world of the root.
+func (a *APK) Prefetch(ctx context.Context, world []string) (err error) {
+	if a.cache == nil {
+		return errors.New("prefetching needs a cache, see WithCache")
+	}
+	if a.cache.offline {
+		return withKind(ErrOffline, errors.New("cannot prefetch into an offline cache"))
+	}
+
+	ctx, cancel := withTimeout(ctx, a.timeouts.Total, "prefetching")
+	defer cancel()
+	defer func() { err = timedOut(ctx, err) }()
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Prefetch")
+	defer span.End()
+
+	indexes, err := a.worldIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	pkgs, _, err := a.resolve(ctx, indexes, world)
+	if err != nil {
+		return fmt.Errorf("error getting package dependencies: %w", err)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for _, pkg := range pkgs {
+		pkg := pkg
+		if _, ok := isVirtual(pkg); ok {
+			continue
+		}
+		g.Go(func() error {
+			a.emit(gctx, Event{Type: EventFetchStarted, Package: pkg.Name, Version: pkg.Version})
+			exp, err := a.expandPackage(gctx, pkg)
+			a.emit(gctx, Event{Type: EventFetchFinished, Package: pkg.Name, Version: pkg.Version, Err: err})
+			if err != nil {
+				return fmt.Errorf("expanding %s: %w", pkg, err)
+			}
+			return exp.Close()
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("prefetching packages: %w", err)
+	}
+	clog.FromContext(ctx).Infof("prefetched %d packages from %d indexes", len(pkgs), len(indexes))
+	return nil
+}
+
+// InstallPackages installs the given packages, in order. Packages that already are installed are skipped,
+// and those installed at another version or build are replaced by the given one.
+//
+// An existing file under a path protected by etc/apk/protected_paths.d that differs from the one in a package
+// is kept, and the new one is written next to it with an .apk-new suffix.
+func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage) (err error) {
+	return a.installPackages(ctx, sourceDateEpoch, allpkgs, nil)
+}
+
+// installPackages is InstallPackages, recording what it did in report, if it is not nil.
+func (a *APK) installPackages(ctx context.Context, sourceDateEpoch *time.Time, allpkgs []InstallablePackage, report *InstallReport) (err error) {
+	ctx, cancel := withTimeout(ctx, a.timeouts.Total, "installing packages")
+	defer cancel()
+	defer func() { err = timedOut(ctx, err) }()
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "InstallPackages")
+	defer span.End()
+	ctx, downloads := withDownloadCounter(ctx)
+
+	protectedPaths, err := a.loadProtectedPaths()
+	if err != nil {
+		return err
+	}
+	a.protectedPaths = protectedPaths
+
+	// The installed db is only updated once everything is installed, so we only need to read it once.
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return fmt.Errorf("error getting installed packages: %w", err)
+	}
+	if a.dbOwners, err = a.owners(); err != nil {
+		return fmt.Errorf("error getting installed files: %w", err)
+	}
+	allpkgs, replaced := a.notInstalled(ctx, installed, allpkgs)
+	span.SetAttributes(attribute.Int("packages", len(allpkgs)))
+
 	// TODO: Consider making this configurable option.
 	jobs := runtime.GOMAXPROCS(0)
 
@@ -605,6 +898,13 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 		done[i] = make(chan struct{})
 	}
 
+	// when everything was fetched, and when everything was installed, since start
+	var (
+		start              = time.Now()
+		fetchMu            sync.Mutex
+		fetched, extracted time.Duration
+	)
+
 	// Kick off a goroutine that sequentially installs packages as they become ready.
 	//
 	// We could probably do better than this by mirroring the dependency graph or even
@@ -619,30 +919,41 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 				exp := expanded[i]
 				pkg := allpkgs[i]
 
-				isInstalled, err := a.isInstalledPackage(pkg.PackageName())
-				if err != nil {
-					return fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
-				}
-
-				if isInstalled {
+				if virtual, ok := isVirtual(pkg); ok {
+					// nothing to extract, it is only recorded as installed
+					infos[i] = virtual
 					continue
 				}
 
 				// The data in .PKGINFO is more complete than what is in APKINDEX.
-				pkgInfo, err := packageInfo(exp)
+				pkgInfo, err := parseExpandedPackage(exp)
 				if err != nil {
 					return fmt.Errorf("failed to read .PKGINFO for %s: %w", pkg, err)
 				}
+
+				if err := a.hooks.BeforeInstall(gctx, pkgInfo); errors.Is(err, ErrSkipPackage) {
+					continue
+				} else if err != nil {
+					return fmt.Errorf("before installing %s: %w", pkg, err)
+				}
 				infos[i] = pkgInfo
 
-				installedFiles, err := a.installPackage(gctx, pkgInfo, exp, sourceDateEpoch)
+				extractCtx, cancel := withTimeout(gctx, a.timeouts.Extraction, "extracting "+pkgInfo.Name)
+				installedFiles, err := a.installPackage(extractCtx, pkgInfo, exp, sourceDateEpoch)
+				err = timedOut(extractCtx, err)
+				cancel()
 				if err != nil {
 					return fmt.Errorf("installing %s: %w", pkg, err)
 				}
 
+				if err := a.hooks.AfterInstall(gctx, pkgInfo, installedFiles); err != nil {
+					return fmt.Errorf("after installing %s: %w", pkg, err)
+				}
+
 				allFiles[i] = installedFiles
 			}
 		}
+		extracted = time.Since(start)
 
 		return nil
 	})
@@ -652,13 +963,23 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 	for i, pkg := range allpkgs {
 		i, pkg := i, pkg
 
+		if _, ok := isVirtual(pkg); ok {
+			close(done[i])
+			continue
+		}
+
 		g.Go(func() error {
+			a.emit(gctx, Event{Type: EventFetchStarted, Package: pkg.PackageName()})
 			exp, err := a.expandPackage(gctx, pkg)
+			a.emit(gctx, Event{Type: EventFetchFinished, Package: pkg.PackageName(), Err: err})
 			if err != nil {
 				return fmt.Errorf("expanding %s: %w", pkg, err)
 			}
 
 			expanded[i] = exp
+			fetchMu.Lock()
+			fetched = max(fetched, time.Since(start))
+			fetchMu.Unlock()
 			close(done[i])
 
 			return nil
@@ -668,8 +989,20 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 	if err := g.Wait(); err != nil {
 		return fmt.Errorf("installing packages: %w", err)
 	}
+	commitStart := time.Now()
+
+	committed := make([]*Package, 0, len(infos))
+	for _, pkg := range infos {
+		if pkg != nil {
+			committed = append(committed, pkg)
+		}
+	}
+	if err := a.hooks.BeforeCommit(ctx, committed); err != nil {
+		return fmt.Errorf("before updating installed packages: %w", err)
+	}
 
 	// update the installed file
+	var replacedPkgs []*InstalledPackage
 	for i, files := range allFiles {
 		pkg := infos[i]
 
@@ -681,6 +1014,14 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 			continue
 		}
 
+		// the build it replaces goes, along with the files that this one does not have
+		if from, ok := replaced[pkg.Name]; ok {
+			if err := a.removeInstalledPackage(from, files); err != nil {
+				return fmt.Errorf("unable to replace %s: %w", pkg.Name, err)
+			}
+			replacedPkgs = append(replacedPkgs, from)
+		}
+
 		// Remove any files that were overwritten by another package.
 		files = slices.DeleteFunc(files, func(hdr tar.Header) bool {
 			owner, ok := a.installedFiles[hdr.Name]
@@ -692,14 +1033,73 @@ func (a *APK) InstallPackages(ctx context.Context, sourceDateEpoch *time.Time, a
 			return owner != pkg
 		})
 
-		if err := a.AddInstalledPackage(pkg, files); err != nil {
-			return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
+		if err := a.updateInstalledDB(ctx, pkg, files); err != nil {
+			return err
 		}
 	}
 
+	if err := a.hooks.AfterCommit(ctx, committed); err != nil {
+		return fmt.Errorf("after updating installed packages: %w", err)
+	}
+
+	if report != nil {
+		report.Installed = committed
+		report.Replaced = replacedPkgs
+		report.Downloaded = downloads.n.Load()
+		report.Phases.Fetch = fetched
+		report.Phases.Extract = extracted
+		report.Phases.Commit = time.Since(commitStart)
+	}
 	return nil
 }
 
+// updateInstalledDB records pkg and its files in the installed database, and the contents database if enabled.
+func (a *APK) updateInstalledDB(ctx context.Context, pkg *Package, files []tar.Header) error {
+	_, span := otel.Tracer("go-apk").Start(ctx, "updateInstalledDB", trace.WithAttributes(attribute.String("package", pkg.Name), attribute.Int("files", len(files))))
+	defer span.End()
+
+	if err := a.AddInstalledPackage(pkg, files); err != nil {
+		return fmt.Errorf("unable to update installed file for pkg %s: %w", pkg.Name, err)
+	}
+	if a.contentsDB {
+		if err := a.addContents(pkg, files); err != nil {
+			return fmt.Errorf("unable to update contents file for pkg %s: %w", pkg.Name, err)
+		}
+	}
+	return nil
+}
+
+// notInstalled returns the packages in pkgs that are not installed, diffing them against the installed
+// database, so that running again on a root that has most of them does not fetch or expand those again.
+// A package installed at another version or build is an upgrade: it is returned, and so is the installed
+// package it replaces, by name.
+func (a *APK) notInstalled(ctx context.Context, installed []*InstalledPackage, pkgs []InstallablePackage) ([]InstallablePackage, map[string]*InstalledPackage) {
+	log := clog.FromContext(ctx)
+
+	byName := make(map[string]*InstalledPackage, len(installed))
+	for _, pkg := range installed {
+		byName[pkg.Name] = pkg
+	}
+
+	todo := make([]InstallablePackage, 0, len(pkgs))
+	replaced := map[string]*InstalledPackage{}
+	for _, pkg := range pkgs {
+		from, ok := byName[pkg.PackageName()]
+		switch {
+		case !ok:
+			todo = append(todo, pkg)
+		case from.ChecksumString() != pkg.ChecksumString():
+			log.Infof("%s is installed from another build (%s %s), replacing it", pkg.PackageName(), from.Version, from.ChecksumString())
+			todo = append(todo, pkg)
+			replaced[pkg.PackageName()] = from
+		}
+	}
+	if skipped := len(pkgs) - len(todo); skipped > 0 {
+		log.Infof("%d of %d packages are already installed", skipped, len(pkgs))
+	}
+	return todo, replaced
+}
+
 type NoKeysFoundError struct {
 	arch     string
 	releases []string
@@ -766,7 +1166,7 @@ func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) erro
 		if err != nil {
 			return fmt.Errorf("failed to unescape key filename %s: %w", basefilenameEscape, err)
 		}
-		filename := filepath.Join(keysDirPath, basefilename)
+		filename := filepath.Join(a.layoutPath(keysDirPath), basefilename)
 		f, err := a.fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0o644)
 		if err != nil {
 			return fmt.Errorf("failed to open key file %s: %w", filename, err)
@@ -779,7 +1179,7 @@ func (a *APK) fetchAlpineKeys(ctx context.Context, alpineVersions []string) erro
 	return nil
 }
 
-func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *expandapk.APKExpanded, cacheDir string) (*expandapk.APKExpanded, error) {
+func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *expandapk.APKExpanded, cacheDir string, provenance *CacheProvenance) (*expandapk.APKExpanded, error) {
 	_, span := otel.Tracer("go-apk").Start(ctx, "cachePackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
 	defer span.End()
 
@@ -813,11 +1213,23 @@ func (a *APK) cachePackage(ctx context.Context, pkg InstallablePackage, exp *exp
 
 	exp.PackageFile = datDst
 
-	tarDst := strings.TrimSuffix(exp.PackageFile, ".gz")
-	if err := os.Rename(exp.TarFile, tarDst); err != nil {
-		return nil, fmt.Errorf("renaming control file: %w", err)
+	// The data section is only kept gzipped, and is read through its index from now on, so that exp has
+	// nothing left in its temp dir when it is handed out by globalApkCache.
+	tarFS, err := cachedPackageData(ctx, datDst)
+	if err != nil {
+		return nil, err
+	}
+	if err := exp.TarFS.Close(); err != nil {
+		return nil, fmt.Errorf("closing %q: %w", exp.TarFile, err)
+	}
+	exp.TarFS, exp.TarFile = tarFS, ""
+
+	if provenance != nil {
+		// This is best effort, as the package is cached all the same.
+		if err := writeProvenance(filepath.Join(cacheDir, ctlHex), provenance); err != nil {
+			clog.FromContext(ctx).Warnf("unable to record the provenance of %s in the cache: %v", pkg.PackageName(), err)
+		}
 	}
-	exp.TarFile = tarDst
 
 	return exp, nil
 }
@@ -826,12 +1238,7 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 	_, span := otel.Tracer("go-apk").Start(ctx, "cachedPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
 	defer span.End()
 
-	chk := pkg.ChecksumString()
-	if !strings.HasPrefix(chk, "Q1") {
-		return nil, fmt.Errorf("unexpected checksum: %q", chk)
-	}
-
-	checksum, err := base64.StdEncoding.DecodeString(chk[2:])
+	checksum, err := packageChecksum(pkg)
 	if err != nil {
 		return nil, err
 	}
@@ -859,6 +1266,7 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 	}
 
 	exp.Size += cf.Size()
+	exp.ControlUncompressedSize = int64(len(control))
 
 	sig := filepath.Join(cacheDir, pkgHexSum+".sig.tar.gz")
 	sf, err := os.Stat(sig)
@@ -866,6 +1274,9 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 		exp.SignatureFile = sig
 		exp.Signed = true
 		exp.Size += sf.Size()
+		if exp.SignatureUncompressedSize, err = gunzippedSize(sig); err != nil {
+			return nil, fmt.Errorf("reading %q: %w", sig, err)
+		}
 	}
 
 	f, err := os.Open(ctl)
@@ -891,22 +1302,127 @@ func (a *APK) cachedPackage(ctx context.Context, pkg InstallablePackage, cacheDi
 	if err != nil {
 		return nil, err
 	}
+	// The data section is cached by its hash, so it has what the datahash says it should have.
+	exp.ExpectedPackageHash = exp.PackageHash
 
-	exp.TarFile = strings.TrimSuffix(exp.PackageFile, ".gz")
-	data, err := exp.PackageData()
+	exp.TarFS, err = cachedPackageData(ctx, dat)
 	if err != nil {
 		return nil, err
 	}
-	info, err := data.Stat()
+	// The index of the gzipped tar knows the size of the tar, so it does not have to be read.
+	exp.PackageUncompressedSize = exp.TarFS.GzipIndex().Size()
+
+	return &exp, nil
+}
+
+// gunzippedSize returns the size of the contents of the gzip file name.
+func gunzippedSize(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zr, err := gzpool.GetReader(f)
+	defer gzpool.PutReader(zr)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(io.Discard, zr)
+}
+
+// gzipIndexExt is the extension of the file stored next to the data section of a package in the cache, the
+// gzindex.Index of its gzipped tar.
+const gzipIndexExt = ".idx"
+
+// cachedPackageData returns an FS of the gzipped tar of the data section at file in the cache, which reads it
+// through the index next to it rather than expanding it. The index is built if there is none, or it does not
+// fit the tar, which decompresses the tar once without writing it out, and kept for the next time.
+func cachedPackageData(ctx context.Context, file string) (*tarfs.FS, error) {
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
-	exp.TarFS, err = tarfs.New(data, info.Size())
+	info, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
-	return &exp, nil
+	var idx *gzindex.Index
+	if b, err := os.ReadFile(file + gzipIndexExt); err == nil {
+		idx = &gzindex.Index{}
+		if err := idx.UnmarshalBinary(b); err != nil {
+			clog.FromContext(ctx).Warnf("ignoring the index of %s: %v", file, err)
+			idx = nil
+		}
+	}
+	fsys, err := tarfs.NewGzip(f, info.Size(), idx)
+	if err != nil && idx != nil {
+		clog.FromContext(ctx).Warnf("ignoring the index of %s: %v", file, err)
+		idx = nil
+		fsys, err = tarfs.NewGzip(f, info.Size(), nil)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("indexing %q: %w", file, err)
+	}
+
+	if idx == nil {
+		// This is best effort, as the index is built again next time without it.
+		b, err := fsys.GzipIndex().MarshalBinary()
+		if err == nil {
+			err = writeFileAtomic(file+gzipIndexExt, b)
+		}
+		if err != nil {
+			clog.FromContext(ctx).Warnf("unable to keep the index of %s in the cache: %v", file, err)
+		}
+	}
+
+	return fsys, nil
+}
+
+// packageChecksum returns the Q1 checksum of pkg, the sha1 of its control section, as bytes.
+func packageChecksum(pkg InstallablePackage) ([]byte, error) {
+	return ParseChecksum(pkg.ChecksumString())
+}
+
+// verifyChecksums checks that the package expanded as exp is the one the index has for pkg, by the checksum of
+// its control section, and that its data section was verified against a datahash, for WithStrictVerification.
+func verifyChecksums(pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	want, err := packageChecksum(pkg)
+	if err != nil || len(want) == 0 {
+		return withKind(ErrChecksumMismatch, fmt.Errorf("package %s has no checksum to verify", pkg.PackageName()))
+	}
+	if err := verifyChecksum(pkg, exp); err != nil {
+		return err
+	}
+	if exp.ExpectedPackageHash == nil {
+		return withKind(ErrChecksumMismatch, fmt.Errorf("package %s has no datahash to verify its data section", pkg.PackageName()))
+	}
+	return nil
+}
+
+// verifyChecksum checks that the package expanded as exp has the checksum of its control section that the index
+// has for pkg, if it has one, see WithChecksumVerification. The datahash in the control section covers the rest.
+func verifyChecksum(pkg InstallablePackage, exp *expandapk.APKExpanded) error {
+	if pkg.ChecksumString() == "" {
+		return nil
+	}
+	want, err := packageChecksum(pkg)
+	if err != nil {
+		return withKind(ErrChecksumMismatch, fmt.Errorf("package %s has an invalid checksum: %w", pkg.PackageName(), err))
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	got, err := expandedChecksum(exp)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, got) {
+		return withKind(ErrChecksumMismatch, fmt.Errorf("%s control section checksum was %x, computed %x", pkg.PackageName(), want, got))
+	}
+	return nil
 }
 
 type apkResult struct {
@@ -915,26 +1431,32 @@ type apkResult struct {
 }
 
 type apkCache struct {
-	// url -> *sync.Once
+	// url and verification, see packageVerification -> *sync.Once
 	onces sync.Map
 
-	// url -> apkResult
+	// url and verification -> apkResult
 	resps sync.Map
 }
 
 func (c *apkCache) get(ctx context.Context, a *APK, pkg InstallablePackage) (*expandapk.APKExpanded, error) {
 	u := pkg.URL()
+	verification, err := a.packageVerification(pkg)
+	if err != nil {
+		return nil, err
+	}
+	// the package is expanded for each way it is verified, so that it is verified by each of them
+	key := u + "\x00" + verification
 	// Do all the expensive things inside the once.
-	once, _ := c.onces.LoadOrStore(u, &sync.Once{})
+	once, _ := c.onces.LoadOrStore(key, &sync.Once{})
 	once.(*sync.Once).Do(func() {
 		exp, err := expandPackage(ctx, a, pkg)
-		c.resps.Store(u, apkResult{
+		c.resps.Store(key, apkResult{
 			exp: exp,
 			err: err,
 		})
 	})
 
-	v, ok := c.resps.Load(u)
+	v, ok := c.resps.Load(key)
 	if !ok {
 		panic(fmt.Errorf("did not see apk %q after writing it", u))
 	}
@@ -943,7 +1465,29 @@ func (c *apkCache) get(ctx context.Context, a *APK, pkg InstallablePackage) (*ex
 	return result.exp, result.err
 }
 
+// packageVerification returns how expanding pkg verifies it, by its checksums and detached signature, so that
+// the package expanded by an APK is only handed out to another that verifies it the same way.
+func (a *APK) packageVerification(pkg InstallablePackage) (string, error) {
+	verification := fmt.Sprintf("strict=%t checksums=%t", a.strictVerification, a.checksums)
+	repo, detached := a.detachedSigRepository(pkg)
+	if !detached {
+		return verification, nil
+	}
+	keys, err := a.trustedKeys()
+	if err != nil {
+		return "", err
+	}
+	if keys, err = a.repositoryKeys(repo, keys); err != nil {
+		return "", err
+	}
+	return verification + " detached=" + keysDigest(keys), nil
+}
+
 func (a *APK) expandPackage(ctx context.Context, pkg InstallablePackage) (*expandapk.APKExpanded, error) {
+	// before the cache, which may have the package from a fetch that was allowed
+	if err := a.checkPackageFetch(pkg); err != nil {
+		return nil, err
+	}
 	if a.cache == nil {
 		// If we don't have a cache configured, don't use the global cache.
 		// Calling APKExpanded.Close() will clean up a tempdir.
@@ -955,6 +1499,18 @@ func (a *APK) expandPackage(ctx context.Context, pkg InstallablePackage) (*expan
 	return globalApkCache.get(ctx, a, pkg)
 }
 
+// PackageScripts fetches pkg, or finds it in the cache, and returns the scripts in its control section, such as
+// .pre-install and .trigger, so that what installing it would run can be inspected first.
+func (a *APK) PackageScripts(ctx context.Context, pkg InstallablePackage) ([]expandapk.Script, error) {
+	exp, err := a.expandPackage(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
+	}
+	defer exp.Close()
+
+	return exp.Scripts()
+}
+
 func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expandapk.APKExpanded, error) {
 	log := clog.FromContext(ctx)
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "expandPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
@@ -963,12 +1519,13 @@ func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expand
 	cacheDir := ""
 	if a.cache != nil {
 		var err error
-		cacheDir, err = cacheDirForPackage(a.cache.dir, pkg)
+		cacheDir, err = cacheDirForPackage(a.cache.dir, a.cache.keys, pkg)
 		if err != nil {
 			return nil, err
 		}
 
 		exp, err := a.cachedPackage(ctx, pkg, cacheDir)
+		span.SetAttributes(attribute.Bool("cache.hit", err == nil))
 		if err == nil {
 			log.Debugf("cache hit (%s)", pkg.PackageName())
 			return exp, nil
@@ -981,23 +1538,100 @@ func expandPackage(ctx context.Context, a *APK, pkg InstallablePackage) (*expand
 		}
 	}
 
-	rc, err := a.FetchPackage(ctx, pkg)
+	// The package is expanded as it is downloaded, so the span of the download lasts until it has all been read.
+	downloadCtx, downloadSpan := otel.Tracer("go-apk").Start(ctx, "downloadPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
+	rc, header, err := a.fetchPackageWithTimeout(downloadCtx, pkg)
 	if err != nil {
+		downloadSpan.End()
 		return nil, fmt.Errorf("fetching package %q: %w", pkg.PackageName(), err)
 	}
-	defer rc.Close()
+	var provenance *CacheProvenance
+	if a.cache != nil {
+		provenance = packageProvenance(pkg, header)
+	}
+	download := &spanReader{r: rc, span: downloadSpan}
+	defer download.Close()
+	if downloads := downloadCounterFrom(ctx); downloads != nil {
+		defer func() { downloads.n.Add(download.n) }()
+	}
 
-	exp, err := expandapk.ExpandApk(ctx, rc, cacheDir)
+	expandOpts := []expandapk.Option{expandapk.WithDataHashVerification(true)}
+	if a.parallelBlocks > 0 {
+		expandOpts = append(expandOpts, expandapk.WithParallelDecompression(a.parallelBlocks))
+	}
+	if a.parallelHash {
+		expandOpts = append(expandOpts, expandapk.WithParallelHashing(true))
+	}
+	if a.tempDir != "" {
+		expandOpts = append(expandOpts, expandapk.WithTempDir(a.tempDir))
+	}
+	if rp, ok := pkg.(*RepositoryPackage); ok {
+		// the compressed streams, and the data section uncompressed
+		expandOpts = append(expandOpts, expandapk.WithExpectedSize(int64(rp.Size+rp.InstalledSize))) //nolint:gosec // sizes of packages fit in an int64
+	}
+
+	// the detached signature of a package is over all of it, so it is hashed as it is expanded
+	repo, detached := a.detachedSigRepository(pkg)
+	var src io.Reader = download
+	digest := sha1.New() //nolint:gosec
+	if detached {
+		src = io.TeeReader(download, digest)
+	}
+
+	expandCtx, expandSpan := otel.Tracer("go-apk").Start(ctx, "expandApk", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
+	exp, err := expandapk.ExpandApk(expandCtx, src, cacheDir, expandOpts...)
 	if err != nil {
+		expandSpan.End()
 		return nil, fmt.Errorf("expanding %s: %w", pkg.PackageName(), err)
 	}
+	expandSpan.SetAttributes(attribute.Int64("bytes", exp.Size))
+	expandSpan.End()
+	if detached {
+		verification, err := func() (*Verification, error) {
+			if _, err := io.Copy(digest, download); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", pkg.PackageName(), err)
+			}
+			return a.verifyDetachedSignature(ctx, pkg, repo, digest.Sum(nil))
+		}()
+		if err != nil {
+			exp.Close()
+			return nil, err
+		}
+		if provenance != nil {
+			provenance.Verification = verification
+		}
+	}
+	if a.strictVerification || a.checksums {
+		_, verifySpan := otel.Tracer("go-apk").Start(ctx, "verifyPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
+		verify := verifyChecksum
+		if a.strictVerification {
+			verify = verifyChecksums
+		}
+		err := verify(pkg, exp)
+		verifySpan.End()
+		if err != nil {
+			exp.Close()
+			return nil, err
+		}
+	}
 
 	// If we don't have a cache, we're done.
 	if a.cache == nil {
 		return exp, nil
 	}
 
-	return a.cachePackage(ctx, pkg, exp, cacheDir)
+	return a.cachePackage(ctx, pkg, exp, cacheDir, provenance)
+}
+
+// packageProvenance returns the provenance of pkg, fetched with a response with header, if from HTTP.
+func packageProvenance(pkg InstallablePackage, header http.Header) *CacheProvenance {
+	u := pkg.URL()
+	if asURL, err := packageAsURL(pkg); err == nil {
+		u = asURL.Redacted()
+	}
+	provenance := provenanceFromResponse(u, header)
+	provenance.Checksum = pkg.ChecksumString()
+	return provenance
 }
 
 func packageAsURI(pkg InstallablePackage) (uri.URI, error) {
@@ -1023,6 +1657,22 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 	log := clog.FromContext(ctx)
 	log.Debugf("fetching %s", pkg)
 
+	rc, _, err := a.fetchPackageWithTimeout(ctx, pkg)
+	return rc, err
+}
+
+// fetchPackageWithTimeout is FetchPackage, also returning the headers of the response for an HTTP repository.
+func (a *APK) fetchPackageWithTimeout(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, http.Header, error) {
+	ctx, cancel := withTimeout(ctx, a.timeouts.PackageFetch, "fetching "+pkg.PackageName())
+	rc, header, err := a.fetchPackage(ctx, pkg)
+	if err != nil {
+		cancel()
+		return nil, nil, timedOut(ctx, err)
+	}
+	return &timeoutReader{ReadCloser: rc, ctx: ctx, cancel: cancel}, header, nil
+}
+
+func (a *APK) fetchPackage(ctx context.Context, pkg InstallablePackage) (io.ReadCloser, http.Header, error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "fetchPackage", trace.WithAttributes(attribute.String("package", pkg.PackageName())))
 	defer span.End()
 
@@ -1033,24 +1683,27 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 	// into a url.URL{}.
 	asURL, err := packageAsURL(pkg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse package as URL: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse package as URL: %w", err)
 	}
 
 	switch asURL.Scheme {
 	case "file":
 		f, err := os.Open(u)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read repository package apk %s: %w", u, err)
+			return nil, nil, fmt.Errorf("failed to read repository package apk %s: %w", u, err)
 		}
-		return f, nil
+		return f, nil, nil
 	case "https", "http":
+		if err := checkFetch(a.fetchPolicies, asURL); err != nil {
+			return nil, nil, err
+		}
 		client := a.client
 		if a.cache != nil {
 			client = a.cache.client(client, false)
 		}
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if a, ok := a.auth[asURL.Host]; ok && a.user != "" && a.pass != "" {
 			req.SetBasicAuth(a.user, a.pass)
@@ -1060,44 +1713,52 @@ func (a *APK) FetchPackage(ctx context.Context, pkg InstallablePackage) (io.Read
 		rrt := newRangeRetryTransport(ctx, client)
 		res, err := rrt.RoundTrip(req)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
+			return nil, nil, fmt.Errorf("unable to get package apk at %s: %w", u, err)
 		}
 		if res.StatusCode != http.StatusOK {
 			res.Body.Close()
-			return nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
+			return nil, nil, fmt.Errorf("unable to get package apk at %s: %v", u, res.Status)
 		}
-		return res.Body, nil
+		return res.Body, res.Header, nil
 	default:
-		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+		return nil, nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
 	}
 }
 
-type WriteHeaderer interface {
-	WriteHeader(hdr tar.Header, tfs fs.FS, pkg *Package) (bool, error)
+// spanReader ends span once everything has been read from r, or it is closed, recording how many bytes were read.
+type spanReader struct {
+	r    io.ReadCloser
+	span trace.Span
+	n    int64
+	once sync.Once
 }
 
-func packageInfo(exp *expandapk.APKExpanded) (*Package, error) {
-	f, err := exp.ControlFS.Open(".PKGINFO")
+func (s *spanReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
 	if err != nil {
-		return nil, fmt.Errorf("opening .PKGINFO in %s: %w", exp.ControlFile, err)
+		s.end(err)
 	}
-	defer f.Close()
+	return n, err
+}
 
-	cfg, err := ini.ShadowLoad(f)
-	if err != nil {
-		return nil, fmt.Errorf("ini.ShadowLoad(): %w", err)
-	}
+func (s *spanReader) Close() error {
+	s.end(nil)
+	return s.r.Close()
+}
 
-	pkg := new(Package)
-	if err = cfg.MapTo(pkg); err != nil {
-		return nil, fmt.Errorf("cfg.MapTo(): %w", err)
-	}
-	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
-	pkg.InstalledSize = pkg.Size
-	pkg.Size = uint64(exp.Size)
-	pkg.Checksum = exp.ControlHash
+func (s *spanReader) end(err error) {
+	s.once.Do(func() {
+		s.span.SetAttributes(attribute.Int64("bytes", s.n))
+		if err != nil && !errors.Is(err, io.EOF) {
+			s.span.RecordError(err)
+		}
+		s.span.End()
+	})
+}
 
-	return pkg, nil
+type WriteHeaderer interface {
+	WriteHeader(hdr tar.Header, tfs fs.FS, pkg *Package) (bool, error)
 }
 
 // installPackage installs a single package and updates installed db.
@@ -1105,7 +1766,7 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 	log := clog.FromContext(ctx)
 	log.Infof("installing %s (%s)", pkg.Name, pkg.Version)
 
-	ctx, span := otel.Tracer("go-apk").Start(ctx, "installPackage", trace.WithAttributes(attribute.String("package", pkg.Name)))
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "installPackage", trace.WithAttributes(attribute.String("package", pkg.Name), attribute.String("version", pkg.Version)))
 	defer span.End()
 
 	defer expanded.Close()
@@ -1121,7 +1782,7 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 			return nil, fmt.Errorf("unable to install files for pkg %s: %w", pkg.Name, err)
 		}
 	} else {
-		packageData, err := expanded.PackageData()
+		packageData, err := expanded.PackageReader()
 		if err != nil {
 			return nil, fmt.Errorf("opening package file %q: %w", expanded.PackageFile, err)
 		}
@@ -1133,6 +1794,9 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 		}
 	}
 
+	_, scriptsSpan := otel.Tracer("go-apk").Start(ctx, "updateScripts", trace.WithAttributes(attribute.String("package", pkg.Name)))
+	defer scriptsSpan.End()
+
 	// update the scripts.tar
 	controlData, err := os.Open(expanded.ControlFile)
 	if err != nil {
@@ -1151,6 +1815,9 @@ func (a *APK) installPackage(ctx context.Context, pkg *Package, expanded *expand
 	if err := a.updateTriggers(pkg, controlData); err != nil {
 		return nil, fmt.Errorf("unable to update triggers for pkg %s: %w", pkg.Name, err)
 	}
+	scriptsSpan.End()
+	a.emit(ctx, Event{Type: EventScriptsUpdated, Package: pkg.Name, Version: pkg.Version})
+	a.emit(ctx, Event{Type: EventPackageInstalled, Package: pkg.Name, Version: pkg.Version})
 
 	return installedFiles, nil
 }
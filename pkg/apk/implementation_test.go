@@ -15,7 +15,10 @@
 package apk
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
@@ -31,6 +34,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
@@ -69,7 +73,7 @@ func TestInitDB(t *testing.T) {
 	err = apk.InitDB(context.Background())
 	require.NoError(t, err)
 	// check all of the contents
-	for _, d := range initDirectories {
+	for _, d := range apk.initDirectories() {
 		fi, err := fs.Stat(src, d.path)
 		require.NoError(t, err, "error statting %s", d.path)
 		require.True(t, fi.IsDir(), "expected %s to be a directory, got %v", d.path, fi.Mode())
@@ -94,6 +98,80 @@ func TestInitDB(t *testing.T) {
 	}
 }
 
+func TestInitDBLayout(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(true), WithConfigDir("/sandbox/etc/apk"), WithDatabaseDir("usr/lib/apk/db/"))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+
+	for _, h := range a.ListInitFiles() {
+		if h.Typeflag == tar.TypeChar {
+			continue
+		}
+		_, err := fs.Stat(src, strings.TrimPrefix(h.Name, "/"))
+		require.NoError(t, err, "listed init file %s", h.Name)
+	}
+	for _, name := range []string{"sandbox/etc/apk/world", "sandbox/etc/apk/arch", "sandbox/etc/apk/keys", "usr/lib/apk/db/installed", "usr/lib/apk/db/scripts.tar", "usr/lib/apk/db/triggers"} {
+		_, err := fs.Stat(src, name)
+		require.NoError(t, err, "expected %s", name)
+	}
+	for _, name := range []string{"etc/apk", "lib/apk"} {
+		_, err := fs.Stat(src, name)
+		require.ErrorIs(t, err, fs.ErrNotExist, "did not expect %s", name)
+	}
+
+	require.NoError(t, a.SetWorld(ctx, []string{"layout"}))
+	world, err := src.ReadFile("sandbox/etc/apk/world")
+	require.NoError(t, err)
+	require.Equal(t, "layout\n", string(world))
+
+	pkg := fakePackage(t, &Package{Name: "layout", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/layout", 0o644, false, []byte("layout"), nil},
+	})
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{pkg}))
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, "layout", installed[0].Name)
+	b, err := src.ReadFile("usr/lib/apk/db/installed")
+	require.NoError(t, err)
+	require.Contains(t, string(b), "P:layout\n")
+
+	for _, dir := range []string{"", ".", "..", "../etc/apk", "/etc/../../apk"} {
+		_, err := New(WithDatabaseDir(dir))
+		require.Error(t, err, "database dir %q", dir)
+	}
+}
+
+func TestInitDBWithOptions(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(true), WithArch("aarch64"))
+	require.NoError(t, err)
+
+	keyPath := filepath.Join(t.TempDir(), "alpine-devel@lists.alpinelinux.org-5e69ca50.rsa.pub")
+	require.NoError(t, os.WriteFile(keyPath, []byte(testDemoKey), 0o644)) //nolint:gosec
+	repos := []string{"https://dl-cdn.alpinelinux.org/alpine/v3.16/main", "@edge https://dl-cdn.alpinelinux.org/alpine/edge/main"}
+	require.NoError(t, a.InitDBWithOptions(ctx, WithInitRepositories(repos...), WithInitKeyring(keyPath)))
+
+	arch, err := src.ReadFile("etc/apk/arch")
+	require.NoError(t, err)
+	require.Equal(t, "aarch64\n", string(arch))
+	got, err := a.GetRepositories()
+	require.NoError(t, err)
+	require.Equal(t, repos, got)
+	key, err := src.ReadFile("etc/apk/keys/alpine-devel@lists.alpinelinux.org-5e69ca50.rsa.pub")
+	require.NoError(t, err)
+	require.Equal(t, testDemoKey, string(key))
+
+	for _, line := range []string{"@edge", "@ https://dl-cdn.alpinelinux.org/alpine/edge/main"} {
+		err := a.InitDBWithOptions(ctx, WithInitRepositories(line))
+		require.ErrorContains(t, err, "invalid repository line", "line %q", line)
+	}
+}
+
 func TestSetWorld(t *testing.T) {
 	ctx := context.Background()
 	src := apkfs.NewMemFS()
@@ -403,19 +481,14 @@ func TestFetchPackage(t *testing.T) {
 	t.Run("cache miss network should fill cache", func(t *testing.T) {
 		tmpDir := t.TempDir()
 		a := prepLayout(t, tmpDir)
-		// fill the cache
-		repoDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch)
-		err := os.MkdirAll(repoDir, 0o755)
-		require.NoError(t, err, "unable to mkdir cache")
-
-		cacheApkFile := filepath.Join(repoDir, testPkgFilename)
-		cacheApkDir := strings.TrimSuffix(cacheApkFile, ".apk")
+		// packages are cached by their checksum
+		cacheApkDir := filepath.Join(tmpDir, "packages", hex.EncodeToString(testPkg.Checksum))
 
 		a.SetClient(&http.Client{
 			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
 		})
 
-		_, err = a.expandPackage(ctx, pkg)
+		_, err := a.expandPackage(ctx, pkg)
 		require.NoErrorf(t, err, "unable to install pkg")
 		// check that the package file is in place
 		_, err = os.Stat(cacheApkDir)
@@ -441,6 +514,16 @@ func TestFetchPackage(t *testing.T) {
 		apk2, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, testPkgFilename))
 		require.NoError(t, err, "unable to read previous apk file")
 		require.Equal(t, apk1, apk2, "apk files do not match")
+
+		// the same package from another mirror is in the cache, without the network
+		mirror := Repository{URI: fmt.Sprintf("%s/%s", "https://mirror.example.com/alpine/v3.16/main", testArch)}
+		mirrorPkg := NewRepositoryPackage(&testPkg, mirror.WithIndex(&APKIndex{Packages: packages}))
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{fail: true},
+		})
+		exp, err = a.expandPackage(ctx, mirrorPkg)
+		require.NoError(t, err, "package from mirror was not in the cache")
+		require.Equal(t, cacheApkDir, filepath.Dir(exp.ControlFile))
 	})
 	t.Run("cache hit no etag", func(t *testing.T) {
 		tmpDir := t.TempDir()
@@ -534,6 +617,403 @@ func TestFetchPackage(t *testing.T) {
 	})
 }
 
+func TestExpandPackageParallelDecompression(t *testing.T) {
+	var (
+		repo          = Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+		repoWithIndex = repo.WithIndex(&APKIndex{
+			Packages: []*Package{&testPkg},
+		})
+		pkg = NewRepositoryPackage(&testPkg, repoWithIndex)
+		ctx = context.Background()
+	)
+
+	var expanded []*expandapk.APKExpanded
+	for _, opts := range [][]Option{
+		{WithFS(apkfs.NewMemFS())},
+		{WithFS(apkfs.NewMemFS()), WithParallelDecompression(2)},
+		{WithFS(apkfs.NewMemFS()), WithParallelHashing(true)},
+		{WithFS(apkfs.NewMemFS()), WithParallelDecompression(2), WithParallelHashing(true)},
+	} {
+		a, err := New(opts...)
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err, "unable to expand package")
+		defer exp.Close()
+		expanded = append(expanded, exp)
+	}
+
+	serial := expanded[0]
+	want, err := os.ReadFile(serial.TarFile)
+	require.NoError(t, err)
+	for _, parallel := range expanded[1:] {
+		require.Equal(t, serial.ControlHash, parallel.ControlHash)
+		require.Equal(t, serial.PackageHash, parallel.PackageHash)
+
+		got, err := os.ReadFile(parallel.TarFile)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+		require.Equal(t, int64(len(got)), parallel.PackageUncompressedSize)
+	}
+	control, err := serial.ControlData()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(control)), serial.ControlUncompressedSize)
+	require.True(t, serial.Signed)
+	require.NotZero(t, serial.SignatureUncompressedSize)
+	require.Equal(t, serial.PackageHash, serial.ExpectedPackageHash, "datahash was not verified")
+}
+
+func TestExpandPackageDataHash(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err, "unable to create APK")
+
+	// the datahash in .PKGINFO is of some other data section
+	pkg := fakePackage(t, &Package{Name: "wrong", Version: "1.0-r0", DataHash: hex.EncodeToString(make([]byte, 32))}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/wrong", 0o644, false, []byte("wrong"), nil},
+	})
+	_, err = a.expandPackage(ctx, pkg)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestStrictVerification(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	newAPK := func(t *testing.T) *APK {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithStrictVerification(true))
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		return a
+	}
+
+	t.Run("verified", func(t *testing.T) {
+		pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+		exp, err := newAPK(t).expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer exp.Close()
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		wrong := testPkg
+		wrong.Checksum = make([]byte, len(testPkg.Checksum))
+		pkg := NewRepositoryPackage(&wrong, repo.WithIndex(&APKIndex{Packages: []*Package{&wrong}}))
+		_, err := newAPK(t).expandPackage(ctx, pkg)
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+	t.Run("no checksum", func(t *testing.T) {
+		missing := testPkg
+		missing.Checksum = nil
+		pkg := NewRepositoryPackage(&missing, repo.WithIndex(&APKIndex{Packages: []*Package{&missing}}))
+		_, err := newAPK(t).expandPackage(ctx, pkg)
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+	t.Run("no datahash", func(t *testing.T) {
+		pkg := fakePackage(t, &Package{Name: "nodatahash", Version: "1.0-r0"}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+		})
+		_, err := newAPK(t).expandPackage(ctx, pkg)
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+		require.ErrorContains(t, err, "no datahash")
+	})
+	t.Run("unsigned indexes", func(t *testing.T) {
+		_, err := New(WithStrictVerification(true), WithNoSignatureIndexes("https://example.com/repo"))
+		require.ErrorIs(t, err, ErrSignatureInvalid)
+
+		a, err := New(WithFS(apkfs.NewMemFS()), WithStrictVerification(true))
+		require.NoError(t, err)
+		_, err = a.GetRepositoryIndexes(ctx, true)
+		require.ErrorIs(t, err, ErrSignatureInvalid)
+	})
+}
+
+func TestChecksumVerification(t *testing.T) {
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	newAPK := func(t *testing.T, options ...Option) *APK {
+		a, err := New(append([]Option{WithFS(apkfs.NewMemFS())}, options...)...)
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		return a
+	}
+	wrong := testPkg
+	wrong.Checksum = make([]byte, len(testPkg.Checksum))
+	mismatched := NewRepositoryPackage(&wrong, repo.WithIndex(&APKIndex{Packages: []*Package{&wrong}}))
+
+	t.Run("verified by default", func(t *testing.T) {
+		pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+		exp, err := newAPK(t).expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer exp.Close()
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		_, err := newAPK(t).expandPackage(ctx, mismatched)
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+	t.Run("no checksum", func(t *testing.T) {
+		missing := testPkg
+		missing.Checksum = nil
+		pkg := NewRepositoryPackage(&missing, repo.WithIndex(&APKIndex{Packages: []*Package{&missing}}))
+		exp, err := newAPK(t).expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer exp.Close()
+	})
+	t.Run("opted out", func(t *testing.T) {
+		exp, err := newAPK(t, WithChecksumVerification(false)).expandPackage(ctx, mismatched)
+		require.NoError(t, err)
+		defer exp.Close()
+	})
+	t.Run("opted out with strict verification", func(t *testing.T) {
+		_, err := New(WithFS(apkfs.NewMemFS()), WithStrictVerification(true), WithChecksumVerification(false))
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+}
+
+func TestPackageCacheVerification(t *testing.T) {
+	// Reset caches so we have isolated tests.
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	newAPK := func(t *testing.T, options ...Option) *APK {
+		a, err := New(append([]Option{WithFS(apkfs.NewMemFS()), WithCache(t.TempDir(), false)}, options...)...)
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
+		})
+		return a
+	}
+	wrong := testPkg
+	wrong.Checksum = make([]byte, len(testPkg.Checksum))
+	mismatched := NewRepositoryPackage(&wrong, repo.WithIndex(&APKIndex{Packages: []*Package{&wrong}}))
+
+	// the package expanded without verifying it is not handed out to those that verify it
+	exp, err := newAPK(t, WithChecksumVerification(false)).expandPackage(ctx, mismatched)
+	require.NoError(t, err)
+	defer exp.Close()
+	_, err = newAPK(t, WithStrictVerification(true)).expandPackage(ctx, mismatched)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	_, err = newAPK(t).expandPackage(ctx, mismatched)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestCachedPackageData(t *testing.T) {
+	// Reset caches so we have isolated tests.
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+	repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+	pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+	client := &http.Client{Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}}
+
+	// the package as expanded without a cache
+	a, err := New(WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err)
+	a.SetClient(client)
+	want, err := a.expandPackage(ctx, pkg)
+	require.NoError(t, err)
+	defer want.Close()
+	wantTar, err := os.ReadFile(want.TarFile)
+	require.NoError(t, err)
+
+	cache := t.TempDir()
+	a, err = New(WithFS(apkfs.NewMemFS()), WithCache(cache, false))
+	require.NoError(t, err)
+	a.SetClient(client)
+	cacheDir, err := cacheDirForPackage(a.cache.dir, a.cache.keys, pkg)
+	require.NoError(t, err)
+	exp, err := a.expandPackage(ctx, pkg)
+	require.NoError(t, err)
+	require.NoError(t, exp.Close())
+
+	// the data section is kept gzipped, with its index, rather than expanded
+	dat := filepath.Join(cacheDir, hex.EncodeToString(want.PackageHash)+".dat.tar.gz")
+	require.FileExists(t, dat+gzipIndexExt)
+	require.NoFileExists(t, strings.TrimSuffix(dat, ".gz"))
+
+	check := func(t *testing.T, exp *expandapk.APKExpanded) {
+		require.Empty(t, exp.TarFile)
+		require.Equal(t, want.Size, exp.Size)
+		require.Equal(t, want.SignatureUncompressedSize, exp.SignatureUncompressedSize)
+		require.Equal(t, want.ControlUncompressedSize, exp.ControlUncompressedSize)
+		require.Equal(t, want.PackageUncompressedSize, exp.PackageUncompressedSize)
+		require.NotZero(t, exp.SignatureUncompressedSize)
+		for _, e := range want.TarFS.Entries() {
+			if !e.Header.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			b, err := fs.ReadFile(want.TarFS, e.Header.Name)
+			require.NoError(t, err)
+			got, err := fs.ReadFile(exp.TarFS, e.Header.Name)
+			require.NoError(t, err, e.Header.Name)
+			require.Equal(t, b, got, e.Header.Name)
+		}
+		rc, err := exp.PackageReader()
+		require.NoError(t, err)
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, wantTar, got)
+	}
+	// both the package that was just cached, after it was closed, and the one the cache has
+	check(t, exp)
+	cached, err := a.cachedPackage(ctx, pkg, cacheDir)
+	require.NoError(t, err)
+	check(t, cached)
+
+	// an index that is not of the tar is built again
+	require.NoError(t, os.WriteFile(dat+gzipIndexExt, []byte("not an index"), 0o644))
+	cached, err = a.cachedPackage(ctx, pkg, cacheDir)
+	require.NoError(t, err)
+	check(t, cached)
+	b, err := os.ReadFile(dat + gzipIndexExt)
+	require.NoError(t, err)
+	require.NotEqual(t, "not an index", string(b))
+}
+
+func TestPrefetch(t *testing.T) {
+	// Reset caches so we have isolated tests.
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+
+	// a repository with a single package without dependencies, and its unsigned index
+	repoDir := t.TempDir()
+	b, err := os.ReadFile("testdata/replaces/replaces-0.0.1-r0.apk")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "replaces-0.0.1-r0.apk"), b, 0o644))
+	pkg, err := ParsePackage(ctx, bytes.NewReader(b))
+	require.NoError(t, err)
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{pkg}})
+	require.NoError(t, err)
+	index, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "APKINDEX.tar.gz"), index, 0o644))
+
+	cacheDir := t.TempDir()
+	newAPK := func(t *testing.T, offline bool, transport http.RoundTripper) *APK {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithCache(cacheDir, offline), WithIgnoreMknodErrors(ignoreMknodErrors))
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{Transport: transport})
+		a.ignoreSignatures = true
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/repo"}))
+		return a
+	}
+
+	a := newAPK(t, false, &testLocalTransport{root: repoDir, basenameOnly: true, headers: map[string][]string{
+		http.CanonicalHeaderKey("etag"): {"an-etag"},
+	}})
+	require.NoError(t, a.Prefetch(ctx, []string{"replaces"}))
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Empty(t, installed, "prefetching should not install anything")
+	_, err = os.Stat(filepath.Join(cacheDir, packagesCacheDir, hex.EncodeToString(pkg.Checksum)))
+	require.NoError(t, err, "package was not cached")
+
+	// a later build finds everything in the cache
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	a = newAPK(t, true, &testLocalTransport{fail: true})
+	require.NoError(t, a.SetWorld(ctx, []string{"replaces"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+	installed, err = a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, "replaces", installed[0].Name)
+
+	require.ErrorIs(t, a.Prefetch(ctx, []string{"replaces"}), ErrOffline)
+}
+
+func TestInstallUpgradeAvailable(t *testing.T) {
+	// Reset caches so we have isolated tests.
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+
+	// a repository of each build of the same version of a package, with its unsigned index
+	repository := func(t *testing.T, contents string) (string, *Package) {
+		fp := fakePackage(t, &Package{Name: "rebuilt", Version: "1.0-r0", Arch: testArch, Description: contents}, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/rebuilt", 0o644, false, []byte(contents), nil},
+		})
+		b, err := os.ReadFile(fp.(*testPackage).file)
+		require.NoError(t, err)
+		pkg, err := ParsePackage(ctx, bytes.NewReader(b))
+		require.NoError(t, err)
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, pkg.Filename()), b, 0o644))
+		archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{pkg}})
+		require.NoError(t, err)
+		index, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "APKINDEX.tar.gz"), index, 0o644))
+		return dir, pkg
+	}
+	firstDir, first := repository(t, "first")
+	secondDir, second := repository(t, "second")
+
+	src := apkfs.NewMemFS()
+	a, err := New(WithFS(src), WithArch(testArch), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err)
+	a.ignoreSignatures = true
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/repo"}))
+	require.NoError(t, a.SetWorld(ctx, []string{"rebuilt"}))
+	a.SetClient(&http.Client{Transport: &testLocalTransport{root: firstDir, basenameOnly: true}})
+	require.NoError(t, a.FixateWorld(ctx, nil))
+
+	// the repository republished the version as another build
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	a.SetClient(&http.Client{Transport: &testLocalTransport{root: secondDir, basenameOnly: true}})
+	indexes, err := a.GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+
+	delta, err := NewPkgResolver(ctx, indexes).ResolveWithInstalled(ctx, []string{"rebuilt"}, installed)
+	require.NoError(t, err)
+	require.Empty(t, delta.ToInstall(), "the same version is kept without WithUpgradeAvailable")
+
+	delta, err = NewPkgResolver(ctx, indexes).ResolveWithInstalled(ctx, []string{"rebuilt"}, installed, WithUpgradeAvailable(true))
+	require.NoError(t, err)
+	require.Len(t, delta.Upgrade, 1)
+	require.Equal(t, first.ChecksumString(), delta.Upgrade[0].From.ChecksumString())
+	require.NoError(t, a.InstallPackages(ctx, nil, delta.ToInstall()))
+
+	installed, err = a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+	require.Equal(t, second.ChecksumString(), installed[0].ChecksumString())
+	b, err := src.ReadFile("etc/rebuilt")
+	require.NoError(t, err)
+	require.Equal(t, "second", string(b))
+}
+
+func TestPackageScripts(t *testing.T) {
+	a, err := New(WithFS(apkfs.NewMemFS()))
+	require.NoError(t, err, "unable to create APK")
+
+	scripts := []expandapk.Script{
+		{Name: ".pre-install", Contents: []byte("#!/bin/sh\necho pre-install\n")},
+		{Name: ".trigger", Contents: []byte("#!/bin/sh\necho trigger\n")},
+	}
+	pkg := fakePackageWithScripts(t, &Package{Name: "scripted", Version: "1.0-r0"}, scripts, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+	})
+	got, err := a.PackageScripts(context.Background(), pkg)
+	require.NoError(t, err)
+	require.Equal(t, scripts, got)
+
+	pkg = fakePackage(t, &Package{Name: "unscripted", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+	})
+	got, err = a.PackageScripts(context.Background(), pkg)
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
 func TestAuth_good(t *testing.T) {
 	called := false
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
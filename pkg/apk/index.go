@@ -16,29 +16,37 @@ package apk
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha1" //nolint:gosec // signatures of indexes are over SHA1 digests
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/klauspost/compress/gzip"
-
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 	"go.lsp.dev/uri"
 	"go.opentelemetry.io/otel"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sync/errgroup"
 )
 
-var signatureFileRegex = regexp.MustCompile(`^\.SIGN\.RSA\.(.*\.rsa\.pub)$`)
-
 // This is terrible but simpler than plumbing around a cache for now.
 // We just hold the parsed index in memory rather than re-parsing it every time,
 // which requires gunzipping, which is (somewhat) expensive.
@@ -47,8 +55,9 @@ var globalIndexCache = &indexCache{
 }
 
 type indexResult struct {
-	idx *APKIndex
-	err error
+	idx   *APKIndex
+	fetch *IndexFetch
+	err   error
 }
 
 type indexCache struct {
@@ -59,20 +68,144 @@ type indexCache struct {
 	sync.Mutex
 	modtimes map[string]time.Time
 
-	// repoBase -> indexResult
+	// repoBase and verification, see verificationKey -> indexResult
 	indexes sync.Map
+
+	// the verifiers of WithIndexVerifier, numbered for verificationKey
+	verifiersMu sync.Mutex
+	verifiers   map[IndexVerifier]int
+
+	// Parsed indexes by the strong etag of their URL, or else by the digest of their contents, so
+	// that an index we have already seen at a URL is not parsed again if it has the same etag, and
+	// the same contents are only held in memory once, even if they were fetched again, from another
+	// repository, or their modtime changed. The parsed indexes are shared by all who fetched them,
+	// so they must not be modified, see GetRepositoryIndexes.
+	parsedMu sync.Mutex
+	// content key -> parsed index
+	parsed map[string]*APKIndex
+	// repoBase -> content key, so we only hold on to the latest index for each repository
+	parsedKeys map[string]string
 }
 
-func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) {
-	if strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") {
+// parse returns the parsed index for index data b from u, which is identified by key, parsing its
+// packages lazily if lazy is set.
+func (i *indexCache) parse(u, key string, b []byte, lazy bool) (*APKIndex, error) {
+	key = parsedKey(key, lazy)
+	idx := i.lookup(key)
+	if idx == nil {
+		// Parse without holding the lock, so we can parse several repositories at once.
+		var err error
+		idx, err = indexFromArchive(io.NopCloser(bytes.NewReader(b)), lazy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return i.store(u, key, idx), nil
+}
+
+// parsedKey returns the key of the parsed index with content key, see indexCache.lookup.
+func parsedKey(key string, lazy bool) string {
+	if lazy {
+		// so that lazily parsed indexes are not handed out to those who want them in full
+		return key + ":lazy"
+	}
+	return key
+}
+
+// lookup returns the parsed index with key, or nil if there is none.
+func (i *indexCache) lookup(key string) *APKIndex {
+	i.parsedMu.Lock()
+	defer i.parsedMu.Unlock()
+	return i.parsed[key]
+}
+
+// store records idx as the parsed index with key, and the latest index of u, returning the index that was
+// already parsed with key instead, if any.
+func (i *indexCache) store(u, key string, idx *APKIndex) *APKIndex {
+	i.parsedMu.Lock()
+	defer i.parsedMu.Unlock()
+
+	if i.parsed == nil {
+		i.parsed = map[string]*APKIndex{}
+		i.parsedKeys = map[string]string{}
+	}
+	if existing, ok := i.parsed[key]; ok {
+		idx = existing
+	} else {
+		i.parsed[key] = idx
+	}
+
+	old, ok := i.parsedKeys[u]
+	i.parsedKeys[u] = key
+	if ok && old != key && !slices.Contains(maps.Values(i.parsedKeys), old) {
+		delete(i.parsed, old)
+	}
+
+	return idx
+}
+
+// verificationKey returns what the index at u is verified with, with keys and opts, so that an index is only
+// handed out to a later fetch of u that verifies it the same way, and not to one that is stricter. It is false
+// if the verifier of opts cannot be told apart from others, in which case the index is not cached.
+func (i *indexCache) verificationKey(u string, keys map[string][]byte, arch string, opts *indexOpts) (string, bool) {
+	key := fmt.Sprintf("lazy=%t", opts.lazy)
+	if !shouldCheckSignatureForIndex(u, arch, opts) {
+		return key, true
+	}
+	verifier := 0
+	if opts.verifier != nil {
+		if !reflect.ValueOf(opts.verifier).Comparable() {
+			return "", false
+		}
+		i.verifiersMu.Lock()
+		if i.verifiers == nil {
+			i.verifiers = map[IndexVerifier]int{}
+		}
+		if _, ok := i.verifiers[opts.verifier]; !ok {
+			i.verifiers[opts.verifier] = len(i.verifiers) + 1
+		}
+		verifier = i.verifiers[opts.verifier]
+		i.verifiersMu.Unlock()
+	}
+	return fmt.Sprintf("%s keys=%s threshold=%d verifier=%d only=%t", key, keysDigest(keys), opts.signatureThreshold, verifier, opts.verifierOnly), true
+}
+
+func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, *IndexFetch, error) {
+	remote := strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
+	verification, ok := i.verificationKey(u, keys, arch, opts)
+	if !ok {
+		if _, err := os.Stat(u); !remote && err != nil {
+			return nil, nil, nil
+		}
+		return getRepositoryIndex(ctx, u, keys, arch, opts)
+	}
+	// the index is cached for each way it is verified, so that it is verified by each of them
+	cacheKey := u + "\x00" + verification
+
+	if remote {
+		// the index of an earlier fetch is not handed out to a later one that may not fetch it
+		if len(opts.fetchPolicies) > 0 {
+			asURL, err := url.Parse(u)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse repo as URI: %w", err)
+			}
+			if err := checkFetch(opts.fetchPolicies, asURL); err != nil {
+				return nil, nil, err
+			}
+		}
 		// We don't want remote indexes to change while we're running.
-		once, _ := i.onces.LoadOrStore(u, &sync.Once{})
+		once, _ := i.onces.LoadOrStore(cacheKey, &sync.Once{})
 		once.(*sync.Once).Do(func() {
-			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
-				idx: idx,
-				err: err,
+			idx, fetch, err := getRepositoryIndex(ctx, u, keys, arch, opts)
+			i.indexes.Store(cacheKey, indexResult{
+				idx:   idx,
+				fetch: fetch,
+				err:   err,
 			})
+			if err != nil && ctx.Err() != nil {
+				// the fetch was canceled or timed out rather than failing, so a later one may succeed
+				i.onces.Delete(cacheKey)
+			}
 		})
 	} else {
 		i.Lock()
@@ -81,41 +214,97 @@ func (i *indexCache) get(ctx context.Context, u string, keys map[string][]byte,
 		// We do expect local indexes to change, so we check modtimes.
 		stat, err := os.Stat(u)
 		if err != nil {
-			return nil, nil
+			return nil, nil, nil
 		}
 
 		mod := stat.ModTime()
-		before, ok := i.modtimes[u]
+		before, ok := i.modtimes[cacheKey]
 		if !ok || mod.After(before) {
 			// If this is the first time or it has changed since the last time...
-			idx, err := getRepositoryIndex(ctx, u, keys, arch, opts)
-			i.indexes.Store(u, indexResult{
-				idx: idx,
-				err: err,
+			idx, fetch, err := getRepositoryIndex(ctx, u, keys, arch, opts)
+			i.indexes.Store(cacheKey, indexResult{
+				idx:   idx,
+				fetch: fetch,
+				err:   err,
 			})
-			i.modtimes[u] = mod
+			if i.modtimes == nil {
+				i.modtimes = map[string]time.Time{}
+			}
+			i.modtimes[cacheKey] = mod
 		}
 	}
 
-	v, ok := i.indexes.Load(u)
+	v, ok := i.indexes.Load(cacheKey)
 	if !ok {
 		asURL, _ := url.Parse(u)
 		panic(fmt.Errorf("did not see index %q after writing it", asURL.Redacted()))
 	}
 	result := v.(indexResult)
 
-	return result.idx, result.err
+	return result.idx, result.fetch, result.err
 }
 
 // IndexURL full URL to the index file for the given repo and arch
 func IndexURL(repo, arch string) string {
-	return fmt.Sprintf("%s/%s/%s", repo, arch, indexFilename)
+	return fmt.Sprintf("%s/%s/%s", repo, ArchToAPK(arch), indexFilename)
+}
+
+// DefaultRepositoryLayout is the layout of Alpine repositories, which have a directory for each architecture.
+const DefaultRepositoryLayout = "%{repo}/%{arch}"
+
+var layoutPlaceholder = regexp.MustCompile(`%\{([^}]*)\}`)
+
+// RepositoryURL returns the URL of the directory with the APKINDEX.tar.gz and the packages of repo for
+// arch, following layout, in which %{repo} is replaced by repo and %{arch} by the apk name of arch, see
+// ArchToAPK. For example, a flat repository without architecture directories has the layout "%{repo}",
+// and a mirror behind a proxy could have "https://proxy.example.com/alpine/%{arch}".
+func RepositoryURL(layout, repo, arch string) string {
+	return layoutPlaceholder.ReplaceAllStringFunc(layout, func(placeholder string) string {
+		switch placeholder {
+		case "%{repo}":
+			return strings.TrimSuffix(repo, "/")
+		case "%{arch}":
+			return ArchToAPK(arch)
+		}
+		return placeholder
+	})
+}
+
+// ValidateRepositoryLayout checks that layout only has the placeholders RepositoryURL knows.
+func ValidateRepositoryLayout(layout string) error {
+	if layout == "" {
+		return errors.New("empty repository layout")
+	}
+	for _, m := range layoutPlaceholder.FindAllStringSubmatch(layout, -1) {
+		switch m[1] {
+		case "repo", "arch":
+		default:
+			return fmt.Errorf("unknown placeholder %s in repository layout %q", m[0], layout)
+		}
+	}
+	return nil
+}
+
+// repositoryURL is RepositoryURL with the layout of repo, or the default one.
+func (o *indexOpts) repositoryURL(repo, arch string) string {
+	layout, ok := o.layouts[repo]
+	if !ok {
+		layout = DefaultRepositoryLayout
+	}
+	return RepositoryURL(layout, repo, arch)
 }
 
 // GetRepositoryIndexes returns the indexes for the named repositories, keys and archs.
 // The signatures for each index are verified unless ignoreSignatures is set to true.
 // The key-value pairs in the map for `keys` are the name of the key and the contents of the key.
 // The name is just indicative. If it finds a match, it will use it. Else, it will try all keys.
+//
+// It stops at the first repository whose index cannot be read, unless WithIndexPartialResults is set, in
+// which case it returns the indexes it could read together with a *RepositoryIndexErrors, and only fails
+// if it could read none of them.
+//
+// The parsed indexes, and their packages, are cached for the process and shared by everything that fetches
+// the same contents, so they must be treated as read-only.
 func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][]byte, arch string, options ...IndexOption) (indexes []NamedIndex, err error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexes")
 	defer span.End()
@@ -124,63 +313,163 @@ func GetRepositoryIndexes(ctx context.Context, repos []string, keys map[string][
 	for _, opt := range options {
 		opt(opts)
 	}
+	return getRepositoryIndexes(ctx, repos, keys, arch, opts)
+}
 
-	for _, repo := range repos {
-		// does it start with a pin?
-		var (
-			repoName string
-			repoURL  = repo
-		)
-		if strings.HasPrefix(repo, "@") {
-			// it's a pinned repository, get the name
-			parts := strings.Fields(repo)
-			if len(parts) < 2 {
-				return nil, fmt.Errorf("invalid repository line: %q", repo)
+// GetRepositoryIndexesForArchs is GetRepositoryIndexes for several architectures at once, returning the
+// indexes of each architecture by its name. The architectures are fetched in parallel with the same
+// options, HTTP client and keys, and an index that is the same for several architectures, as in a flat
+// repository, is only fetched and verified once.
+//
+// With WithIndexPartialResults, the *RepositoryIndexErrors has the failed repositories of all architectures.
+func GetRepositoryIndexesForArchs(ctx context.Context, repos []string, keys map[string][]byte, archs []string, options ...IndexOption) (map[string][]NamedIndex, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexesForArchs")
+	defer span.End()
+
+	opts := &indexOpts{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	var (
+		mu      sync.Mutex
+		indexes = make(map[string][]NamedIndex, len(archs))
+		failed  = make(map[string][]*RepositoryIndexError, len(archs))
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, arch := range archs {
+		arch := arch
+		g.Go(func() error {
+			archIndexes, err := getRepositoryIndexes(gctx, repos, keys, arch, opts)
+			var repoErrs *RepositoryIndexErrors
+			if err != nil && (!errors.As(err, &repoErrs) || archIndexes == nil) {
+				return fmt.Errorf("getting indexes for %s: %w", arch, err)
 			}
-			repoName = parts[0][1:]
-			repoURL = parts[1]
-		}
 
-		u := IndexURL(repoURL, arch)
-		repoBase := fmt.Sprintf("%s/%s", repoURL, arch)
+			mu.Lock()
+			defer mu.Unlock()
+			indexes[arch] = archIndexes
+			if repoErrs != nil {
+				failed[arch] = repoErrs.Errors
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		// in the order of the architectures, rather than the order they failed in
+		repoErrs := &RepositoryIndexErrors{}
+		for _, arch := range archs {
+			repoErrs.Errors = append(repoErrs.Errors, failed[arch]...)
+		}
+		return indexes, repoErrs
+	}
+	return indexes, nil
+}
 
-		index, err := globalIndexCache.get(ctx, u, keys, arch, opts)
+func getRepositoryIndexes(ctx context.Context, repos []string, keys map[string][]byte, arch string, opts *indexOpts) (indexes []NamedIndex, err error) {
+	var failed []*RepositoryIndexError
+	for _, repo := range repos {
+		namedIndex, err := getNamedIndex(ctx, repo, keys, arch, opts)
 		if err != nil {
-			asURL, _ := url.Parse(u)
-			return nil, fmt.Errorf("reading index %s: %w", asURL.Redacted(), err)
+			if !opts.partialResults {
+				return nil, err
+			}
+			failed = append(failed, err)
+			continue
 		}
 
 		// Can happen for fs.ErrNotExist in file scheme, we just ignore it.
-		if index == nil {
+		if namedIndex == nil {
 			continue
 		}
-
-		repoRef := Repository{URI: repoBase}
-		indexes = append(indexes, NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)))
+		indexes = append(indexes, namedIndex)
+	}
+	if len(failed) > 0 && len(indexes) == 0 {
+		return nil, fmt.Errorf("no repository index could be read: %w", &RepositoryIndexErrors{Errors: failed})
+	}
+	if len(failed) > 0 {
+		return indexes, &RepositoryIndexErrors{Errors: failed}
 	}
 	return indexes, nil
 }
 
+// parseRepositoryLine returns the pinned name, if any, and the URL of repo, a line of etc/apk/repositories such as
+// "@edge https://dl-cdn.alpinelinux.org/alpine/edge/main".
+func parseRepositoryLine(repo string) (name, repoURL string, err error) {
+	// does it start with a pin?
+	if !strings.HasPrefix(repo, "@") {
+		return "", repo, nil
+	}
+	// it's a pinned repository, get the name
+	parts := strings.Fields(repo)
+	if len(parts) < 2 || len(parts[0]) == 1 {
+		return "", "", fmt.Errorf("invalid repository line: %q", repo)
+	}
+	return parts[0][1:], parts[1], nil
+}
+
+// getNamedIndex returns the index of repo, a line of etc/apk/repositories, or nil if it is a local repository
+// without an index.
+func getNamedIndex(ctx context.Context, repo string, keys map[string][]byte, arch string, opts *indexOpts) (NamedIndex, *RepositoryIndexError) {
+	repoName, repoURL, err := parseRepositoryLine(repo)
+	if err != nil {
+		return nil, &RepositoryIndexError{Repository: repo, Err: err}
+	}
+
+	repoBase := opts.repositoryURL(repoURL, arch)
+	u := repoBase + "/" + indexFilename
+
+	repoKeys := keys
+	if k, ok := opts.keys[repoURL]; ok {
+		repoKeys = k
+	}
+
+	index, fetch, err := globalIndexCache.get(ctx, u, repoKeys, arch, opts)
+	if err != nil {
+		asURL, _ := url.Parse(u)
+		return nil, &RepositoryIndexError{Repository: repo, URL: asURL.Redacted(), Err: err}
+	}
+
+	if index == nil {
+		return nil, nil
+	}
+
+	repoRef := Repository{URI: repoBase}
+	var namedIndex NamedIndex = NewFetchedIndex(NewNamedRepositoryWithIndex(repoName, repoRef.WithIndex(index)), fetch)
+	if priority, ok := opts.priorities[repoURL]; ok {
+		namedIndex = NewPrioritizedIndex(namedIndex, priority)
+	}
+	return namedIndex, nil
+}
+
 func shouldCheckSignatureForIndex(index string, arch string, opts *indexOpts) bool {
 	if opts.ignoreSignatures {
 		return false
 	}
 	for _, ignoredIndex := range opts.noSignatureIndexes {
-		if IndexURL(ignoredIndex, arch) == index {
+		if opts.repositoryURL(ignoredIndex, arch)+"/"+indexFilename == index {
 			return false
 		}
 	}
 	return true
 }
 
-func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, error) { //nolint:gocyclo
+func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, arch string, opts *indexOpts) (*APKIndex, *IndexFetch, error) { //nolint:gocyclo
 	// Normalize the repo as a URI, so that local paths
 	// are translated into file:// URLs, allowing them to be parsed
 	// into a url.URL{}.
 	var (
-		b     []byte
 		asURL *url.URL
 		err   error
+		// etag of the index, if the server or cache gave us one
+		etag string
+		// where and how the index was fetched, and the key that verified it
+		fetch = &IndexFetch{}
+		// how the index was fetched with deltas, if it was
+		deltas *indexDeltaFetch
 	)
 	if strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://") {
 		asURL, err = url.Parse(u)
@@ -190,130 +479,380 @@ func getRepositoryIndex(ctx context.Context, u string, keys map[string][]byte, a
 		asURL, err = url.Parse(string(uri.New(u)))
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse repo as URI: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse repo as URI: %w", err)
 	}
+	fetch.URL = asURL.Redacted()
 
+	var body io.ReadCloser
 	switch asURL.Scheme {
 	case "file":
-		b, err = os.ReadFile(u)
+		f, err := os.Open(u)
 		if err != nil {
 			if !errors.Is(err, fs.ErrNotExist) {
-				return nil, fmt.Errorf("failed to read repository %s: %w", asURL.Redacted(), err)
+				return nil, nil, fmt.Errorf("failed to read repository %s: %w", asURL.Redacted(), err)
 			}
-			return nil, nil
+			return nil, nil, nil
 		}
+		body = f
+		fetch.FetchedAt = time.Now()
 	case "https", "http":
+		if err := checkFetch(opts.fetchPolicies, asURL); err != nil {
+			return nil, nil, err
+		}
 		client := opts.httpClient
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, asURL.String(), nil)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		// if the repo URL contains HTTP Basic Auth credentials, add them to the request
-		if asURL.User != nil {
-			user := asURL.User.Username()
-			pass, _ := asURL.User.Password()
-			req.SetBasicAuth(user, pass)
-		} else if a, ok := opts.auth[asURL.Host]; ok && a.user != "" || a.pass != "" {
-			req.SetBasicAuth(a.user, a.pass)
+		opts.authorize(req, asURL)
+
+		// a verifier checks the whole index as it was published, which a delta is not
+		if opts.deltaDir != "" && opts.verifier == nil {
+			store, err := newIndexDeltaStore(opts.deltaDir, asURL)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid delta cache path based on URL: %w", err)
+			}
+			deltas = &indexDeltaFetch{store: store}
+			deltas.request(req)
 		}
 
 		// This will return a body that retries requests using Range requests if Read() hits an error.
 		rrt := newRangeRetryTransport(ctx, client)
 		res, err := rrt.RoundTrip(req)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get repository index at %s: %w", asURL.Redacted(), err)
+			return nil, nil, fmt.Errorf("unable to get repository index at %s: %w", asURL.Redacted(), err)
+		}
+		if deltas != nil && deltas.base != nil && (res.StatusCode == http.StatusNotModified || res.StatusCode == http.StatusIMUsed) {
+			body, etag, err = deltas.response(res)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to get repository index delta at %s: %w", asURL.Redacted(), err)
+			}
+			fetch.ETag = etag
+			fetch.FetchedAt = time.Now()
+			fetch.FromCache = deltas.delta == nil
+			fetch.Delta = deltas.delta != nil
+			break
 		}
 		switch res.StatusCode {
 		case http.StatusOK:
 			// this is fine
 		case http.StatusNotFound:
-			return nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, asURL.Redacted())
+			res.Body.Close()
+			return nil, nil, fmt.Errorf("repository index not found for architecture %s at %s", arch, asURL.Redacted())
 		default:
-			return nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, asURL.Redacted())
+			res.Body.Close()
+			return nil, nil, fmt.Errorf("unexpected status code %d when getting repository index for architecture %s at %s", res.StatusCode, arch, asURL.Redacted())
 		}
-		defer res.Body.Close()
-		buf := bytes.NewBuffer(nil)
-		if _, err := io.Copy(buf, res.Body); err != nil {
-			return nil, fmt.Errorf("unable to read repository index at %s: %w", asURL.Redacted(), err)
+		body = res.Body
+		etag, _ = etagFromResponse(res)
+		if deltas != nil {
+			body, etag, _ = deltas.response(res)
 		}
-		b = buf.Bytes()
+		fetch.ETag = etag
+		fetch.LastModified = res.Header.Get("Last-Modified")
+		fetch.FetchedAt = time.Now()
+		fetch.FromCache = res.Header.Get(cacheHitHeader) != ""
+		fetch.CacheFile = res.Header.Get(cacheFileHeader)
 	default:
-		return nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+		return nil, nil, fmt.Errorf("repository scheme %s not supported", asURL.Scheme)
+	}
+	defer body.Close()
+
+	// Hash, verify and parse the index in one pass over the body, unless we have already parsed the same
+	// thing, which we can only know up front when it has a strong etag. A weak one, or a Last-Modified,
+	// does not promise that the contents are the same.
+	var key string
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		key = parsedKey("etag:"+asURL.Redacted()+":"+etag, opts.lazy)
+	}
+	var index *APKIndex
+	if key != "" {
+		index = globalIndexCache.lookup(key)
+	}
+	check := shouldCheckSignatureForIndex(u, arch, opts)
+	verify := check && (opts.verifier == nil || !opts.verifierOnly)
+	read, err := readIndex(body, verify, index == nil, opts.lazy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read repository index at %s: %w", asURL.Redacted(), err)
 	}
 
-	// validate the signature
-	if shouldCheckSignatureForIndex(u, arch, opts) {
-		buf := bytes.NewReader(b)
-		gzipReader, err := gzip.NewReader(buf)
+	// validate the signature before the index is used, or its parse errors reported
+	if verify {
+		if keys == nil {
+			return nil, nil, withKind(ErrSignatureInvalid, errors.New("no keys provided to verify signature"))
+		}
+		fetch.Verifications, err = read.verify(keys, opts.signatureThreshold)
 		if err != nil {
-			return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+			return nil, nil, err
+		}
+		fetch.Verification = fetch.Verifications[0]
+		if fetch.CacheFile != "" {
+			if err := recordCacheVerification(fetch.CacheFile, fetch.Verification); err != nil {
+				clog.FromContext(ctx).Debugf("unable to record the verification of %s in the cache: %v", asURL.Redacted(), err)
+			}
+		}
+		if deltas != nil {
+			if err := deltas.verify(keys, opts.signatureThreshold); err != nil {
+				return nil, nil, fmt.Errorf("unable to update repository index at %s: %w", asURL.Redacted(), err)
+			}
+		}
+	}
+	if check && opts.verifier != nil {
+		artifact := &IndexArtifact{
+			URL:    asURL.Redacted(),
+			Digest: read.contentDigest,
+			fetch: func(ctx context.Context, name string) (io.ReadCloser, error) {
+				return fetchNextToIndex(ctx, u, asURL, name, opts)
+			},
+		}
+		if err := opts.verifier.VerifyIndex(ctx, artifact); err != nil {
+			return nil, nil, withKind(ErrSignatureInvalid, fmt.Errorf("unable to verify repository index at %s: %w", asURL.Redacted(), err))
 		}
+	}
+	if read.parseErr != nil {
+		return nil, nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", asURL.Redacted(), read.parseErr)
+	}
+	if index == nil {
+		index = read.index
+		if deltas != nil {
+			if index, err = deltas.apply(index); err != nil {
+				return nil, nil, fmt.Errorf("unable to update repository index at %s: %w", asURL.Redacted(), err)
+			}
+		}
+	}
+	if deltas != nil {
+		if err := deltas.save(); err != nil {
+			clog.FromContext(ctx).Warnf("unable to keep repository index at %s for deltas: %v", asURL.Redacted(), err)
+		}
+	}
+	if key == "" {
+		key = parsedKey(fmt.Sprintf("sha256:%x", read.contentDigest), opts.lazy)
+	}
+
+	return globalIndexCache.store(u, key, index), fetch, nil
+}
+
+// authorize adds the HTTP Basic Auth credentials for u to req, those in u itself or else those for its host.
+func (o *indexOpts) authorize(req *http.Request, u *url.URL) {
+	if u.User != nil {
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		req.SetBasicAuth(user, pass)
+	} else if a, ok := o.auth[u.Host]; ok && a.user != "" || a.pass != "" {
+		req.SetBasicAuth(a.user, a.pass)
+	}
+}
+
+// fetchNextToIndex returns the file called name next to the index at u, parsed as asURL, fetched as the index
+// is, see IndexArtifact.Fetch.
+func fetchNextToIndex(ctx context.Context, u string, asURL *url.URL, name string, opts *indexOpts) (io.ReadCloser, error) {
+	if asURL.Scheme == "file" {
+		return os.Open(filepath.Join(filepath.Dir(u), name))
+	}
+	next := *asURL
+	next.Path = path.Join(path.Dir(asURL.Path), name)
+	next.RawPath = ""
+	if err := checkFetch(opts.fetchPolicies, &next); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, next.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	opts.authorize(req, &next)
+	res, err := opts.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s: %w", next.Redacted(), err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d when getting %s", res.StatusCode, next.Redacted())
+	}
+	return res.Body, nil
+}
+
+// indexRead is what readIndex found in the archive of an index.
+type indexRead struct {
+	// index is the parsed index, nil if it was not parsed
+	index *APKIndex
+	// parseErr is why the index could not be parsed, which is only reported once its signature is verified
+	parseErr error
+
+	// keyName, scheme and signature are of the first signature of the index, if it was verified
+	keyName   string
+	scheme    sign.Scheme
+	signature []byte
+	// signatures are all the signatures of the index, if it was verified, the first one included
+	signatures []indexSignature
+	// signedDigest is the SHA1 digest of the signed part of the archive, everything after the signature
+	signedDigest []byte
+	// contentDigest is the SHA256 digest of the whole archive
+	contentDigest []byte
+}
+
+// indexSignature is a signature of an index by one key.
+type indexSignature struct {
+	keyName   string
+	scheme    sign.Scheme
+	signature []byte
+}
+
+// verify verifies the signatures of the index with keys, returning which key verified each one that it
+// counted. With a threshold above 1, the index must be signed by that many different keys; otherwise the
+// first signature that any of the keys verifies will do, as with apk-tools.
+func (r *indexRead) verify(keys map[string][]byte, threshold int) ([]*Verification, error) {
+	threshold = max(threshold, 1)
+	// so that no key counts twice
+	unused := maps.Clone(keys)
+	var (
+		verifications []*Verification
+		firstErr      error
+	)
+	for _, s := range r.signatures {
+		verification, err := verifyIndexSignature(s.keyName, s.scheme, r.signedDigest, s.signature, unused)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delete(unused, verification.KeyName)
+		if slices.ContainsFunc(verifications, func(v *Verification) bool { return v.Fingerprint == verification.Fingerprint }) {
+			// the same key under another name
+			continue
+		}
+		verifications = append(verifications, verification)
+		if len(verifications) == threshold {
+			return verifications, nil
+		}
+	}
+	if threshold == 1 {
+		return nil, firstErr
+	}
+	return nil, withKind(ErrSignatureInvalid, fmt.Errorf("index is signed by %d of the keys, %d are needed", len(verifications), threshold))
+}
+
+// indexHashes hashes the bytes of an index archive as they are read from its source: all of them, and those
+// after the signature once signed is set.
+type indexHashes struct {
+	content hash.Hash
+	signed  hash.Hash
+}
+
+func (h *indexHashes) Write(p []byte) (int, error) {
+	h.content.Write(p)
+	if h.signed != nil {
+		h.signed.Write(p)
+	}
+	return len(p), nil
+}
+
+// readIndex reads the archive of an index from r in a single pass, hashing it as it goes, reading the signature
+// from the first gzip stream if verify is set, and parsing the index that follows if parse is set.
+func readIndex(r io.Reader, verify, parse, lazy bool) (*indexRead, error) {
+	hashes := &indexHashes{content: sha256.New()}
+	// gzip reads exactly the bytes of each stream from a reader that is an io.ByteReader, so what the buffer
+	// holds past the end of the signature, and all it reads after that, is what was signed.
+	br := bufio.NewReader(io.TeeReader(r, hashes))
+
+	read := &indexRead{}
+	// whether there is nothing after the signature
+	var empty bool
+	gzipReader, err := gzpool.GetReader(br)
+	defer gzpool.PutReader(gzipReader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
+	}
+	defer gzipReader.Close()
+
+	if verify {
 		// set multistream to false, so we can read each part separately;
 		// the first part is the signature, the second is the index, which should be
 		// verified.
 		gzipReader.Multistream(false)
-		defer gzipReader.Close()
-
 		tarReader := tar.NewReader(gzipReader)
 
-		// read the signature
+		// read the signature, and those of any other keys that signed the index as well
 		signatureFile, err := tarReader.Next()
 		if err != nil {
 			return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
 		}
-		matches := signatureFileRegex.FindStringSubmatch(signatureFile.Name)
-		if len(matches) != 2 {
-			return nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
-		}
-		signature, err := io.ReadAll(tarReader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
+		for signatureFile != nil {
+			keyName, scheme, ok := sign.ParseSignatureName(signatureFile.Name)
+			if !ok && len(read.signatures) == 0 {
+				return nil, fmt.Errorf("failed to find key name in signature file name: %s", signatureFile.Name)
+			}
+			signature, err := io.ReadAll(tarReader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read signature from repository index: %w", err)
+			}
+			if ok {
+				read.signatures = append(read.signatures, indexSignature{keyName: keyName, scheme: scheme, signature: signature})
+			}
+			// with multistream false, we should read the next one
+			if signatureFile, err = tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
+			}
 		}
-		// with multistream false, we should read the next one
-		if _, err := tarReader.Next(); err != nil && !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("unexpected error reading from tgz: %w", err)
+		read.keyName, read.scheme, read.signature = read.signatures[0].keyName, read.signatures[0].scheme, read.signatures[0].signature
+
+		hashes.signed = sha1.New() //nolint:gosec // signatures of indexes are over SHA1 digests
+		buffered, _ := br.Peek(br.Buffered())
+		hashes.signed.Write(buffered)
+		// the rest is the index, if there is anything
+		if err := gzipReader.Reset(br); errors.Is(err, io.EOF) {
+			empty = true
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to create gzip reader for repository index: %w", err)
 		}
-		// we now have the signature bytes and name, get the contents of the rest;
-		// this should be everything else in the raw gzip file as is.
-		allBytes := len(b)
-		unreadBytes := buf.Len()
-		readBytes := allBytes - unreadBytes
-		indexData := b[readBytes:]
+	}
 
-		indexDigest, err := sign.HashData(indexData)
-		if err != nil {
-			return nil, err
-		}
-		// now we can check the signature
-		if keys == nil {
-			return nil, fmt.Errorf("no keys provided to verify signature")
-		}
-		var verified bool
-		keyData, ok := keys[matches[1]]
-		if ok {
-			if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err != nil {
-				verified = false
-			}
-		}
-		if !verified {
-			for _, keyData := range keys {
-				if err := sign.RSAVerifySHA1Digest(indexDigest, signature, keyData); err == nil {
-					verified = true
-					break
-				}
+	if parse {
+		read.index = &APKIndex{Signature: read.signature}
+		if !empty {
+			if err := read.index.readTar(tar.NewReader(gzipReader), lazy); err != nil {
+				read.index, read.parseErr = nil, err
 			}
 		}
-		if !verified {
-			return nil, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", matches[1])
-		}
 	}
-	// with a valid signature, convert it to an ApkIndex
-	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
-	if err != nil {
-		return nil, fmt.Errorf("unable to read convert repository index bytes to index struct at %s: %w", asURL.Redacted(), err)
+	// whatever was not parsed still has to be hashed
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return nil, err
 	}
 
-	return index, err
+	read.contentDigest = hashes.content.Sum(nil)
+	if hashes.signed != nil {
+		read.signedDigest = hashes.signed.Sum(nil)
+	}
+	return read, nil
+}
+
+// verifyIndexSignature finds the key that made signature over indexDigest, trying the key the signature
+// is named after first, and then all the other keys, by name.
+func verifyIndexSignature(keyName string, scheme sign.Scheme, indexDigest, signature []byte, keys map[string][]byte) (*Verification, error) {
+	names := []string{}
+	if _, ok := keys[keyName]; ok {
+		names = append(names, keyName)
+	}
+	others := maps.Keys(keys)
+	slices.Sort(others)
+	for _, name := range others {
+		if name != keyName {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		if err := sign.RSAVerifySHA1DigestWithScheme(indexDigest, signature, keys[name], scheme); err != nil {
+			continue
+		}
+		fingerprint, err := sign.KeyFingerprint(keys[name])
+		if err != nil {
+			return nil, err
+		}
+		return &Verification{KeyName: name, Fingerprint: fingerprint, Scheme: scheme}, nil
+	}
+	return nil, withKind(ErrSignatureInvalid, fmt.Errorf("no key found to verify signature for keyfile %s; tried all other keys as well", keyName))
 }
 
 type indexOpts struct {
@@ -321,6 +860,16 @@ type indexOpts struct {
 	noSignatureIndexes []string
 	httpClient         *http.Client
 	auth               map[string]auth
+	priorities         map[string]int
+	layouts            map[string]string
+	keys               map[string]map[string][]byte
+	partialResults     bool
+	lazy               bool
+	deltaDir           string
+	verifier           IndexVerifier
+	verifierOnly       bool
+	signatureThreshold int
+	fetchPolicies      []FetchPolicy
 }
 type IndexOption func(*indexOpts)
 
@@ -342,6 +891,100 @@ func WithHTTPClient(c *http.Client) IndexOption {
 	}
 }
 
+// WithIndexFetchPolicy denies fetching the indexes that policy denies, and what is next to them, with an
+// ErrFetchDenied error, before any request is made for them. Each policy is asked in addition to those of
+// earlier options. Redirects are only checked by the client, see WithFetchPolicy.
+func WithIndexFetchPolicy(policy FetchPolicy) IndexOption {
+	return func(o *indexOpts) {
+		o.fetchPolicies = append(o.fetchPolicies, policy)
+	}
+}
+
+// WithIndexPriority sets the priority of the repository at repo, without any @tag, to break ties
+// when the same version of a package is in several repositories. See PrioritizedIndex.
+func WithIndexPriority(repo string, priority int) IndexOption {
+	return func(o *indexOpts) {
+		if o.priorities == nil {
+			o.priorities = make(map[string]int)
+		}
+		o.priorities[repo] = priority
+	}
+}
+
+// WithIndexLayout sets the layout of the repository at repo, without any @tag, for repositories that do
+// not have a directory for each architecture. See RepositoryURL.
+func WithIndexLayout(repo, layout string) IndexOption {
+	return func(o *indexOpts) {
+		if o.layouts == nil {
+			o.layouts = make(map[string]string)
+		}
+		o.layouts[repo] = layout
+	}
+}
+
+// WithIndexKeys sets the only keys that can verify the signature of the index of the repository at repo,
+// without any @tag, instead of the keys passed to GetRepositoryIndexes, so that the keys of one repository
+// cannot vouch for another. The keys are by name, as the keys passed to GetRepositoryIndexes.
+func WithIndexKeys(repo string, keys map[string][]byte) IndexOption {
+	return func(o *indexOpts) {
+		if o.keys == nil {
+			o.keys = make(map[string]map[string][]byte)
+		}
+		o.keys[repo] = keys
+	}
+}
+
+// WithIndexPartialResults sets whether GetRepositoryIndexes goes on with the other repositories when the index
+// of one cannot be read, returning the indexes it could read together with a *RepositoryIndexErrors describing
+// the repositories that failed.
+func WithIndexPartialResults(partial bool) IndexOption {
+	return func(o *indexOpts) {
+		o.partialResults = partial
+	}
+}
+
+// WithIndexLazyParsing sets whether the packages of the indexes are parsed lazily, see IndexFromArchiveLazy.
+// The package resolver materializes the packages it selects, but other users of the indexes must call
+// RepositoryPackage.Materialize before reading fields other than those needed for resolution.
+func WithIndexLazyParsing(lazy bool) IndexOption {
+	return func(o *indexOpts) {
+		o.lazy = lazy
+	}
+}
+
+// WithIndexDeltaDir sets the directory to keep the indexes of HTTP repositories in, so that the next time only
+// the changes since are fetched, from a server that offers deltas from them. The server is asked for the index
+// with If-None-Match set to the etag of the index that is kept, and an A-IM of apkindex-delta, as in RFC
+// 3229, and may answer with 226 IM Used and the signed archive of the IndexDelta to its current index, see
+// ArchiveFromIndexDelta, which is verified with the keys of the index. Any other answer is as without deltas.
+// Only an index fetched in full is kept, so the server sends the delta from it until it sends all of it again.
+func WithIndexDeltaDir(dir string) IndexOption {
+	return func(o *indexOpts) {
+		o.deltaDir = dir
+	}
+}
+
+// WithIndexSignatureThreshold sets how many of the keys must have signed each index whose signature is checked,
+// for indexes signed by several keys, see sign.SignIndexWithSigners. By default, and with a threshold of 1 or
+// less, any one of the keys that verifies a signature of the index will do. The keys are counted once each,
+// however many signatures they made, or names they are under.
+func WithIndexSignatureThreshold(threshold int) IndexOption {
+	return func(o *indexOpts) {
+		o.signatureThreshold = threshold
+	}
+}
+
+// WithIndexVerifier sets a verifier that every index whose signature is checked must also pass, such as one
+// for the cosign signature of the index, see IndexVerifier. With only set, the verifier is checked instead of
+// the RSA signature embedded in the index, so that the index need not be signed with any of the keys at all.
+// Indexes that are checked by a verifier are always fetched in full, see WithIndexDeltaDir.
+func WithIndexVerifier(verifier IndexVerifier, only bool) IndexOption {
+	return func(o *indexOpts) {
+		o.verifier = verifier
+		o.verifierOnly = only
+	}
+}
+
 func WithIndexAuth(domain, user, pass string) IndexOption {
 	return func(o *indexOpts) {
 		if o.auth == nil {
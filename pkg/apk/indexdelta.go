@@ -0,0 +1,347 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
+)
+
+// removedFilename is the file of the archive of an IndexDelta with the entries of the packages it removes.
+const removedFilename = "REMOVED"
+
+// IndexDelta is what changed from one index to another, so that a client with the old index only needs the
+// changes to get the new one. A repository can offer deltas from the indexes it published before, see
+// WithIndexDeltaDir.
+type IndexDelta struct {
+	// Added are the packages of the new index that the old one does not have.
+	Added []*Package
+	// Removed are the packages of the old index that the new one does not have.
+	Removed []*Package
+	// Description is that of the new index.
+	Description string
+}
+
+// indexEntryKey identifies a package of an index, by its name, version and checksum, which is that of the
+// build of the package.
+func indexEntryKey(pkg *Package) string {
+	return pkg.Name + "\x00" + pkg.Version + "\x00" + string(pkg.Checksum)
+}
+
+// DiffIndexes returns the delta from the index from to the index to.
+func DiffIndexes(from, to *APKIndex) (*IndexDelta, error) {
+	inFrom := make(map[string]bool, len(from.Packages))
+	for _, pkg := range from.Packages {
+		inFrom[indexEntryKey(pkg)] = true
+	}
+	inTo := make(map[string]bool, len(to.Packages))
+	delta := &IndexDelta{Description: to.Description}
+	for _, pkg := range to.Packages {
+		key := indexEntryKey(pkg)
+		inTo[key] = true
+		if inFrom[key] {
+			continue
+		}
+		if err := to.Materialize(pkg); err != nil {
+			return nil, err
+		}
+		delta.Added = append(delta.Added, pkg)
+	}
+	for _, pkg := range from.Packages {
+		if !inTo[indexEntryKey(pkg)] {
+			delta.Removed = append(delta.Removed, pkg)
+		}
+	}
+	return delta, nil
+}
+
+// Apply returns a copy of idx with the changes of the delta, which fails if idx does not have a package that
+// the delta removes, as it is not the index the delta is from. The packages of idx come first, in its order,
+// and then those the delta adds, so the order may not be that of the index the delta is to. The copy has no
+// signature.
+func (d *IndexDelta) Apply(idx *APKIndex) (*APKIndex, error) {
+	removed := make(map[string]bool, len(d.Removed))
+	for _, pkg := range d.Removed {
+		removed[indexEntryKey(pkg)] = true
+	}
+	applied := &APKIndex{
+		Description: d.Description,
+		Packages:    make([]*Package, 0, len(idx.Packages)+len(d.Added)-len(d.Removed)),
+		lazy:        idx.lazy,
+	}
+	found := make(map[string]bool, len(removed))
+	for _, pkg := range idx.Packages {
+		if key := indexEntryKey(pkg); removed[key] {
+			found[key] = true
+			continue
+		}
+		applied.Packages = append(applied.Packages, pkg)
+	}
+	if len(found) != len(removed) {
+		return nil, fmt.Errorf("index has %d of the %d packages that the delta removes, it is not the index the delta is from", len(found), len(removed))
+	}
+	applied.Packages = append(applied.Packages, d.Added...)
+	return applied, nil
+}
+
+// ArchiveFromIndexDelta returns the archive of the delta, which is as that of an index, with an APKINDEX that
+// has the packages the delta adds, a REMOVED in the same format with those it removes, and a DESCRIPTION. It
+// is signed as an index is, see signature.SignIndex.
+func ArchiveFromIndexDelta(delta *IndexDelta, options ...ArchiveOption) (io.Reader, error) {
+	// the packages of DiffIndexes are already materialized
+	added, err := indexEntries(&APKIndex{}, delta.Added)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := indexEntries(&APKIndex{}, delta.Removed)
+	if err != nil {
+		return nil, err
+	}
+	return archiveIndexFiles([]indexArchiveFile{
+		{apkIndexFilename, added},
+		{removedFilename, removed},
+		{descriptionFilename, []byte(delta.Description)},
+	}, options)
+}
+
+// IndexDeltaFromArchive parses the archive of a delta, as ArchiveFromIndexDelta writes it, skipping its
+// signature, if it has one. It does not verify the signature.
+func IndexDeltaFromArchive(archive io.ReadCloser) (*IndexDelta, error) {
+	gzipReader, err := gzpool.GetReader(archive)
+	defer gzpool.PutReader(gzipReader)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	delta := &IndexDelta{}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			return delta, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch hdr.Name {
+		case apkIndexFilename:
+			if delta.Added, err = ParsePackageIndex(tarReader); err != nil {
+				return nil, fmt.Errorf("parsing added packages of delta: %w", err)
+			}
+		case removedFilename:
+			if delta.Removed, err = ParsePackageIndex(tarReader); err != nil {
+				return nil, fmt.Errorf("parsing removed packages of delta: %w", err)
+			}
+		case descriptionFilename:
+			description, err := io.ReadAll(tarReader)
+			if err != nil {
+				return nil, err
+			}
+			delta.Description = string(description)
+		default:
+			if !strings.HasPrefix(hdr.Name, ".SIGN.") {
+				return nil, fmt.Errorf("unexpected file found in index delta: %s", hdr.Name)
+			}
+		}
+	}
+}
+
+// indexDeltaIM is how the deltas of indexes are asked for and sent, as the A-IM and IM headers of RFC 3229,
+// delta encoding in HTTP. The client asks for the index with If-None-Match set to the etag of the index it
+// has, and A-IM set to this. A server that can make a delta from it answers with 226 IM Used, the archive of
+// the delta from it to the current index, see ArchiveFromIndexDelta, signed, and the etag of the current
+// index. A server that cannot answers with the whole index, as it would without A-IM.
+const indexDeltaIM = "apkindex-delta"
+
+// indexDeltasCacheDir is the directory under the cache root of the indexes that deltas are asked from, see
+// WithIndexDeltas. Like packagesCacheDir, it cannot be an escaped URL.
+const indexDeltasCacheDir = "index-deltas"
+
+// indexDeltaStore keeps the archive of the last index of a URL that was fetched in full, the base that deltas
+// are asked from, once its signature is verified. The archive is named by the digest of its ETag header, which
+// may be weak or have any characters in it, and the header is kept next to it, with etagFileExt.
+type indexDeltaStore struct {
+	dir string
+}
+
+// etagFileExt is the extension of the file with the ETag header of a base, next to its archive.
+const etagFileExt = ".etag"
+
+func newIndexDeltaStore(root string, u *url.URL) (*indexDeltaStore, error) {
+	p, err := cachePathFromURL(root, *u)
+	if err != nil {
+		return nil, err
+	}
+	return &indexDeltaStore{dir: cacheDirFromFile(p)}, nil
+}
+
+// read returns the archive of the base and its ETag header, or nil if there is none.
+func (s *indexDeltaStore) read() ([]byte, string) {
+	matches, _ := filepath.Glob(filepath.Join(s.dir, "*.tar.gz"))
+	if len(matches) == 0 {
+		return nil, ""
+	}
+	header, err := os.ReadFile(matches[0] + etagFileExt)
+	if err != nil || len(header) == 0 {
+		return nil, ""
+	}
+	b, err := os.ReadFile(matches[0])
+	if err != nil {
+		return nil, ""
+	}
+	return b, string(header)
+}
+
+// write replaces the base with archive, of the index with the ETag header.
+func (s *indexDeltaStore) write(archive []byte, header string) error {
+	sum := sha256.Sum256([]byte(header))
+	name := filepath.Join(s.dir, hex.EncodeToString(sum[:])+".tar.gz")
+	// the header goes first, so that the archive is never read without it
+	if err := writeFileAtomic(name+etagFileExt, []byte(header)); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(name, archive); err != nil {
+		return err
+	}
+	matches, _ := filepath.Glob(filepath.Join(s.dir, "*.tar.gz"))
+	var errs []error
+	for _, m := range matches {
+		if m != name {
+			errs = append(errs, os.Remove(m))
+			if err := os.Remove(m + etagFileExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// indexDeltaFetch is an index fetched with deltas, see indexDeltaIM.
+type indexDeltaFetch struct {
+	store *indexDeltaStore
+	// base is the archive of the index the delta is from, baseHeader its ETag header and baseEtag its etag
+	base       []byte
+	baseHeader string
+	baseEtag   string
+	// delta is the archive of the delta the server sent, if it did
+	delta []byte
+	// full has the archive of the index as it is read, when the server sent all of it, and fullHeader its
+	// ETag header
+	full       *bytes.Buffer
+	fullHeader string
+}
+
+// request asks for a delta from the base in the store, if there is one.
+func (f *indexDeltaFetch) request(req *http.Request) {
+	f.base, f.baseHeader = f.store.read()
+	if f.base == nil {
+		return
+	}
+	f.baseEtag = etagFromHeader(f.baseHeader)
+	req.Header.Set("If-None-Match", f.baseHeader)
+	req.Header.Set("A-IM", indexDeltaIM)
+}
+
+// response returns the archive of the index of res, the index itself or the base, and the etag of the
+// index. A delta in res is only read, it is applied once its base is verified and parsed, see apply.
+func (f *indexDeltaFetch) response(res *http.Response) (io.ReadCloser, string, error) {
+	etag, _ := etagFromResponse(res)
+	switch {
+	case res.StatusCode == http.StatusNotModified && f.base != nil:
+		res.Body.Close()
+		return io.NopCloser(bytes.NewReader(f.base)), f.baseEtag, nil
+	case res.StatusCode == http.StatusIMUsed && f.base != nil:
+		defer res.Body.Close()
+		if im := res.Header.Get("IM"); im != indexDeltaIM {
+			return nil, "", fmt.Errorf("unexpected delta encoding %q", im)
+		}
+		if base := etagFromHeader(res.Header.Get("Delta-Base")); base != "" && base != f.baseEtag {
+			return nil, "", fmt.Errorf("delta is from %s, not from the index %s", base, f.baseEtag)
+		}
+		if etag == "" {
+			return nil, "", errors.New("delta without the etag of the index it is to")
+		}
+		delta, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading delta: %w", err)
+		}
+		f.delta = delta
+		return io.NopCloser(bytes.NewReader(f.base)), etag, nil
+	}
+	if etag != "" {
+		f.full, f.fullHeader = &bytes.Buffer{}, res.Header.Get("ETag")
+		return &teeReadCloser{Reader: io.TeeReader(res.Body, f.full), Closer: res.Body}, etag, nil
+	}
+	return res.Body, etag, nil
+}
+
+// verify verifies the signatures of the delta the server sent, if it did, as those of the index are, see
+// WithIndexSignatureThreshold.
+func (f *indexDeltaFetch) verify(keys map[string][]byte, threshold int) error {
+	if f.delta == nil {
+		return nil
+	}
+	read, err := readIndex(bytes.NewReader(f.delta), true, false, false)
+	if err != nil {
+		return fmt.Errorf("reading delta: %w", err)
+	}
+	if _, err := read.verify(keys, threshold); err != nil {
+		return fmt.Errorf("verifying delta: %w", err)
+	}
+	return nil
+}
+
+// apply returns the index with the delta the server sent applied to base, the parsed index of the base.
+func (f *indexDeltaFetch) apply(base *APKIndex) (*APKIndex, error) {
+	if f.delta == nil {
+		return base, nil
+	}
+	delta, err := IndexDeltaFromArchive(io.NopCloser(bytes.NewReader(f.delta)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing delta: %w", err)
+	}
+	index, err := delta.Apply(base)
+	if err != nil {
+		return nil, fmt.Errorf("applying delta: %w", err)
+	}
+	return index, nil
+}
+
+// save keeps the index as the new base, once it is verified, if it was sent in full.
+func (f *indexDeltaFetch) save() error {
+	if f.full == nil {
+		return nil
+	}
+	return f.store.write(f.full.Bytes(), f.fullHeader)
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func testDeltaPackage(name, version string) *Package {
+	return &Package{Name: name, Version: version, Arch: "x86_64", Checksum: []byte(name + "-" + version), Description: name}
+}
+
+func packageFilenames(pkgs []*Package) []string {
+	names := make([]string, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Filename())
+	}
+	return names
+}
+
+func TestDiffIndexes(t *testing.T) {
+	from := &APKIndex{Description: "v1", Packages: []*Package{
+		testDeltaPackage("foo", "1.0-r0"),
+		testDeltaPackage("bar", "1.0-r0"),
+		testDeltaPackage("baz", "1.0-r0"),
+	}}
+	rebuilt := testDeltaPackage("baz", "1.0-r0")
+	rebuilt.Checksum = []byte("rebuilt")
+	to := &APKIndex{Description: "v2", Packages: []*Package{
+		testDeltaPackage("foo", "1.0-r0"),
+		testDeltaPackage("foo", "1.1-r0"),
+		rebuilt,
+	}}
+
+	delta, err := DiffIndexes(from, to)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-1.1-r0.apk", "baz-1.0-r0.apk"}, packageFilenames(delta.Added))
+	require.Equal(t, []string{"bar-1.0-r0.apk", "baz-1.0-r0.apk"}, packageFilenames(delta.Removed))
+
+	// the delta is the same once archived and parsed again
+	archive, err := ArchiveFromIndexDelta(delta)
+	require.NoError(t, err)
+	parsed, err := IndexDeltaFromArchive(io.NopCloser(archive))
+	require.NoError(t, err)
+	require.Equal(t, "v2", parsed.Description)
+	require.Equal(t, packageFilenames(delta.Added), packageFilenames(parsed.Added))
+	require.Equal(t, packageFilenames(delta.Removed), packageFilenames(parsed.Removed))
+	require.Equal(t, []byte("rebuilt"), parsed.Added[1].Checksum)
+
+	applied, err := parsed.Apply(from)
+	require.NoError(t, err)
+	require.Equal(t, "v2", applied.Description)
+	require.ElementsMatch(t, packageFilenames(to.Packages), packageFilenames(applied.Packages))
+	require.Len(t, from.Packages, 3, "the index the delta is applied to is not changed")
+
+	// the delta is only from the index it was made from
+	_, err = parsed.Apply(to)
+	require.ErrorContains(t, err, "not the index the delta is from")
+}
+
+func TestIndexDeltaFetch(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, pub := testSigningKey(t, dir, "test.rsa")
+	keys := map[string][]byte{"test.rsa.pub": pub}
+	signer, err := sign.NewKeySigner(keyFile)
+	require.NoError(t, err)
+	signed := func(t *testing.T, archive io.Reader) []byte {
+		f := filepath.Join(t.TempDir(), indexFilename)
+		b, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(f, b, 0o644))
+		require.NoError(t, sign.SignIndexWithSigner(context.Background(), signer, f))
+		b, err = os.ReadFile(f)
+		require.NoError(t, err)
+		return b
+	}
+
+	v1 := &APKIndex{Packages: []*Package{testDeltaPackage("foo", "1.0-r0"), testDeltaPackage("bar", "1.0-r0")}}
+	v2 := &APKIndex{Packages: []*Package{testDeltaPackage("foo", "1.1-r0"), testDeltaPackage("bar", "1.0-r0")}}
+	archives := map[string][]byte{}
+	for etag, idx := range map[string]*APKIndex{"v1": v1, "v2": v2} {
+		archive, err := ArchiveFromIndex(idx)
+		require.NoError(t, err)
+		archives[etag] = signed(t, archive)
+	}
+	delta, err := DiffIndexes(v1, v2)
+	require.NoError(t, err)
+	deltaArchive, err := ArchiveFromIndexDelta(delta)
+	require.NoError(t, err)
+	deltas := map[string][]byte{"v1": signed(t, deltaArchive)}
+
+	var (
+		mu      sync.Mutex
+		current = "v1"
+		sent    []string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", `"`+current+`"`)
+		have := r.Header.Get("If-None-Match")
+		switch {
+		case have == `"`+current+`"`:
+			sent = append(sent, "not modified")
+			w.WriteHeader(http.StatusNotModified)
+		case r.Header.Get("A-IM") == indexDeltaIM && deltas[have[1:len(have)-1]] != nil && current == "v2":
+			sent = append(sent, "delta")
+			w.Header().Set("IM", indexDeltaIM)
+			w.Header().Set("Delta-Base", have)
+			w.WriteHeader(http.StatusIMUsed)
+			_, _ = w.Write(deltas[have[1:len(have)-1]])
+		default:
+			sent = append(sent, "full "+current)
+			_, _ = w.Write(archives[current])
+		}
+	}))
+	defer s.Close()
+
+	opts := &indexOpts{httpClient: s.Client(), deltaDir: filepath.Join(dir, "deltas")}
+	u := s.URL + "/main/x86_64/" + indexFilename
+	get := func(t *testing.T) (*APKIndex, *IndexFetch) {
+		t.Helper()
+		index, fetch, err := getRepositoryIndex(context.Background(), u, keys, "x86_64", opts)
+		require.NoError(t, err)
+		return index, fetch
+	}
+
+	index, fetch := get(t)
+	require.Equal(t, []string{"foo-1.0-r0.apk", "bar-1.0-r0.apk"}, packageFilenames(index.Packages))
+	require.False(t, fetch.Delta)
+	require.False(t, fetch.FromCache)
+
+	index, fetch = get(t)
+	require.Equal(t, []string{"foo-1.0-r0.apk", "bar-1.0-r0.apk"}, packageFilenames(index.Packages))
+	require.True(t, fetch.FromCache)
+
+	mu.Lock()
+	current = "v2"
+	mu.Unlock()
+	index, fetch = get(t)
+	require.ElementsMatch(t, []string{"foo-1.1-r0.apk", "bar-1.0-r0.apk"}, packageFilenames(index.Packages))
+	require.True(t, fetch.Delta)
+	require.Equal(t, "v2", fetch.ETag)
+	require.Equal(t, "test.rsa.pub", fetch.Verification.KeyName)
+
+	// a delta that is not signed by the keys is not applied
+	other, _ := testSigningKey(t, dir, "other.rsa")
+	otherSigner, err := sign.NewKeySigner(other)
+	require.NoError(t, err)
+	signer = otherSigner
+	deltaArchive, err = ArchiveFromIndexDelta(delta)
+	require.NoError(t, err)
+	mu.Lock()
+	deltas["v1"] = signed(t, deltaArchive)
+	mu.Unlock()
+	_, _, err = getRepositoryIndex(context.Background(), u, keys, "x86_64", opts)
+	require.ErrorIs(t, err, ErrSignatureInvalid)
+
+	// a server without deltas sends all of the index, which is the base from then on
+	mu.Lock()
+	delete(deltas, "v1")
+	mu.Unlock()
+	index, fetch = get(t)
+	require.ElementsMatch(t, []string{"foo-1.1-r0.apk", "bar-1.0-r0.apk"}, packageFilenames(index.Packages))
+	require.False(t, fetch.Delta)
+	_, fetch = get(t)
+	require.True(t, fetch.FromCache)
+
+	require.Equal(t, []string{"full v1", "not modified", "delta", "delta", "full v2", "not modified"}, sent)
+}
+
+func TestIndexDeltaStore(t *testing.T) {
+	root := t.TempDir()
+	u, err := url.Parse("https://example.com/main/x86_64/" + indexFilename)
+	require.NoError(t, err)
+	store, err := newIndexDeltaStore(filepath.Join(root, "deltas"), u)
+	require.NoError(t, err)
+
+	b, header := store.read()
+	require.Nil(t, b)
+	require.Empty(t, header)
+
+	for _, header := range []string{`W/"abc"`, `"../../../escaped"`, `"v1/v2"`} {
+		t.Run(header, func(t *testing.T) {
+			require.NoError(t, store.write([]byte(header), header))
+			b, got := store.read()
+			require.Equal(t, header, got)
+			require.Equal(t, header, string(b))
+
+			// the base is in the directory of the URL, and replaces the one before it
+			matches, err := filepath.Glob(filepath.Join(store.dir, "*"))
+			require.NoError(t, err)
+			require.Len(t, matches, 2)
+			var files []string
+			require.NoError(t, filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					files = append(files, p)
+				}
+				return err
+			}))
+			require.ElementsMatch(t, matches, files)
+
+			// the server is asked for deltas from the base with its header as it was sent
+			req := httptest.NewRequest(http.MethodGet, u.String(), nil)
+			fetch := &indexDeltaFetch{store: store}
+			fetch.request(req)
+			require.Equal(t, header, req.Header.Get("If-None-Match"))
+			require.Equal(t, etagFromHeader(header), fetch.baseEtag)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// IndexVerifier verifies the index of a repository in a way other than the RSA signature embedded in it,
+// such as a sigstore signature or attestation published next to it, see WithIndexVerifier. This package
+// only has a verifier for signatures made with a cosign key, see NewCosignKeyVerifier; keyless signatures
+// can be verified with one built on sigstore itself, which this package does not depend on.
+type IndexVerifier interface {
+	// VerifyIndex returns an error if index cannot be verified.
+	VerifyIndex(ctx context.Context, index *IndexArtifact) error
+}
+
+// IndexArtifact is the index of a repository as it was fetched, for an IndexVerifier.
+type IndexArtifact struct {
+	// URL is the URL of the APKINDEX.tar.gz, with any password redacted.
+	URL string
+	// Digest is the SHA256 digest of the whole APKINDEX.tar.gz, which is what cosign signs.
+	Digest []byte
+
+	fetch func(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// Fetch returns the file called name next to the index, e.g. APKINDEX.tar.gz.sig, fetched as the index
+// was, with the same client and credentials.
+func (i *IndexArtifact) Fetch(ctx context.Context, name string) (io.ReadCloser, error) {
+	return i.fetch(ctx, name)
+}
+
+type cosignKeyVerifier struct {
+	publicKey []byte
+}
+
+// NewCosignKeyVerifier returns an IndexVerifier for the signature that cosign sign-blob made of each index
+// with the private key of publicKey, which is next to the index with sign.CosignSignatureExt, as in:
+//
+//	cosign sign-blob --key cosign.key --output-signature APKINDEX.tar.gz.sig APKINDEX.tar.gz
+func NewCosignKeyVerifier(publicKey []byte) (IndexVerifier, error) {
+	if _, err := sign.ParseCosignPublicKey(publicKey); err != nil {
+		return nil, err
+	}
+	return &cosignKeyVerifier{publicKey: publicKey}, nil
+}
+
+func (v *cosignKeyVerifier) VerifyIndex(ctx context.Context, index *IndexArtifact) error {
+	name := indexFilename + sign.CosignSignatureExt
+	rc, err := index.Fetch(ctx, name)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", name, err)
+	}
+	defer rc.Close()
+	signature, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	return sign.CosignVerifySHA256Digest(index.Digest, signature, v.publicKey)
+}
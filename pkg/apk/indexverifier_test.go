@@ -0,0 +1,143 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+// testCosignSign writes the signature of file by key next to it, as cosign sign-blob does.
+func testCosignSign(t *testing.T, file string, key crypto.Signer) {
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	digest := sha256.Sum256(b)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file+sign.CosignSignatureExt, []byte(base64.StdEncoding.EncodeToString(sig)), 0o644))
+}
+
+func testCosignPublicKey(t *testing.T, key crypto.Signer) []byte {
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+func TestIndexVerifier(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyFile, pub := testSigningKey(t, dir, "test.rsa")
+	keys := map[string][]byte{"test.rsa.pub": pub}
+	signer, err := sign.NewKeySigner(keyFile)
+	require.NoError(t, err)
+
+	cosignKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	verifier, err := NewCosignKeyVerifier(testCosignPublicKey(t, cosignKey))
+	require.NoError(t, err)
+
+	// signedIndex returns an index signed by signer if any, and by key if any
+	signedIndex := func(t *testing.T, signer *sign.Signer, key crypto.Signer) string {
+		indexFile := filepath.Join(t.TempDir(), testArch, indexFilename)
+		if signer != nil {
+			testSignedIndex(t, indexFile, signer)
+		} else {
+			archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: "foo", Version: "1.0-r0"}}})
+			require.NoError(t, err)
+			data, err := io.ReadAll(archive)
+			require.NoError(t, err)
+			require.NoError(t, os.MkdirAll(filepath.Dir(indexFile), 0o755))
+			require.NoError(t, os.WriteFile(indexFile, data, 0o644))
+		}
+		if key != nil {
+			testCosignSign(t, indexFile, key)
+		}
+		return indexFile
+	}
+
+	t.Run("in addition", func(t *testing.T) {
+		index, fetch, err := getRepositoryIndex(ctx, signedIndex(t, signer, cosignKey), keys, testArch, &indexOpts{verifier: verifier})
+		require.NoError(t, err)
+		require.Len(t, index.Packages, 1)
+		require.Equal(t, "test.rsa.pub", fetch.Verification.KeyName)
+	})
+	t.Run("in addition without a cosign signature", func(t *testing.T) {
+		_, _, err := getRepositoryIndex(ctx, signedIndex(t, signer, nil), keys, testArch, &indexOpts{verifier: verifier})
+		require.ErrorIs(t, err, ErrSignatureInvalid)
+	})
+	t.Run("in addition without a signature", func(t *testing.T) {
+		_, _, err := getRepositoryIndex(ctx, signedIndex(t, nil, cosignKey), keys, testArch, &indexOpts{verifier: verifier})
+		require.Error(t, err)
+	})
+	t.Run("only", func(t *testing.T) {
+		index, fetch, err := getRepositoryIndex(ctx, signedIndex(t, nil, cosignKey), nil, testArch, &indexOpts{verifier: verifier, verifierOnly: true})
+		require.NoError(t, err)
+		require.Len(t, index.Packages, 1)
+		require.Nil(t, fetch.Verification)
+	})
+	t.Run("other key", func(t *testing.T) {
+		_, _, err := getRepositoryIndex(ctx, signedIndex(t, nil, otherKey), nil, testArch, &indexOpts{verifier: verifier, verifierOnly: true})
+		require.ErrorIs(t, err, ErrSignatureInvalid)
+	})
+	t.Run("ignored signatures", func(t *testing.T) {
+		_, _, err := getRepositoryIndex(ctx, signedIndex(t, nil, nil), nil, testArch, &indexOpts{verifier: verifier, ignoreSignatures: true})
+		require.NoError(t, err)
+	})
+	t.Run("rsa key", func(t *testing.T) {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		verifier, err := NewCosignKeyVerifier(testCosignPublicKey(t, rsaKey))
+		require.NoError(t, err)
+		_, _, err = getRepositoryIndex(ctx, signedIndex(t, nil, rsaKey), nil, testArch, &indexOpts{verifier: verifier, verifierOnly: true})
+		require.NoError(t, err)
+	})
+	t.Run("http", func(t *testing.T) {
+		indexFile := signedIndex(t, signer, cosignKey)
+		s := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir(filepath.Dir(indexFile)))))
+		defer s.Close()
+		_, fetch, err := getRepositoryIndex(ctx, IndexURL(s.URL, testArch), keys, testArch, &indexOpts{httpClient: s.Client(), verifier: verifier})
+		require.NoError(t, err)
+		require.Equal(t, "test.rsa.pub", fetch.Verification.KeyName)
+
+		require.NoError(t, os.Remove(indexFile+sign.CosignSignatureExt))
+		_, _, err = getRepositoryIndex(ctx, IndexURL(s.URL, testArch), keys, testArch, &indexOpts{httpClient: s.Client(), verifier: verifier})
+		require.ErrorIs(t, err, ErrSignatureInvalid)
+		require.ErrorContains(t, err, "404")
+	})
+	t.Run("invalid key", func(t *testing.T) {
+		_, err := NewCosignKeyVerifier(pub[:10])
+		require.Error(t, err)
+	})
+}
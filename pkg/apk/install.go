@@ -25,29 +25,45 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strings"
 
+	"github.com/chainguard-dev/clog"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
 )
 
+// ConflictPolicy determines what happens when a package installs a file over an existing one
+// with different contents, that is not permitted by the origin and replaces rules.
+type ConflictPolicy int
+
+const (
+	// ConflictPolicyError fails the install. This is the default.
+	ConflictPolicyError ConflictPolicy = iota
+	// ConflictPolicyKeepFirst keeps the existing file and silently skips the new one.
+	ConflictPolicyKeepFirst
+	// ConflictPolicyOverwrite replaces the existing file with the new one, like `apk add --force-overwrite`.
+	ConflictPolicyOverwrite
+	// ConflictPolicyReportOnly keeps the existing file and logs a warning for the conflict.
+	ConflictPolicyReportOnly
+)
+
 // writeOneFile writes one file from the APK given the tar header and tar reader.
 func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool) error {
 	// check if the file exists; allow override if the origin i
 	if _, err := a.fs.Stat(header.Name); err == nil {
 		if !allowOverwrite {
 			// get the sum of the file, so we can compare it to the new file
-			w := sha1.New() //nolint:gosec // this is what apk tools is using
-			f, err := a.fs.Open(header.Name)
+			sum, err := a.sha1File(header.Name)
 			if err != nil {
-				return fmt.Errorf("unable to open existing file to calculate sum %s: %w", header.Name, err)
+				return err
 			}
-			defer f.Close()
-			if _, err := io.Copy(w, f); err != nil {
-				return fmt.Errorf("unable to calculate sum of existing file %s: %w", header.Name, err)
-			}
-			return FileExistsError{Path: header.Name, Sha1: w.Sum(nil)}
+			return FileExistsError{Path: header.Name, Sha1: sum}
 		}
 		// allowOverwrite, so remove the file
 		if err := a.fs.Remove(header.Name); err != nil {
@@ -60,25 +76,34 @@ func (a *APK) writeOneFile(header *tar.Header, r io.Reader, allowOverwrite bool)
 	}
 	defer f.Close()
 
-	if _, err := io.CopyN(f, r, header.Size); err != nil {
+	if _, err := copyN(f, r, header.Size); err != nil {
 		return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
 	}
 	// override one of the
 	return nil
 }
 
+// sha1File returns the sha1 of the contents of the file at name, as the installed db records it.
+func (a *APK) sha1File(name string) ([]byte, error) {
+	w := sha1.New() //nolint:gosec // this is what apk tools is using
+	f, err := a.fs.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open existing file to calculate sum %s: %w", name, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, fmt.Errorf("unable to calculate sum of existing file %s: %w", name, err)
+	}
+	return w.Sum(nil), nil
+}
+
 // installRegularFile handles the various error modes of writing a regular file
-func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir string, pkg *Package) (bool, error) {
+func (a *APK) installRegularFile(ctx context.Context, header *tar.Header, tr *tar.Reader, tmpDir string, pkg *Package) (bool, error) {
 	checksum, err := checksumFromHeader(header)
 	if err != nil {
 		return false, err
 	}
 
-	replaceMap := map[string]struct{}{}
-	for _, r := range pkg.Replaces {
-		replaceMap[r] = struct{}{}
-	}
-
 	var r io.Reader = tr
 
 	if checksum == nil {
@@ -109,77 +134,205 @@ func (a *APK) installRegularFile(header *tar.Header, tr *tar.Reader, tmpDir stri
 		r = f
 	}
 
+	target := header
+	// the checksum of the file that ends up under the name of header, for the installed db
+	recorded := checksum
 	if err := a.writeOneFile(header, r, false); err != nil {
 		// If the error is something other than the file exists, return the error.
 		var fileExistsError FileExistsError
-		if !errors.As(err, &fileExistsError) || pkg.Origin == "" {
+		if !errors.As(err, &fileExistsError) {
+			return false, err
+		}
+
+		if _, ok := a.installedFiles[header.Name]; !ok && !bytes.Equal(checksum, fileExistsError.Sha1) && a.isProtected(header.Name) && a.locallyModified(header.Name, fileExistsError.Sha1) {
+			// The file was changed since it was installed, so leave it alone and write ours next
+			// to it, like apk-tools does. What stays under its name is what was there.
+			newHeader := *header
+			newHeader.Name += apkNewSuffix
+			target = &newHeader
+			recorded = fileExistsError.Sha1
+		} else {
+			overwrite, err := a.resolveFileConflict(ctx, pkg, checksum, fileExistsError)
+			if err != nil {
+				return false, err
+			}
+			if !overwrite {
+				return false, nil
+			}
+		}
+
+		if err := a.writeOneFile(target, r, true); err != nil {
 			return false, err
 		}
+	}
+
+	// we need to save this somewhere. The output expects []tar.Header, so we need to override that.
+	// Reusing a field should be good enough, provided that we know it is not getting in the way of
+	// anything downstream. Since we know it is not, this is good enough.
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	// apk installed db uses this format
+	header.PAXRecords[paxRecordsChecksumKey] = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(recorded))
+
+	if err := a.setXattrs(target); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
+// locallyModified reports whether the existing file at name, with the checksum sum, is not what the package that
+// installed it recorded in the installed db. A file that no package installed may have been changed too.
+func (a *APK) locallyModified(name string, sum []byte) bool {
+	_, installed, ok := a.installedOwner(name)
+	return !ok || !bytes.Equal(installed, sum)
+}
+
+// resolveFileConflict determines whether a file from pkg should overwrite an existing file, as described
+// by exists. It returns true if the file should be overwritten, false if the existing file should be kept,
+// or an error if the conflict is not permitted by the conflict policy.
+func (a *APK) resolveFileConflict(ctx context.Context, pkg *Package, checksum []byte, exists FileExistsError) (bool, error) {
+	identical := bytes.Equal(checksum, exists.Sha1)
+
+	var conflict error = exists
+	if pkg.Origin != "" || a.conflictPolicy != ConflictPolicyError {
 		// If the two files are identical, no need to overwrite, but we will keep the first one
 		// that wrote it, which might be the base system or an earlier package.
-		if bytes.Equal(checksum, fileExistsError.Sha1) {
+		if identical {
 			return false, nil
 		}
-
+	}
+	pk, ok := a.installedFiles[exists.Path]
+	if !ok {
+		// a file installed before, by a package in the installed db
+		if owner, _, found := a.installedOwner(exists.Path); found {
+			pk, ok = &owner.Package, true
+		}
+	}
+	if ok && pk.Name == pkg.Name {
+		// the file is of the build of pkg that pkg replaces
+		return true, nil
+	}
+	if pkg.Origin != "" {
 		// If the files are not identical, then we can overwrite the file in two situations:
 		// 1. One of the packages replaces the other.
 		// 2. The packages are in the same origin.
 
 		// If the existing file's package replaces the package we want to install, we don't need to write this file.
-		pk, ok := a.installedFiles[header.Name]
-		if !ok {
-			return false, fmt.Errorf("found existing file we did not install (this should never happen): %s", header.Name)
-		}
+		if ok {
+			for _, rep := range pk.Replaces {
+				if pkg.Name == rep {
+					return false, nil
+				}
+			}
 
-		for _, rep := range pk.Replaces {
-			if pkg.Name == rep {
-				return false, nil
+			// Otherwise, we can only overwrite the file if it's in the same origin or if it replaces the existing package.
+			if pk.Origin == pkg.Origin || slices.Contains(pkg.Replaces, pk.Name) {
+				return true, nil
 			}
+			conflict = withKind(ErrFileConflict, fmt.Errorf("unable to install file over existing one, different contents: %s", exists.Path))
+		} else {
+			conflict = withKind(ErrFileConflict, fmt.Errorf("found existing file we did not install (this should never happen): %s", exists.Path))
 		}
+	}
 
-		// Otherwise, we can only overwrite the file if it's in the same origin or if it replaces the existing package.
-		_, isReplaced := replaceMap[pk.Name]
-		if pk.Origin != pkg.Origin && !isReplaced {
-			return false, fmt.Errorf("unable to install file over existing one, different contents: %s", header.Name)
-		}
+	log := clog.FromContext(ctx)
+	switch a.conflictPolicy {
+	case ConflictPolicyOverwrite:
+		log.Warnf("%s: overwriting %s", pkg.Name, exists.Path)
+		return true, nil
+	case ConflictPolicyKeepFirst:
+		log.Debugf("%s: keeping existing %s", pkg.Name, exists.Path)
+		return false, nil
+	case ConflictPolicyReportOnly:
+		log.Warnf("%s: not installing %s: %v", pkg.Name, exists.Path, conflict)
+		return false, nil
+	default:
+		return false, conflict
+	}
+}
 
-		if err := a.writeOneFile(header, r, true); err != nil {
-			return false, err
+// allowXattr reports whether the extended attribute with the given name passes the
+// configured allow and deny lists.
+func (a *APK) allowXattr(name string) bool {
+	if len(a.xattrAllow) > 0 {
+		allowed := false
+		for _, p := range a.xattrAllow {
+			if ok, _ := path.Match(p, name); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for _, p := range a.xattrDeny {
+		if ok, _ := path.Match(p, name); ok {
+			return false
 		}
 	}
+	return true
+}
 
-	// we need to save this somewhere. The output expects []tar.Header, so we need to override that.
-	// Reusing a field should be good enough, provided that we know it is not getting in the way of
-	// anything downstream. Since we know it is not, this is good enough.
-	if header.PAXRecords == nil {
-		header.PAXRecords = make(map[string]string)
+// filterXattrs removes the xattr PAX records from the header that are not permitted by the
+// xattr policy. The PAX records are copied rather than modified in place, as they may be shared.
+func (a *APK) filterXattrs(header *tar.Header) {
+	if len(a.xattrAllow) == 0 && len(a.xattrDeny) == 0 {
+		return
 	}
-	// apk installed db uses this format
-	header.PAXRecords[paxRecordsChecksumKey] = fmt.Sprintf("Q1%s", base64.StdEncoding.EncodeToString(checksum))
+	var records map[string]string
+	for k := range header.PAXRecords {
+		if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) || a.allowXattr(strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)) {
+			continue
+		}
+		if records == nil {
+			records = maps.Clone(header.PAXRecords)
+		}
+		delete(records, k)
+	}
+	if records != nil {
+		header.PAXRecords = records
+	}
+}
 
-	// xattrs
+// setXattrs sets the extended attributes from the PAX records of the header on the installed file.
+func (a *APK) setXattrs(header *tar.Header) error {
 	for k, v := range header.PAXRecords {
 		if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
 			continue
 		}
 		attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
 		if err := a.fs.SetXattr(header.Name, attrName, []byte(v)); err != nil {
-			return false, fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
+			return fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
 		}
 	}
-	return true, nil
+	return nil
+}
+
+// extractedBytes returns the size of the regular files in files, for the spans of installing them.
+func extractedBytes(files []tar.Header) int64 {
+	var n int64
+	for _, f := range files {
+		if f.Typeflag == tar.TypeReg {
+			n += f.Size
+		}
+	}
+	return n
 }
 
 // installAPKFiles install the files from the APK and return the list of installed files
 // and their permissions. Returns a tar.Header because it is a convenient existing
 // struct that has all of the fields we need.
 func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) ([]tar.Header, error) {
-	_, span := otel.Tracer("go-apk").Start(ctx, "installAPKFiles")
+	_, span := otel.Tracer("go-apk").Start(ctx, "installAPKFiles", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
 
 	var files []tar.Header
-	tmpDir, err := os.MkdirTemp("", "apk-install")
+	defer func() {
+		span.SetAttributes(attribute.Int("files", len(files)), attribute.Int64("bytes", extractedBytes(files)))
+	}()
+	tmpDir, err := os.MkdirTemp(a.tempDir, "apk-install")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
 	}
@@ -191,8 +344,18 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 	//  * This does not make any sense if the file has v2.0
 	//  * style .PKGINFO
 	var startedDataSection bool
+
+	// checksums of the regular files installed so far from this package, so that hardlinks
+	// to them can be recorded in the installed db with the same checksum, as apk-tools does.
+	checksums := map[string]string{}
+
 	tr := tar.NewReader(in)
 	for {
+		// stop writing files as soon as we are cancelled, rather than finishing the package
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break
@@ -200,6 +363,9 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 		if err != nil {
 			return nil, err
 		}
+		if err := tarfs.ValidateHeader(header); err != nil {
+			return nil, err
+		}
 		// if it was a hidden file and not a directory and we have not yet started the data section,
 		// so skip this file
 		if !startedDataSection && header.Name[0] == '.' && !strings.Contains(header.Name, "/") {
@@ -208,6 +374,8 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
+		a.filterXattrs(header)
+
 		switch header.Typeflag {
 		case tar.TypeDir:
 			// special case, if the target already exists, and it is a symlink to a directory, we can accept it as is
@@ -223,19 +391,12 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 			if err := a.fs.MkdirAll(header.Name, header.FileInfo().Mode().Perm()); err != nil {
 				return nil, fmt.Errorf("error creating directory %s: %w", header.Name, err)
 			}
-			// xattrs
-			for k, v := range header.PAXRecords {
-				if !strings.HasPrefix(k, xattrTarPAXRecordsPrefix) {
-					continue
-				}
-				attrName := strings.TrimPrefix(k, xattrTarPAXRecordsPrefix)
-				if err := a.fs.SetXattr(header.Name, attrName, []byte(v)); err != nil {
-					return nil, fmt.Errorf("error setting xattr %s on %s: %w", attrName, header.Name, err)
-				}
+			if err := a.setXattrs(header); err != nil {
+				return nil, err
 			}
 
 		case tar.TypeReg:
-			installed, err := a.installRegularFile(header, tr, tmpDir, pkg)
+			installed, err := a.installRegularFile(ctx, header, tr, tmpDir, pkg)
 			if err != nil {
 				return nil, err
 			}
@@ -243,6 +404,9 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 			if installed {
 				a.installedFiles[header.Name] = pkg
 			}
+			if header.PAXRecords != nil {
+				checksums[header.Name] = header.PAXRecords[paxRecordsChecksumKey]
+			}
 
 		case tar.TypeSymlink:
 			// some underlying filesystems and some memfs that we use in tests do not support symlinks.
@@ -255,9 +419,13 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 				return nil, fmt.Errorf("unable to install symlink from %s -> %s: %w", header.Name, header.Linkname, err)
 			}
 		case tar.TypeLink:
-			if err := a.fs.Link(header.Linkname, header.Name); err != nil {
+			installed, err := a.installHardlink(ctx, header, checksums[header.Linkname], pkg)
+			if err != nil {
 				return nil, err
 			}
+			if installed {
+				a.installedFiles[header.Name] = pkg
+			}
 		default:
 			return nil, fmt.Errorf("unsupported file type %s %v", header.Name, header.Typeflag)
 		}
@@ -268,6 +436,57 @@ func (a *APK) installAPKFiles(ctx context.Context, in io.Reader, pkg *Package) (
 	return files, nil
 }
 
+// installHardlink creates a hardlink for the given header, pointing at a file that already
+// was installed. The link shares the contents of its target rather than duplicating them,
+// and is recorded with the checksum of the target. Something already at the name of the link
+// is replaced as a regular file with the contents of the target would replace it, see
+// resolveFileConflict, and false is returned if it is kept.
+func (a *APK) installHardlink(ctx context.Context, header *tar.Header, checksum string, pkg *Package) (bool, error) {
+	// hardlink targets in a tar are relative to the root of the archive, not to the link itself
+	target := strings.TrimPrefix(header.Linkname, "/")
+	fi, err := a.fs.Stat(target)
+	if err != nil {
+		return false, fmt.Errorf("unable to install hardlink from %s -> %s: %w", header.Name, header.Linkname, err)
+	}
+	if fi.IsDir() {
+		return false, fmt.Errorf("unable to install hardlink from %s -> %s: target is a directory", header.Name, header.Linkname)
+	}
+	if checksum == "" {
+		// the target is not from this package, or was not recorded with a checksum
+		sum, err := a.sha1File(target)
+		if err != nil {
+			return false, err
+		}
+		checksum = "Q1" + base64.StdEncoding.EncodeToString(sum)
+	}
+	if _, err := a.fs.Lstat(header.Name); err == nil {
+		sum, err := a.sha1File(header.Name)
+		if err != nil {
+			return false, err
+		}
+		linked, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(checksum, "Q1"))
+		if err != nil {
+			return false, fmt.Errorf("decoding checksum of hardlink target %s: %w", header.Linkname, err)
+		}
+		overwrite, err := a.resolveFileConflict(ctx, pkg, linked, FileExistsError{Path: header.Name, Sha1: sum})
+		if err != nil || !overwrite {
+			return false, err
+		}
+		if err := a.fs.Remove(header.Name); err != nil {
+			return false, fmt.Errorf("unable to remove existing file %s: %w", header.Name, err)
+		}
+	}
+	if err := a.fs.Link(target, header.Name); err != nil {
+		return false, fmt.Errorf("unable to install hardlink from %s -> %s: %w", header.Name, header.Linkname, err)
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[paxRecordsChecksumKey] = checksum
+	return true, nil
+}
+
 func checksumFromHeader(header *tar.Header) ([]byte, error) {
 	pax := header.PAXRecords
 	if pax == nil {
@@ -305,13 +524,20 @@ func checksumFromHeader(header *tar.Header) ([]byte, error) {
 //
 // This is an optimizing fastpath for when a.fs is a specific implementation that supports it.
 func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh WriteHeaderer, tf *tarfs.FS, pkg *Package) ([]tar.Header, error) {
-	_, span := otel.Tracer("go-apk").Start(ctx, "lazilyInstallAPKFiles")
+	_, span := otel.Tracer("go-apk").Start(ctx, "lazilyInstallAPKFiles", trace.WithAttributes(attribute.String("package", pkg.Name)))
 	defer span.End()
 
 	var files []tar.Header
+	defer func() {
+		span.SetAttributes(attribute.Int("files", len(files)), attribute.Int64("bytes", extractedBytes(files)))
+	}()
 
 	var startedDataSection bool
 	for _, file := range tf.Entries() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// per https://git.alpinelinux.org/apk-tools/tree/src/extract_v2.c?id=337734941831dae9a6aa441e38611c43a5fd72c0#n120
 		//  * APKv1.0 compatibility - first non-hidden file is
 		//  * considered to start the data section of the file.
@@ -323,16 +549,20 @@ func (a *APK) lazilyInstallAPKFiles(ctx context.Context, wh WriteHeaderer, tf *t
 		// whatever it is now, it is in the data section
 		startedDataSection = true
 
-		installed, err := wh.WriteHeader(file.Header, tf, pkg)
+		// copy the header, as the entry is shared by everything that uses the expanded package
+		header := file.Header
+		a.filterXattrs(&header)
+
+		installed, err := wh.WriteHeader(header, tf, pkg)
 		if err != nil {
 			return nil, err
 		}
 
-		if installed && file.Header.Typeflag == tar.TypeReg {
-			a.installedFiles[file.Header.Name] = pkg
+		if installed && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeLink) {
+			a.installedFiles[header.Name] = pkg
 		}
 
-		files = append(files, file.Header)
+		files = append(files, header)
 	}
 
 	return files, nil
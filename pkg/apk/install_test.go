@@ -22,14 +22,27 @@ import (
 	"crypto/sha1" //nolint:gosec // this is what apk tools is using
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"text/template"
 
+	"github.com/chainguard-dev/clog"
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 type testDirEntry struct {
@@ -104,6 +117,32 @@ func TestInstallAPKFiles(t *testing.T) {
 			}
 		}
 	})
+	t.Run("invalid names", func(t *testing.T) {
+		for _, hdr := range []*tar.Header{
+			{Name: "/etc/passwd", Typeflag: tar.TypeReg},
+			{Name: "../etc/passwd", Typeflag: tar.TypeReg},
+			{Name: "usr/../../etc/passwd", Typeflag: tar.TypeReg},
+			{Name: "usr/" + strings.Repeat("a", 256), Typeflag: tar.TypeReg},
+			{Name: "usr/passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+		} {
+			t.Run(hdr.Name, func(t *testing.T) {
+				apk, _, err := testGetTestAPK()
+				require.NoErrorf(t, err, "failed to get test APK")
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				require.NoError(t, tw.WriteHeader(hdr))
+				require.NoError(t, tw.Close())
+
+				_, err = apk.installAPKFiles(context.Background(), bytes.NewReader(buf.Bytes()), &Package{Origin: ""})
+				var nameErr InvalidNameError
+				require.ErrorAs(t, err, &nameErr)
+
+				_, err = tarfs.New(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				require.ErrorAs(t, err, &nameErr)
+			})
+		}
+	})
 
 	t.Run("xattrs", func(t *testing.T) {
 		apk, src, err := testGetTestAPK()
@@ -150,6 +189,263 @@ func TestInstallAPKFiles(t *testing.T) {
 		}
 	})
 
+	t.Run("xattr policy", func(t *testing.T) {
+		apk, src, err := testGetTestAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+		apk.xattrAllow = []string{"security.capability", "user.*"}
+		apk.xattrDeny = []string{"user.drop"}
+
+		entries := []testDirEntry{
+			{"etc", 0o755, true, nil, map[string][]byte{"trusted.etc": []byte("no")}},
+			{"etc/foo", 0o644, false, []byte("hello world"), map[string][]byte{
+				"security.capability": []byte("cap"),
+				"user.keep":           []byte("keep"),
+				"user.drop":           []byte("drop"),
+				"trusted.foo":         []byte("no"),
+			}},
+		}
+
+		r := testCreateTarForPackage(entries)
+		headers, err := apk.installAPKFiles(context.Background(), r, &Package{})
+		require.NoError(t, err)
+		require.Len(t, headers, len(entries))
+
+		xattrs, err := src.ListXattrs("etc")
+		require.NoError(t, err)
+		require.Empty(t, xattrs)
+
+		xattrs, err = src.ListXattrs("etc/foo")
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{
+			"security.capability": []byte("cap"),
+			"user.keep":           []byte("keep"),
+		}, xattrs)
+		_, ok := headers[1].PAXRecords[xattrTarPAXRecordsPrefix+"user.drop"]
+		require.False(t, ok, "filtered xattr should not be in the returned headers")
+	})
+
+	t.Run("hardlinks", func(t *testing.T) {
+		apk, src, err := testGetTestAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+
+		content := []byte("hello world")
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, writeFiles(tw, []testDirEntry{
+			{"usr", 0o755, true, nil, nil},
+			{"usr/bin", 0o755, true, nil, nil},
+			{"usr/bin/foo", 0o755, false, content, nil},
+		}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     "usr/bin/bar",
+			Typeflag: tar.TypeLink,
+			Linkname: "usr/bin/foo",
+			Mode:     0o755,
+		}))
+		require.NoError(t, tw.Close())
+
+		pkg := &Package{Name: "hardlinks"}
+		headers, err := apk.installAPKFiles(context.Background(), bytes.NewReader(buf.Bytes()), pkg)
+		require.NoError(t, err)
+		require.Len(t, headers, 4)
+
+		actual, err := src.ReadFile("usr/bin/bar")
+		require.NoError(t, err, "error reading hardlink")
+		require.Equal(t, content, actual)
+
+		// the link must share contents with its target, not be a copy of it
+		err = src.WriteFile("usr/bin/foo", []byte("changed"), 0o755)
+		require.NoError(t, err)
+		actual, err = src.ReadFile("usr/bin/bar")
+		require.NoError(t, err, "error reading hardlink")
+		require.Equal(t, []byte("changed"), actual)
+
+		// the link is recorded with the checksum of its target
+		link := headers[3]
+		require.Equal(t, "usr/bin/bar", link.Name)
+		require.Equal(t, headers[2].PAXRecords[paxRecordsChecksumKey], link.PAXRecords[paxRecordsChecksumKey])
+		require.Equal(t, pkg, apk.installedFiles["usr/bin/bar"])
+	})
+
+	t.Run("hardlinks over existing files", func(t *testing.T) {
+		linked := func(t *testing.T, pkg *Package, policy ConflictPolicy) (*APK, apkfs.FullFS, error) {
+			apk, src, err := testGetTestAPK()
+			require.NoErrorf(t, err, "failed to get test APK")
+			apk.conflictPolicy = policy
+			first := &Package{Name: "first", Origin: "first"}
+			_, err = apk.installAPKFiles(context.Background(), testCreateTarForPackage([]testDirEntry{
+				{"usr", 0o755, true, nil, nil},
+				{"usr/bin", 0o755, true, nil, nil},
+				{"usr/bin/bar", 0o755, false, []byte("first"), nil},
+			}), first)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			require.NoError(t, writeFiles(tw, []testDirEntry{
+				{"usr", 0o755, true, nil, nil},
+				{"usr/bin", 0o755, true, nil, nil},
+				{"usr/bin/foo", 0o755, false, []byte("second"), nil},
+			}))
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr/bin/bar", Typeflag: tar.TypeLink, Linkname: "usr/bin/foo", Mode: 0o755}))
+			require.NoError(t, tw.Close())
+			_, err = apk.installAPKFiles(context.Background(), bytes.NewReader(buf.Bytes()), pkg)
+			return apk, src, err
+		}
+
+		// the link is a conflict as a file with the contents of its target would be
+		_, src, err := linked(t, &Package{Name: "second", Origin: "second"}, ConflictPolicyError)
+		require.ErrorIs(t, err, ErrFileConflict)
+		actual, err := src.ReadFile("usr/bin/bar")
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), actual)
+
+		apk, src, err := linked(t, &Package{Name: "second", Origin: "second"}, ConflictPolicyKeepFirst)
+		require.NoError(t, err)
+		actual, err = src.ReadFile("usr/bin/bar")
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), actual)
+		require.Equal(t, "first", apk.installedFiles["usr/bin/bar"].Name)
+
+		// and replaces the file of a package it replaces
+		second := &Package{Name: "second", Origin: "second", Replaces: []string{"first"}}
+		apk, src, err = linked(t, second, ConflictPolicyError)
+		require.NoError(t, err)
+		actual, err = src.ReadFile("usr/bin/bar")
+		require.NoError(t, err)
+		require.Equal(t, []byte("second"), actual)
+		require.Equal(t, second, apk.installedFiles["usr/bin/bar"])
+	})
+
+	t.Run("hardlinks with a WriteHeaderer", func(t *testing.T) {
+		apk, src, err := testGetTestAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, writeFiles(tw, []testDirEntry{
+			{"usr", 0o755, true, nil, nil},
+			{"usr/bin", 0o755, true, nil, nil},
+			{"usr/bin/foo", 0o755, false, []byte("hello world"), nil},
+		}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "usr/bin/bar", Typeflag: tar.TypeLink, Linkname: "usr/bin/foo", Mode: 0o755}))
+		require.NoError(t, tw.Close())
+		tf, err := tarfs.New(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+
+		pkg := &Package{Name: "hardlinks"}
+		wh := &testWriteHeaderer{FullFS: src}
+		_, err = apk.lazilyInstallAPKFiles(context.Background(), wh, tf, pkg)
+		require.NoError(t, err)
+		require.Equal(t, []string{"usr", "usr/bin", "usr/bin/foo", "usr/bin/bar"}, wh.written)
+		require.Equal(t, pkg, apk.installedFiles["usr/bin/foo"])
+		require.Equal(t, pkg, apk.installedFiles["usr/bin/bar"])
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		apk, src, err := testGetTestAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+
+		r := testCreateTarForPackage([]testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/foo", 0o644, false, []byte("hello world"), nil},
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = apk.installAPKFiles(ctx, r, &Package{})
+		require.ErrorIs(t, err, context.Canceled)
+
+		_, err = src.Stat("etc/foo")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("protected paths", func(t *testing.T) {
+		apk, src, err := testGetTestAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+
+		err = src.MkdirAll("etc/apk/protected_paths.d", 0o755)
+		require.NoError(t, err)
+		err = src.WriteFile("etc/apk/protected_paths.d/test.list", []byte("+etc\n-etc/unprotected\n"), 0o644)
+		require.NoError(t, err)
+		err = src.WriteFile("etc/config", []byte("local changes"), 0o644)
+		require.NoError(t, err)
+
+		pkg := &Package{Name: "first", Origin: "first"}
+		fp := fakePackage(t, pkg, []testDirEntry{
+			{"etc", 0o755, true, nil, nil},
+			{"etc/config", 0o644, false, []byte("packaged"), nil},
+		})
+
+		err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp})
+		require.NoError(t, err)
+
+		actual, err := src.ReadFile("etc/config")
+		require.NoError(t, err)
+		require.Equal(t, []byte("local changes"), actual)
+
+		actual, err = src.ReadFile("etc/config.apk-new")
+		require.NoError(t, err)
+		require.Equal(t, []byte("packaged"), actual)
+		require.Equal(t, pkg.Name, apk.installedFiles["etc/config"].Name)
+
+		require.True(t, apk.isProtected("etc/config"))
+		require.False(t, apk.isProtected("etc/unprotected/config"))
+		require.False(t, apk.isProtected("etcetera"))
+	})
+
+	t.Run("protected paths in the installed db", func(t *testing.T) {
+		sum := func(b string) string {
+			h := sha1.Sum([]byte(b)) //nolint:gosec // this is what apk tools is using
+			return FormatChecksum(h[:])
+		}
+		for _, tt := range []struct {
+			name, onDisk, want, wantNew, wantChecksum string
+		}{
+			{name: "unmodified", onDisk: "v1", want: "v2", wantChecksum: sum("v2")},
+			{name: "modified", onDisk: "local changes", want: "local changes", wantNew: "v2", wantChecksum: sum("local changes")},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				apk, src, err := testGetTestAPK()
+				require.NoErrorf(t, err, "failed to get test APK")
+
+				require.NoError(t, src.MkdirAll("etc/apk/protected_paths.d", 0o755))
+				require.NoError(t, src.WriteFile("etc/apk/protected_paths.d/test.list", []byte("+etc\n"), 0o644))
+				// installed by config at v1, which is on disk as that or with local changes
+				require.NoError(t, apk.AddInstalledPackage(&Package{Name: "config", Version: "1", Origin: "config"}, []tar.Header{
+					{Name: "etc", Typeflag: tar.TypeDir, Mode: 0o755},
+					{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0o644, PAXRecords: map[string]string{paxRecordsChecksumKey: sum("v1")}},
+				}))
+				require.NoError(t, src.WriteFile("etc/config", []byte(tt.onDisk), 0o644))
+
+				// a package from the same origin brings v2
+				pkg := &Package{Name: "config-next", Origin: "config"}
+				fp := fakePackage(t, pkg, []testDirEntry{
+					{"etc", 0o755, true, nil, nil},
+					{"etc/config", 0o644, false, []byte("v2"), nil},
+				})
+				require.NoError(t, apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp}))
+
+				actual, err := src.ReadFile("etc/config")
+				require.NoError(t, err)
+				require.Equal(t, tt.want, string(actual))
+				actual, err = src.ReadFile("etc/config.apk-new")
+				if tt.wantNew == "" {
+					require.ErrorIs(t, err, fs.ErrNotExist)
+				} else {
+					require.NoError(t, err)
+					require.Equal(t, tt.wantNew, string(actual))
+				}
+
+				// the installed db has the checksum of what is under the name
+				installed, err := apk.GetInstalled()
+				require.NoError(t, err)
+				file, ok := installed[len(installed)-1].File("etc/config")
+				require.True(t, ok)
+				require.Equal(t, tt.wantChecksum, FormatChecksum(file.Checksum))
+			})
+		}
+	})
+
 	t.Run("overlapping files", func(t *testing.T) {
 		t.Run("different origin and content", func(t *testing.T) {
 			apk, src, err := testGetTestAPK()
@@ -173,6 +469,7 @@ func TestInstallAPKFiles(t *testing.T) {
 
 			err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2})
 			require.Error(t, err, "some double-write error")
+			require.ErrorIs(t, err, ErrFileConflict)
 
 			actual, err := src.ReadFile(overwriteFilename)
 			require.NoError(t, err, "error reading %s", overwriteFilename)
@@ -180,6 +477,47 @@ func TestInstallAPKFiles(t *testing.T) {
 
 			checkDuplicateIDBEntries(t, apk)
 		})
+		t.Run("different origin and content, with conflict policy", func(t *testing.T) {
+			originalContent := []byte("hello world")
+			finalContent := []byte("extra long I am here")
+			overwriteFilename := "etc/doublewrite" //nolint:goconst
+
+			for _, tt := range []struct {
+				policy ConflictPolicy
+				want   []byte
+				owner  string
+			}{
+				{ConflictPolicyKeepFirst, originalContent, "first"},
+				{ConflictPolicyReportOnly, originalContent, "first"},
+				{ConflictPolicyOverwrite, finalContent, "second"},
+			} {
+				apk, src, err := testGetTestAPK()
+				require.NoErrorf(t, err, "failed to get test APK")
+				apk.conflictPolicy = tt.policy
+
+				pkg := &Package{Name: "first", Origin: "first"}
+				fp1 := fakePackage(t, pkg, []testDirEntry{
+					{"etc", 0o755, true, nil, nil},
+					{overwriteFilename, 0o755, false, originalContent, nil},
+				})
+
+				pkg2 := &Package{Name: "second", Origin: "second"}
+				fp2 := fakePackage(t, pkg2, []testDirEntry{
+					{"etc", 0o755, true, nil, nil},
+					{overwriteFilename, 0o755, false, finalContent, nil},
+				})
+
+				err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp1, fp2})
+				require.NoError(t, err, "policy %d", tt.policy)
+
+				actual, err := src.ReadFile(overwriteFilename)
+				require.NoError(t, err, "error reading %s", overwriteFilename)
+				require.Equal(t, tt.want, actual, "policy %d", tt.policy)
+				require.Equal(t, tt.owner, apk.installedFiles[overwriteFilename].Name, "policy %d", tt.policy)
+
+				checkDuplicateIDBEntries(t, apk)
+			}
+		})
 		t.Run("different origin and content, but with replaces", func(t *testing.T) {
 			apk, src, err := testGetTestAPK()
 			require.NoErrorf(t, err, "failed to get test APK")
@@ -349,7 +687,380 @@ func (t *testPackage) ChecksumString() string {
 	return t.checksum
 }
 
-func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) InstallablePackage {
+func TestInstallPackagesEvents(t *testing.T) {
+	apk, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "failed to get test APK")
+
+	var (
+		mu     sync.Mutex
+		events []Event
+	)
+	apk.eventHandler = func(_ context.Context, event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	pkg := &Package{Name: "first", Version: "1.0-r0"}
+	fp := fakePackage(t, pkg, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+	})
+
+	err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{fp})
+	require.NoError(t, err)
+
+	require.Equal(t, []Event{
+		{Type: EventFetchStarted, Package: "first"},
+		{Type: EventFetchFinished, Package: "first"},
+		{Type: EventScriptsUpdated, Package: "first", Version: "1.0-r0"},
+		{Type: EventPackageInstalled, Package: "first", Version: "1.0-r0"},
+	}, events)
+}
+
+func TestInstallPackagesContentsDB(t *testing.T) {
+	apk, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "failed to get test APK")
+	apk.contentsDB = true
+
+	first := fakePackage(t, &Package{Name: "first", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/first", 0o644, false, []byte("first"), nil},
+	})
+	second := fakePackage(t, &Package{Name: "second", Version: "1.0-r0"}, []testDirEntry{
+		{"usr", 0o755, true, nil, nil},
+		{"usr/bin", 0o755, true, nil, nil},
+		{"usr/bin/second", 0o755, false, []byte("second"), nil},
+	})
+	err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{first, second})
+	require.NoError(t, err)
+
+	contents, err := apk.GetContents()
+	require.NoError(t, err)
+	firstSum, secondSum := sha1.Sum([]byte("first")), sha1.Sum([]byte("second")) //nolint:gosec // this is what apk tools is using
+	require.Equal(t, []ContentsEntry{
+		{Path: "etc/first", Package: "first", Checksum: firstSum[:]},
+		{Path: "usr/bin/second", Package: "second", Checksum: secondSum[:]},
+	}, contents)
+
+	contents, err = ParseContents(strings.NewReader("busybox\tQ1kavxlyJ9L+cdAW9My2ixbJybJ2g=\tbin/busy\tbox\n"))
+	require.NoError(t, err)
+	require.Equal(t, []ContentsEntry{{
+		Path:     "bin/busy\tbox",
+		Package:  "busybox",
+		Checksum: []byte{0x91, 0xab, 0xf1, 0x97, 0x22, 0x7d, 0x2f, 0xe7, 0x1d, 0x01, 0x6f, 0x4c, 0xcb, 0x68, 0xb1, 0x6c, 0x9c, 0x9b, 0x27, 0x68},
+	}}, contents)
+
+	_, err = ParseContents(strings.NewReader("busybox bin/busybox\n"))
+	require.Error(t, err)
+}
+
+type testHooks struct {
+	NoopHooks
+	calls []string
+	skip  string
+}
+
+func (h *testHooks) BeforeInstall(_ context.Context, pkg *Package) error {
+	h.calls = append(h.calls, "before-install "+pkg.Name)
+	if pkg.Name == h.skip {
+		return ErrSkipPackage
+	}
+	return nil
+}
+
+func (h *testHooks) AfterInstall(_ context.Context, pkg *Package, headers []tar.Header) error {
+	h.calls = append(h.calls, fmt.Sprintf("after-install %s %d", pkg.Name, len(headers)))
+	return nil
+}
+
+func (h *testHooks) BeforeCommit(_ context.Context, pkgs []*Package) error {
+	h.calls = append(h.calls, fmt.Sprintf("before-commit %d", len(pkgs)))
+	return nil
+}
+
+func (h *testHooks) AfterCommit(_ context.Context, pkgs []*Package) error {
+	h.calls = append(h.calls, fmt.Sprintf("after-commit %d", len(pkgs)))
+	return nil
+}
+
+func TestInstallPackagesHooks(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoErrorf(t, err, "failed to get test APK")
+
+	hooks := &testHooks{skip: "second"}
+	apk.hooks = hooks
+
+	first := fakePackage(t, &Package{Name: "first", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/first", 0o644, false, []byte("first"), nil},
+	})
+	second := fakePackage(t, &Package{Name: "second", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/second", 0o644, false, []byte("second"), nil},
+	})
+
+	err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{first, second})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"before-install first",
+		"after-install first 2",
+		"before-install second",
+		"before-commit 1",
+		"after-commit 1",
+	}, hooks.calls)
+
+	_, err = src.Stat("etc/second")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	installed, err := apk.isInstalledPackage("second")
+	require.NoError(t, err)
+	require.False(t, installed)
+
+	t.Run("error", func(t *testing.T) {
+		apk, _, err := testGetTestAPK()
+		require.NoErrorf(t, err, "failed to get test APK")
+		apk.hooks = failingHooks{}
+		err = apk.InstallPackages(context.Background(), nil, []InstallablePackage{first})
+		require.ErrorContains(t, err, "vetoed")
+	})
+}
+
+func TestInstallPackagesIncremental(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoErrorf(t, err, "failed to get test APK")
+
+	first := fakePackage(t, &Package{Name: "first", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/first", 0o644, false, []byte("first"), nil},
+	})
+	second := fakePackage(t, &Package{Name: "second", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/second", 0o644, false, []byte("second"), nil},
+	})
+	require.NoError(t, apk.InstallPackages(context.Background(), nil, []InstallablePackage{first}))
+
+	// first is not fetched again, as it is installed already
+	require.NoError(t, os.Remove(first.(*testPackage).file))
+	var fetched []string
+	apk.eventHandler = func(_ context.Context, e Event) {
+		if e.Type == EventFetchStarted {
+			fetched = append(fetched, e.Package)
+		}
+	}
+	require.NoError(t, apk.InstallPackages(context.Background(), nil, []InstallablePackage{first, second}))
+	require.Equal(t, []string{"second"}, fetched)
+
+	installed, err := apk.GetInstalled()
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range installed {
+		names = append(names, pkg.Name)
+	}
+	require.Equal(t, []string{"first", "second"}, names[len(names)-2:])
+	_, err = src.Stat("etc/second")
+	require.NoError(t, err)
+}
+
+// recordingTracerProvider records the spans that are ended, with their attributes.
+type recordingTracerProvider struct {
+	embedded.TracerProvider
+	mu    sync.Mutex
+	ended []*recordingSpan
+}
+
+func (p *recordingTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{p: p}
+}
+
+// spans returns the attributes of the ended spans with name, by the package they are for.
+func (p *recordingTracerProvider) spans(name string) map[string]map[attribute.Key]attribute.Value {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	spans := map[string]map[attribute.Key]attribute.Value{}
+	for _, s := range p.ended {
+		if s.name != name {
+			continue
+		}
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range s.attrs {
+			attrs[kv.Key] = kv.Value
+		}
+		spans[attrs["package"].AsString()] = attrs
+	}
+	return spans
+}
+
+type recordingTracer struct {
+	embedded.Tracer
+	p *recordingTracerProvider
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	s := &recordingSpan{p: t.p, name: name, attrs: cfg.Attributes()}
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+type recordingSpan struct {
+	noop.Span
+	p     *recordingTracerProvider
+	name  string
+	attrs []attribute.KeyValue
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) { s.attrs = append(s.attrs, kv...) }
+
+func (s *recordingSpan) End(...trace.SpanEndOption) {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+	s.p.ended = append(s.p.ended, s)
+}
+
+func TestInstallPackagesSpans(t *testing.T) {
+	tp := &recordingTracerProvider{}
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	apk, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "failed to get test APK")
+	content := bytes.Repeat([]byte("spans"), 100)
+	pkg := fakePackage(t, &Package{Name: "traced", Version: "1.0-r0"}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/traced", 0o644, false, content, nil},
+	})
+	file, err := os.Stat(pkg.(*testPackage).file)
+	require.NoError(t, err)
+	require.NoError(t, apk.InstallPackages(context.Background(), nil, []InstallablePackage{pkg}))
+
+	download := tp.spans("downloadPackage")["traced"]
+	require.Equal(t, file.Size(), download["bytes"].AsInt64())
+	require.NotZero(t, tp.spans("expandApk")["traced"]["bytes"].AsInt64())
+
+	extract, ok := tp.spans("installAPKFiles")["traced"]
+	if !ok {
+		extract = tp.spans("lazilyInstallAPKFiles")["traced"]
+	}
+	require.Equal(t, int64(len(content)), extract["bytes"].AsInt64())
+	require.Equal(t, int64(2), extract["files"].AsInt64())
+
+	for _, name := range []string{"installPackage", "updateScripts", "updateInstalledDB"} {
+		require.Contains(t, tp.spans(name), "traced", "no %s span", name)
+	}
+	require.Equal(t, int64(1), tp.spans("InstallPackages")[""]["packages"].AsInt64())
+}
+
+func TestInstallPackagesReplacesBuild(t *testing.T) {
+	apk, src, err := testGetTestAPK()
+	require.NoErrorf(t, err, "failed to get test APK")
+	ctx := context.Background()
+
+	// two builds of the same version, with different files and scripts
+	first := fakePackageWithScripts(t, &Package{Name: "rebuilt", Version: "1.0-r0"}, []expandapk.Script{
+		{Name: ".post-install", Contents: []byte("#!/bin/sh\necho first\n")},
+	}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/rebuilt", 0o644, false, []byte("first"), nil},
+		{"etc/dropped", 0o644, false, []byte("first"), nil},
+	})
+	second := fakePackageWithScripts(t, &Package{Name: "rebuilt", Version: "1.0-r0"}, []expandapk.Script{
+		{Name: ".post-install", Contents: []byte("#!/bin/sh\necho second\n")},
+	}, []testDirEntry{
+		{"etc", 0o755, true, nil, nil},
+		{"etc/rebuilt", 0o644, false, []byte("second"), nil},
+	})
+	require.NotEqual(t, first.ChecksumString(), second.ChecksumString())
+
+	require.NoError(t, apk.InstallPackages(ctx, nil, []InstallablePackage{first}))
+	var report InstallReport
+	require.NoError(t, apk.installPackages(ctx, nil, []InstallablePackage{second}, &report))
+
+	// the second build is installed in place of the first
+	require.Len(t, report.Replaced, 1)
+	require.Equal(t, first.ChecksumString(), report.Replaced[0].ChecksumString())
+	installed, err := apk.GetInstalled()
+	require.NoError(t, err)
+	var checksums []string
+	for _, pkg := range installed {
+		if pkg.Name == "rebuilt" {
+			checksums = append(checksums, pkg.ChecksumString())
+		}
+	}
+	require.Equal(t, []string{second.ChecksumString()}, checksums)
+
+	actual, err := src.ReadFile("etc/rebuilt")
+	require.NoError(t, err)
+	require.Equal(t, "second", string(actual))
+	_, err = src.Stat("etc/dropped")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// with only the scripts of the second build
+	rc, err := apk.readScriptsTar()
+	require.NoError(t, err)
+	defer rc.Close()
+	var scripts []string
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		if strings.HasPrefix(header.Name, "rebuilt-") {
+			b, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			scripts = append(scripts, string(b))
+		}
+	}
+	require.Equal(t, []string{"#!/bin/sh\necho second\n"}, scripts)
+}
+
+type failingHooks struct{ NoopHooks }
+
+func (failingHooks) BeforeInstall(context.Context, *Package) error {
+	return errors.New("vetoed")
+}
+
+// BenchmarkInstallPackages installs 200 small packages, to keep an eye on the allocations made per package.
+func BenchmarkInstallPackages(b *testing.B) {
+	content := bytes.Repeat([]byte("hello world\n"), 1<<12)
+
+	pkgs := make([]InstallablePackage, 0, 200)
+	for i := 0; i < cap(pkgs); i++ {
+		name := fmt.Sprintf("pkg-%d", i)
+		pkgs = append(pkgs, fakePackage(b, &Package{Name: name, Version: "1.0-r0", Origin: name}, []testDirEntry{
+			{"usr", 0o755, true, nil, nil},
+			{"usr/share", 0o755, true, nil, nil},
+			{"usr/share/" + name, 0o755, true, nil, nil},
+			{"usr/share/" + name + "/a", 0o644, false, content, nil},
+			{"usr/share/" + name + "/b", 0o644, false, content, nil},
+		}))
+	}
+
+	ctx := clog.WithLogger(context.Background(), clog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		apk, _, err := testGetTestAPK()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if err := apk.InstallPackages(ctx, nil, pkgs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func fakePackage(t testing.TB, pkg *Package, entries []testDirEntry) InstallablePackage {
+	t.Helper()
+	return fakePackageWithScripts(t, pkg, nil, entries)
+}
+
+// fakePackageWithScripts is fakePackage with scripts, such as .post-install, in the control section after .PKGINFO.
+func fakePackageWithScripts(t testing.TB, pkg *Package, scripts []expandapk.Script, entries []testDirEntry) InstallablePackage {
 	t.Helper()
 
 	dir := t.TempDir()
@@ -384,6 +1095,20 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 		t.Fatal(err)
 	}
 
+	for _, script := range scripts {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     script.Name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o755,
+			Size:     int64(len(script.Contents)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(script.Contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+
 	if err := tw.Flush(); err != nil {
 		t.Fatal(err)
 	}
@@ -416,10 +1141,21 @@ func fakePackage(t *testing.T, pkg *Package, entries []testDirEntry) Installable
 	return &testPackage{
 		pkg:      pkg,
 		file:     f.Name(),
-		checksum: base64.StdEncoding.EncodeToString(h.Sum(nil)),
+		checksum: "Q1" + base64.StdEncoding.EncodeToString(h.Sum(nil)),
 	}
 }
 
+// testWriteHeaderer installs nothing, and only records the names of the headers it is given.
+type testWriteHeaderer struct {
+	apkfs.FullFS
+	written []string
+}
+
+func (w *testWriteHeaderer) WriteHeader(hdr tar.Header, _ fs.FS, _ *Package) (bool, error) {
+	w.written = append(w.written, hdr.Name)
+	return true, nil
+}
+
 func writeFiles(tw *tar.Writer, entries []testDirEntry) error {
 	for _, e := range entries {
 		var header *tar.Header
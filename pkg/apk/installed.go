@@ -17,11 +17,13 @@ package apk
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
@@ -29,7 +31,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/klauspost/compress/gzip"
+	"golang.org/x/exp/slices"
+
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
 )
 
 type InstalledPackage struct {
@@ -37,11 +41,87 @@ type InstalledPackage struct {
 	Files []tar.Header
 }
 
+// InstalledFile is a file or directory that a package installed, as recorded in the installed database.
+type InstalledFile struct {
+	// Path is the path of the file within the root, without a leading /, e.g. usr/bin/foo.
+	Path string
+	Dir  bool
+	// Mode is the permissions of the file.
+	Mode fs.FileMode
+	UID  int
+	GID  int
+	// Checksum is the sha1 of the contents of the file, nil for directories and files without one.
+	Checksum []byte
+}
+
+// InstalledFiles returns the files and directories that the package installed, in the order of the
+// installed database.
+func (p *InstalledPackage) InstalledFiles() []InstalledFile {
+	files := make([]InstalledFile, 0, len(p.Files))
+	for _, header := range p.Files {
+		file := InstalledFile{
+			Path: strings.TrimPrefix(filepath.Clean(header.Name), "/"),
+			Dir:  header.Typeflag == tar.TypeDir,
+			Mode: fs.FileMode(header.Mode).Perm(),
+			UID:  header.Uid,
+			GID:  header.Gid,
+		}
+		if checksum := header.PAXRecords[paxRecordsChecksumKey]; checksum != "" {
+			file.Checksum = decodeFileChecksum(checksum)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// File returns the file or directory at path that the package installed, if it did. The path is
+// within the root, with or without a leading /.
+func (p *InstalledPackage) File(path string) (InstalledFile, bool) {
+	path = strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	for _, file := range p.InstalledFiles() {
+		if file.Path == path {
+			return file, true
+		}
+	}
+	return InstalledFile{}, false
+}
+
+// OwnersOf returns the installed packages that installed path, in the order of installed, as in
+// apk info --who-owns. A file usually has one owner, the package that installed it, but a directory
+// may have many.
+func OwnersOf(installed []*InstalledPackage, path string) []*InstalledPackage {
+	var owners []*InstalledPackage
+	for _, pkg := range installed {
+		if _, ok := pkg.File(path); ok {
+			owners = append(owners, pkg)
+		}
+	}
+	return owners
+}
+
+// decodeFileChecksum decodes the checksum of a file, either Q1 and base64, as in the installed database,
+// or hex, as in the headers of a package. It returns nil if the checksum cannot be decoded.
+func decodeFileChecksum(checksum string) []byte {
+	var (
+		b   []byte
+		err error
+	)
+	if strings.HasPrefix(checksum, "Q1") {
+		b, err = base64.StdEncoding.DecodeString(checksum[2:])
+	} else {
+		b, err = hex.DecodeString(checksum)
+	}
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
 // getInstalledPackages get list of installed packages
 func (a *APK) GetInstalled() ([]*InstalledPackage, error) {
-	installedFile, err := a.fs.Open(installedFilePath)
+	installedFile, err := a.fs.Open(a.layoutPath(installedFilePath))
 	if err != nil {
-		return nil, fmt.Errorf("could not open installed file in %s at %s: %w", a.fs, installedFilePath, err)
+		return nil, fmt.Errorf("could not open installed file in %s at %s: %w", a.fs, a.layoutPath(installedFilePath), err)
 	}
 	defer installedFile.Close()
 	return ParseInstalled(installedFile)
@@ -50,9 +130,9 @@ func (a *APK) GetInstalled() ([]*InstalledPackage, error) {
 // addInstalledPackage add a package to the list of installed packages
 func (a *APK) AddInstalledPackage(pkg *Package, files []tar.Header) error {
 	// be sure to open the file in append mode so we add to the end
-	installedFile, err := a.fs.OpenFile(installedFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	installedFile, err := a.fs.OpenFile(a.layoutPath(installedFilePath), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("could not open installed file at %s: %w", installedFilePath, err)
+		return fmt.Errorf("could not open installed file at %s: %w", a.layoutPath(installedFilePath), err)
 	}
 	defer installedFile.Close()
 
@@ -84,7 +164,7 @@ func (a *APK) AddInstalledPackage(pkg *Package, files []tar.Header) error {
 						if err != nil {
 							return err
 						}
-						checksum = "Q1" + base64.StdEncoding.EncodeToString(hexsum)
+						checksum = FormatChecksum(hexsum)
 					}
 					pkgLines = append(pkgLines, fmt.Sprintf("Z:%s", checksum))
 				}
@@ -100,6 +180,115 @@ func (a *APK) AddInstalledPackage(pkg *Package, files []tar.Header) error {
 }
 
 // isInstalledPackage check if a specific package is installed
+// removeInstalledPackage removes pkg from the installed database, with its scripts and triggers, so that the
+// build that replaces it can be added in its place. The files of pkg that are not in files, those of the build
+// that replaces it, are removed too, unless they are under a protected path or another package has them.
+func (a *APK) removeInstalledPackage(pkg *InstalledPackage, files []tar.Header) error {
+	b, err := a.fs.ReadFile(a.layoutPath(installedFilePath))
+	if err != nil {
+		return fmt.Errorf("could not read installed file at %s: %w", a.layoutPath(installedFilePath), err)
+	}
+	var kept strings.Builder
+	for _, entry := range strings.SplitAfter(string(b), "\n\n") {
+		if !slices.Contains(strings.Split(entry, "\n"), "P:"+pkg.Name) {
+			kept.WriteString(entry)
+		}
+	}
+	if err := a.fs.WriteFile(a.layoutPath(installedFilePath), []byte(kept.String()), 0o644); err != nil {
+		return fmt.Errorf("could not write installed file at %s: %w", a.layoutPath(installedFilePath), err)
+	}
+
+	if len(pkg.Checksum) != 0 {
+		if err := a.removeTriggers(&pkg.Package); err != nil {
+			return err
+		}
+		if err := a.removeScripts(&pkg.Package); err != nil {
+			return err
+		}
+	}
+
+	replacing := make(map[string]bool, len(files))
+	for _, f := range files {
+		replacing[strings.TrimPrefix(filepath.Clean("/"+f.Name), "/")] = true
+	}
+	for _, f := range pkg.InstalledFiles() {
+		if f.Dir || replacing[f.Path] || a.isProtected(f.Path) {
+			continue
+		}
+		if owner, ok := a.installedFiles[f.Path]; ok && owner.Name != pkg.Name {
+			continue
+		}
+		if owner, _, ok := a.installedOwner(f.Path); ok && owner.Name != pkg.Name {
+			continue
+		}
+		if err := a.fs.Remove(f.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to remove %s of the replaced %s: %w", f.Path, pkg.Name, err)
+		}
+		delete(a.installedFiles, f.Path)
+	}
+	return nil
+}
+
+// removeTriggers removes the line of pkg from the triggers file.
+func (a *APK) removeTriggers(pkg *Package) error {
+	b, err := a.fs.ReadFile(a.layoutPath(triggersFilePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read triggers file %s: %w", a.layoutPath(triggersFilePath), err)
+	}
+	prefix := FormatChecksum(pkg.Checksum) + " "
+	var kept strings.Builder
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			kept.WriteString(line)
+		}
+	}
+	if err := a.fs.WriteFile(a.layoutPath(triggersFilePath), []byte(kept.String()), 0o644); err != nil {
+		return fmt.Errorf("unable to write triggers file %s: %w", a.layoutPath(triggersFilePath), err)
+	}
+	return nil
+}
+
+// removeScripts removes the scripts of pkg from scripts.tar.
+func (a *APK) removeScripts(pkg *Package) error {
+	b, err := a.fs.ReadFile(a.layoutPath(scriptsFilePath))
+	if errors.Is(err, fs.ErrNotExist) || len(b) == 0 {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read scripts file %s: %w", a.layoutPath(scriptsFilePath), err)
+	}
+	prefix := scriptsPrefix(pkg) + "."
+	var buf bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(b))
+	tw := tar.NewWriter(&buf)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read scripts file %s: %w", a.layoutPath(scriptsFilePath), err)
+		}
+		if strings.HasPrefix(header.Name, prefix) {
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("unable to write scripts header for %s: %w", header.Name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("unable to write content for %s: %w", header.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := a.fs.WriteFile(a.layoutPath(scriptsFilePath), buf.Bytes(), scriptsTarPerms); err != nil {
+		return fmt.Errorf("unable to write scripts file %s: %w", a.layoutPath(scriptsFilePath), err)
+	}
+	return nil
+}
+
 func (a *APK) isInstalledPackage(pkg string) (bool, error) {
 	installedPackages, err := a.GetInstalled()
 	if err != nil {
@@ -113,21 +302,34 @@ func (a *APK) isInstalledPackage(pkg string) (bool, error) {
 	return false, nil
 }
 
+// scriptTypes are the scripts that apk-tools keeps in scripts.tar, by the names of the files in the control
+// section of a package, without the leading dot.
+var scriptTypes = map[string]bool{
+	"pre-install":    true,
+	"post-install":   true,
+	"pre-deinstall":  true,
+	"post-deinstall": true,
+	"pre-upgrade":    true,
+	"post-upgrade":   true,
+	"trigger":        true,
+}
+
 // updateScriptsTar insert the scripts into the tarball
 func (a *APK) updateScriptsTar(pkg *Package, controlTarGz io.Reader, sourceDateEpoch *time.Time) error {
-	gz, err := gzip.NewReader(controlTarGz)
+	gz, err := gzpool.GetReader(controlTarGz)
+	defer gzpool.PutReader(gz)
 	if err != nil {
 		return fmt.Errorf("unable to gunzip control tar.gz file: %w", err)
 	}
 	defer gz.Close()
 	tr := tar.NewReader(gz)
-	fi, err := a.fs.Stat(scriptsFilePath)
+	fi, err := a.fs.Stat(a.layoutPath(scriptsFilePath))
 	if err != nil {
 		return fmt.Errorf("unable to stat scripts file: %w", err)
 	}
-	scripts, err := a.fs.OpenFile(scriptsFilePath, os.O_RDWR, 0)
+	scripts, err := a.fs.OpenFile(a.layoutPath(scriptsFilePath), os.O_RDWR, 0)
 	if err != nil {
-		return fmt.Errorf("unable to open scripts file %s: %w", scriptsFilePath, err)
+		return fmt.Errorf("unable to open scripts file %s: %w", a.layoutPath(scriptsFilePath), err)
 	}
 	defer scripts.Close()
 
@@ -149,13 +351,20 @@ func (a *APK) updateScriptsTar(pkg *Package, controlTarGz io.Reader, sourceDateE
 			return err
 		}
 
-		// ignore .PKGINFO as it is not a script
-		if header.Name == ".PKGINFO" { //nolint:goconst
+		// ignore .PKGINFO and anything else that is not a script apk-tools knows
+		if !scriptTypes[strings.TrimPrefix(header.Name, ".")] {
 			continue
 		}
 
+		// named and owned as apk-tools writes them, so that it finds the scripts of the package by its checksum
 		origName := header.Name
-		header.Name = fmt.Sprintf("%s-%s.Q1%s%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum), origName)
+		header.Name = scriptsPrefix(pkg) + origName
+		header.Typeflag = tar.TypeReg
+		header.Mode = 0o755
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "root", "root"
+		header.Format = tar.FormatUSTAR
+		header.PAXRecords = nil
 
 		// zero out timestamps for reproducibility
 		if sourceDateEpoch != nil {
@@ -177,14 +386,21 @@ func (a *APK) updateScriptsTar(pkg *Package, controlTarGz io.Reader, sourceDateE
 	return nil
 }
 
+// scriptsPrefix returns what the names of the scripts of pkg in scripts.tar start with, before the name of
+// the script, such as .post-install.
+func scriptsPrefix(pkg *Package) string {
+	return fmt.Sprintf("%s-%s.Q1%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum))
+}
+
 // readScriptsTar returns a reader for the current scripts.tar. It is up to the caller to close it.
 func (a *APK) readScriptsTar() (io.ReadCloser, error) {
-	return a.fs.Open(scriptsFilePath)
+	return a.fs.Open(a.layoutPath(scriptsFilePath))
 }
 
 // TODO: We should probably parse control section on the first pass and reuse it.
 func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error) {
-	gz, err := gzip.NewReader(controlTarGz)
+	gz, err := gzpool.GetReader(controlTarGz)
+	defer gzpool.PutReader(gz)
 	if err != nil {
 		return nil, fmt.Errorf("unable to gunzip control tar file: %w", err)
 	}
@@ -202,11 +418,12 @@ func (a *APK) controlValue(controlTarGz io.Reader, want string) ([]string, error
 	return values, nil
 }
 
-// updateTriggers insert the triggers into the triggers file
+// updateTriggers insert the triggers into the triggers file, as a line of the Q1 checksum of the package
+// and the paths it triggers on, as apk-tools writes them.
 func (a *APK) updateTriggers(pkg *Package, controlTarGz io.Reader) error {
-	triggers, err := a.fs.OpenFile(triggersFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0)
+	triggers, err := a.fs.OpenFile(a.layoutPath(triggersFilePath), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0)
 	if err != nil {
-		return fmt.Errorf("unable to open triggers file %s: %w", triggersFilePath, err)
+		return fmt.Errorf("unable to open triggers file %s: %w", a.layoutPath(triggersFilePath), err)
 	}
 	defer triggers.Close()
 
@@ -215,10 +432,17 @@ func (a *APK) updateTriggers(pkg *Package, controlTarGz io.Reader) error {
 		return fmt.Errorf("updating triggers for %s: %w", pkg.Name, err)
 	}
 
+	// one line for the package, with its checksum as apk-tools reads it and all of its triggers
+	var paths []string
 	for _, value := range values {
-		if _, err := triggers.Write([]byte(fmt.Sprintf("%s %s\n", base64.StdEncoding.EncodeToString(pkg.Checksum), value))); err != nil {
-			return fmt.Errorf("unable to write triggers file %s: %w", triggersFilePath, err)
-		}
+		paths = append(paths, strings.Fields(value)...)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	line := fmt.Sprintf("%s %s\n", FormatChecksum(pkg.Checksum), strings.Join(paths, " "))
+	if _, err := triggers.Write([]byte(line)); err != nil {
+		return fmt.Errorf("unable to write triggers file %s: %w", a.layoutPath(triggersFilePath), err)
 	}
 
 	return nil
@@ -226,7 +450,7 @@ func (a *APK) updateTriggers(pkg *Package, controlTarGz io.Reader) error {
 
 // readTriggers returns a reader for the current triggers. It is up to the caller to close it.
 func (a *APK) readTriggers() (io.ReadCloser, error) {
-	return a.fs.Open(triggersFilePath)
+	return a.fs.Open(a.layoutPath(triggersFilePath))
 }
 
 // parseInstalled parses an installed file. It returns the installed packages.
@@ -241,7 +465,8 @@ func ParseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 
 	pkg := &InstalledPackage{}
 	linenr := 1
-	var lastDir, lastFile *tar.Header
+	// the indexes in pkg.Files of the last directory and file, for the lines that follow them, or -1
+	lastDir, lastFile := -1, -1
 
 	for indexScanner.Scan() {
 		line := indexScanner.Text()
@@ -250,8 +475,7 @@ func ParseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 				packages = append(packages, pkg)
 			}
 			pkg = &InstalledPackage{}
-			lastDir = nil
-			lastFile = nil
+			lastDir, lastFile = -1, -1
 			continue
 		}
 
@@ -316,59 +540,65 @@ func ParseInstalled(installed io.Reader) ([]*InstalledPackage, error) { //nolint
 			pkg.ProviderPriority = priority
 		case "C":
 			// Handle SHA1 checksums:
-			if strings.HasPrefix(val, "Q1") {
-				checksum, err := base64.StdEncoding.DecodeString(val[2:])
+			if strings.HasPrefix(val, checksumPrefix) {
+				checksum, err := ParseChecksum(val)
 				if err != nil {
 					return nil, err
 				}
 				pkg.Checksum = checksum
 			}
 		case "F":
-			lastDir = &tar.Header{
+			pkg.Files = append(pkg.Files, tar.Header{
 				Name:     val,
 				Mode:     0o755,
 				Uid:      0,
 				Gid:      0,
 				Typeflag: tar.TypeDir,
-			}
-			pkg.Files = append(pkg.Files, *lastDir)
-			lastFile = nil
+			})
+			lastDir, lastFile = len(pkg.Files)-1, -1
 		case "M":
 			// directory perms if not 0o755
-			if lastDir == nil {
+			if lastDir < 0 {
 				return nil, fmt.Errorf("cannot parse line %d: no directory specified when setting permissions", linenr)
 			}
 			uid, gid, perms, err := parseInstalledPerms(val)
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse line %d: %w", linenr, err)
 			}
-			lastDir.Uid = uid
-			lastDir.Gid = gid
-			lastDir.Mode = perms
+			pkg.Files[lastDir].Uid = uid
+			pkg.Files[lastDir].Gid = gid
+			pkg.Files[lastDir].Mode = perms
 		case "R":
 			fullpath := val
-			if lastDir != nil {
-				fullpath, _ = sanitizeArchivePath(lastDir.Name, val)
-			}
-			lastFile = &tar.Header{
-				Name: fullpath,
-				Mode: 0o644,
-				Uid:  0,
-				Gid:  0,
+			if lastDir >= 0 {
+				fullpath, _ = sanitizeArchivePath(pkg.Files[lastDir].Name, val)
 			}
-			pkg.Files = append(pkg.Files, *lastFile)
+			pkg.Files = append(pkg.Files, tar.Header{
+				Name:     fullpath,
+				Mode:     0o644,
+				Uid:      0,
+				Gid:      0,
+				Typeflag: tar.TypeReg,
+			})
+			lastFile = len(pkg.Files) - 1
 		case "a":
 			// file perms if not 0o644
-			if lastFile == nil {
+			if lastFile < 0 {
 				return nil, fmt.Errorf("cannot parse line %d: no file specified when setting permissions", linenr)
 			}
 			uid, gid, perms, err := parseInstalledPerms(val)
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse line %d: %w", linenr, err)
 			}
-			lastFile.Uid = uid
-			lastFile.Gid = gid
-			lastFile.Mode = perms
+			pkg.Files[lastFile].Uid = uid
+			pkg.Files[lastFile].Gid = gid
+			pkg.Files[lastFile].Mode = perms
+		case "Z":
+			// file checksum, kept as installing it would have it
+			if lastFile < 0 {
+				return nil, fmt.Errorf("cannot parse line %d: no file specified when setting checksum", linenr)
+			}
+			pkg.Files[lastFile].PAXRecords = map[string]string{paxRecordsChecksumKey: val}
 		}
 
 		linenr++
@@ -19,8 +19,10 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -104,6 +106,79 @@ func TestAddInstalledPackage(t *testing.T) {
 	require.Contains(t, str, want)
 }
 
+func TestInstalledFiles(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
+	err = a.AddInstalledPackage(&Package{Name: "testpkg", Version: "1.0.0"}, []tar.Header{
+		{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/foo", Typeflag: tar.TypeDir, Mode: 0o700, Uid: 1000, Gid: 1000},
+		{Name: "usr/foo/testfile", Typeflag: tar.TypeReg, Size: 1234, Mode: 0o644},
+		{Name: "usr/foo/oddfile", Typeflag: tar.TypeReg, Size: 1234, Mode: 0o600, Uid: 1000, PAXRecords: map[string]string{
+			paxRecordsChecksumKey: "91abf197227d2fe71d016f4ccb68b16c9c9b2768",
+		}},
+	})
+	require.NoError(t, err, "unable to add installed package")
+	err = a.AddInstalledPackage(&Package{Name: "otherpkg", Version: "1.0.0"}, []tar.Header{
+		{Name: "usr", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/other", Typeflag: tar.TypeReg, Mode: 0o644},
+	})
+	require.NoError(t, err, "unable to add installed package")
+
+	pkgs, err := a.GetInstalled()
+	require.NoError(t, err, "unable to get installed packages")
+	testpkg := pkgs[len(pkgs)-2]
+	checksum, err := hex.DecodeString("91abf197227d2fe71d016f4ccb68b16c9c9b2768")
+	require.NoError(t, err)
+	require.Equal(t, []InstalledFile{
+		{Path: "usr", Dir: true, Mode: 0o755},
+		{Path: "usr/foo", Dir: true, Mode: 0o700, UID: 1000, GID: 1000},
+		{Path: "usr/foo/oddfile", Mode: 0o600, UID: 1000, Checksum: checksum},
+		{Path: "usr/foo/testfile", Mode: 0o644},
+	}, testpkg.InstalledFiles())
+
+	file, ok := testpkg.File("/usr/foo/oddfile")
+	require.True(t, ok, "file was not found")
+	require.Equal(t, "usr/foo/oddfile", file.Path)
+	_, ok = testpkg.File("usr/other")
+	require.False(t, ok, "file of another package was found")
+
+	names := func(pkgs []*InstalledPackage) []string {
+		var out []string
+		for _, pkg := range pkgs {
+			out = append(out, pkg.Name)
+		}
+		return out
+	}
+	require.Equal(t, []string{"testpkg"}, names(OwnersOf(pkgs, "/usr/foo/testfile")))
+	require.Equal(t, []string{"otherpkg"}, names(OwnersOf(pkgs, "usr/other")))
+	require.Contains(t, names(OwnersOf(pkgs, "usr")), "otherpkg")
+	require.Empty(t, OwnersOf(pkgs, "usr/nothing"))
+}
+
+func TestOwnerOf(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
+
+	pkg, err := a.OwnerOf("/bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", pkg.Name)
+
+	_, err = a.OwnerOf("bin")
+	require.ErrorIs(t, err, ErrPackageNotFound, "directories are not owned")
+	_, err = a.OwnerOf("usr/bin/nothing")
+	require.ErrorIs(t, err, ErrPackageNotFound)
+
+	// a package installed later, with the same file, owns it
+	err = a.AddInstalledPackage(&Package{Name: "otherbox", Version: "1.0.0"}, []tar.Header{
+		{Name: "bin", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0o755},
+	})
+	require.NoError(t, err, "unable to add installed package")
+	pkg, err = a.OwnerOf("bin/busybox")
+	require.NoError(t, err)
+	require.Equal(t, "otherbox", pkg.Name)
+}
+
 func TestIsInstalledPackage(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
@@ -124,6 +199,67 @@ func TestIsInstalledPackage(t *testing.T) {
 	}
 }
 
+func TestInstalledWhoDependsOn(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
+	tests := []struct {
+		name string
+		want []string
+	}{
+		// via the so: it provides
+		{"libssl1.1", []string{"ssl_client", "apk-tools"}},
+		// via /bin/sh
+		{"busybox", []string{"alpine-baselayout"}},
+		{"libc-utils", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkgs, err := a.WhoDependsOn(tt.name)
+			require.NoError(t, err)
+			var got []string
+			for _, pkg := range pkgs {
+				got = append(got, pkg.Name)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+	t.Run("not installed", func(t *testing.T) {
+		_, err := a.WhoDependsOn("notreal123")
+		require.Error(t, err)
+	})
+}
+
+func TestGetOrphans(t *testing.T) {
+	a, _, err := testGetTestAPK()
+	require.NoErrorf(t, err, "unable to initialize APK implementation: %v", err)
+	names := func(pkgs []*InstalledPackage) []string {
+		var out []string
+		for _, pkg := range pkgs {
+			out = append(out, pkg.Name)
+		}
+		return out
+	}
+
+	require.NoError(t, a.fs.MkdirAll("etc/apk", 0o755))
+	require.NoError(t, a.SetWorld(context.Background(), []string{"alpine-baselayout", "libc-utils"}))
+	orphans, err := a.GetOrphans()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alpine-keys", "ca-certificates-bundle", "libcrypto1.1", "libssl1.1", "ssl_client", "zlib", "apk-tools"}, names(orphans))
+
+	reasons, err := a.GetInstallReasons()
+	require.NoError(t, err)
+	require.Len(t, reasons, len(testInstalledPackages))
+	require.Equal(t, InstallReasonExplicit, reasons["alpine-baselayout"])
+	require.Equal(t, InstallReasonExplicit, reasons["libc-utils"])
+	require.Equal(t, InstallReasonDependency, reasons["musl"])
+
+	// ssl_client is installed if busybox and libssl1.1 are
+	require.NoError(t, a.SetWorld(context.Background(), []string{"alpine-baselayout", "libc-utils", "libssl1.1"}))
+	orphans, err = a.GetOrphans()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alpine-keys", "ca-certificates-bundle", "zlib", "apk-tools"}, names(orphans))
+}
+
 func TestUpdateScriptsTar(t *testing.T) {
 	a, _, err := testGetTestAPK()
 	require.NoError(t, err, "unable to initialize APK implementation")
@@ -149,7 +285,9 @@ func TestUpdateScriptsTar(t *testing.T) {
 		".post-install": []byte("echo 'post install'"),
 		".pre-upgrade":  []byte("echo 'pre upgrade'"),
 		".post-upgrade": []byte("echo 'post upgrade'"),
+		".trigger":      []byte("echo 'trigger'"),
 		".PKGINFO":      []byte(pkginfo),
+		".not-a-script": []byte("ignored"),
 	}
 	var buf bytes.Buffer
 	gw := gzip.NewWriter(&buf)
@@ -171,7 +309,7 @@ func TestUpdateScriptsTar(t *testing.T) {
 	require.NoErrorf(t, err, "unable to update scripts tar: %v", err)
 	expected := map[string][]byte{}
 	for k, v := range scripts {
-		if k == ".PKGINFO" {
+		if k == ".PKGINFO" || k == ".not-a-script" {
 			continue
 		}
 		expected[fmt.Sprintf("%s-%s.Q1%s%s", pkg.Name, pkg.Version, base64.StdEncoding.EncodeToString(pkg.Checksum), k)] = v
@@ -192,12 +330,14 @@ func TestUpdateScriptsTar(t *testing.T) {
 		if !strings.HasPrefix(header.Name, fmt.Sprintf("%s-%s", pkg.Name, pkg.Version)) {
 			continue
 		}
+		require.Equal(t, int64(0o755), header.Mode, "script %s is not executable", header.Name)
+		require.Equal(t, "root", header.Uname)
 		var buf bytes.Buffer
 		_, err = io.Copy(&buf, tr) //nolint:gosec
 		require.NoError(t, err, "unable to read script %s: %v", header.Name, err)
 		foundScripts[header.Name] = buf.Bytes()
 	}
-	// foundScripts should include everything in the controltargz *except* PKGINFO
+	// foundScripts should include every script in the controltargz, but not PKGINFO or other files
 	require.Equal(t, len(expected), len(foundScripts), "expected %d scripts, got %d", len(expected), len(foundScripts))
 	for name, content := range expected {
 		foundContent, ok := foundScripts[name]
@@ -256,7 +396,7 @@ func TestUpdateTriggers(t *testing.T) {
 	readTriggers, err := a.readTriggers()
 	require.NoError(t, err, "unable to read triggers: %v", err)
 	defer readTriggers.Close()
-	cksum := base64.StdEncoding.EncodeToString(pkg.Checksum)
+	cksum := "Q1" + base64.StdEncoding.EncodeToString(pkg.Checksum)
 	// read every line in triggers, looking for one with our comment
 	scanner := bufio.NewScanner(readTriggers)
 	for scanner.Scan() {
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxInternedStrings bounds the strings an interner holds on to. Once it is reached the interner starts over,
+// so that a long-running process that keeps loading new indexes does not grow without bound; the strings it
+// handed out before stay valid, they are just no longer shared with the new ones.
+const maxInternedStrings = 1 << 20
+
+// indexStrings interns the strings that repeat across the packages of indexes, such as architectures, licenses
+// and dependency atoms like so:libc.so.6, so that each is only held in memory once across all indexes.
+var indexStrings = &interner{}
+
+// interner returns one shared copy of each string it is asked for.
+type interner struct {
+	mu      sync.Mutex
+	strings map[string]string
+}
+
+// intern returns the string for b, allocating it only the first time it is seen.
+func (i *interner) intern(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	// the compiler does not allocate for the string(b) of a map lookup
+	if s, ok := i.strings[string(b)]; ok {
+		return s
+	}
+	if i.strings == nil || len(i.strings) >= maxInternedStrings {
+		i.strings = make(map[string]string)
+	}
+	s := string(b)
+	i.strings[s] = s
+	return s
+}
+
+// internFields splits b, a field of the index that may have several values separated by spaces, interning
+// each of them.
+func (i *interner) internFields(b []byte) []string {
+	// Splitting an empty field would result in a single empty value, which would be treated as a package
+	// with an empty name.
+	if len(b) == 0 {
+		return nil
+	}
+	fields := make([]string, 0, bytes.Count(b, []byte{' '})+1)
+	for {
+		field, rest, found := bytes.Cut(b, []byte{' '})
+		fields = append(fields, i.intern(field))
+		if !found {
+			return fields
+		}
+		b = rest
+	}
+}
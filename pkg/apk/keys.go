@@ -0,0 +1,143 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+
+	"github.com/chainguard-dev/clog"
+	"go.opentelemetry.io/otel"
+)
+
+// keyPerms are the permissions of the keys in etc/apk/keys, which apk needs to be able to read as any user.
+const keyPerms = 0o644
+
+// trustedKeys returns the keys that the indexes are verified with, by their name in etc/apk/keys, see
+// configSource.
+func (a *APK) trustedKeys() (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	keysFS, keysDir := a.configSource(keysDirPath)
+	dir, err := fs.ReadDir(keysFS, keysDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", keysFS, keysDir, err)
+	}
+	for _, d := range dir {
+		if d.IsDir() {
+			continue
+		}
+		fullPath := path.Join(keysDir, d.Name())
+		b, err := fs.ReadFile(keysFS, fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
+		}
+		keys[d.Name()] = b
+	}
+	return keys, nil
+}
+
+// keysDigest returns a digest of keys, their names and contents, which is the same for the same keys.
+func keysDigest(keys map[string][]byte) string {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(keys[name]))
+		h.Write(keys[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// repositoryKeys returns the keys of keys that can verify the repository at repo, as it appears in
+// etc/apk/repositories without any @tag, those of WithRepositoryKeys, or else all of them.
+func (a *APK) repositoryKeys(repo string, keys map[string][]byte) (map[string][]byte, error) {
+	names, ok := a.repoKeys[repo]
+	if !ok {
+		return keys, nil
+	}
+	repoKeys := make(map[string][]byte, len(names))
+	for _, name := range names {
+		b, ok := keys[name]
+		if !ok {
+			return nil, fmt.Errorf("key %s for repository %s not found in %s", name, repo, keysDirPath)
+		}
+		repoKeys[name] = b
+	}
+	return repoKeys, nil
+}
+
+// InstallTrustedKeys writes the keys that the indexes are verified with, those of the host with WithHostConfig,
+// into etc/apk/keys of the root, so that apk in the root can verify the same repositories later, e.g. for an
+// apk upgrade in an image. A key that the root already has with the same contents is not written again, though
+// its permissions are fixed, and one with the same name but other contents is an error, as apk looks keys up by
+// name. It returns the names of the keys that it wrote, sorted.
+func (a *APK) InstallTrustedKeys(ctx context.Context) ([]string, error) {
+	log := clog.FromContext(ctx)
+	_, span := otel.Tracer("go-apk").Start(ctx, "InstallTrustedKeys")
+	defer span.End()
+
+	keys, err := a.trustedKeys()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keysDir := a.layoutPath(keysDirPath)
+	if err := a.fs.MkdirAll(keysDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to make keys dir: %w", err)
+	}
+	var written []string
+	for _, name := range names {
+		filename := path.Join(keysDir, name)
+		existing, err := a.fs.ReadFile(filename)
+		switch {
+		case err == nil && !bytes.Equal(existing, keys[name]):
+			return written, fmt.Errorf("key %s is already in %s with other contents", name, keysDir)
+		case err == nil:
+			fi, err := a.fs.Stat(filename)
+			if err != nil {
+				return written, fmt.Errorf("failed to stat key file %s: %w", filename, err)
+			}
+			if fi.Mode().Perm() != keyPerms {
+				if err := a.fs.Chmod(filename, keyPerms); err != nil {
+					return written, fmt.Errorf("failed to set permissions of key file %s: %w", filename, err)
+				}
+			}
+			continue
+		case !errors.Is(err, fs.ErrNotExist):
+			return written, fmt.Errorf("failed to read key file %s: %w", filename, err)
+		}
+		log.Debugf("installing trusted key %s", name)
+		// #nosec G306 -- apk keyring must be publicly readable
+		if err := a.fs.WriteFile(filename, keys[name], keyPerms); err != nil {
+			return written, fmt.Errorf("failed to write key file %s: %w", filename, err)
+		}
+		written = append(written, name)
+	}
+	return written, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestInstallTrustedKeys(t *testing.T) {
+	ctx := context.Background()
+	host := fstest.MapFS{
+		"etc/apk/keys/one.rsa.pub": {Data: []byte("one")},
+		"etc/apk/keys/two.rsa.pub": {Data: []byte("two")},
+	}
+	root := apkfs.NewMemFS()
+	a, err := New(WithFS(root), WithIgnoreMknodErrors(true), WithHostConfig(host))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, root.WriteFile("etc/apk/keys/one.rsa.pub", []byte("one"), 0o600))
+
+	written, err := a.InstallTrustedKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"two.rsa.pub"}, written)
+	for name, contents := range map[string]string{"one.rsa.pub": "one", "two.rsa.pub": "two"} {
+		b, err := root.ReadFile("etc/apk/keys/" + name)
+		require.NoError(t, err)
+		require.Equal(t, contents, string(b))
+		fi, err := root.Stat("etc/apk/keys/" + name)
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o644), fi.Mode().Perm(), "permissions of %s", name)
+	}
+
+	// installing again writes nothing
+	written, err = a.InstallTrustedKeys(ctx)
+	require.NoError(t, err)
+	require.Empty(t, written)
+
+	// apk looks keys up by name, so a different key with the same name cannot be installed
+	require.NoError(t, root.WriteFile("etc/apk/keys/two.rsa.pub", []byte("other"), 0o644))
+	_, err = a.InstallTrustedKeys(ctx)
+	require.ErrorContains(t, err, "key two.rsa.pub is already in etc/apk/keys with other contents")
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// layoutDir cleans dir, a directory of the apk layout of the root, to a path relative to the root.
+func layoutDir(dir string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(dir, "/"))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+		return "", fmt.Errorf("invalid directory %q: must be a directory under the root", dir)
+	}
+	return clean, nil
+}
+
+// layoutPath returns where p, a path of the default apk layout such as those in const.go, is in the root with the
+// directories set by WithConfigDir and WithDatabaseDir. p keeps its leading /, if it has one.
+func (a *APK) layoutPath(p string) string {
+	rel := strings.TrimPrefix(p, "/")
+	for _, l := range []struct{ def, dir string }{
+		{defaultConfigDir, a.configDir},
+		{defaultDatabaseDir, a.databaseDir},
+	} {
+		if rest, ok := strings.CutPrefix(rel, l.def); ok && (rest == "" || rest[0] == '/') {
+			rel = l.dir + rest
+			break
+		}
+	}
+	if strings.HasPrefix(p, "/") {
+		return "/" + rel
+	}
+	return rel
+}
+
+// configSource returns the filesystem that p, a file or directory of the default layout of the apk
+// configuration, is read from, and its path there: the default layout of the host with WithHostConfig, or else
+// the layout of the root.
+func (a *APK) configSource(p string) (fs.FS, string) {
+	if a.hostConfig != nil {
+		return a.hostConfig, p
+	}
+	return a.fs, a.layoutPath(p)
+}
+
+// initDirectories returns the directories of the apk layout that InitDB creates, parents first, leaving out
+// those in baseDirectories.
+func (a *APK) initDirectories() []directory {
+	var dirs []directory
+	seen := map[string]bool{}
+	for _, e := range baseDirectories {
+		seen[e.path] = true
+	}
+	add := func(dir string) {
+		var p string
+		for _, elem := range strings.Split(dir, "/") {
+			p += "/" + elem
+			if !seen[p] {
+				seen[p] = true
+				dirs = append(dirs, directory{p, 0o755})
+			}
+		}
+	}
+	add(a.configDir)
+	add(a.layoutPath(keysDirPath))
+	add(a.databaseDir)
+	for _, e := range initDirectories {
+		add(strings.TrimPrefix(e.path, "/"))
+	}
+	return dirs
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+)
+
+// isPackageFile returns whether the world entry is the path or URL of an .apk file, as in apk add ./foo.apk,
+// rather than a package name.
+func isPackageFile(entry string) bool {
+	return strings.HasSuffix(entry, ".apk")
+}
+
+// packageFile is the path or URL of an .apk file, to fetch it as a package.
+type packageFile string
+
+func (f packageFile) URL() string            { return string(f) }
+func (f packageFile) PackageName() string    { return path.Base(string(f)) }
+func (f packageFile) ChecksumString() string { return "" }
+
+// localPackages reads the packages of the world entries that are .apk files, and returns indexes with one
+// more index of those packages, and world with each file replaced by the name and checksum of its package,
+// as apk-tools does. That way the resolver installs the file rather than a package of the same name from the
+// repositories, and resolves its dependencies from the repositories as for any other package. Each file must
+// be signed by a trusted key, unless WithAllowUntrusted is set. An entry of the name and checksum of a file that
+// was read before, as SetWorld writes them, is also resolved from the file.
+func (a *APK) localPackages(ctx context.Context, indexes []NamedIndex, world []string) ([]NamedIndex, []string, error) {
+	var (
+		repo     = &RepositoryWithIndex{Repository: &Repository{}, index: &APKIndex{}}
+		local    = &localIndex{repo: repo}
+		replaced []string
+	)
+	for _, entry := range world {
+		var lf *localFile
+		if isPackageFile(entry) {
+			var err error
+			if lf, err = a.readLocalFile(ctx, entry); err != nil {
+				return nil, nil, err
+			}
+		} else if v, ok := a.localFiles.Load(entry); ok {
+			lf = v.(*localFile)
+		} else {
+			replaced = append(replaced, entry)
+			continue
+		}
+		repo.index.Packages = append(repo.index.Packages, lf.pkg)
+		local.pkgs = append(local.pkgs, &RepositoryPackage{Package: lf.pkg, repository: repo, url: lf.file})
+		replaced = append(replaced, lf.entry())
+	}
+	if len(local.pkgs) == 0 {
+		return indexes, world, nil
+	}
+	return append(indexes[:len(indexes):len(indexes)], local), replaced, nil
+}
+
+// localFile is the package of an .apk file in the world, see localPackages.
+type localFile struct {
+	file string
+	pkg  *Package
+}
+
+// entry is the world entry of the package, its name and checksum, as apk-tools writes it.
+func (f *localFile) entry() string {
+	return f.pkg.Name + "><" + f.pkg.ChecksumString()
+}
+
+// readLocalFile reads the package of the world entry that is the .apk file at entry, and remembers it by the
+// entry it is written to the world as.
+func (a *APK) readLocalFile(ctx context.Context, entry string) (*localFile, error) {
+	file := entry
+	if u, err := packageAsURL(packageFile(entry)); err == nil && u.Scheme == "file" {
+		if file, err = filepath.Abs(entry); err != nil {
+			return nil, fmt.Errorf("finding package file %s: %w", entry, err)
+		}
+	}
+	pkg, err := a.readPackageFile(ctx, file)
+	if err != nil {
+		return nil, fmt.Errorf("reading package file %s: %w", entry, err)
+	}
+	lf := &localFile{file: file, pkg: pkg}
+	a.localFiles.Store(lf.entry(), lf)
+	return lf, nil
+}
+
+// readPackageFile returns the package of the .apk file at file, a path or URL, after verifying its signature
+// with the keys in etc/apk/keys, unless WithAllowUntrusted is set. As the file is not in an index, the
+// signature is all that vouches for it.
+func (a *APK) readPackageFile(ctx context.Context, file string) (*Package, error) {
+	rc, err := a.FetchPackage(ctx, packageFile(file))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var opts []expandapk.Option
+	if a.tempDir != "" {
+		opts = append(opts, expandapk.WithTempDir(a.tempDir))
+	}
+	exp, err := expandapk.ExpandApk(ctx, rc, "", opts...)
+	if err != nil {
+		return nil, fmt.Errorf("expanding: %w", err)
+	}
+	defer exp.Close()
+
+	if !a.allowUntrusted {
+		if err := a.verifyPackageSignature(exp); err != nil {
+			return nil, err
+		}
+	}
+	return parseExpandedPackage(exp)
+}
+
+// verifyPackageSignature verifies the signature of the package expanded as exp, which is over its control
+// section, with the keys in etc/apk/keys.
+func (a *APK) verifyPackageSignature(exp *expandapk.APKExpanded) error {
+	if !exp.Signed {
+		return withKind(ErrSignatureInvalid, errors.New("package is not signed, see WithAllowUntrusted"))
+	}
+	f, err := os.Open(exp.SignatureFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keyName, scheme, signature, err := readSignatureSection(f)
+	if err != nil {
+		return withKind(ErrSignatureInvalid, fmt.Errorf("reading signature: %w", err))
+	}
+	keys, err := a.trustedKeys()
+	if err != nil {
+		return err
+	}
+	if _, err := verifyIndexSignature(keyName, scheme, exp.ControlHash, signature, keys); err != nil {
+		return fmt.Errorf("verifying signature: %w", err)
+	}
+	return nil
+}
+
+// localIndex is the index of the packages of .apk files in the world, see localPackages. Unlike a
+// repository, its packages are fetched from the files they were read from.
+type localIndex struct {
+	repo *RepositoryWithIndex
+	pkgs []*RepositoryPackage
+}
+
+func (l *localIndex) Name() string                   { return "" }
+func (l *localIndex) Packages() []*RepositoryPackage { return l.pkgs }
+func (l *localIndex) Source() string                 { return "" }
+func (l *localIndex) Count() int                     { return len(l.pkgs) }
@@ -0,0 +1,162 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func TestLocalPackages(t *testing.T) {
+	ctx := context.Background()
+	data, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{(&Repository{URI: testPrimaryPkgDir}).WithIndex(index)})
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch("x86_64"), WithIgnoreMknodErrors(ignoreMknodErrors), WithAllowUntrusted(true))
+	require.NoError(t, err)
+	const file = "testdata/hello-0.1.0-r0.apk"
+	pkgs, _, err := a.resolve(ctx, indexes, []string{"./" + file})
+	require.NoError(t, err)
+
+	// hello is from the file, and its dependencies from the repository
+	var names []string
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Name)
+	}
+	require.Equal(t, []string{"musl", "busybox", "hello"}, names)
+	hello := pkgs[len(pkgs)-1]
+	abs, err := filepath.Abs(file)
+	require.NoError(t, err)
+	require.Equal(t, abs, hello.URL())
+	require.Equal(t, "just a test package", hello.Description)
+
+	rc, err := a.FetchPackage(ctx, hello)
+	require.NoError(t, err)
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	want, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	_, _, err = a.resolve(ctx, indexes, []string{"testdata/missing-1.0-r0.apk"})
+	require.ErrorContains(t, err, "reading package file testdata/missing-1.0-r0.apk")
+}
+
+func TestLocalPackageWorld(t *testing.T) {
+	ctx := context.Background()
+	data, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{(&Repository{URI: testPrimaryPkgDir}).WithIndex(index)})
+
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch("x86_64"), WithIgnoreMknodErrors(ignoreMknodErrors), WithAllowUntrusted(true))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(ctx))
+	const file = "testdata/hello-0.1.0-r0.apk"
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	pkg, err := ParsePackage(ctx, bytes.NewReader(b))
+	require.NoError(t, err)
+
+	// the file is written to the world as the name and checksum of its package, once
+	require.NoError(t, a.SetWorld(ctx, []string{"./" + file, "busybox", file}))
+	world, err := a.GetWorld()
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox", "hello><" + pkg.ChecksumString()}, world)
+
+	// which still is resolved from the file
+	pkgs, _, err := a.resolve(ctx, indexes, world)
+	require.NoError(t, err)
+	hello := pkgs[len(pkgs)-1]
+	require.Equal(t, "hello", hello.Name)
+	abs, err := filepath.Abs(file)
+	require.NoError(t, err)
+	require.Equal(t, abs, hello.URL())
+
+	require.ErrorContains(t, a.SetWorld(ctx, []string{"testdata/missing-1.0-r0.apk"}), "reading package file testdata/missing-1.0-r0.apk")
+}
+
+func TestLocalPackageSignatures(t *testing.T) {
+	ctx := context.Background()
+	data, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+	index, err := IndexFromArchive(io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{(&Repository{URI: testPrimaryPkgDir}).WithIndex(index)})
+
+	// hello signed with the test key
+	const unsigned = "testdata/hello-0.1.0-r0.apk"
+	f, err := os.Open(unsigned)
+	require.NoError(t, err)
+	defer f.Close()
+	exp, err := expandapk.ExpandApk(ctx, f, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+	control, err := os.Open(exp.ControlFile)
+	require.NoError(t, err)
+	defer control.Close()
+	pkgData, err := os.Open(exp.PackageFile)
+	require.NoError(t, err)
+	defer pkgData.Close()
+	signer, err := sign.NewKeySigner("../signature/testdata/test.rsa")
+	require.NoError(t, err)
+	signedPkg, err := sign.SignAPK(ctx, signer, control, pkgData)
+	require.NoError(t, err)
+	b, err := io.ReadAll(signedPkg)
+	require.NoError(t, err)
+	signed := filepath.Join(t.TempDir(), "hello-0.1.0-r0.apk")
+	require.NoError(t, os.WriteFile(signed, b, 0o644))
+
+	pub, err := os.ReadFile("../signature/testdata/test.rsa.pub")
+	require.NoError(t, err)
+	newAPK := func(t *testing.T, trusted bool, options ...Option) *APK {
+		fsys := apkfs.NewMemFS()
+		require.NoError(t, fsys.MkdirAll(keysDirPath, 0o755))
+		if trusted {
+			require.NoError(t, fsys.WriteFile(filepath.Join(keysDirPath, "test.rsa.pub"), pub, 0o644))
+		}
+		a, err := New(append([]Option{WithFS(fsys), WithArch("x86_64")}, options...)...)
+		require.NoError(t, err)
+		return a
+	}
+	resolve := func(a *APK, file string) error {
+		_, _, err := a.resolve(ctx, indexes, []string{file})
+		return err
+	}
+
+	require.NoError(t, resolve(newAPK(t, true), signed))
+	require.NoError(t, resolve(newAPK(t, true, WithStrictVerification(true)), signed))
+	require.ErrorIs(t, resolve(newAPK(t, false), signed), ErrSignatureInvalid)
+	require.ErrorIs(t, resolve(newAPK(t, true), "./"+unsigned), ErrSignatureInvalid)
+	require.NoError(t, resolve(newAPK(t, false, WithAllowUntrusted(true)), "./"+unsigned))
+
+	_, err = New(WithStrictVerification(true), WithAllowUntrusted(true))
+	require.ErrorIs(t, err, ErrSignatureInvalid)
+}
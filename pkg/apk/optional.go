@@ -0,0 +1,83 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// SetOptional marks the packages of the world with names as optional, so that Resolve installs them if they
+// can be resolved with the rest of the world, and skips them with a warning if not, such as packages that only
+// exist for some architectures or that conflict with what else is installed. The packages that it skipped are the Skipped of the Resolution.
+func (p *PkgResolver) SetOptional(names ...string) {
+	p.optional = make(map[string]bool, len(names))
+	for _, name := range names {
+		p.optional[name] = true
+	}
+}
+
+// resolveOptional resolves packages, and if they cannot be resolved together, resolves them again without the
+// optional ones that break the resolution, which it returns as skipped. What is not optional has to resolve on
+// its own, and the optional packages are then added back in order, each kept if it still resolves with what
+// was kept before it.
+func (p *PkgResolver) resolveOptional(ctx context.Context, packages []string, optional map[string]bool) (resolution *Resolution, skipped []string, err error) {
+	resolution, err = p.resolve(packages, nil)
+	if err == nil || len(optional) == 0 {
+		return resolution, nil, err
+	}
+
+	keep := make([]bool, len(packages))
+	isOptional := make([]bool, len(packages))
+	anyOptional := false
+	for i, pkg := range packages {
+		isOptional[i] = optional[p.resolvePackageNameVersionPin(pkg).name]
+		keep[i] = !isOptional[i]
+		anyOptional = anyOptional || isOptional[i]
+	}
+	if !anyOptional {
+		return resolution, nil, err
+	}
+	kept := func() []string {
+		k := make([]string, 0, len(packages))
+		for i, pkg := range packages {
+			if keep[i] {
+				k = append(k, pkg)
+			}
+		}
+		return k
+	}
+
+	if resolution, err = p.resolve(kept(), nil); err != nil {
+		return resolution, nil, err
+	}
+	log := clog.FromContext(ctx)
+	for i, pkg := range packages {
+		if !isOptional[i] {
+			continue
+		}
+		keep[i] = true
+		r, err := p.resolve(kept(), nil)
+		if err != nil {
+			log.Warnf("skipping optional package %s: %v", pkg, err)
+			keep[i] = false
+			skipped = append(skipped, pkg)
+			continue
+		}
+		resolution = r
+	}
+	return resolution, skipped, nil
+}
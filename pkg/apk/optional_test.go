@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptional(t *testing.T) {
+	ctx := context.Background()
+	newResolver := func() *PkgResolver {
+		return makeResolver(nil, map[string][]string{
+			"foo=1.0-r0":    nil,
+			"broken=1.0-r0": {"missing"},
+			"nofoo=1.0-r0":  {"!foo"},
+		})
+	}
+	filenames := func(pkgs []*RepositoryPackage) []string {
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Filename())
+		}
+		return names
+	}
+
+	_, err := newResolver().Resolve(ctx, []string{"foo", "x86-only"})
+	require.ErrorIs(t, err, ErrPackageNotFound)
+
+	resolver := newResolver()
+	resolver.SetOptional("x86-only", "broken")
+	resolution, err := resolver.Resolve(ctx, []string{"foo", "x86-only", "broken>=1.0"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-1.0-r0.apk"}, filenames(resolution.Packages))
+	require.Equal(t, []string{"x86-only", "broken>=1.0"}, resolution.Skipped)
+
+	// an optional package that resolves on its own, but not with the rest of the world, is skipped
+	resolver = newResolver()
+	resolver.SetOptional("nofoo")
+	resolution, err = resolver.Resolve(ctx, []string{"nofoo", "foo"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-1.0-r0.apk"}, filenames(resolution.Packages))
+	require.Equal(t, []string{"nofoo"}, resolution.Skipped)
+	resolution, err = resolver.Resolve(ctx, []string{"nofoo"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"nofoo-1.0-r0.apk"}, filenames(resolution.Packages))
+	require.Empty(t, resolution.Skipped)
+
+	// an optional package that resolves is installed
+	resolver.SetOptional("foo")
+	resolution, err = resolver.Resolve(ctx, []string{"foo"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-1.0-r0.apk"}, filenames(resolution.Packages))
+	require.Empty(t, resolution.Skipped)
+
+	resolution, err = newResolver().ResolveRequirements(ctx, []Requirement{
+		{Name: "foo"},
+		{Name: "x86-only", Optional: true},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-1.0-r0.apk"}, filenames(resolution.Packages))
+	require.Equal(t, []string{"x86-only"}, resolution.Skipped)
+}
@@ -15,7 +15,15 @@
 package apk
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 
@@ -29,8 +37,43 @@ type opts struct {
 	fs                 apkfs.FullFS
 	version            string
 	cache              *cache
+	cacheKeys          *cacheKeys
 	noSignatureIndexes []string
 	auth               map[string]auth
+	xattrAllow         []string
+	xattrDeny          []string
+	conflictPolicy     ConflictPolicy
+	eventHandler       EventHandler
+	parallelBlocks     int
+	parallelHash       bool
+	tempDir            string
+	timeouts           Timeouts
+	repoPriorities     map[string]int
+	repoLayouts        map[string]string
+	repoKeys           map[string][]string
+	partialIndexes     bool
+	hooks              Hooks
+	contentsDB         bool
+	strictVerification bool
+	checksums          bool
+	detachedSigRepos   []string
+	lazyIndexes        bool
+	indexDeltas        bool
+	indexVerifier      IndexVerifier
+	verifierOnly       bool
+	sigThreshold       int
+	transportWrappers  []func(http.RoundTripper) http.RoundTripper
+	proxy              func(*http.Request) (*url.URL, error)
+	dialContext        func(ctx context.Context, network, addr string) (net.Conn, error)
+	fetchPolicies      []FetchPolicy
+	strictVersions     bool
+	configDir          string
+	databaseDir        string
+	hostConfig         fs.FS
+	holds              []string
+	optionalPackages   []string
+	virtualPackages    []*Package
+	allowUntrusted     bool
 }
 
 type Option func(*opts) error
@@ -43,10 +86,11 @@ func WithExecutor(executor Executor) Option {
 	}
 }
 
-// WithArch sets the architecture to use. If not provided, will use the default runtime.GOARCH.
+// WithArch sets the architecture to use, either as apk names it or as an alias ArchToAPK knows.
+// If not provided, will use the default runtime.GOARCH.
 func WithArch(arch string) Option {
 	return func(o *opts) error {
-		o.arch = arch
+		o.arch = ArchToAPK(arch)
 		return nil
 	}
 }
@@ -91,6 +135,10 @@ func WithCache(cacheDir string, offline bool) Option {
 			}
 			cacheDir = filepath.Join(cacheDir, "dev.chainguard.go-apk")
 		}
+		// a relative directory is relative to the current directory, wherever the root is
+		if cacheDir, err = filepath.Abs(cacheDir); err != nil {
+			return err
+		}
 		o.cache = &cache{
 			dir:     cacheDir,
 			offline: offline,
@@ -99,6 +147,18 @@ func WithCache(cacheDir string, offline bool) Option {
 	}
 }
 
+// WithCacheKeyNormalization caches responses by their URL without its fragment or query string, except
+// for the query parameters named in keep, so that URLs with volatile query strings, such as pre-signed S3
+// or GCS URLs, share what is cached for them and revalidate it. Requests still use the full URL. Servers
+// that refuse the HEAD for a pre-signed URL are revalidated by downloading again. It has no effect without
+// WithCache.
+func WithCacheKeyNormalization(keep ...string) Option {
+	return func(o *opts) error {
+		o.cacheKeys = &cacheKeys{query: keep}
+		return nil
+	}
+}
+
 func WithNoSignatureIndexes(noSignatureIndex ...string) Option {
 	return func(o *opts) error {
 		o.noSignatureIndexes = append(o.noSignatureIndexes, noSignatureIndex...)
@@ -106,6 +166,395 @@ func WithNoSignatureIndexes(noSignatureIndex ...string) Option {
 	}
 }
 
+// WithXattrAllowList restricts the extended attributes set on installed files to those whose
+// name matches one of the given patterns, e.g. "security.capability" or "user.*". Patterns use
+// the syntax of path.Match. Extended attributes that do not match are dropped. If not
+// provided, all extended attributes are allowed.
+func WithXattrAllowList(patterns ...string) Option {
+	return func(o *opts) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid xattr pattern %q: %w", p, err)
+			}
+		}
+		o.xattrAllow = append(o.xattrAllow, patterns...)
+		return nil
+	}
+}
+
+// WithXattrDenyList drops the extended attributes whose name matches one of the given patterns
+// when installing files, e.g. "user.*". Patterns use the syntax of path.Match. The deny list
+// is applied after the allow list.
+func WithXattrDenyList(patterns ...string) Option {
+	return func(o *opts) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid xattr pattern %q: %w", p, err)
+			}
+		}
+		o.xattrDeny = append(o.xattrDeny, patterns...)
+		return nil
+	}
+}
+
+// WithConflictPolicy sets what InstallPackages does when a package would overwrite a file installed
+// by another package with different contents, and neither the origin nor the replaces of the packages
+// allow it. Default is ConflictPolicyError.
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(o *opts) error {
+		switch policy {
+		case ConflictPolicyError, ConflictPolicyKeepFirst, ConflictPolicyOverwrite, ConflictPolicyReportOnly:
+		default:
+			return fmt.Errorf("invalid conflict policy %d", policy)
+		}
+		o.conflictPolicy = policy
+		return nil
+	}
+}
+
+// WithEventHandler sets a handler that is called with Events as packages are resolved, fetched and installed,
+// for showing progress. To receive events on a channel, send to it from the handler.
+func WithEventHandler(handler EventHandler) Option {
+	return func(o *opts) error {
+		o.eventHandler = handler
+		return nil
+	}
+}
+
+// WithParallelDecompression decompresses the data section of packages with up to blocks blocks of 1MB
+// read ahead and decompressed in parallel, which speeds up expanding large packages on many-core machines.
+// If blocks is 0 or less, it is set to GOMAXPROCS.
+func WithParallelDecompression(blocks int) Option {
+	return func(o *opts) error {
+		if blocks <= 0 {
+			blocks = runtime.GOMAXPROCS(0)
+		}
+		o.parallelBlocks = blocks
+		return nil
+	}
+}
+
+// WithParallelHashing computes the sha256 of the data section of packages in its own goroutine while
+// they are expanded, overlapping it with downloading and decompressing them.
+func WithParallelHashing(parallel bool) Option {
+	return func(o *opts) error {
+		o.parallelHash = parallel
+		return nil
+	}
+}
+
+// WithTempDir sets the scratch directory that packages are expanded and extracted through when they are not
+// cached, rather than os.TempDir, e.g. for a disk that is larger than /tmp. Before expanding a package, its
+// free space is checked against the size of the package, failing with ErrInsufficientSpace if it is short.
+func WithTempDir(dir string) Option {
+	return func(o *opts) error {
+		o.tempDir = dir
+		return nil
+	}
+}
+
+// WithTimeouts bounds how long installing packages, and each phase of it, may take. An operation that takes
+// longer fails with ErrTimeout, and the phase that took too long.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(o *opts) error {
+		o.timeouts = timeouts
+		return nil
+	}
+}
+
+// WithHooks sets the hooks that InstallPackages calls as it installs packages.
+func WithHooks(hooks Hooks) Option {
+	return func(o *opts) error {
+		if hooks == nil {
+			return errors.New("hooks must not be nil")
+		}
+		o.hooks = hooks
+		return nil
+	}
+}
+
+// WithRepositoryPriority sets the priority of the repository at repo, as it appears in etc/apk/repositories
+// without any @tag. When the same version of a package is in several repositories, the one in the repository
+// with the highest priority is installed. Repositories have priority 0 by default, and ties are broken by
+// the order of the repositories.
+func WithRepositoryPriority(repo string, priority int) Option {
+	return func(o *opts) error {
+		if o.repoPriorities == nil {
+			o.repoPriorities = make(map[string]int)
+		}
+		o.repoPriorities[repo] = priority
+		return nil
+	}
+}
+
+// WithRepositoryLayout sets the layout of the repository at repo, as it appears in etc/apk/repositories
+// without any @tag, for mirrors that do not follow the Alpine convention of a directory for each
+// architecture, e.g. "%{repo}" for a flat repository. See RepositoryURL.
+func WithRepositoryLayout(repo, layout string) Option {
+	return func(o *opts) error {
+		if err := ValidateRepositoryLayout(layout); err != nil {
+			return err
+		}
+		if o.repoLayouts == nil {
+			o.repoLayouts = make(map[string]string)
+		}
+		o.repoLayouts[repo] = layout
+		return nil
+	}
+}
+
+// WithDetachedSignatures requires a detached signature next to each package of the repositories at repos, as
+// they appear in etc/apk/repositories without any @tag, as in foo-1.0-r0.apk.sig, see signature.SignDetached.
+// The signature is verified with the keys of the repository, see WithRepositoryKeys, before the package is
+// installed, and a package without one is not installed. Packages that are already in the cache of WithCache
+// were verified when they were cached.
+func WithDetachedSignatures(repos ...string) Option {
+	return func(o *opts) error {
+		o.detachedSigRepos = append(o.detachedSigRepos, repos...)
+		return nil
+	}
+}
+
+// WithRepositoryKeys restricts the keys that can verify the index of the repository at repo, as it appears
+// in etc/apk/repositories without any @tag, to the named keys in etc/apk/keys, e.g.
+// "alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub". Repositories without keys set are verified by any
+// of the keys.
+func WithRepositoryKeys(repo string, keyNames ...string) Option {
+	return func(o *opts) error {
+		if len(keyNames) == 0 {
+			return fmt.Errorf("no keys for repository %s", repo)
+		}
+		if o.repoKeys == nil {
+			o.repoKeys = make(map[string][]string)
+		}
+		o.repoKeys[repo] = append(o.repoKeys[repo], keyNames...)
+		return nil
+	}
+}
+
+// WithRepositoryPartialResults sets whether GetRepositoryIndexes, and so resolving the world, goes on without
+// the repositories whose index cannot be read, logging a warning for each, rather than failing. It still fails
+// if none of the indexes can be read.
+func WithRepositoryPartialResults(partial bool) Option {
+	return func(o *opts) error {
+		o.partialIndexes = partial
+		return nil
+	}
+}
+
+// WithIndexDeltas sets whether only the changes to the indexes of HTTP repositories are fetched, from servers
+// that offer deltas, see WithIndexDeltaDir. The indexes are kept for it in the cache of WithCache, instead of
+// how the cache keeps them otherwise, so it does nothing without a cache or with an offline one.
+func WithIndexDeltas(deltas bool) Option {
+	return func(o *opts) error {
+		o.indexDeltas = deltas
+		return nil
+	}
+}
+
+// WithRepositoryVerifier sets a verifier that the indexes of the repositories must also pass, such as one for their
+// cosign signatures, see IndexVerifier. With only set, the verifier is checked instead of the signatures of the
+// indexes by the keys of the root. Indexes that are not verified, see WithNoSignatureIndexes, are not checked
+// by the verifier either, and the indexes are always fetched in full, see WithIndexDeltas.
+func WithRepositoryVerifier(verifier IndexVerifier, only bool) Option {
+	return func(o *opts) error {
+		o.indexVerifier = verifier
+		o.verifierOnly = only
+		return nil
+	}
+}
+
+// WithSignatureThreshold sets how many of the keys of the root must have signed each index of the repositories,
+// for indexes signed by several keys, see WithIndexSignatureThreshold. Any one of them will do by default.
+func WithSignatureThreshold(threshold int) Option {
+	return func(o *opts) error {
+		o.sigThreshold = threshold
+		return nil
+	}
+}
+
+// WithLazyIndexParsing sets whether the indexes of the repositories are parsed lazily, only reading the fields
+// needed to resolve packages up front, see IndexFromArchiveLazy. The packages that resolving the world selects
+// are parsed in full, but the packages of the indexes returned by GetRepositoryIndexes are not.
+func WithLazyIndexParsing(lazy bool) Option {
+	return func(o *opts) error {
+		o.lazyIndexes = lazy
+		return nil
+	}
+}
+
+// WithTransportWrapper wraps the transport of the HTTP client, see SetClient, with wrap, for all the requests
+// that go out to the network, for indexes, packages and keys. The transport is wrapped rather than the client
+// replaced, so that tracing, metrics or proxy middleware apply however the client is set up. Each wrapper wraps
+// those of earlier options, and responses served from the cache do not go through any of them.
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return func(o *opts) error {
+		o.transportWrappers = append(o.transportWrappers, wrap)
+		return nil
+	}
+}
+
+// WithProxy sets the proxy for all the requests that go out to the network, for indexes, packages and keys, as
+// the Proxy of http.Transport does, so that a socks5:// URL proxies through SOCKS5. See http.ProxyURL for a
+// single proxy. It is set on a copy of the transport of the client, see SetClient, when that is an
+// http.Transport or the default one; any other transport does its own proxying and is left as it is.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) Option {
+	return func(o *opts) error {
+		o.proxy = proxy
+		return nil
+	}
+}
+
+// WithDialContext sets how connections are made for all the requests that go out to the network, for indexes,
+// packages and keys, as the DialContext of http.Transport does, e.g. the DialContext of a net.Dialer with other
+// timeouts, or one that dials a unix socket whatever the address. As with WithProxy, it only applies to an
+// http.Transport or the default one.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(o *opts) error {
+		o.dialContext = dial
+		return nil
+	}
+}
+
+// WithFetchPolicy denies the fetches of indexes, packages and keys, and their redirects, that policy denies,
+// with an ErrFetchDenied error, before any request is made for them. Each policy is asked in addition to those
+// of earlier options.
+func WithFetchPolicy(policy FetchPolicy) Option {
+	return func(o *opts) error {
+		o.fetchPolicies = append(o.fetchPolicies, policy)
+		return nil
+	}
+}
+
+// WithStrictVersions sets whether resolving parses and compares the versions of packages strictly, rejecting
+// some that apk-tools accepts, rather than exactly as apk-tools does. See PkgResolver.SetStrictVersions.
+// Default is false.
+func WithStrictVersions(strict bool) Option {
+	return func(o *opts) error {
+		o.strictVersions = strict
+		return nil
+	}
+}
+
+// WithContentsDB sets whether InstallPackages records every file it installs, with its package and checksum,
+// in lib/apk/db/contents, so that files can be attributed to packages later without reading any package.
+// See GetContents.
+func WithContentsDB(enabled bool) Option {
+	return func(o *opts) error {
+		o.contentsDB = enabled
+		return nil
+	}
+}
+
+// WithStrictVerification sets whether to fail closed on anything that cannot be verified. Every index must be
+// signed by a trusted key, so WithNoSignatureIndexes and ignoring signatures are errors, and every package must
+// have the checksum of its control section that the index has for it, and a datahash that its data section
+// matches. The .apk files in the world must be signed by a trusted key, so WithAllowUntrusted is an error.
+// Failures are ErrSignatureInvalid or ErrChecksumMismatch. Default is false.
+func WithStrictVerification(strict bool) Option {
+	return func(o *opts) error {
+		o.strictVerification = strict
+		return nil
+	}
+}
+
+// WithChecksumVerification sets whether each package that is fetched must have the checksum of its control section
+// that the index has for it, if it has one, rather than trusting the mirror and TLS for what it serves; the datahash
+// in the control section then vouches for the data section. Mismatches are ErrChecksumMismatch. Default is true.
+// Packages without a checksum, such as local .apk files, are not checked, unless with WithStrictVerification, which
+// cannot be combined with turning this off.
+func WithChecksumVerification(verify bool) Option {
+	return func(o *opts) error {
+		o.checksums = verify
+		return nil
+	}
+}
+
+// WithConfigDir sets the directory of the apk configuration in the root, by default etc/apk, where world,
+// repositories, arch, keys and protected_paths.d are read and written by InitDB, InitKeyring, SetWorld and the like.
+func WithConfigDir(dir string) Option {
+	return func(o *opts) error {
+		clean, err := layoutDir(dir)
+		if err != nil {
+			return fmt.Errorf("config dir: %w", err)
+		}
+		o.configDir = clean
+		return nil
+	}
+}
+
+// WithDatabaseDir sets the directory of the apk database in the root, by default lib/apk/db, where the installed,
+// scripts.tar, triggers and contents files are, e.g. usr/lib/apk/db for distributions with a merged /usr.
+func WithDatabaseDir(dir string) Option {
+	return func(o *opts) error {
+		clean, err := layoutDir(dir)
+		if err != nil {
+			return fmt.Errorf("database dir: %w", err)
+		}
+		o.databaseDir = clean
+		return nil
+	}
+}
+
+// WithHostConfig reads the repositories and keys from etc/apk/repositories and etc/apk/keys of host, such as
+// os.DirFS("/"), rather than from the root that packages are installed into, as apk --root /target add does
+// with the configuration of the host. The world, arch and installed database are still those of the root, and
+// InitDB, SetRepositories and InitKeyring still write to the root. Key files passed to InitKeyring, and the
+// cache directory of WithCache, are paths on the host in any case.
+func WithHostConfig(host fs.FS) Option {
+	return func(o *opts) error {
+		if host == nil {
+			return errors.New("host config filesystem must not be nil")
+		}
+		o.hostConfig = host
+		return nil
+	}
+}
+
+// WithOptionalPackages marks the packages of the world with names as optional when resolving it, so that they
+// are installed if they can be resolved, and skipped with a warning if not, such as packages that only exist
+// for x86_64. See PkgResolver.SetOptional.
+func WithOptionalPackages(names ...string) Option {
+	return func(o *opts) error {
+		o.optionalPackages = append(o.optionalPackages, names...)
+		return nil
+	}
+}
+
+// WithVirtualPackages adds virtual packages to resolve the world from, see NewVirtualPackage, so that a world
+// with the name of one installs its dependencies, and the virtual package itself in the installed database,
+// without any files.
+func WithVirtualPackages(pkgs ...*Package) Option {
+	return func(o *opts) error {
+		o.virtualPackages = append(o.virtualPackages, pkgs...)
+		return nil
+	}
+}
+
+// WithAllowUntrusted sets whether the .apk files in the world are installed even if they are not signed by any
+// of the keys in etc/apk/keys, as apk add --allow-untrusted does. It is an error with WithStrictVerification.
+// Default is false.
+func WithAllowUntrusted(allow bool) Option {
+	return func(o *opts) error {
+		o.allowUntrusted = allow
+		return nil
+	}
+}
+
+// WithHolds holds packages at versions when resolving the world, e.g. foo=1.2.3-r0, so that they are not
+// upgraded past them even when newer versions exist. See PkgResolver.SetHolds.
+func WithHolds(holds ...string) Option {
+	return func(o *opts) error {
+		for _, h := range holds {
+			if _, err := parseHold(h); err != nil {
+				return err
+			}
+		}
+		o.holds = append(o.holds, holds...)
+		return nil
+	}
+}
+
 type auth struct{ user, pass string }
 
 func WithAuth(domain, user, pass string) Option {
@@ -122,5 +571,9 @@ func defaultOpts() *opts {
 	return &opts{
 		arch:              ArchToAPK(runtime.GOARCH),
 		ignoreMknodErrors: false,
+		hooks:             NoopHooks{},
+		checksums:         true,
+		configDir:         defaultConfigDir,
+		databaseDir:       defaultDatabaseDir,
 	}
 }
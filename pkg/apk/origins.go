@@ -0,0 +1,60 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+// OriginName returns the origin of pkg, the package it was built from, e.g. foo for foo-dev and foo-doc. A
+// package without an origin is its own origin.
+func OriginName(pkg *Package) string {
+	if pkg.Origin != "" {
+		return pkg.Origin
+	}
+	return pkg.Name
+}
+
+// ByOrigin groups the packages of the index by their origin, see OriginName, in the order of the index. Each
+// group has all the versions of the origin that the index has.
+func (a *APKIndex) ByOrigin() map[string][]*Package {
+	groups := make(map[string][]*Package)
+	for _, pkg := range a.Packages {
+		origin := OriginName(pkg)
+		groups[origin] = append(groups[origin], pkg)
+	}
+	return groups
+}
+
+// Subpackages returns the packages of the index that are built from origin, of any version, in the order of
+// the index.
+func (a *APKIndex) Subpackages(origin string) []*Package {
+	var pkgs []*Package
+	for _, pkg := range a.Packages {
+		if OriginName(pkg) == origin {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// Siblings returns the other packages of the index that were built together with pkg, i.e. that have the same
+// origin and version, e.g. foo-dev and foo-doc for foo, in the order of the index.
+func (a *APKIndex) Siblings(pkg *Package) []*Package {
+	origin := OriginName(pkg)
+	var pkgs []*Package
+	for _, other := range a.Packages {
+		if other != pkg && other.Version == pkg.Version && OriginName(other) == origin {
+			pkgs = append(pkgs, other)
+		}
+	}
+	return pkgs
+}
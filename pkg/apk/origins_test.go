@@ -0,0 +1,45 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrigins(t *testing.T) {
+	foo := &Package{Name: "foo", Version: "1.0-r0", Origin: "foo"}
+	fooDev := &Package{Name: "foo-dev", Version: "1.0-r0", Origin: "foo"}
+	fooDoc := &Package{Name: "foo-doc", Version: "1.0-r0", Origin: "foo"}
+	fooNext := &Package{Name: "foo", Version: "1.1-r0", Origin: "foo"}
+	bar := &Package{Name: "bar", Version: "2.0-r0"}
+	index := &APKIndex{Packages: []*Package{foo, bar, fooDev, fooNext, fooDoc}}
+
+	require.Equal(t, "foo", OriginName(fooDev))
+	require.Equal(t, "bar", OriginName(bar))
+
+	require.Equal(t, map[string][]*Package{
+		"foo": {foo, fooDev, fooNext, fooDoc},
+		"bar": {bar},
+	}, index.ByOrigin())
+	require.Equal(t, []*Package{foo, fooDev, fooNext, fooDoc}, index.Subpackages("foo"))
+	require.Empty(t, index.Subpackages("baz"))
+
+	require.Equal(t, []*Package{fooDev, fooDoc}, index.Siblings(foo))
+	require.Equal(t, []*Package{foo, fooDoc}, index.Siblings(fooDev))
+	require.Empty(t, index.Siblings(fooNext))
+	require.Empty(t, index.Siblings(bar))
+}
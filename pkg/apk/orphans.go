@@ -0,0 +1,161 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InstallReason is why a package is installed.
+type InstallReason int
+
+const (
+	// InstallReasonDependency is a package that is installed because another package needs it.
+	InstallReasonDependency InstallReason = iota
+	// InstallReasonExplicit is a package that is installed because it is in /etc/apk/world.
+	InstallReasonExplicit
+)
+
+func (r InstallReason) String() string {
+	switch r {
+	case InstallReasonDependency:
+		return "dependency"
+	case InstallReasonExplicit:
+		return "explicit"
+	default:
+		return "unknown"
+	}
+}
+
+// GetInstallReasons returns why each installed package, by name, is installed. As with apk-tools, the
+// record of the packages that were explicitly requested is /etc/apk/world, so a package removed from
+// world becomes a dependency, or an orphan if nothing else needs it.
+func (a *APK) GetInstallReasons() (map[string]InstallReason, error) {
+	installed, world, err := a.installedAndWorld()
+	if err != nil {
+		return nil, err
+	}
+	reasons := make(map[string]InstallReason, len(installed))
+	for _, pkg := range installed {
+		reasons[pkg.Name] = InstallReasonDependency
+	}
+	for _, pkg := range explicitPackages(installed, world) {
+		reasons[pkg.Name] = InstallReasonExplicit
+	}
+	return reasons, nil
+}
+
+// GetOrphans returns the installed packages that are not needed by the packages in /etc/apk/world,
+// neither directly nor by a chain of dependencies or install_if, in the order they are installed.
+// These are the packages that autoremove would remove.
+func (a *APK) GetOrphans() ([]*InstalledPackage, error) {
+	installed, world, err := a.installedAndWorld()
+	if err != nil {
+		return nil, err
+	}
+
+	// the resolver is only used for its caches of parsed versions and constraints
+	p := newPkgResolver(nil, a.strictVersions)
+
+	needed := make(map[*InstalledPackage]bool, len(installed))
+	queue := explicitPackages(installed, world)
+	for _, pkg := range queue {
+		needed[pkg] = true
+	}
+	for len(queue) != 0 {
+		for len(queue) != 0 {
+			pkg := queue[0]
+			queue = queue[1:]
+			for _, dep := range installed {
+				if !needed[dep] && p.dependsOn(&pkg.Package, &dep.Package) {
+					needed[dep] = true
+					queue = append(queue, dep)
+				}
+			}
+		}
+		// install_if packages are needed while everything they are installed for is needed
+		for _, pkg := range installed {
+			if !needed[pkg] && len(pkg.InstallIf) != 0 && installIfMet(p, pkg, installed, needed) {
+				needed[pkg] = true
+				queue = append(queue, pkg)
+			}
+		}
+	}
+
+	var orphans []*InstalledPackage
+	for _, pkg := range installed {
+		if !needed[pkg] {
+			orphans = append(orphans, pkg)
+		}
+	}
+	return orphans, nil
+}
+
+func (a *APK) installedAndWorld() ([]*InstalledPackage, []string, error) {
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting world packages: %w", err)
+	}
+	return installed, world, nil
+}
+
+// explicitPackages returns the installed packages that are named in world, or, for a name in world
+// that no installed package has, the first one that provides it.
+func explicitPackages(installed []*InstalledPackage, world []string) []*InstalledPackage {
+	var explicit []*InstalledPackage
+	for _, constraint := range world {
+		if strings.HasPrefix(constraint, "!") {
+			continue
+		}
+		name := resolvePackageNameVersionPin(constraint).name
+		if pkg := installedProvider(installed, name); pkg != nil {
+			explicit = append(explicit, pkg)
+		}
+	}
+	return explicit
+}
+
+func installedProvider(installed []*InstalledPackage, name string) *InstalledPackage {
+	for _, pkg := range installed {
+		if pkg.Name == name {
+			return pkg
+		}
+	}
+	for _, pkg := range installed {
+		for _, prov := range pkg.Provides {
+			if resolvePackageNameVersionPin(prov).name == name {
+				return pkg
+			}
+		}
+	}
+	return nil
+}
+
+// installIfMet reports whether every install_if condition of pkg is a needed package.
+func installIfMet(p *PkgResolver, pkg *InstalledPackage, installed []*InstalledPackage, needed map[*InstalledPackage]bool) bool {
+	for _, cond := range pkg.InstallIf {
+		constraint := p.resolvePackageNameVersionPin(cond)
+		provider := installedProvider(installed, constraint.name)
+		if provider == nil || !needed[provider] || !p.satisfiesPackage(&provider.Package, constraint) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ownerIndex maps the files in the installed database to the packages that own them. It is
+// built for the installed database with the size and modification time it has.
+type ownerIndex struct {
+	sync.Mutex
+
+	size    int64
+	modTime time.Time
+	owners  map[string]*InstalledPackage
+}
+
+// OwnerOf returns the installed package that owns the file at path, within the root, with or without
+// a leading /, as in apk info --who-owns. If more than one package has the file, the one installed
+// last owns it. The index of owners is built from the installed database the first time, and again
+// only when the database changes, so scanners can attribute many files cheaply.
+func (a *APK) OwnerOf(path string) (*InstalledPackage, error) {
+	owners, err := a.owners()
+	if err != nil {
+		return nil, err
+	}
+	pkg, ok := owners[strings.TrimPrefix(filepath.Clean("/"+path), "/")]
+	if !ok {
+		return nil, withKind(ErrPackageNotFound, fmt.Errorf("could not find owner package of %s", path))
+	}
+	return pkg, nil
+}
+
+// owners returns the index of the files in the installed database to their owners, building it
+// again if the installed database has changed since it was last built.
+func (a *APK) owners() (map[string]*InstalledPackage, error) {
+	fi, err := a.fs.Stat(a.layoutPath(installedFilePath))
+	if err != nil {
+		return nil, fmt.Errorf("could not stat installed file at %s: %w", a.layoutPath(installedFilePath), err)
+	}
+
+	idx := &a.ownerIndex
+	idx.Lock()
+	defer idx.Unlock()
+	if idx.owners != nil && idx.size == fi.Size() && idx.modTime.Equal(fi.ModTime()) {
+		return idx.owners, nil
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+	owners := map[string]*InstalledPackage{}
+	for _, pkg := range installed {
+		for _, file := range pkg.InstalledFiles() {
+			if !file.Dir {
+				owners[file.Path] = pkg
+			}
+		}
+	}
+	idx.size, idx.modTime, idx.owners = fi.Size(), fi.ModTime(), owners
+	return owners, nil
+}
+
+// installedOwner returns the package that owned the file at name in the installed database when InstallPackages
+// started, and the checksum it recorded for the file, nil if it has none.
+func (a *APK) installedOwner(name string) (*InstalledPackage, []byte, bool) {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	pkg, ok := a.dbOwners[name]
+	if !ok {
+		return nil, nil, false
+	}
+	file, _ := pkg.File(name)
+	return pkg, file.Checksum, true
+}
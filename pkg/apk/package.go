@@ -16,7 +16,6 @@ package apk
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"strings"
@@ -91,6 +90,12 @@ func (p *Package) String() string {
 }
 func (p *Package) PackageName() string { return p.Name }
 
+// MatchesArch returns whether the package can be installed on arch, which it can if it is for the same
+// architecture, under any name ArchToAPK knows, or for no particular architecture.
+func (p *Package) MatchesArch(arch string) bool {
+	return p.Arch == "" || p.Arch == NoArch || ArchesEqual(p.Arch, arch)
+}
+
 // Filename returns the package filename as it's named in a repository.
 func (p *Package) Filename() string {
 	// Note: Doesn't use fmt.Sprintf because we call this a lot when we disqualify images.
@@ -99,7 +104,7 @@ func (p *Package) Filename() string {
 
 // ChecksumString returns a human-readable version of the control section checksum.
 func (p *Package) ChecksumString() string {
-	return "Q1" + base64.StdEncoding.EncodeToString(p.Checksum)
+	return FormatChecksum(p.Checksum)
 }
 
 // ParsePackage parses a .apk file and returns a Package struct
@@ -111,6 +116,11 @@ func ParsePackage(ctx context.Context, apkPackage io.Reader) (*Package, error) {
 
 	defer expanded.Close()
 
+	return parseExpandedPackage(expanded)
+}
+
+// parseExpandedPackage returns the Package of the package expanded as expanded, see ParsePackage.
+func parseExpandedPackage(expanded *expandapk.APKExpanded) (*Package, error) {
 	r, err := expanded.ControlFS.Open(".PKGINFO")
 	if err != nil {
 		return nil, fmt.Errorf("expanded.ControlData(): %v", err)
@@ -128,7 +138,9 @@ func ParsePackage(ctx context.Context, apkPackage io.Reader) (*Package, error) {
 	pkg.BuildTime = time.Unix(pkg.BuildDate, 0).UTC()
 	pkg.InstalledSize = pkg.Size
 	pkg.Size = uint64(expanded.Size)
-	pkg.Checksum = expanded.ControlHash
+	if pkg.Checksum, err = expandedChecksum(expanded); err != nil {
+		return nil, err
+	}
 
 	return pkg, nil
 }
@@ -0,0 +1,76 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"go.opentelemetry.io/otel"
+)
+
+// InstallPlan is what installing a world would fetch and install, see Plan.
+type InstallPlan struct {
+	// Packages are the packages that would be installed, in the order they would be. Packages that already
+	// are installed are not in it, unless they are installed at another version or build, which they replace.
+	Packages []*RepositoryPackage
+	// DownloadSize is the sum of the sizes of the Packages, as their indexes have them, whether or not they
+	// are in the cache.
+	DownloadSize uint64
+	// InstalledSize is the sum of the installed sizes of the Packages, as their indexes have them.
+	InstalledSize uint64
+}
+
+// Plan resolves the world, and returns what installing it would do, from the indexes alone, without fetching
+// any package. This is so that callers can reject an install that is too large before paying for it. Packages
+// that already are installed in the root are left out; a root without an apk database has none.
+func (a *APK) Plan(ctx context.Context, world []string) (_ *InstallPlan, err error) {
+	ctx, cancel := withTimeout(ctx, a.timeouts.Total, "planning")
+	defer cancel()
+	defer func() { err = timedOut(ctx, err) }()
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Plan")
+	defer span.End()
+
+	indexes, err := a.worldIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pkgs, _, err := a.resolve(ctx, indexes, world)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+
+	installed, err := a.GetInstalled()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error getting installed packages: %w", err)
+	}
+	instPkgs := make([]InstallablePackage, len(pkgs))
+	for i, pkg := range pkgs {
+		instPkgs[i] = pkg
+	}
+
+	plan := &InstallPlan{}
+	todo, _ := a.notInstalled(ctx, installed, instPkgs)
+	for _, pkg := range todo {
+		pkg := pkg.(*RepositoryPackage)
+		plan.Packages = append(plan.Packages, pkg)
+		plan.DownloadSize += pkg.Size
+		plan.InstalledSize += pkg.InstalledSize
+	}
+	return plan, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestPlan(t *testing.T) {
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+
+	repoDir := t.TempDir()
+	b, err := os.ReadFile("testdata/replaces/replaces-0.0.1-r0.apk")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "replaces-0.0.1-r0.apk"), b, 0o644))
+	pkg, err := ParsePackage(ctx, bytes.NewReader(b))
+	require.NoError(t, err)
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{pkg}})
+	require.NoError(t, err)
+	index, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "APKINDEX.tar.gz"), index, 0o644))
+
+	transport := &recordingTransport{next: &testLocalTransport{root: repoDir, basenameOnly: true}}
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(ignoreMknodErrors),
+		WithNoSignatureIndexes("https://example.com/repo"))
+	require.NoError(t, err, "unable to create APK")
+	a.SetClient(&http.Client{Transport: transport})
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/repo"}))
+
+	plan, err := a.Plan(ctx, []string{"replaces"})
+	require.NoError(t, err)
+	require.Len(t, plan.Packages, 1)
+	require.Equal(t, "replaces", plan.Packages[0].Name)
+	require.Positive(t, plan.DownloadSize)
+	require.Equal(t, pkg.Size, plan.DownloadSize)
+	require.Equal(t, pkg.InstalledSize, plan.InstalledSize)
+
+	for _, u := range transport.requested {
+		require.NotContains(t, u, ".apk", "no package should be fetched to plan")
+	}
+
+	require.NoError(t, a.InstallPackages(ctx, nil, []InstallablePackage{plan.Packages[0]}))
+	plan, err = a.Plan(ctx, []string{"replaces"})
+	require.NoError(t, err)
+	require.Empty(t, plan.Packages)
+	require.Zero(t, plan.DownloadSize)
+	require.Zero(t, plan.InstalledSize)
+}
+
+// recordingTransport records the URLs of the requests it passes on to the next transport.
+type recordingTransport struct {
+	next      http.RoundTripper
+	mu        sync.Mutex
+	requested []string
+}
+
+func (t *recordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requested = append(t.requested, request.URL.String())
+	t.mu.Unlock()
+	return t.next.RoundTrip(request)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// FetchPolicy decides whether a URL may be fetched, returning why not if it may not. It is asked before any
+// request is made for an http or https URL, and for every redirect, whether or not the response would come
+// from the cache. See WithFetchPolicy and WithIndexFetchPolicy.
+type FetchPolicy func(u *url.URL) error
+
+// DenyInsecure is a FetchPolicy that denies plain http URLs.
+func DenyInsecure() FetchPolicy {
+	return func(u *url.URL) error {
+		if u.Scheme != "https" {
+			return fmt.Errorf("scheme %s is not https", u.Scheme)
+		}
+		return nil
+	}
+}
+
+// AllowHosts is a FetchPolicy that denies URLs of any other host than hosts, such as the approved mirrors. A
+// host matches with or without the port of the URL.
+func AllowHosts(hosts ...string) FetchPolicy {
+	return func(u *url.URL) error {
+		for _, host := range hosts {
+			if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host %s is not allowed", u.Host)
+	}
+}
+
+// checkFetch returns an ErrFetchDenied error if any of policies denies u.
+func checkFetch(policies []FetchPolicy, u *url.URL) error {
+	for _, policy := range policies {
+		if err := policy(u); err != nil {
+			return withKind(ErrFetchDenied, fmt.Errorf("fetching %s is denied: %w", u.Redacted(), err))
+		}
+	}
+	return nil
+}
+
+// checkPackageFetch returns an ErrFetchDenied error if pkg is in an http or https repository, and any of the
+// policies of WithFetchPolicy denies its URL.
+func (a *APK) checkPackageFetch(pkg InstallablePackage) error {
+	if len(a.fetchPolicies) == 0 {
+		return nil
+	}
+	asURL, err := packageAsURL(pkg)
+	if err != nil {
+		return fmt.Errorf("failed to parse package as URL: %w", err)
+	}
+	if asURL.Scheme != "https" && asURL.Scheme != "http" {
+		return nil
+	}
+	return checkFetch(a.fetchPolicies, asURL)
+}
+
+// policyClient returns a copy of client with its transport, or the default one, wrapped to deny the requests,
+// including redirects, that any of policies denies, or client itself if there are no policies.
+func policyClient(client *http.Client, policies []FetchPolicy) *http.Client {
+	if len(policies) == 0 || client == nil {
+		return client
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	wrapped := *client
+	wrapped.Transport = &policyTransport{policies: policies, next: transport}
+	return &wrapped
+}
+
+type policyTransport struct {
+	policies []FetchPolicy
+	next     http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkFetch(t.policies, req.URL); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchPolicies(t *testing.T) {
+	for _, tt := range []struct {
+		policy FetchPolicy
+		u      string
+		denied bool
+	}{
+		{DenyInsecure(), "https://repo.example.com/main", false},
+		{DenyInsecure(), "http://repo.example.com/main", true},
+		{AllowHosts("repo.example.com"), "https://repo.example.com/main", false},
+		{AllowHosts("repo.example.com"), "https://REPO.example.com:8443/main", false},
+		{AllowHosts("repo.example.com:8443"), "https://repo.example.com:8443/main", false},
+		{AllowHosts("repo.example.com:8443"), "https://repo.example.com/main", true},
+		{AllowHosts("repo.example.com"), "https://mirror.example.com/main", true},
+		{AllowHosts(), "https://repo.example.com/main", true},
+	} {
+		u, err := url.Parse(tt.u)
+		require.NoError(t, err)
+		err = checkFetch([]FetchPolicy{tt.policy}, u)
+		if tt.denied {
+			require.ErrorIs(t, err, ErrFetchDenied, tt.u)
+		} else {
+			require.NoError(t, err, tt.u)
+		}
+	}
+}
+
+func TestWithFetchPolicy(t *testing.T) {
+	ctx := context.Background()
+	const repo = "http://repo.invalid/alpine/v3.16/main"
+
+	var requested []string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.String())
+		if req.URL.Host == "redirect.invalid" {
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": []string{"http://evil.invalid/key.rsa.pub"}},
+				Body:       io.NopCloser(bytes.NewReader(nil)),
+				Request:    req,
+			}, nil
+		}
+		return (&testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}).RoundTrip(req)
+	})
+	newAPK := func(t *testing.T, opts ...Option) *APK {
+		globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+		_, src, err := testGetTestAPK()
+		require.NoError(t, err)
+		require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+		require.NoError(t, src.WriteFile(archFilePath, []byte(testArch+"\n"), 0o644))
+		require.NoError(t, src.WriteFile(reposFilePath, []byte(repo), 0o644))
+		a, err := New(append([]Option{WithFS(src)}, opts...)...)
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: transport})
+		requested = nil
+		return a
+	}
+
+	// the package of an index that was fetched before the policy
+	indexes, err := newAPK(t).GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	pkgs, err := NewPkgResolver(ctx, indexes).ResolvePackage(testPkg.Name, nil)
+	require.NoError(t, err)
+	pkg := pkgs[0]
+
+	t.Run("index", func(t *testing.T) {
+		_, err := newAPK(t, WithFetchPolicy(DenyInsecure())).GetRepositoryIndexes(ctx, true)
+		require.ErrorIs(t, err, ErrFetchDenied)
+		require.Empty(t, requested)
+	})
+	t.Run("package", func(t *testing.T) {
+		a := newAPK(t, WithFetchPolicy(AllowHosts("mirror.invalid")))
+		_, err := a.FetchPackage(ctx, pkg)
+		require.ErrorIs(t, err, ErrFetchDenied)
+		_, err = a.expandPackage(ctx, pkg)
+		require.ErrorIs(t, err, ErrFetchDenied)
+		require.Empty(t, requested)
+	})
+	t.Run("key", func(t *testing.T) {
+		a := newAPK(t, WithFetchPolicy(DenyInsecure()))
+		err := a.InitKeyring(ctx, []string{"http://repo.invalid/key.rsa.pub"}, nil)
+		require.ErrorIs(t, err, ErrFetchDenied)
+		require.Empty(t, requested)
+	})
+	t.Run("redirect", func(t *testing.T) {
+		a := newAPK(t, WithFetchPolicy(AllowHosts("redirect.invalid")))
+		err := a.InitKeyring(ctx, []string{"http://redirect.invalid/key.rsa.pub"}, nil)
+		require.ErrorIs(t, err, ErrFetchDenied)
+		require.Equal(t, []string{"http://redirect.invalid/key.rsa.pub"}, requested)
+	})
+	t.Run("allowed", func(t *testing.T) {
+		a := newAPK(t, WithFetchPolicy(AllowHosts("repo.invalid")))
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		rc, err := a.FetchPackage(ctx, pkg)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Len(t, requested, 2)
+	})
+}
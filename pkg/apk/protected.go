@@ -0,0 +1,102 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// protectedPath is a single entry from a protected_paths.d list file.
+type protectedPath struct {
+	path      string
+	protected bool
+}
+
+// loadProtectedPaths reads all of the *.list files in etc/apk/protected_paths.d, with the same
+// semantics as apk-tools:
+//
+//	+path  files under path are protected
+//	!path  files under path are protected, changes to them are ignored by audit
+//	@path  only symlinks under path are protected
+//	-path  files under path are not protected
+//
+// The most specific path wins. A missing directory means nothing is protected.
+func (a *APK) loadProtectedPaths() ([]protectedPath, error) {
+	entries, err := a.fs.ReadDir(a.layoutPath(protectedPathsDirPath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read protected paths in %s: %w", a.layoutPath(protectedPathsDirPath), err)
+	}
+
+	var paths []protectedPath
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".list") {
+			continue
+		}
+		filename := path.Join(a.layoutPath(protectedPathsDirPath), e.Name())
+		b, err := a.fs.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not read protected paths file %s: %w", filename, err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) < 2 {
+				continue
+			}
+			p := strings.Trim(path.Clean(line[1:]), "/")
+			switch line[0] {
+			case '+', '!':
+				paths = append(paths, protectedPath{path: p, protected: true})
+			case '@', '-':
+				// We only protect regular files, so symlink-only protection is the same as none.
+				paths = append(paths, protectedPath{path: p, protected: false})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("could not parse protected paths file %s: %w", filename, err)
+		}
+	}
+	return paths, nil
+}
+
+// isProtected reports whether the file at name is under a protected path.
+func (a *APK) isProtected(name string) bool {
+	name = strings.TrimPrefix(path.Clean(name), "/")
+
+	var (
+		protected bool
+		longest   = -1
+	)
+	for _, p := range a.protectedPaths {
+		if name != p.path && !strings.HasPrefix(name, p.path+"/") {
+			continue
+		}
+		if len(p.path) >= longest {
+			longest = len(p.path)
+			protected = p.protected
+		}
+	}
+	return protected
+}
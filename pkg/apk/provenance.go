@@ -0,0 +1,144 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// provenanceExt is the extension of the file stored next to an artifact in the cache, recording where it came
+// from, see CacheProvenance.
+const provenanceExt = ".provenance"
+
+// cacheFileHeader is set on the responses the cache serves to the file in the cache that they are read from.
+const cacheFileHeader = "X-Go-Apk-Cache-File"
+
+// CacheProvenance is where an artifact in the cache came from, as recorded when it was cached, so that builds
+// can attest exactly where the bits they used came from. See ReadCacheProvenance.
+type CacheProvenance struct {
+	// URL is the URL the artifact was fetched from, with any password redacted.
+	URL string `json:"url"`
+	// FetchedAt is when the artifact was fetched.
+	FetchedAt time.Time `json:"fetchedAt"`
+	// ETag is the etag the server gave for the artifact, if any.
+	ETag string `json:"etag,omitempty"`
+	// Headers are the headers of the response the artifact was read from, without any cookies.
+	Headers http.Header `json:"headers,omitempty"`
+	// Checksum is the Q1 checksum of a package, as in an APKINDEX.
+	Checksum string `json:"checksum,omitempty"`
+	// Verification is which key verified the signature of the artifact, if it was checked: that of an
+	// index, or the detached signature of a package, see WithDetachedSignatures.
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// ReadCacheProvenance returns the provenance of the artifact in the cache at file, such as the index that
+// IndexFetch.CacheFile names. Packages are cached in parts, see APK.CachedPackageProvenance for theirs.
+func ReadCacheProvenance(file string) (*CacheProvenance, error) {
+	b, err := os.ReadFile(file + provenanceExt)
+	if err != nil {
+		return nil, fmt.Errorf("reading provenance of %s: %w", file, err)
+	}
+	var p CacheProvenance
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parsing provenance of %s: %w", file, err)
+	}
+	return &p, nil
+}
+
+// CachedPackageProvenance returns the provenance of pkg in the cache of WithCache, as recorded when it was
+// fetched and cached.
+func (a *APK) CachedPackageProvenance(pkg InstallablePackage) (*CacheProvenance, error) {
+	if a.cache == nil {
+		return nil, fmt.Errorf("no cache to read the provenance of %s from", pkg.PackageName())
+	}
+	file, err := packageProvenanceFile(a.cache, pkg)
+	if err != nil {
+		return nil, err
+	}
+	return ReadCacheProvenance(file)
+}
+
+// packageProvenanceFile returns the file in the cache that the provenance of pkg is stored next to, which is
+// named by its checksum, as its parts are.
+func packageProvenanceFile(c *cache, pkg InstallablePackage) (string, error) {
+	cacheDir, err := cacheDirForPackage(c.dir, c.keys, pkg)
+	if err != nil {
+		return "", err
+	}
+	checksum, err := packageChecksum(pkg)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, hex.EncodeToString(checksum)), nil
+}
+
+// provenanceFromResponse returns the provenance of what was read from u, with a response with header if any.
+func provenanceFromResponse(u string, header http.Header) *CacheProvenance {
+	p := &CacheProvenance{URL: u, FetchedAt: time.Now()}
+	if header != nil {
+		p.ETag, _ = etagFromResponse(&http.Response{Header: header})
+		p.Headers = header.Clone()
+		p.Headers.Del("Set-Cookie")
+		p.Headers.Del(cacheHitHeader)
+		p.Headers.Del(cacheFileHeader)
+	}
+	return p
+}
+
+// writeProvenance stores p next to the artifact in the cache at file.
+func writeProvenance(file string, p *CacheProvenance) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file+provenanceExt, b)
+}
+
+// recordCacheVerification adds which key verified the artifact in the cache at file to its provenance.
+func recordCacheVerification(file string, verification *Verification) error {
+	p, err := ReadCacheProvenance(file)
+	if err != nil {
+		return err
+	}
+	p.Verification = verification
+	return writeProvenance(file, p)
+}
+
+// writeFileAtomic writes b to name through a temporary file next to it, so that name is never read half
+// written.
+func writeFileAtomic(name string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, werr := tmp.Write(b)
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	return os.Rename(tmp.Name(), name)
+}
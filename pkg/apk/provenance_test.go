@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+)
+
+func TestCacheProvenance(t *testing.T) {
+	ctx := context.Background()
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	headers := map[string][]string{
+		http.CanonicalHeaderKey("etag"): {"an-etag"},
+		"Set-Cookie":                    {"session=secret"},
+		"X-Served-By":                   {"mirror-1"},
+	}
+
+	t.Run("index", func(t *testing.T) {
+		repoDir := t.TempDir()
+		keyFile, pub := testSigningKey(t, t.TempDir(), "test.rsa")
+		signer, err := sign.NewKeySigner(keyFile)
+		require.NoError(t, err)
+		testSignedIndex(t, filepath.Join(repoDir, indexFilename), signer)
+
+		c := &cache{dir: t.TempDir()}
+		client := c.client(&http.Client{Transport: &testLocalTransport{root: repoDir, basenameOnly: true, headers: headers}}, true)
+		u := IndexURL("https://example.com/provenance", testArch)
+		_, fetch, err := getRepositoryIndex(ctx, u, map[string][]byte{"test.rsa.pub": pub}, testArch, &indexOpts{httpClient: client})
+		require.NoError(t, err)
+		require.NotEmpty(t, fetch.CacheFile)
+
+		provenance, err := ReadCacheProvenance(fetch.CacheFile)
+		require.NoError(t, err)
+		require.Equal(t, u, provenance.URL)
+		require.Equal(t, "an-etag", provenance.ETag)
+		require.False(t, provenance.FetchedAt.IsZero())
+		require.Equal(t, "mirror-1", provenance.Headers.Get("X-Served-By"))
+		require.Empty(t, provenance.Headers.Get("Set-Cookie"))
+		require.NotNil(t, provenance.Verification)
+		require.Equal(t, "test.rsa.pub", provenance.Verification.KeyName)
+	})
+	t.Run("package", func(t *testing.T) {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithCache(t.TempDir(), false))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true, headers: headers},
+		})
+		repo := Repository{URI: fmt.Sprintf("%s/%s", testAlpineRepos, testArch)}
+		pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+
+		_, err = a.CachedPackageProvenance(pkg)
+		require.Error(t, err, "the package is not cached yet")
+		exp, err := a.expandPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer exp.Close()
+
+		provenance, err := a.CachedPackageProvenance(pkg)
+		require.NoError(t, err)
+		require.Equal(t, pkg.URL(), provenance.URL)
+		require.Equal(t, testPkg.ChecksumString(), provenance.Checksum)
+		require.Equal(t, "an-etag", provenance.ETag)
+		require.Equal(t, "mirror-1", provenance.Headers.Get("X-Served-By"))
+		require.Nil(t, provenance.Verification)
+	})
+}
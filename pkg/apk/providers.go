@@ -0,0 +1,75 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+// Provider is a package that provides a name, see PkgResolver.Providers.
+type Provider struct {
+	Package *RepositoryPackage
+	// Version is the version of the name that the package provides, which is the version of the package if it
+	// has the name, and empty if it provides the name without a version.
+	Version string
+	// ProviderPriority is the provider_priority of the package, which decides between the packages that provide
+	// a name without a version.
+	ProviderPriority uint64
+	// RepositoryPriority is the priority of the repository the package is from, see WithIndexPriority.
+	RepositoryPriority int
+	// Pin is the name of the tagged repository the package is from, e.g. "edge", or empty.
+	Pin string
+}
+
+// Providers returns the packages in all of the indexes that have the name of atom or provide it, such as
+// cmd:gcc or so:libcrypto.so.3, including those in tagged repositories. An atom with a version constraint,
+// e.g. so:libcrypto.so.3>=3, only returns the providers that satisfy it. The providers are in the order that
+// resolving atom would prefer them, best first, and each package is returned once.
+func (p *PkgResolver) Providers(atom string) []Provider {
+	constraint := p.resolvePackageNameVersionPin(atom)
+	candidates := p.filterPackages(p.nameMap[constraint.name], nil, withVersion(constraint.version, constraint.dep), withAnyPin())
+
+	seen := make(map[*RepositoryPackage]bool, len(candidates))
+	pkgs := make([]*repositoryPackage, 0, len(candidates))
+	for _, pkg := range candidates {
+		// a package that provides the name more than once is in the name map more than once
+		if !seen[pkg.RepositoryPackage] {
+			seen[pkg.RepositoryPackage] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	p.sortPackages(pkgs, nil, constraint.name, nil, nil, constraint.pin)
+
+	providers := make([]Provider, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		providers = append(providers, Provider{
+			Package:            pkg.RepositoryPackage,
+			Version:            p.providedVersion(pkg.Package, constraint.name),
+			ProviderPriority:   pkg.ProviderPriority,
+			RepositoryPriority: pkg.priority,
+			Pin:                pkg.pinnedName,
+		})
+	}
+	return providers
+}
+
+// providedVersion returns the version of name that pkg provides, empty if it provides it without a version.
+func (p *PkgResolver) providedVersion(pkg *Package, name string) string {
+	if pkg.Name == name {
+		return pkg.Version
+	}
+	for _, prov := range pkg.Provides {
+		if constraint := p.resolvePackageNameVersionPin(prov); constraint.name == name {
+			return constraint.version
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviders(t *testing.T) {
+	main := Repository{URI: "https://main.example.com"}
+	edge := Repository{URI: "https://edge.example.com"}
+	resolver := NewPkgResolver(context.Background(), []NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc", Version: "13.2.1-r0", Provides: []string{"cmd:gcc=13.2.1-r0", "cmd:cc=13.2.1-r0"}},
+				{Name: "gcc-12", Version: "12.3.0-r0", Provides: []string{"cmd:gcc=12.3.0-r0"}},
+				{Name: "fakecc", Version: "1.0-r0", Provides: []string{"cmd:gcc", "cmd:gcc"}, ProviderPriority: 10},
+				{Name: "make", Version: "4.4-r0"},
+			},
+		})),
+		NewPrioritizedIndex(NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc", Version: "14.1.0-r0", Provides: []string{"cmd:gcc=14.1.0-r0"}},
+			},
+		})), 5),
+	})
+	describe := func(providers []Provider) []string {
+		var out []string
+		for _, p := range providers {
+			out = append(out, fmt.Sprintf("%s %s %q k:%d priority:%d pin:%q", p.Package.Repository().URI, p.Package.Filename(), p.Version, p.ProviderPriority, p.RepositoryPriority, p.Pin))
+		}
+		return out
+	}
+
+	// the provider priority wins over the versions, and the tagged repository comes last as it is not asked for
+	require.Equal(t, []string{
+		`https://main.example.com fakecc-1.0-r0.apk "" k:10 priority:0 pin:""`,
+		`https://main.example.com gcc-13.2.1-r0.apk "13.2.1-r0" k:0 priority:0 pin:""`,
+		`https://main.example.com gcc-12-12.3.0-r0.apk "12.3.0-r0" k:0 priority:0 pin:""`,
+		`https://edge.example.com gcc-14.1.0-r0.apk "14.1.0-r0" k:0 priority:5 pin:"edge"`,
+	}, describe(resolver.Providers("cmd:gcc")))
+
+	require.Equal(t, []string{
+		`https://main.example.com gcc-13.2.1-r0.apk "13.2.1-r0" k:0 priority:0 pin:""`,
+		`https://edge.example.com gcc-14.1.0-r0.apk "14.1.0-r0" k:0 priority:5 pin:"edge"`,
+	}, describe(resolver.Providers("cmd:gcc>13")))
+
+	require.Equal(t, []string{
+		`https://main.example.com make-4.4-r0.apk "4.4-r0" k:0 priority:0 pin:""`,
+	}, describe(resolver.Providers("make")))
+	require.Empty(t, resolver.Providers("cmd:clang"))
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// PruneOption is an option for PruneIndex.
+type PruneOption func(*pruneOpts)
+
+type pruneOpts struct {
+	packageDir string
+}
+
+// WithPrunePackageDir removes the files of the packages that are pruned from dir, the directory of the
+// repository with the index, where the files are named as Package.Filename names them. Files that are not
+// there are skipped.
+func WithPrunePackageDir(dir string) PruneOption {
+	return func(o *pruneOpts) {
+		o.packageDir = dir
+	}
+}
+
+// PruneIndex returns a copy of idx with only the newest keep versions of each package name, in the order of
+// idx, and the packages it pruned. Versions that do not parse are older than any that do. idx itself is not
+// changed, and the copy has no signature, as the packages it signed are not all there anymore.
+func PruneIndex(idx *APKIndex, keep int, options ...PruneOption) (*APKIndex, []*Package, error) {
+	if keep < 1 {
+		return nil, nil, fmt.Errorf("cannot keep %d versions of each package, at least 1 is needed", keep)
+	}
+	var opts pruneOpts
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	versions := map[string][]string{}
+	for _, pkg := range idx.Packages {
+		versions[pkg.Name] = append(versions[pkg.Name], pkg.Version)
+	}
+	kept := map[string]map[string]bool{}
+	for name, vers := range versions {
+		kept[name] = newestVersions(vers, keep)
+	}
+
+	pruned := &APKIndex{Description: idx.Description, lazy: idx.lazy}
+	var removed []*Package
+	for _, pkg := range idx.Packages {
+		if kept[pkg.Name][pkg.Version] {
+			pruned.Packages = append(pruned.Packages, pkg)
+		} else {
+			removed = append(removed, pkg)
+		}
+	}
+
+	if opts.packageDir != "" {
+		for _, pkg := range removed {
+			name := filepath.Join(opts.packageDir, pkg.Filename())
+			if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, nil, fmt.Errorf("removing pruned package %s: %w", name, err)
+			}
+		}
+	}
+	return pruned, removed, nil
+}
+
+// newestVersions returns the newest n of the distinct versions of vers.
+func newestVersions(vers []string, n int) map[string]bool {
+	type parsed struct {
+		s  string
+		v  Version
+		ok bool
+	}
+	distinct := map[string]bool{}
+	var all []parsed
+	for _, s := range vers {
+		if distinct[s] {
+			continue
+		}
+		distinct[s] = true
+		v, err := ParseVersion(s)
+		all = append(all, parsed{s: s, v: v, ok: err == nil})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].ok != all[j].ok {
+			return all[i].ok
+		}
+		return all[i].ok && CompareVersions(all[i].v, all[j].v) > 0
+	})
+
+	newest := map[string]bool{}
+	for _, p := range all[:min(n, len(all))] {
+		newest[p.s] = true
+	}
+	return newest
+}
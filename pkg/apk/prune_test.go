@@ -0,0 +1,78 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneIndex(t *testing.T) {
+	idx := &APKIndex{
+		Description: "test",
+		Signature:   []byte("signature"),
+		Packages: []*Package{
+			{Name: "foo", Version: "1.0-r0"},
+			{Name: "foo", Version: "1.10-r0"},
+			{Name: "bar", Version: "2.0-r0"},
+			{Name: "foo", Version: "1.2-r0"},
+			{Name: "foo", Version: "bad"},
+			{Name: "foo", Version: "1.10-r0", Arch: "aarch64"},
+			{Name: "foo", Version: "1.9-r1"},
+		},
+	}
+	describe := func(pkgs []*Package) []string {
+		var out []string
+		for _, pkg := range pkgs {
+			out = append(out, pkg.Filename())
+		}
+		return out
+	}
+
+	dir := t.TempDir()
+	for _, pkg := range idx.Packages {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, pkg.Filename()), nil, 0o644))
+	}
+	pruned, removed, err := PruneIndex(idx, 2, WithPrunePackageDir(dir))
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo-1.10-r0.apk", "bar-2.0-r0.apk", "foo-1.10-r0.apk", "foo-1.9-r1.apk"}, describe(pruned.Packages))
+	require.Equal(t, []string{"foo-1.0-r0.apk", "foo-1.2-r0.apk", "foo-bad.apk"}, describe(removed))
+	require.Equal(t, "test", pruned.Description)
+	require.Nil(t, pruned.Signature)
+	require.Len(t, idx.Packages, 7, "the index itself is not changed")
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.apk"))
+	require.NoError(t, err)
+	for i, f := range files {
+		files[i] = filepath.Base(f)
+	}
+	require.ElementsMatch(t, []string{"foo-1.10-r0.apk", "bar-2.0-r0.apk", "foo-1.9-r1.apk"}, files)
+
+	// pruning the same index again prunes the same packages, whose files are already gone
+	_, removed, err = PruneIndex(idx, 2, WithPrunePackageDir(dir))
+	require.NoError(t, err)
+	require.Len(t, removed, 3)
+
+	pruned, removed, err = PruneIndex(idx, 10)
+	require.NoError(t, err)
+	require.Len(t, pruned.Packages, 7)
+	require.Empty(t, removed)
+
+	_, _, err = PruneIndex(idx, 0)
+	require.Error(t, err)
+}
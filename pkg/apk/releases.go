@@ -81,7 +81,7 @@ func (r Releases) GetReleaseBranch(version string) *ReleaseBranch {
 // for deprecation.
 func (r ReleaseBranch) KeysFor(arch string, date time.Time) []string {
 	var urls []string
-	keyset, ok := r.Keys[arch]
+	keyset, ok := r.Keys[ArchToAPK(arch)]
 	if !ok {
 		return urls
 	}
@@ -23,11 +23,15 @@ import (
 	"io"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/chainguard-dev/clog"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
+
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
+	"github.com/chainguard-dev/go-apk/pkg/version"
 )
 
 // NamedIndex an index that contains all of its packages,
@@ -40,6 +44,135 @@ type NamedIndex interface {
 	Count() int
 }
 
+// PrioritizedIndex is a NamedIndex with a priority. When the same version of a package is in several
+// indexes, the one in the index with the highest priority is preferred, and after that the one in the
+// index that came first. Indexes that are not a PrioritizedIndex have priority 0.
+type PrioritizedIndex interface {
+	NamedIndex
+	Priority() int
+}
+
+type prioritizedIndex struct {
+	NamedIndex
+	priority int
+}
+
+// NewPrioritizedIndex returns index with the given priority.
+func NewPrioritizedIndex(index NamedIndex, priority int) PrioritizedIndex {
+	return &prioritizedIndex{
+		NamedIndex: index,
+		priority:   priority,
+	}
+}
+
+func (p *prioritizedIndex) Priority() int {
+	return p.priority
+}
+
+func indexPriority(index NamedIndex) int {
+	if p, ok := index.(PrioritizedIndex); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// Verification is which key verified the signature of an index.
+type Verification struct {
+	// KeyName is the name of the key, as a file in /etc/apk/keys, e.g. alpine-devel@lists.alpinelinux.org-4a6a0840.rsa.pub.
+	KeyName string `json:"keyName"`
+	// Fingerprint is the hex encoded SHA-256 of the DER encoded public key.
+	Fingerprint string `json:"fingerprint"`
+	// Scheme is the scheme of the signature.
+	Scheme sign.Scheme `json:"scheme"`
+}
+
+// VerifiedIndex is a NamedIndex that knows whether its signature was verified, and by which key.
+type VerifiedIndex interface {
+	NamedIndex
+	// Verification returns which key verified the signature of the index, or nil if it was not checked.
+	Verification() *Verification
+}
+
+// IndexFetch is where and when an index was fetched, which identifies the exact snapshot of the index.
+type IndexFetch struct {
+	// URL is the URL of the APKINDEX.tar.gz, with any password redacted.
+	URL string
+	// ETag is the etag the server or the cache gave for the index, if any. The cache of WithCache gives the
+	// digest of the index, as sha256-<hex>, for one the server gave no validator for.
+	ETag string
+	// LastModified is the Last-Modified the server gave for the index, if any, as it was sent.
+	LastModified string
+	// FetchedAt is when the index was read.
+	FetchedAt time.Time
+	// FromCache is whether the index was read from the cache rather than downloaded.
+	FromCache bool
+	// CacheFile is the file in the cache of WithCache that the index was read from, if any, whose provenance
+	// ReadCacheProvenance returns.
+	CacheFile string
+	// Delta is whether only the changes to the index were downloaded, see WithIndexDeltaDir.
+	Delta bool
+	// Verification is which key verified the signature of the index, or nil if it was not checked.
+	Verification *Verification
+	// Verifications are the keys that verified the signatures of the index, the first being Verification,
+	// so more than one only for indexes signed by several keys, see WithIndexSignatureThreshold.
+	Verifications []*Verification
+}
+
+// FetchedIndex is a NamedIndex that was fetched from a repository. GetRepositoryIndexes returns a
+// FetchedIndex, which also is a VerifiedIndex, for every index.
+type FetchedIndex interface {
+	VerifiedIndex
+	Fetch() *IndexFetch
+}
+
+type fetchedIndex struct {
+	NamedIndex
+	fetch *IndexFetch
+}
+
+// NewFetchedIndex returns index with the given fetch metadata.
+func NewFetchedIndex(index NamedIndex, fetch *IndexFetch) FetchedIndex {
+	return &fetchedIndex{
+		NamedIndex: index,
+		fetch:      fetch,
+	}
+}
+
+func (f *fetchedIndex) Fetch() *IndexFetch {
+	return f.fetch
+}
+
+func (f *fetchedIndex) Verification() *Verification {
+	if f.fetch == nil {
+		return nil
+	}
+	return f.fetch.Verification
+}
+
+// IndexVerification returns which key verified the signature of index, also when it is wrapped
+// by NewPrioritizedIndex, or nil if its signature was not checked.
+func IndexVerification(index NamedIndex) *Verification {
+	switch idx := index.(type) {
+	case VerifiedIndex:
+		return idx.Verification()
+	case *prioritizedIndex:
+		return IndexVerification(idx.NamedIndex)
+	}
+	return nil
+}
+
+// IndexFetchInfo returns where and when index was fetched, also when it is wrapped by NewPrioritizedIndex,
+// or nil if it is not a FetchedIndex.
+func IndexFetchInfo(index NamedIndex) *IndexFetch {
+	switch idx := index.(type) {
+	case FetchedIndex:
+		return idx.Fetch()
+	case *prioritizedIndex:
+		return IndexFetchInfo(idx.NamedIndex)
+	}
+	return nil
+}
+
 func indexNames(indexes []NamedIndex) []string {
 	names := make([]string, len(indexes))
 	for i, idx := range indexes {
@@ -90,6 +223,9 @@ func (n *namedRepositoryWithIndex) Source() string {
 type repositoryPackage struct {
 	*RepositoryPackage
 	pinnedName string
+	// priority and order of the index the package is from, to break ties between equal packages
+	priority int
+	order    int
 }
 
 // SetRepositories sets the contents of /etc/apk/repositories file.
@@ -108,7 +244,7 @@ func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 	data := strings.Join(repos, "\n") + "\n"
 
 	// #nosec G306 -- apk repositories must be publicly readable
-	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "repositories"),
+	if err := a.fs.WriteFile(a.layoutPath(reposFilePath),
 		[]byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk repositories list: %w", err)
 	}
@@ -118,9 +254,10 @@ func (a *APK) SetRepositories(ctx context.Context, repos []string) error {
 
 func (a *APK) GetRepositories() (repos []string, err error) {
 	// get the repository URLs
-	reposFile, err := a.fs.Open(reposFilePath)
+	fsys, name := a.configSource(reposFilePath)
+	reposFile, err := fsys.Open(name)
 	if err != nil {
-		return nil, fmt.Errorf("could not open repositories file in %s at %s: %w", a.fs, reposFilePath, err)
+		return nil, fmt.Errorf("could not open repositories file in %s at %s: %w", fsys, name, err)
 	}
 	defer reposFile.Close()
 	scanner := bufio.NewScanner(reposFile)
@@ -131,18 +268,27 @@ func (a *APK) GetRepositories() (repos []string, err error) {
 }
 
 // GetRepositoryIndexes returns the indexes for the repositories in the specified root.
-// The signatures for each index are verified unless ignoreSignatures is set to true.
-func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) ([]NamedIndex, error) {
+// The signatures for each index are verified unless ignoreSignatures is set to true, which is an error
+// with WithStrictVerification.
+func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (_ []NamedIndex, err error) {
+	ctx, cancel := withTimeout(ctx, a.timeouts.IndexFetch, "fetching indexes")
+	defer cancel()
+	defer func() { err = timedOut(ctx, err) }()
+
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetRepositoryIndexes")
 	defer span.End()
 
+	if ignoreSignatures && a.strictVerification {
+		return nil, withKind(ErrSignatureInvalid, errors.New("signatures of indexes cannot be ignored with strict verification"))
+	}
+
 	// get the repository URLs
 	repos, err := a.GetRepositories()
 	if err != nil {
 		return nil, err
 	}
 
-	archFile, err := a.fs.Open(archFilePath)
+	archFile, err := a.fs.Open(a.layoutPath(archFilePath))
 	if err != nil {
 		return nil, fmt.Errorf("could not open arch file in %s at %s: %w", a.fs, archFile, err)
 	}
@@ -156,33 +302,66 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 	arch := strings.TrimSuffix(string(archB), "\n")
 
 	// create the list of keys
-	keys := make(map[string][]byte)
-	dir, err := a.fs.ReadDir(keysDirPath)
+	keys, err := a.trustedKeys()
 	if err != nil {
-		return nil, fmt.Errorf("could not read keys directory in %s at %s: %w", a.fs, keysDirPath, err)
-	}
-	for _, d := range dir {
-		if d.IsDir() {
-			continue
-		}
-		fullPath := filepath.Join(keysDirPath, d.Name())
-		b, err := a.fs.ReadFile(fullPath)
-		if err != nil {
-			return nil, fmt.Errorf("could not read key file at %s: %w", fullPath, err)
-		}
-		keys[d.Name()] = b
+		return nil, err
 	}
 	httpClient := a.client
-	if a.cache != nil {
+	var deltaDir string
+	switch {
+	case a.cache != nil && a.indexDeltas && a.indexVerifier == nil && !a.cache.offline:
+		// the indexes kept for deltas are the cache of the indexes
+		deltaDir = filepath.Join(a.cache.dir, indexDeltasCacheDir)
+	case a.cache != nil:
 		httpClient = a.cache.client(httpClient, true)
 	}
 	opts := []IndexOption{WithIgnoreSignatures(ignoreSignatures),
 		WithIgnoreSignatureForIndexes(a.noSignatureIndexes...),
 		WithHTTPClient(httpClient)}
+	if deltaDir != "" {
+		opts = append(opts, WithIndexDeltaDir(deltaDir))
+	}
+	for _, policy := range a.fetchPolicies {
+		opts = append(opts, WithIndexFetchPolicy(policy))
+	}
 	for domain, auth := range a.auth {
 		opts = append(opts, WithIndexAuth(domain, auth.user, auth.pass))
 	}
-	return GetRepositoryIndexes(ctx, repos, keys, arch, opts...)
+	for repo, priority := range a.repoPriorities {
+		opts = append(opts, WithIndexPriority(repo, priority))
+	}
+	for repo, layout := range a.repoLayouts {
+		opts = append(opts, WithIndexLayout(repo, layout))
+	}
+	if a.partialIndexes {
+		opts = append(opts, WithIndexPartialResults(true))
+	}
+	if a.lazyIndexes {
+		opts = append(opts, WithIndexLazyParsing(true))
+	}
+	if a.indexVerifier != nil {
+		opts = append(opts, WithIndexVerifier(a.indexVerifier, a.verifierOnly))
+	}
+	if a.sigThreshold > 1 {
+		opts = append(opts, WithIndexSignatureThreshold(a.sigThreshold))
+	}
+	for repo := range a.repoKeys {
+		repoKeys, err := a.repositoryKeys(repo, keys)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithIndexKeys(repo, repoKeys))
+	}
+	indexes, err := GetRepositoryIndexes(ctx, repos, keys, arch, opts...)
+	var repoErrs *RepositoryIndexErrors
+	if a.partialIndexes && len(indexes) > 0 && errors.As(err, &repoErrs) {
+		log := clog.FromContext(ctx)
+		for _, repoErr := range repoErrs.Errors {
+			log.Warnf("skipping repository %s: %v", repoErr.Repository, repoErr)
+		}
+		return indexes, nil
+	}
+	return indexes, err
 }
 
 // PkgResolver resolves packages from a list of indexes.
@@ -194,6 +373,13 @@ func (a *APK) GetRepositoryIndexes(ctx context.Context, ignoreSignatures bool) (
 // indexes. If you need to look only in a certain set, you should create a new
 // PkgResolver with only those indexes.
 // If the indexes change, you should generate a new pkgResolver.
+//
+// Indexes with a name, i.e. tagged repositories such as "@edge", follow the pinning rules of apk-tools:
+//   - a package from a tagged repository is only used when it is asked for with that tag, e.g. "foo@edge";
+//   - the tagged repository is preferred only for the package that is named; its dependencies may also
+//     come from the tagged repository, but prefer the untagged repositories;
+//   - install_if packages from a tagged repository are only added for packages asked for with that tag;
+//   - conflicts, e.g. "!foo", apply to packages from every repository.
 type PkgResolver struct {
 	indexes      []NamedIndex
 	nameMap      map[string][]*repositoryPackage
@@ -201,6 +387,26 @@ type PkgResolver struct {
 
 	parsedVersions map[string]Version
 	depForVersion  map[string]parsedConstraint
+
+	// see SetHolds
+	holds []hold
+	// see SetStrictVersions
+	strictVersions bool
+	// see SetArch
+	arch string
+	// see SetOptional
+	optional map[string]bool
+}
+
+// newPkgResolver returns a resolver of indexes with empty caches, without the maps of their packages that
+// NewPkgResolver builds. This is all that comparing packages and matching their dependencies needs.
+func newPkgResolver(indexes []NamedIndex, strictVersions bool) *PkgResolver {
+	return &PkgResolver{
+		indexes:        indexes,
+		parsedVersions: map[string]Version{},
+		depForVersion:  map[string]parsedConstraint{},
+		strictVersions: strictVersions,
+	}
 }
 
 // NewPkgResolver creates a new pkgResolver from a list of indexes.
@@ -215,19 +421,21 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 		pkgNameMap   = make(map[string][]*repositoryPackage, numPackages)
 		installIfMap = map[string][]*repositoryPackage{}
 	)
-	p := &PkgResolver{
-		indexes:        indexes,
-		parsedVersions: map[string]Version{},
-		depForVersion:  map[string]parsedConstraint{},
-	}
+	p := newPkgResolver(indexes, false)
 
 	// create a map of every package by name and version to its RepositoryPackage
-	for _, index := range indexes {
+	allPkgs := make([]*repositoryPackage, 0, numPackages)
+	for i, index := range indexes {
+		priority := indexPriority(index)
 		for _, pkg := range index.Packages() {
-			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], &repositoryPackage{
+			rp := &repositoryPackage{
 				RepositoryPackage: pkg,
 				pinnedName:        index.Name(),
-			})
+				priority:          priority,
+				order:             i,
+			}
+			pkgNameMap[pkg.Name] = append(pkgNameMap[pkg.Name], rp)
+			allPkgs = append(allPkgs, rp)
 			for _, dep := range pkg.InstallIf {
 				if _, ok := installIfMap[dep]; !ok {
 					installIfMap[dep] = []*repositoryPackage{}
@@ -235,21 +443,18 @@ func NewPkgResolver(_ context.Context, indexes []NamedIndex) *PkgResolver {
 				installIfMap[dep] = append(installIfMap[dep], &repositoryPackage{
 					RepositoryPackage: pkg,
 					pinnedName:        index.Name(),
+					priority:          priority,
+					order:             i,
 				})
 			}
 		}
 	}
-	// create a map of every provided file to its package
-	allPkgs := make([][]*repositoryPackage, 0, len(pkgNameMap))
-	for _, pkgVersions := range pkgNameMap {
-		allPkgs = append(allPkgs, pkgVersions)
-	}
-	for _, pkgVersions := range allPkgs {
-		for _, pkg := range pkgVersions {
-			for _, provide := range pkg.Provides {
-				name := p.resolvePackageNameVersionPin(provide).name
-				pkgNameMap[name] = append(pkgNameMap[name], pkg)
-			}
+	// create a map of every provided file to its package, in the order of the indexes so that the providers
+	// of a name are always in the same order
+	for _, pkg := range allPkgs {
+		for _, provide := range pkg.Provides {
+			name := p.resolvePackageNameVersionPin(provide).name
+			pkgNameMap[name] = append(pkgNameMap[name], pkg)
 		}
 	}
 	p.nameMap = pkgNameMap
@@ -269,7 +474,7 @@ func (p *PkgResolver) nextPackage(packages []string, dq map[*RepositoryPackage]s
 			return "", &ConstraintError{pkgName, err}
 		}
 		if len(pkgs) == 0 {
-			return "", fmt.Errorf("could not find package %s", pkgName)
+			return "", withKind(ErrPackageNotFound, fmt.Errorf("could not find package %s", pkgName))
 		}
 
 		if next == "" {
@@ -295,7 +500,12 @@ func (p *PkgResolver) disqualifyProviders(constraint string, dq map[*RepositoryP
 		return
 	}
 
-	conflicting := p.filterPackages(providers, dq, withVersion(parsed.version, parsed.dep), withPreferPin(parsed.pin))
+	pinOpt := withPreferPin(parsed.pin)
+	if parsed.pin == "" {
+		// an unpinned conflict excludes the package from every repository, not just the untagged ones
+		pinOpt = withAnyPin()
+	}
+	conflicting := p.filterPackages(providers, dq, withVersion(parsed.version, parsed.dep), pinOpt)
 
 	for _, conflict := range conflicting {
 		if _, dqed := dq[conflict.RepositoryPackage]; dqed {
@@ -392,6 +602,16 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 			continue
 		}
 
+		if parsed.dep == versionChecksum {
+			// only the package itself, with that checksum, satisfies it, not anything that provides its name
+			for _, provider := range providers {
+				if provider.Name != parsed.name || provider.ChecksumString() != parsed.version {
+					p.disqualify(dq, provider.RepositoryPackage, fmt.Sprintf("%q does not satisfy %q", provider.Filename(), constraint))
+				}
+			}
+			continue
+		}
+
 		requiredVersion, err := p.parseVersion(parsed.version)
 		if err != nil {
 			// This shouldn't happen but return an error to be safe.
@@ -407,7 +627,7 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 					continue
 				}
 
-				if !parsed.dep.satisfies(actualVersion, requiredVersion) {
+				if !parsed.dep.Satisfies(actualVersion, requiredVersion) {
 					p.disqualify(dq, provider.RepositoryPackage, fmt.Sprintf("%q does not satisfy %q", provider.Version, constraint))
 				}
 			} else {
@@ -422,7 +642,7 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 						dq[provider.RepositoryPackage] = fmt.Sprintf("parsing %q: %v", pp.version, err)
 						continue
 					}
-					if !parsed.dep.satisfies(actualVersion, requiredVersion) {
+					if !parsed.dep.Satisfies(actualVersion, requiredVersion) {
 						dq[provider.RepositoryPackage] = fmt.Sprintf("%q provides %q which does not satisfy %q", provider.Filename(), provides, constraint)
 					}
 				}
@@ -433,12 +653,85 @@ func (p *PkgResolver) constrain(constraints []string, dq map[*RepositoryPackage]
 	return nil
 }
 
+// Resolution is the result of resolving a set of packages with Resolve.
+type Resolution struct {
+	// Packages are the packages to install, in the order to install them. The order is topological, with
+	// each package after its dependencies, and otherwise lexical: the world is taken in the order it is given,
+	// and the dependencies of each package by the fewest candidates, then by name. It does not depend on map
+	// iteration, so the same indexes and world always resolve to the same order.
+	Packages []*RepositoryPackage
+	// Conflicts are the names of packages that must not be installed with Packages.
+	Conflicts []string
+	// Cycles are the circular dependencies found while resolving. Each is the chain of package
+	// names, starting and ending with the same package, e.g. [a b c a] for a -> b -> c -> a.
+	// Cycles do not stop resolution; packages in a cycle are installed once, in an order that
+	// satisfies all but the closing dependency.
+	Cycles [][]string
+	// Skipped are the optional packages that could not be resolved, see SetOptional.
+	Skipped []string
+}
+
 // GetPackagesWithDependencies get all of the dependencies for the given packages based on the
 // indexes. Does not filter for installed already or not.
 func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages []string) (toInstall []*RepositoryPackage, conflicts []string, err error) {
-	_, span := otel.Tracer("go-apk").Start(ctx, "GetPackageWithDependencies")
+	resolution, err := p.Resolve(ctx, packages)
+	if resolution == nil {
+		return nil, nil, err
+	}
+	return resolution.Packages, resolution.Conflicts, err
+}
+
+// Resolve is like GetPackagesWithDependencies, but also reports the dependency cycles it found.
+func (p *PkgResolver) Resolve(ctx context.Context, packages []string) (*Resolution, error) {
+	return p.resolveWorld(ctx, packages, p.optional)
+}
+
+// resolveWorld is Resolve, with the packages that are optional.
+func (p *PkgResolver) resolveWorld(ctx context.Context, packages []string, optional map[string]bool) (*Resolution, error) {
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "GetPackageWithDependencies")
 	defer span.End()
 
+	resolution, skipped, err := p.resolveOptional(ctx, packages, optional)
+	if err != nil {
+		return resolution, err
+	}
+	if err := materialize(resolution.Packages); err != nil {
+		return nil, err
+	}
+	resolution.Skipped = skipped
+	return resolution, nil
+}
+
+// ResolveRequirements is Resolve, for requirements, which it resolves as their String, as Resolve takes them.
+// Requirements that are Optional are skipped if they cannot be resolved, as for SetOptional.
+func (p *PkgResolver) ResolveRequirements(ctx context.Context, reqs []Requirement) (*Resolution, error) {
+	packages := FormatRequirements(reqs)
+	optional := maps.Clone(p.optional)
+	for _, r := range reqs {
+		if r.Optional {
+			if optional == nil {
+				optional = map[string]bool{}
+			}
+			optional[r.Name] = true
+		}
+	}
+	return p.resolveWorld(ctx, packages, optional)
+}
+
+// materialize parses the fields of lazily parsed packages in full, see WithIndexLazyParsing, so that what
+// the resolver selects is complete.
+func materialize(pkgs []*RepositoryPackage) error {
+	for _, pkg := range pkgs {
+		if err := pkg.Materialize(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve resolves packages, preferring the versions in installed, keyed by name, where
+// they satisfy all of the constraints.
+func (p *PkgResolver) resolve(packages []string, installed map[string]*RepositoryPackage) (*Resolution, error) {
 	// Tracks all the packages we have disqualified and the reason we disqualified them.
 	dq := map[*RepositoryPackage]string{}
 
@@ -446,23 +739,41 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 	constraints := slices.Clone(packages)
 
 	var (
-		dependenciesMap = make(map[string]*RepositoryPackage, len(packages))
+		dependenciesMap = make(map[string]*RepositoryPackage, len(packages)+len(installed))
 		installTracked  = map[string]*RepositoryPackage{}
+		toInstall       []*RepositoryPackage
+		conflicts       []string
+		allCycles       [][]string
+		seenCycles      = map[string]bool{}
 	)
 
+	for name, pkg := range installed {
+		dependenciesMap[name] = pkg
+	}
+	for _, pkgName := range packages {
+		// asking for a package from a tagged repository is asking for it to move there
+		if parsed := p.resolvePackageNameVersionPin(pkgName); parsed.pin != "" && installed[parsed.name] != nil {
+			delete(dependenciesMap, parsed.name)
+			installed = maps.Clone(installed)
+			delete(installed, parsed.name)
+		}
+	}
+
 	if err := p.constrain(constraints, dq); err != nil {
-		return nil, nil, fmt.Errorf("constraining initial packages: %w", err)
+		return nil, fmt.Errorf("constraining initial packages: %w", err)
 	}
+	p.applyArch(dq)
+	p.applyHolds(dq)
 
 	for len(constraints) != 0 {
 		next, err := p.nextPackage(constraints, dq)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 
-		pkg, err := p.resolvePackage(next, dq)
+		pkg, err := p.resolvePackage(next, installed, dq)
 		if err != nil {
-			return nil, nil, &ConstraintError{next, err}
+			return nil, &ConstraintError{next, err}
 		}
 
 		// do not add it to toInstall, as we want to have it in the correct order with dependencies
@@ -478,9 +789,17 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 
 	// now get the dependencies for each package
 	for _, pkgName := range packages {
-		pkg, deps, confs, err := p.GetPackageWithDependencies(pkgName, dependenciesMap, dq)
+		pkg, deps, confs, cycles, err := p.getPackageWithDependencies(pkgName, dependenciesMap, dq)
 		if err != nil {
-			return toInstall, nil, &ConstraintError{pkgName, err}
+			return &Resolution{Packages: toInstall}, &ConstraintError{pkgName, err}
+		}
+		for _, cycle := range cycles {
+			cycle = rotateCycle(cycle)
+			key := strings.Join(cycle, " ")
+			if !seenCycles[key] {
+				seenCycles[key] = true
+				allCycles = append(allCycles, cycle)
+			}
 		}
 		for _, dep := range deps {
 			if _, ok := installTracked[dep.Name]; !ok {
@@ -503,7 +822,31 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 
 	conflicts = uniqify(conflicts)
 
-	return toInstall, conflicts, nil
+	return &Resolution{
+		Packages:  toInstall,
+		Conflicts: conflicts,
+		Cycles:    allCycles,
+	}, nil
+}
+
+// rotateCycle rotates a cycle to start with its lowest package name, so that the same cycle
+// found from different packages is reported once.
+func rotateCycle(cycle []string) []string {
+	// the last name closes the cycle, so is the same as the first
+	names := cycle[:len(cycle)-1]
+	if len(names) == 0 {
+		return cycle
+	}
+	lowest := 0
+	for i, name := range names {
+		if name < names[lowest] {
+			lowest = i
+		}
+	}
+	rotated := make([]string, 0, len(cycle))
+	rotated = append(rotated, names[lowest:]...)
+	rotated = append(rotated, names[:lowest]...)
+	return append(rotated, names[lowest])
 }
 
 // GetPackageWithDependencies get all of the dependencies for a single package as well as looking
@@ -512,7 +855,17 @@ func (p *PkgResolver) GetPackagesWithDependencies(ctx context.Context, packages
 // options may depend on whether or not one already is installed.
 // Must not modify the existing map directly.
 func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) (*RepositoryPackage, []*RepositoryPackage, []string, error) {
-	parents := make(map[string]bool)
+	pkg, deps, conflicts, _, err := p.getPackageWithDependencies(pkgName, existing, dq)
+	if err != nil {
+		return pkg, deps, conflicts, err
+	}
+	if err := materialize(append([]*RepositoryPackage{pkg}, deps...)); err != nil {
+		return nil, nil, nil, err
+	}
+	return pkg, deps, conflicts, nil
+}
+
+func (p *PkgResolver) getPackageWithDependencies(pkgName string, existing map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) (*RepositoryPackage, []*RepositoryPackage, []string, [][]string, error) {
 	localExisting := make(map[string]*RepositoryPackage, len(existing))
 	existingOrigins := map[string]bool{}
 	for k, v := range existing {
@@ -522,15 +875,15 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 		}
 	}
 
-	pkg, err := p.resolvePackage(pkgName, dq)
+	pkg, err := p.resolvePackage(pkgName, existing, dq)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	pin := p.resolvePackageNameVersionPin(pkgName).pin
-	deps, conflicts, err := p.getPackageDependencies(pkg, pin, true, parents, localExisting, existingOrigins, dq)
+	deps, conflicts, cycles, err := p.getPackageDependencies(pkg, pin, true, localExisting, existingOrigins, dq)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 	// eliminate duplication in dependencies
 	added := make(map[string]*RepositoryPackage, len(deps))
@@ -541,8 +894,10 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 			added[dep.Name] = dep
 		}
 	}
-	// are there any installIf dependencies?
-	for dep, depPkg := range added {
+	// are there any installIf dependencies? They are checked in the order of the dependencies, rather than of
+	// added, so that they are added in the same order every time, and so are those they trigger in turn.
+	for i := 0; i < len(dependencies); i++ {
+		dep, depPkg := dependencies[i].Name, dependencies[i]
 		depPkgList, ok := p.installIfMap[dep]
 		if !ok {
 			depPkgList, ok = p.installIfMap[fmt.Sprintf("%s=%s", dep, depPkg.Version)]
@@ -551,7 +906,12 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 			continue
 		}
 		// this package "dep" can trigger an installIf. It might not be enough, so check it
+		depPin := p.pinOf(depPkg)
 		for _, installIfPkg := range depPkgList {
+			// a tagged repository is only allowed if the package that triggers it is from there too
+			if installIfPkg.pinnedName != "" && installIfPkg.pinnedName != depPin {
+				continue
+			}
 			var matchCount int
 			for _, subDep := range installIfPkg.InstallIf {
 				// two possibilities: package name, or name=version
@@ -577,7 +937,17 @@ func (p *PkgResolver) GetPackageWithDependencies(pkgName string, existing map[st
 			}
 		}
 	}
-	return pkg, dependencies, conflicts, nil
+	return pkg, dependencies, conflicts, cycles, nil
+}
+
+// pinOf returns the name of the repository pkg is from, as it is pinned with, or "" for an untagged one.
+func (p *PkgResolver) pinOf(pkg *RepositoryPackage) string {
+	for _, rp := range p.nameMap[pkg.Name] {
+		if rp.RepositoryPackage == pkg {
+			return rp.pinnedName
+		}
+	}
+	return ""
 }
 
 // ResolvePackage given a single package name and optional version constraints, resolve to a list of packages
@@ -589,7 +959,7 @@ func (p *PkgResolver) ResolvePackage(pkgName string, dq map[*RepositoryPackage]s
 	name, version, compare, pin := constraint.name, constraint.version, constraint.dep, constraint.pin
 	pkgsWithVersions, ok := p.nameMap[name]
 	if !ok {
-		return nil, fmt.Errorf("could not find package that provides %s in indexes", pkgName)
+		return nil, withKind(ErrPackageNotFound, fmt.Errorf("could not find package that provides %s in indexes", pkgName))
 	}
 
 	// pkgsWithVersions contains a map of all versions of the package
@@ -606,17 +976,21 @@ func (p *PkgResolver) ResolvePackage(pkgName string, dq map[*RepositoryPackage]s
 		}
 		pkgs = append(pkgs, pkg.RepositoryPackage)
 	}
+	if err := materialize(pkgs); err != nil {
+		return nil, err
+	}
 	return pkgs, nil
 }
 
 // This is like ResolvePackage but we only care about the best match and not all matches.
-func (p *PkgResolver) resolvePackage(pkgName string, dq map[*RepositoryPackage]string) (*RepositoryPackage, error) {
+// A package in existing with the same name and version is preferred.
+func (p *PkgResolver) resolvePackage(pkgName string, existing map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) (*RepositoryPackage, error) {
 	constraint := p.resolvePackageNameVersionPin(pkgName)
 	name, version, compare, pin := constraint.name, constraint.version, constraint.dep, constraint.pin
 
 	pkgsWithVersions, ok := p.nameMap[name]
 	if !ok {
-		return nil, fmt.Errorf("could not find package, alias or a package that provides %s in indexes", pkgName)
+		return nil, withKind(ErrPackageNotFound, fmt.Errorf("could not find package, alias or a package that provides %s in indexes", pkgName))
 	}
 
 	// pkgsWithVersions contains a map of all versions of the package
@@ -625,7 +999,7 @@ func (p *PkgResolver) resolvePackage(pkgName string, dq map[*RepositoryPackage]s
 	if len(packages) == 0 {
 		return nil, maybedqerror(pkgName, pkgsWithVersions, dq)
 	}
-	return p.bestPackage(packages, nil, name, nil, nil, pin).RepositoryPackage, nil
+	return p.bestPackage(packages, nil, name, existing, nil, pin).RepositoryPackage, nil
 }
 
 // getPackageDependencies get all of the dependencies for a single package based on the
@@ -656,88 +1030,50 @@ func (p *PkgResolver) resolvePackage(pkgName string, dq map[*RepositoryPackage]s
 // It might change the order of install.
 // In other words, this _should_ be a DAG (acyclical), but because the packages
 // are just listing dependencies in text, it might be cyclical. We need to be careful of that.
-func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin string, allowSelfFulfill bool, parents map[string]bool, existing map[string]*RepositoryPackage, existingOrigins map[string]bool, dq map[*RepositoryPackage]string) (dependencies []*RepositoryPackage, conflicts []string, err error) {
-	// check if the package we are checking is one of our parents, avoid cyclical graphs
-	if _, ok := parents[pkg.Name]; ok {
-		return nil, nil, nil
-	}
-	myProvides := make(map[string]bool, 2*len(pkg.Provides))
-	// see if we provide this
-	for _, provide := range pkg.Provides {
-		name := p.resolvePackageNameVersionPin(provide).name
-		myProvides[provide] = true
-		myProvides[name] = true
+//
+// The tree is walked with an explicit stack rather than by recursion, so that deep trees do not
+// grow the goroutine stack. A dependency on a package that already is on the stack is a cycle;
+// it is not walked again, and is returned in cycles as the chain of package names from the
+// first occurrence of the package to the repeated one.
+func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin string, allowSelfFulfill bool, existing map[string]*RepositoryPackage, existingOrigins map[string]bool, dq map[*RepositoryPackage]string) (dependencies []*RepositoryPackage, conflicts []string, cycles [][]string, err error) {
+	root, err := p.newDepFrame(pkg, allowSelfFulfill, dq)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-
-	constraints := slices.Clone(pkg.Dependencies)
-
-	if err := p.constrain(constraints, dq); err != nil {
-		return nil, nil, fmt.Errorf("constraining deps for %q: %w", pkg.Filename(), err)
+	stack := []*depFrame{root}
+	onStack := map[string]int{pkg.Name: 1}
+
+	// wrap the error from the frame at depth in each of its parents on the stack, as the
+	// dependencies of every one of them failed to resolve.
+	fail := func(depth int, err error) ([]*RepositoryPackage, []string, [][]string, error) {
+		for i := depth - 1; i >= 0; i-- {
+			err = &DepError{stack[i].pkg, err}
+		}
+		return nil, nil, nil, err
 	}
 
-	for len(constraints) != 0 {
-		options := map[string][]*repositoryPackage{}
-
-		// each dependency has only one of two possibilities:
-		// - !name     - "I cannot be installed along with the package <name>"
-		// - name      - "I need package 'name'" -OR- "I need the package that provides <name>"
-		for _, dep := range constraints {
-			if strings.HasPrefix(dep, "!") {
-				// TODO: This is a little strange, we should revisit why we do this.
-				conflicts = append(conflicts, dep[1:])
+	for {
+		frame := stack[len(stack)-1]
 
-				// If it was a conflict, we don't need to find a provider.
-				continue
-			}
-
-			// this package might be pinned to a version
-			constraint := p.resolvePackageNameVersionPin(dep)
-			name, version, compare := constraint.name, constraint.version, constraint.dep
-			// see if we provide this
-			if myProvides[name] || myProvides[dep] {
-				// we provide this, so skip it
-				continue
-			}
-
-			if allowSelfFulfill && pkg.Name == name {
-				var (
-					actualVersion, requiredVersion Version
-					err1, err2                     error
-				)
-				actualVersion, err1 = p.parseVersion(pkg.Version)
-				if compare != versionAny {
-					requiredVersion, err2 = p.parseVersion(version)
-				}
-				// we accept invalid versions for ourself, but do not try to use it to fulfill
-				if err1 == nil && err2 == nil {
-					if compare.satisfies(actualVersion, requiredVersion) {
-						// we provide it, so skip looking elsewhere
-						continue
-					}
-				}
+		if len(frame.constraints) == 0 {
+			// all of the dependencies of this frame are solved, so hand them to its parent
+			stack = stack[:len(stack)-1]
+			onStack[frame.pkg.Name]--
+			if len(stack) == 0 {
+				return frame.dependencies, frame.conflicts, cycles, nil
 			}
+			parent := stack[len(stack)-1]
+			parent.addChild(frame.dependencies, frame.conflicts, existing, existingOrigins)
+			continue
+		}
 
-			// first see if it is a name of a package
-			depPkgWithVersions, ok := p.nameMap[name]
-			if !ok {
-				return nil, nil, fmt.Errorf("could not find package either named %s or that provides %s for %s", dep, dep, pkg.Name)
-			}
-			// pkgsWithVersions contains a map of all versions of the package
-			// get the one that most matches what was requested
-			pkgs := p.filterPackages(depPkgWithVersions,
-				dq,
-				withVersion(version, compare),
-				withAllowPin(allowPin),
-				withInstalledPackage(existing[name]),
-			)
-			if len(pkgs) == 0 {
-				return nil, nil, &DepError{pkg, maybedqerror(dep, depPkgWithVersions, dq)}
-			}
-			options[dep] = pkgs
+		options, err := p.dependencyOptions(frame, allowPin, existing, dq)
+		if err != nil {
+			return fail(len(stack)-1, err)
 		}
 
-		constraints = maps.Keys(options)
-		if len(constraints) == 0 {
+		frame.constraints = maps.Keys(options)
+		if len(frame.constraints) == 0 {
 			// Nothing left to solve.
 			continue
 		}
@@ -757,54 +1093,215 @@ func (p *PkgResolver) getPackageDependencies(pkg *RepositoryPackage, allowPin st
 		name := p.resolvePackageNameVersionPin(lowest).name
 
 		// Remove this from our constraints.
-		constraints = slices.DeleteFunc(constraints, func(s string) bool {
+		frame.constraints = slices.DeleteFunc(frame.constraints, func(s string) bool {
 			return s == lowest
 		})
 
 		best := p.bestPackage(pkgs, nil, name, existing, existingOrigins, "")
 		if best == nil {
-			return nil, nil, fmt.Errorf("could not find package for %q", name)
+			return fail(len(stack)-1, withKind(ErrPackageNotFound, fmt.Errorf("could not find package for %q", name)))
 		}
 
 		depPkg := best.RepositoryPackage
 		p.disqualifyConflicts(depPkg, dq)
+		frame.child = depPkg
 
-		// and then recurse to its children
-		// each child gets the parental chain, but should not affect any others,
-		// so we duplicate the map for the child
-		childParents := map[string]bool{}
-		for k := range parents {
-			childParents[k] = true
+		// check if the dependency is one of our parents, avoid cyclical graphs
+		if onStack[depPkg.Name] > 0 {
+			cycles = append(cycles, cycleFrom(stack, depPkg.Name))
+			frame.addChild(nil, nil, existing, existingOrigins)
+			continue
 		}
-		childParents[pkg.Name] = true
-		subDeps, confs, err := p.getPackageDependencies(depPkg, allowPin, true, childParents, existing, existingOrigins, dq)
+
+		// and then descend to its children, which are added before the parent (depth-first)
+		child, err := p.newDepFrame(depPkg, true, dq)
 		if err != nil {
-			return nil, nil, &DepError{pkg, err}
+			return fail(len(stack), err)
 		}
-		// first add the children, then the parent (depth-first)
-		dependencies = append(dependencies, subDeps...)
-		dependencies = append(dependencies, depPkg)
-		conflicts = append(conflicts, confs...)
-		for _, dep := range subDeps {
-			existing[dep.Name] = dep
-			existingOrigins[dep.Origin] = true
+		stack = append(stack, child)
+		onStack[depPkg.Name]++
+	}
+}
+
+// depFrame is the state of a single package in the walk of getPackageDependencies.
+type depFrame struct {
+	pkg              *RepositoryPackage
+	allowSelfFulfill bool
+	myProvides       map[string]bool
+	constraints      []string
+
+	// child is the dependency whose own dependencies currently are being walked
+	child        *RepositoryPackage
+	dependencies []*RepositoryPackage
+	conflicts    []string
+}
+
+func (p *PkgResolver) newDepFrame(pkg *RepositoryPackage, allowSelfFulfill bool, dq map[*RepositoryPackage]string) (*depFrame, error) {
+	myProvides := make(map[string]bool, 2*len(pkg.Provides))
+	// see if we provide this
+	for _, provide := range pkg.Provides {
+		name := p.resolvePackageNameVersionPin(provide).name
+		myProvides[provide] = true
+		myProvides[name] = true
+	}
+
+	constraints := slices.Clone(pkg.Dependencies)
+
+	if err := p.constrain(constraints, dq); err != nil {
+		return nil, fmt.Errorf("constraining deps for %q: %w", pkg.Filename(), err)
+	}
+	return &depFrame{
+		pkg:              pkg,
+		allowSelfFulfill: allowSelfFulfill,
+		myProvides:       myProvides,
+		constraints:      constraints,
+	}, nil
+}
+
+// addChild adds the dependencies of the current child, and then the child itself, to the frame.
+func (f *depFrame) addChild(subDeps []*RepositoryPackage, confs []string, existing map[string]*RepositoryPackage, existingOrigins map[string]bool) {
+	// first add the children, then the parent (depth-first)
+	f.dependencies = append(f.dependencies, subDeps...)
+	f.dependencies = append(f.dependencies, f.child)
+	f.conflicts = append(f.conflicts, confs...)
+	for _, dep := range subDeps {
+		existing[dep.Name] = dep
+		existingOrigins[dep.Origin] = true
+	}
+	f.child = nil
+}
+
+// dependencyOptions finds the packages that could satisfy each of the remaining constraints of the frame.
+// Conflicts are added to the frame and do not need a provider.
+func (p *PkgResolver) dependencyOptions(frame *depFrame, allowPin string, existing map[string]*RepositoryPackage, dq map[*RepositoryPackage]string) (map[string][]*repositoryPackage, error) {
+	pkg := frame.pkg
+	options := map[string][]*repositoryPackage{}
+
+	// each dependency has only one of two possibilities:
+	// - !name     - "I cannot be installed along with the package <name>"
+	// - name      - "I need package 'name'" -OR- "I need the package that provides <name>"
+	for _, dep := range frame.constraints {
+		if strings.HasPrefix(dep, "!") {
+			// TODO: This is a little strange, we should revisit why we do this.
+			frame.conflicts = append(frame.conflicts, dep[1:])
+
+			// If it was a conflict, we don't need to find a provider.
+			continue
+		}
+
+		// this package might be pinned to a version
+		constraint := p.resolvePackageNameVersionPin(dep)
+		name, version, compare := constraint.name, constraint.version, constraint.dep
+		// see if we provide this
+		if frame.myProvides[name] || frame.myProvides[dep] {
+			// we provide this, so skip it
+			continue
+		}
+
+		if frame.allowSelfFulfill && pkg.Name == name {
+			var (
+				actualVersion, requiredVersion Version
+				err1, err2                     error
+			)
+			actualVersion, err1 = p.parseVersion(pkg.Version)
+			if compare != versionAny {
+				requiredVersion, err2 = p.parseVersion(version)
+			}
+			// we accept invalid versions for ourself, but do not try to use it to fulfill
+			if err1 == nil && err2 == nil {
+				if compare.Satisfies(actualVersion, requiredVersion) {
+					// we provide it, so skip looking elsewhere
+					continue
+				}
+			}
+		}
+
+		// first see if it is a name of a package
+		depPkgWithVersions, ok := p.nameMap[name]
+		if !ok {
+			return nil, withKind(ErrPackageNotFound, fmt.Errorf("could not find package either named %s or that provides %s for %s", dep, dep, pkg.Name))
+		}
+		// pkgsWithVersions contains a map of all versions of the package
+		// get the one that most matches what was requested
+		pkgs := p.filterPackages(depPkgWithVersions,
+			dq,
+			withVersion(version, compare),
+			withAllowPin(allowPin),
+			withInstalledPackage(existing[name]),
+		)
+		if len(pkgs) == 0 {
+			return nil, &DepError{pkg, maybedqerror(dep, depPkgWithVersions, dq)}
 		}
+		options[dep] = pkgs
 	}
-	return dependencies, conflicts, nil
+	return options, nil
+}
+
+// cycleFrom returns the chain of package names on the stack from the first occurrence of name,
+// ending with name again.
+func cycleFrom(stack []*depFrame, name string) []string {
+	var start int
+	for i, frame := range stack {
+		if frame.pkg.Name == name {
+			start = i
+			break
+		}
+	}
+	cycle := make([]string, 0, len(stack)-start+1)
+	for _, frame := range stack[start:] {
+		cycle = append(cycle, frame.pkg.Name)
+	}
+	return append(cycle, name)
+}
+
+// SetStrictVersions sets whether the versions of packages are parsed and compared strictly, as version.Parse and
+// version.Compare do, rather than exactly as apk-tools does, as version.ParseAPKTools does. Either way, the
+// versions that apk-tools accepts compare the same, but strictly, some that apk-tools accepts are rejected, such
+// as 1.2a3, so packages with them are never selected. It must be set before resolving. Default is false.
+func (p *PkgResolver) SetStrictVersions(strict bool) {
+	p.strictVersions = strict
+	clear(p.parsedVersions)
 }
 
-func (p *PkgResolver) parseVersion(version string) (Version, error) {
-	pkg, ok := p.parsedVersions[version]
+// SetArch only selects packages that can be installed on arch, see Package.MatchesArch, so that a package of
+// another architecture in an index is passed over for one of arch rather than installed. Default is "", which
+// selects packages of any architecture.
+func (p *PkgResolver) SetArch(arch string) {
+	p.arch = arch
+}
+
+// applyArch disqualifies the packages that are not for the architecture of SetArch.
+func (p *PkgResolver) applyArch(dq map[*RepositoryPackage]string) {
+	if p.arch == "" {
+		return
+	}
+	for name, pkgs := range p.nameMap {
+		for _, pkg := range pkgs {
+			// those that only provide the name are also listed under their own
+			if pkg.Name != name || pkg.MatchesArch(p.arch) {
+				continue
+			}
+			p.disqualify(dq, pkg.RepositoryPackage, fmt.Sprintf("for architecture %s, not %s", pkg.Arch, p.arch))
+		}
+	}
+}
+
+func (p *PkgResolver) parseVersion(v string) (Version, error) {
+	pkg, ok := p.parsedVersions[v]
 	if ok {
 		return pkg, nil
 	}
 
-	parsed, err := ParseVersion(version)
+	parse := version.ParseAPKTools
+	if p.strictVersions {
+		parse = version.Parse
+	}
+	parsed, err := parse(v)
 	if err != nil {
 		return parsed, err
 	}
 
-	p.parsedVersions[version] = parsed
+	p.parsedVersions[v] = parsed
 	return parsed, nil
 }
 
@@ -913,7 +1410,7 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 			return -1
 		}
 		versions := CompareVersions(iVersion, jVersion)
-		if versions != equal {
+		if versions != 0 {
 			return -1 * versions
 		}
 		// if versions are equal, they might not be the same as the package versions
@@ -928,12 +1425,20 @@ func (p *PkgResolver) comparePackages(compare *RepositoryPackage, name string, e
 				return -1
 			}
 			versions := CompareVersions(iVersion, jVersion)
-			if versions != equal {
+			if versions != 0 {
 				return -1 * versions
 			}
 		}
 		// if versions are equal, compare names
-		return cmp.Compare(a.Name, b.Name)
+		if names := cmp.Compare(a.Name, b.Name); names != 0 {
+			return names
+		}
+		// the same package in several repositories, so prefer the repository with the highest priority,
+		// and then the one that came first
+		if a.priority != b.priority {
+			return cmp.Compare(b.priority, a.priority)
+		}
+		return cmp.Compare(a.order, b.order)
 	}
 }
 
@@ -1011,16 +1516,22 @@ func (e *DisqualifiedError) Unwrap() error {
 
 func maybedqerror(constraint string, pkgs []*repositoryPackage, dq map[*RepositoryPackage]string) error {
 	errs := make([]error, 0, len(pkgs))
+	held := false
 	for _, pkg := range pkgs {
 		reason, ok := dq[pkg.RepositoryPackage]
 		if ok {
 			errs = append(errs, &DisqualifiedError{pkg.RepositoryPackage, errors.New(reason)})
+			held = held || strings.HasPrefix(reason, heldReason)
 		}
 	}
 
 	if len(errs) != 0 {
-		return &ConstraintError{constraint, errors.Join(errs...)}
+		err := &ConstraintError{constraint, errors.Join(errs...)}
+		if held {
+			return withKind(ErrPackageHeld, err)
+		}
+		return err
 	}
 
-	return fmt.Errorf("could not find constraint %q in indexes", constraint)
+	return withKind(ErrPackageNotFound, fmt.Errorf("could not find constraint %q in indexes", constraint))
 }
@@ -15,24 +15,39 @@
 package apk
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sync/errgroup"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 )
 
 var (
@@ -112,6 +127,9 @@ func TestGetRepositoryIndexes(t *testing.T) {
 		indexes, err := a.GetRepositoryIndexes(context.TODO(), false)
 		require.NoErrorf(t, err, "unable to get indexes")
 		require.Greater(t, len(indexes), 0, "no indexes found")
+		verification := IndexVerification(indexes[0])
+		require.NotNil(t, verification, "index was not verified")
+		require.Contains(t, testKeys, verification.KeyName)
 	})
 	t.Run("cache miss no network", func(t *testing.T) {
 		// Reset etag cache so we have isolated tests.
@@ -127,14 +145,14 @@ func TestGetRepositoryIndexes(t *testing.T) {
 		_, err := a.GetRepositoryIndexes(context.TODO(), false)
 		require.Error(t, err, "should fail when no cache and no network")
 	})
-	t.Run("we can fetch, but do not cache indices without etag", func(t *testing.T) {
+	t.Run("cache indices without etag or last-modified by digest", func(t *testing.T) {
 		// Reset etag cache so we have isolated tests.
 		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
 
-		// we use a transport that can read from the network
-		// it should fail for a cache hit
+		// we use a transport that can read from the network, but sends no validators
 		tmpDir := t.TempDir()
 		a := prepLayout(t, tmpDir, nil)
+		repoDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch)
 
 		a.SetClient(&http.Client{
 			Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true},
@@ -143,9 +161,17 @@ func TestGetRepositoryIndexes(t *testing.T) {
 		require.NoErrorf(t, err, "unable to get indexes")
 		require.Greater(t, len(indexes), 0, "no indexes found")
 
+		index, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, indexFilename))
+		require.NoError(t, err, "unable to read previous index file")
+		digest := fmt.Sprintf("sha256-%x", sha256.Sum256(index))
+		cached, err := os.ReadFile(filepath.Join(repoDir, "APKINDEX", digest+".tar.gz"))
+		require.NoError(t, err, "index was not cached by digest")
+		require.Equal(t, index, cached, "index files do not match")
+		require.Equal(t, digest, IndexFetchInfo(indexes[0]).ETag)
+
 		require.NoError(t, filepath.WalkDir(tmpDir, func(path string, _ fs.DirEntry, _ error) error {
-			if filepath.Ext(path) == ".etag" {
-				t.Errorf("found etag file %q, expected none.", path)
+			if filepath.Ext(path) == ".etag" || filepath.Ext(path) == ".tmp" {
+				t.Errorf("found file %q, expected none.", path)
 			}
 			return nil
 		}))
@@ -180,6 +206,107 @@ func TestGetRepositoryIndexes(t *testing.T) {
 		require.NoError(t, err, "unable to read previous index file")
 		require.Equal(t, index1, index2, "index files do not match")
 	})
+	t.Run("cache miss network should fill cache with a weak etag", func(t *testing.T) {
+		// Reset etag cache so we have isolated tests.
+		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+
+		tmpDir := t.TempDir()
+		a := prepLayout(t, tmpDir, nil)
+		repoDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch)
+
+		const etag = `W/"../../escaped"`
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{
+				root:         testPrimaryPkgDir,
+				basenameOnly: true,
+				headers: map[string][]string{
+					http.CanonicalHeaderKey("etag"): {etag},
+				},
+			},
+		})
+		indexes, err := a.GetRepositoryIndexes(context.TODO(), false)
+		require.NoErrorf(t, err, "unable to get indexes")
+		require.Greater(t, len(indexes), 0, "no indexes found")
+
+		sum := sha256.Sum256([]byte(etagFromHeader(etag)))
+		index1, err := os.ReadFile(filepath.Join(repoDir, "APKINDEX", fmt.Sprintf("etag-sha256-%x.tar.gz", sum)))
+		require.NoError(t, err, "index was not cached by the digest of its etag")
+		index2, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, indexFilename))
+		require.NoError(t, err, "unable to read previous index file")
+		require.Equal(t, index1, index2, "index files do not match")
+		require.NoError(t, filepath.WalkDir(tmpDir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() && strings.Contains(path, "escaped") {
+				t.Errorf("found directory %q from the etag", path)
+			}
+			return err
+		}))
+	})
+	t.Run("cache miss network should fill cache with last-modified", func(t *testing.T) {
+		// Reset etag cache so we have isolated tests.
+		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+
+		tmpDir := t.TempDir()
+		a := prepLayout(t, tmpDir, nil)
+		repoDir := filepath.Join(tmpDir, url.QueryEscape(testAlpineRepos), testArch)
+
+		lastModified := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{
+				root:         testPrimaryPkgDir,
+				basenameOnly: true,
+				headers: map[string][]string{
+					http.CanonicalHeaderKey("last-modified"): {lastModified.Format(http.TimeFormat)},
+				},
+			},
+		})
+		indexes, err := a.GetRepositoryIndexes(context.TODO(), false)
+		require.NoErrorf(t, err, "unable to get indexes")
+		require.Greater(t, len(indexes), 0, "no indexes found")
+
+		_, err = os.Stat(filepath.Join(repoDir, "APKINDEX", fmt.Sprintf("last-modified-%d.tar.gz", lastModified.Unix())))
+		require.NoError(t, err, "index was not cached by last-modified")
+		// the last-modified is not passed off as an etag
+		fetch := IndexFetchInfo(indexes[0])
+		require.Empty(t, fetch.ETag)
+		require.Equal(t, lastModified.Format(http.TimeFormat), fetch.LastModified)
+	})
+	t.Run("cache hit within max-age does not revalidate", func(t *testing.T) {
+		// Reset etag cache so we have isolated tests.
+		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+
+		tmpDir := t.TempDir()
+		a := prepLayout(t, tmpDir, nil)
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{
+				root:         testPrimaryPkgDir,
+				basenameOnly: true,
+				headers: map[string][]string{
+					http.CanonicalHeaderKey("etag"):          {"an-etag"},
+					http.CanonicalHeaderKey("cache-control"): {"public, max-age=3600"},
+				},
+			},
+		})
+		indexes, err := a.GetRepositoryIndexes(context.TODO(), false)
+		require.NoErrorf(t, err, "unable to get indexes")
+		fetch := IndexFetchInfo(indexes[0])
+		require.NotNil(t, fetch, "no fetch metadata")
+		require.Equal(t, IndexURL(testAlpineRepos, testArch), fetch.URL)
+		require.Equal(t, "an-etag", fetch.ETag)
+		require.False(t, fetch.FromCache, "index was downloaded")
+		require.False(t, fetch.FetchedAt.IsZero(), "no fetch time")
+
+		// As if we were a new process, with no network.
+		globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+		a.SetClient(&http.Client{
+			Transport: &testLocalTransport{fail: true},
+		})
+		indexes, err = a.GetRepositoryIndexes(context.TODO(), false)
+		require.NoErrorf(t, err, "should use the fresh cached index")
+		require.Greater(t, len(indexes), 0, "no indexes found")
+		fetch = IndexFetchInfo(indexes[0])
+		require.True(t, fetch.FromCache, "index was not read from the cache")
+		require.Equal(t, "an-etag", fetch.ETag)
+	})
 	t.Run("repo url with http basic auth", func(t *testing.T) {
 		// Reset etag cache so we have isolated tests.
 		globalEtagCache = &etagCache{}
@@ -303,6 +430,29 @@ func TestGetRepositoryIndexes(t *testing.T) {
 	})
 }
 
+func TestIndexCacheParse(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, indexFilename))
+	require.NoError(t, err)
+
+	c := &indexCache{}
+	idx1, err := c.parse("repo1", "etag:1", b, false)
+	require.NoError(t, err)
+
+	// The same content under the same key is only parsed once, even from another repository.
+	idx2, err := c.parse("repo2", "etag:1", b, false)
+	require.NoError(t, err)
+	require.Same(t, idx1, idx2)
+
+	// When a repository moves on, we forget the old index once nothing else refers to it.
+	_, err = c.parse("repo1", "etag:2", b, false)
+	require.NoError(t, err)
+	require.Contains(t, c.parsed, "etag:1")
+	_, err = c.parse("repo2", "etag:2", b, false)
+	require.NoError(t, err)
+	require.NotContains(t, c.parsed, "etag:1")
+	require.Len(t, c.parsed, 1)
+}
+
 func TestIndexAuth_good(t *testing.T) {
 	called := false
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -361,6 +511,399 @@ func TestIndexAuth_bad(t *testing.T) {
 	require.True(t, called, "did not make request")
 }
 
+func TestPartialIndexes(t *testing.T) {
+	// Reset index cache so we have isolated tests.
+	globalIndexCache = &indexCache{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/down/") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/up/x86_64")
+		http.FileServer(http.Dir(testPrimaryPkgDir)).ServeHTTP(w, r)
+	}))
+	defer s.Close()
+	repos := []string{s.URL + "/down", s.URL + "/up", "@bad"}
+
+	ctx := context.Background()
+	_, err := GetRepositoryIndexes(ctx, repos, nil, "x86_64", WithHTTPClient(s.Client()), WithIgnoreSignatures(true))
+	require.Error(t, err, "should fail without partial results")
+
+	indexes, err := GetRepositoryIndexes(ctx, repos, nil, "x86_64", WithHTTPClient(s.Client()), WithIgnoreSignatures(true), WithIndexPartialResults(true))
+	require.Len(t, indexes, 1)
+	require.Equal(t, s.URL+"/up/x86_64/"+indexFilename, indexes[0].Source())
+	var repoErrs *RepositoryIndexErrors
+	require.ErrorAs(t, err, &repoErrs)
+	require.Len(t, repoErrs.Errors, 2)
+	require.Equal(t, s.URL+"/down", repoErrs.Errors[0].Repository)
+	require.ErrorContains(t, repoErrs.Errors[0], "unexpected status code 503")
+	require.Equal(t, "@bad", repoErrs.Errors[1].Repository)
+
+	// it still fails if no repository could be read
+	indexes, err = GetRepositoryIndexes(ctx, []string{s.URL + "/down"}, nil, "x86_64", WithHTTPClient(s.Client()), WithIgnoreSignatures(true), WithIndexPartialResults(true))
+	require.ErrorContains(t, err, "no repository index could be read")
+	require.Empty(t, indexes)
+
+	t.Run("APK", func(t *testing.T) {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch("x86_64"), WithRepositoryPartialResults(true))
+		require.NoError(t, err)
+		a.SetClient(s.Client())
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.SetRepositories(ctx, repos))
+		indexes, err := a.GetRepositoryIndexes(ctx, true)
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Equal(t, s.URL+"/up/x86_64/"+indexFilename, indexes[0].Source())
+
+		require.NoError(t, a.SetRepositories(ctx, []string{s.URL + "/down"}))
+		_, err = a.GetRepositoryIndexes(ctx, true)
+		require.ErrorContains(t, err, "unexpected status code 503")
+	})
+}
+
+func TestGetRepositoryIndexesForArchs(t *testing.T) {
+	// Reset index cache so we have isolated tests.
+	globalIndexCache = &indexCache{}
+
+	var requests sync.Map
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := requests.LoadOrStore(r.URL.Path, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+		r.URL.Path = path.Base(r.URL.Path)
+		http.FileServer(http.Dir(testPrimaryPkgDir)).ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	archs := []string{"x86_64", "aarch64"}
+	indexes, err := GetRepositoryIndexesForArchs(ctx, []string{s.URL + "/main", s.URL + "/flat"}, nil, archs,
+		WithHTTPClient(s.Client()), WithIgnoreSignatures(true), WithIndexLayout(s.URL+"/flat", "%{repo}"))
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	for _, arch := range archs {
+		require.Len(t, indexes[arch], 2, arch)
+		require.Equal(t, fmt.Sprintf("%s/main/%s/%s", s.URL, arch, indexFilename), indexes[arch][0].Source())
+		require.Equal(t, fmt.Sprintf("%s/flat/%s", s.URL, indexFilename), indexes[arch][1].Source())
+	}
+
+	// the flat repository is the same for both architectures, so it is only fetched once
+	n, ok := requests.Load("/flat/" + indexFilename)
+	require.True(t, ok)
+	require.Equal(t, int32(1), n.(*atomic.Int32).Load())
+}
+
+// testSigningKey writes a new RSA private key as name in dir, and returns its path and the PEM of its public key.
+func testSigningKey(t *testing.T, dir, name string) (string, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+// testSignedIndex writes an index with a single package to indexFile, signed by signer.
+func testSignedIndex(t *testing.T, indexFile string, signer *sign.Signer) {
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: "foo", Version: "1.0-r0"}}})
+	require.NoError(t, err)
+	data, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Dir(indexFile), 0o755))
+	require.NoError(t, os.WriteFile(indexFile, data, 0o644))
+	require.NoError(t, sign.SignIndexWithSigner(context.Background(), signer, indexFile))
+}
+
+func TestIndexSignatureSchemes(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, pub := testSigningKey(t, dir, "test.rsa")
+	keys := map[string][]byte{"test.rsa.pub": pub}
+	block, _ := pem.Decode(pub)
+
+	for _, scheme := range []sign.Scheme{sign.SchemePKCS1v15, sign.SchemePSS} {
+		t.Run(scheme.String(), func(t *testing.T) {
+			signer, err := sign.NewKeySigner(keyFile, sign.WithScheme(scheme))
+			require.NoError(t, err)
+			indexFile := filepath.Join(dir, scheme.String()+"-APKINDEX.tar.gz")
+			testSignedIndex(t, indexFile, signer)
+
+			index, fetch, err := getRepositoryIndex(context.Background(), indexFile, keys, testArch, &indexOpts{})
+			require.NoError(t, err)
+			require.Len(t, index.Packages, 1)
+			verification := fetch.Verification
+			require.Equal(t, "test.rsa.pub", verification.KeyName)
+			require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(block.Bytes)), verification.Fingerprint)
+			require.Equal(t, scheme, verification.Scheme)
+		})
+	}
+}
+
+func TestIndexSignatureThreshold(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		signers = map[string]*sign.Signer{}
+		pubs    = map[string][]byte{}
+	)
+	for _, name := range []string{"0", "a", "b", "c"} {
+		keyFile, pub := testSigningKey(t, dir, name+".rsa")
+		signer, err := sign.NewKeySigner(keyFile)
+		require.NoError(t, err)
+		signers[name], pubs[name] = signer, pub
+	}
+	keys := map[string][]byte{"a.rsa.pub": pubs["a"], "b.rsa.pub": pubs["b"], "c.rsa.pub": pubs["c"]}
+	signedIndex := func(t *testing.T, names ...string) string {
+		var indexSigners []*sign.Signer
+		for _, name := range names {
+			indexSigners = append(indexSigners, signers[name])
+		}
+		archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: "foo", Version: "1.0-r0"}}})
+		require.NoError(t, err)
+		data, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		indexFile := filepath.Join(t.TempDir(), indexFilename)
+		require.NoError(t, os.WriteFile(indexFile, data, 0o644))
+		require.NoError(t, sign.SignIndexWithSigners(context.Background(), indexSigners, indexFile))
+		return indexFile
+	}
+	verifiedBy := func(fetch *IndexFetch) []string {
+		var names []string
+		for _, v := range fetch.Verifications {
+			names = append(names, v.KeyName)
+		}
+		return names
+	}
+
+	for _, tt := range []struct {
+		name      string
+		signedBy  []string
+		keys      map[string][]byte
+		threshold int
+		want      []string
+	}{
+		{name: "any key", signedBy: []string{"a", "b"}, keys: keys, want: []string{"a.rsa.pub"}},
+		{name: "untrusted first", signedBy: []string{"0", "b"}, keys: keys, want: []string{"b.rsa.pub"}},
+		{name: "two of three", signedBy: []string{"a", "b"}, keys: keys, threshold: 2, want: []string{"a.rsa.pub", "b.rsa.pub"}},
+		{name: "three of three", signedBy: []string{"a", "b"}, keys: keys, threshold: 3},
+		{name: "untrusted does not count", signedBy: []string{"0", "a"}, keys: keys, threshold: 2},
+		{name: "same key under two names", signedBy: []string{"a", "b"}, keys: map[string][]byte{"a.rsa.pub": pubs["a"], "also-a.rsa.pub": pubs["a"]}, threshold: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			index, fetch, err := getRepositoryIndex(context.Background(), signedIndex(t, tt.signedBy...), tt.keys, testArch, &indexOpts{signatureThreshold: tt.threshold})
+			if tt.want == nil {
+				require.ErrorIs(t, err, ErrSignatureInvalid)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, index.Packages, 1)
+			require.Equal(t, tt.want, verifiedBy(fetch))
+			require.Equal(t, fetch.Verifications[0], fetch.Verification)
+		})
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, pub := testSigningKey(t, dir, "test.rsa")
+	keys := map[string][]byte{"test.rsa.pub": pub}
+	signer, err := sign.NewKeySigner(keyFile)
+	require.NoError(t, err)
+	indexFile := filepath.Join(dir, indexFilename)
+	testSignedIndex(t, indexFile, signer)
+	b, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	want, err := IndexFromArchive(io.NopCloser(bytes.NewReader(b)))
+	require.NoError(t, err)
+
+	verify := func(read *indexRead) error {
+		_, err := verifyIndexSignature(read.keyName, read.scheme, read.signedDigest, read.signature, keys)
+		return err
+	}
+	for name, r := range map[string]func() io.Reader{
+		"buffered": func() io.Reader { return bytes.NewReader(b) },
+		// so that the end of the signature falls anywhere in what was read
+		"one byte at a time": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(b)) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			read, err := readIndex(r(), true, true, false)
+			require.NoError(t, err)
+			require.NoError(t, read.parseErr)
+			require.Equal(t, want, read.index)
+			require.Equal(t, sha256.Sum256(b), [sha256.Size]byte(read.contentDigest))
+			require.NoError(t, verify(read))
+		})
+	}
+
+	t.Run("without parsing", func(t *testing.T) {
+		read, err := readIndex(bytes.NewReader(b), true, false, false)
+		require.NoError(t, err)
+		require.Nil(t, read.index)
+		require.NoError(t, verify(read))
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := bytes.Clone(b)
+		// the last byte of the gzip trailer, the size of the index
+		tampered[len(tampered)-1] ^= 0xff
+		read, err := readIndex(bytes.NewReader(tampered), true, false, false)
+		require.NoError(t, err)
+		require.ErrorIs(t, verify(read), ErrSignatureInvalid)
+	})
+}
+
+func TestRepositoryKeys(t *testing.T) {
+	// Reset index cache so we have isolated tests.
+	globalIndexCache = &indexCache{}
+
+	dir := t.TempDir()
+	ours, oursPub := testSigningKey(t, dir, "ours.rsa")
+	theirs, theirsPub := testSigningKey(t, dir, "theirs.rsa")
+	keys := map[string][]byte{"ours.rsa.pub": oursPub, "theirs.rsa.pub": theirsPub}
+
+	oursRepo, theirsRepo := filepath.Join(dir, "ours"), filepath.Join(dir, "theirs")
+	oursSigner, err := sign.NewKeySigner(ours)
+	require.NoError(t, err)
+	theirsSigner, err := sign.NewKeySigner(theirs)
+	require.NoError(t, err)
+	testSignedIndex(t, IndexURL(oursRepo, testArch), oursSigner)
+	testSignedIndex(t, IndexURL(theirsRepo, testArch), theirsSigner)
+
+	// any key verifies any repository by default
+	indexes, err := GetRepositoryIndexes(context.Background(), []string{oursRepo, theirsRepo}, keys, testArch)
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+
+	// only our key verifies our repository
+	indexes, err = GetRepositoryIndexes(context.Background(), []string{oursRepo, theirsRepo}, keys, testArch,
+		WithIndexKeys(oursRepo, map[string][]byte{"ours.rsa.pub": oursPub}))
+	require.NoError(t, err)
+	require.Len(t, indexes, 2)
+	require.Equal(t, "ours.rsa.pub", IndexVerification(indexes[0]).KeyName)
+
+	// their key cannot vouch for our repository
+	require.NoError(t, os.Chtimes(IndexURL(oursRepo, testArch), time.Now(), time.Now().Add(time.Hour)))
+	testSignedIndex(t, IndexURL(oursRepo, testArch), theirsSigner)
+	require.NoError(t, os.Chtimes(IndexURL(oursRepo, testArch), time.Now(), time.Now().Add(2*time.Hour)))
+	_, err = GetRepositoryIndexes(context.Background(), []string{oursRepo, theirsRepo}, keys, testArch,
+		WithIndexKeys(oursRepo, map[string][]byte{"ours.rsa.pub": oursPub}))
+	require.ErrorContains(t, err, "no key found to verify signature")
+	require.ErrorIs(t, err, ErrSignatureInvalid)
+}
+
+// rejectingVerifier is an IndexVerifier that verifies no index.
+type rejectingVerifier struct{}
+
+func (rejectingVerifier) VerifyIndex(context.Context, *IndexArtifact) error {
+	return errors.New("rejected")
+}
+
+func TestIndexCacheVerification(t *testing.T) {
+	// Reset index cache so we have isolated tests.
+	globalIndexCache = &indexCache{}
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	ours, oursPub := testSigningKey(t, dir, "ours.rsa")
+	_, theirsPub := testSigningKey(t, dir, "theirs.rsa")
+	signer, err := sign.NewKeySigner(ours)
+	require.NoError(t, err)
+	signed, unsigned := filepath.Join(dir, "signed"), filepath.Join(dir, "unsigned")
+	testSignedIndex(t, filepath.Join(signed, indexFilename), signer)
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{{Name: "foo", Version: "1.0-r0"}}})
+	require.NoError(t, err)
+	b, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(unsigned, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(unsigned, indexFilename), b, 0o644))
+
+	keys := map[string][]byte{"ours.rsa.pub": oursPub, "theirs.rsa.pub": theirsPub}
+	get := func(repo, root string, options ...IndexOption) error {
+		client := &http.Client{Transport: &testLocalTransport{root: root, basenameOnly: true}}
+		_, err := GetRepositoryIndexes(ctx, []string{repo}, keys, testArch, append([]IndexOption{WithHTTPClient(client)}, options...)...)
+		return err
+	}
+
+	// each fetch verifies the index its own way, even though the index of the first one is cached
+	const repo = "https://example.com/unsigned"
+	require.NoError(t, get(repo, unsigned, WithIgnoreSignatures(true)))
+	require.ErrorContains(t, get(repo, unsigned), "signature")
+	require.NoError(t, get(repo, unsigned, WithIgnoreSignatureForIndexes(repo)))
+
+	const oursRepo = "https://example.com/ours"
+	require.NoError(t, get(oursRepo, signed))
+	require.ErrorIs(t, get(oursRepo, signed, WithIndexKeys(oursRepo, map[string][]byte{"theirs.rsa.pub": theirsPub})), ErrSignatureInvalid)
+	require.ErrorIs(t, get(oursRepo, signed, WithIndexSignatureThreshold(2)), ErrSignatureInvalid)
+	require.ErrorIs(t, get(oursRepo, signed, WithIndexVerifier(rejectingVerifier{}, false)), ErrSignatureInvalid)
+	require.NoError(t, get(oursRepo, signed, WithIndexKeys(oursRepo, map[string][]byte{"ours.rsa.pub": oursPub})))
+}
+
+func TestHostConfig(t *testing.T) {
+	// Reset index cache so we have isolated tests.
+	globalIndexCache = &indexCache{}
+
+	dir := t.TempDir()
+	key, pub := testSigningKey(t, dir, "host.rsa")
+	signer, err := sign.NewKeySigner(key)
+	require.NoError(t, err)
+	repo := filepath.Join(dir, "repo")
+	testSignedIndex(t, IndexURL(repo, testArch), signer)
+
+	host := filepath.Join(dir, "host")
+	require.NoError(t, os.MkdirAll(filepath.Join(host, keysDirPath), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(host, reposFilePath), []byte(repo+"\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(host, keysDirPath, "host.rsa.pub"), pub, 0o644))
+
+	// the root has the arch, but neither repositories nor keys
+	root := apkfs.NewMemFS()
+	a, err := New(WithFS(root), WithIgnoreMknodErrors(true), WithArch(testArch), WithHostConfig(os.DirFS(host)))
+	require.NoError(t, err)
+	require.NoError(t, a.InitDB(context.Background()))
+
+	repos, err := a.GetRepositories()
+	require.NoError(t, err)
+	require.Equal(t, []string{repo}, repos)
+	indexes, err := a.GetRepositoryIndexes(context.Background(), false)
+	require.NoError(t, err)
+	require.Len(t, indexes, 1)
+	require.Equal(t, "host.rsa.pub", IndexVerification(indexes[0]).KeyName)
+
+	got, err := root.ReadFile(reposFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "\n", string(got), "the repositories of the root are left alone")
+}
+
+func TestRepositoryLayout(t *testing.T) {
+	for _, tt := range []struct {
+		layout string
+		want   string
+	}{
+		{DefaultRepositoryLayout, "https://example.com/main/x86_64"},
+		{"%{repo}", "https://example.com/main"},
+		{"https://proxy.example.com/alpine/%{arch}", "https://proxy.example.com/alpine/x86_64"},
+		{"%{repo}/packages/%{arch}/%{arch}", "https://example.com/main/packages/x86_64/x86_64"},
+	} {
+		require.NoError(t, ValidateRepositoryLayout(tt.layout))
+		require.Equal(t, tt.want, RepositoryURL(tt.layout, "https://example.com/main/", "x86_64"))
+	}
+	require.Error(t, ValidateRepositoryLayout("%{repo}/%{release}"))
+	require.Error(t, ValidateRepositoryLayout(""))
+
+	t.Run("flat repository", func(t *testing.T) {
+		dir := t.TempDir()
+		data, err := os.ReadFile(filepath.Join(testPrimaryPkgDir, indexFilename))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, indexFilename), data, 0o644))
+
+		indexes, err := GetRepositoryIndexes(context.Background(), []string{dir}, nil, testArch,
+			WithIgnoreSignatures(true), WithIndexLayout(dir, "%{repo}"))
+		require.NoError(t, err)
+		require.Len(t, indexes, 1)
+		require.Equal(t, filepath.Join(dir, indexFilename), indexes[0].Source())
+		pkg := indexes[0].Packages()[0]
+		require.Equal(t, dir+"/"+pkg.Filename(), pkg.URL())
+	})
+}
+
 func testGetPackagesAndIndex() ([]*RepositoryPackage, []*RepositoryWithIndex) {
 	// create a tree of packages, including some multiple that depend on the same one
 	// but no circular dependencies; this is an acyclic graph
@@ -631,7 +1174,7 @@ func TestGetPackageDependencies(t *testing.T) {
 		}
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
-				deps, _, err := resolver.getPackageDependencies(pkg6[0], "", tt.allow, nil, nil, nil, map[*RepositoryPackage]string{})
+				deps, _, _, err := resolver.getPackageDependencies(pkg6[0], "", tt.allow, nil, nil, map[*RepositoryPackage]string{})
 				require.NoErrorf(t, err, "unable to get dependencies")
 
 				actual := make([]string, 0, len(deps))
@@ -707,6 +1250,7 @@ func TestResolvePackage(t *testing.T) {
 		version = "1.0.1"
 		pkgs, err = resolver.ResolvePackage("package5="+version, map[*RepositoryPackage]string{})
 		require.Error(t, err, "package5 version 1.0.1 does not exist")
+		require.ErrorIs(t, err, ErrPackageNotFound)
 		require.Len(t, pkgs, 0)
 	})
 	t.Run("greater than version", func(t *testing.T) {
@@ -947,6 +1491,259 @@ func TestConstrains(t *testing.T) {
 	}
 }
 
+func TestRepositoryPriority(t *testing.T) {
+	makeIndex := func(uri string) *RepositoryWithIndex {
+		repo := Repository{URI: uri}
+		return repo.WithIndex(&APKIndex{
+			Packages: []*Package{{Name: "foo", Version: "1.0.0-r0"}},
+		})
+	}
+	first, second := makeIndex("https://first.example.com"), makeIndex("https://second.example.com")
+
+	resolve := func(t *testing.T, indexes ...NamedIndex) string {
+		t.Helper()
+		resolver := NewPkgResolver(context.Background(), indexes)
+		pkg, _, _, err := resolver.GetPackageWithDependencies("foo", nil, map[*RepositoryPackage]string{})
+		require.NoError(t, err)
+		return pkg.Repository().URI
+	}
+
+	t.Run("index order", func(t *testing.T) {
+		require.Equal(t, "https://first.example.com", resolve(t, NewNamedRepositoryWithIndex("", first), NewNamedRepositoryWithIndex("", second)))
+		require.Equal(t, "https://second.example.com", resolve(t, NewNamedRepositoryWithIndex("", second), NewNamedRepositoryWithIndex("", first)))
+	})
+	t.Run("priority", func(t *testing.T) {
+		require.Equal(t, "https://second.example.com", resolve(t,
+			NewNamedRepositoryWithIndex("", first),
+			NewPrioritizedIndex(NewNamedRepositoryWithIndex("", second), 10),
+		))
+		require.Equal(t, "https://first.example.com", resolve(t,
+			NewPrioritizedIndex(NewNamedRepositoryWithIndex("", second), -1),
+			NewNamedRepositoryWithIndex("", first),
+		))
+	})
+}
+
+func TestPinnedRepositories(t *testing.T) {
+	main := Repository{URI: "https://main.example.com"}
+	edge := Repository{URI: "https://edge.example.com"}
+	indexes := []NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "foo", Version: "1.0.0-r0", Dependencies: []string{"lib"}},
+				{Name: "lib", Version: "1.0.0-r0"},
+				{Name: "bar", Version: "1.0.0-r0", Dependencies: []string{"lib"}},
+				{Name: "baz", Version: "1.0.0-r0", Dependencies: []string{"newlib"}},
+				{Name: "nonew", Version: "1.0.0-r0", Dependencies: []string{"!newlib"}},
+			},
+		})),
+		NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "foo", Version: "2.0.0-r0", Dependencies: []string{"lib", "newlib"}},
+				{Name: "lib", Version: "2.0.0-r0"},
+				{Name: "newlib", Version: "1.0.0-r0"},
+				{Name: "lib-doc", Version: "2.0.0-r0", InstallIf: []string{"lib"}},
+				{Name: "newlib-doc", Version: "1.0.0-r0", InstallIf: []string{"newlib"}},
+			},
+		})),
+	}
+	resolve := func(t *testing.T, packages ...string) ([]string, error) {
+		t.Helper()
+		resolver := NewPkgResolver(context.Background(), indexes)
+		pkgs, _, err := resolver.GetPackagesWithDependencies(context.Background(), packages)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Repository().URI+"/"+pkg.Filename())
+		}
+		return names, nil
+	}
+
+	t.Run("unpinned uses untagged", func(t *testing.T) {
+		pkgs, err := resolve(t, "foo")
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"https://main.example.com/lib-1.0.0-r0.apk",
+			"https://main.example.com/foo-1.0.0-r0.apk",
+		}, pkgs)
+	})
+	t.Run("pinned prefers tagged only for the named package", func(t *testing.T) {
+		pkgs, err := resolve(t, "foo@edge")
+		require.NoError(t, err)
+		// a tagged install_if is triggered by a package from its repository, not by one from another
+		require.ElementsMatch(t, []string{
+			"https://main.example.com/lib-1.0.0-r0.apk",
+			"https://edge.example.com/newlib-1.0.0-r0.apk",
+			"https://edge.example.com/newlib-doc-1.0.0-r0.apk",
+			"https://edge.example.com/foo-2.0.0-r0.apk",
+		}, pkgs)
+	})
+	t.Run("unpinned cannot use tagged dependencies", func(t *testing.T) {
+		_, err := resolve(t, "baz")
+		require.Error(t, err)
+	})
+	t.Run("tagged install_if needs the tag", func(t *testing.T) {
+		pkgs, err := resolve(t, "bar")
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"https://main.example.com/lib-1.0.0-r0.apk",
+			"https://main.example.com/bar-1.0.0-r0.apk",
+		}, pkgs)
+	})
+	t.Run("conflicts apply to tagged", func(t *testing.T) {
+		_, err := resolve(t, "nonew", "foo@edge")
+		require.ErrorContains(t, err, "excluded by !newlib")
+	})
+}
+
+func TestResolveCycles(t *testing.T) {
+	dependers := map[string][]string{
+		"a=1.0-r0": {"b"},
+		"b=1.0-r0": {"c"},
+		"c=1.0-r0": {"a"},
+		"d=1.0-r0": {"e"},
+		"e=1.0-r0": {},
+	}
+
+	resolver := makeResolver(nil, dependers)
+	resolution, err := resolver.Resolve(context.Background(), []string{"b", "a", "d"})
+	require.NoError(t, err)
+
+	// The same cycle is found from both a and b, but is reported once.
+	require.Equal(t, [][]string{{"a", "b", "c", "a"}}, resolution.Cycles)
+
+	names := make([]string, 0, len(resolution.Packages))
+	for _, pkg := range resolution.Packages {
+		names = append(names, pkg.Name)
+	}
+	require.Equal(t, []string{"b", "a", "c", "e", "d"}, names)
+}
+
+func TestResolveWithInstalled(t *testing.T) {
+	main := Repository{URI: "https://main.example.com"}
+	edge := Repository{URI: "https://edge.example.com"}
+	indexes := []NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "foo", Version: "1.0.0-r0", Dependencies: []string{"lib"}},
+				{Name: "foo", Version: "2.0.0-r0", Dependencies: []string{"lib"}},
+				{Name: "lib", Version: "1.0.0-r0"},
+				{Name: "lib", Version: "2.0.0-r0"},
+				{Name: "baz", Version: "1.0.0-r0"},
+				{Name: "qux", Version: "1.0.0-r0"},
+				{Name: "old", Version: "1.0.0-r0"},
+			},
+		})),
+		NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "foo", Version: "3.0.0-r0", Dependencies: []string{"lib"}},
+			},
+		})),
+	}
+	installed := []*InstalledPackage{
+		{Package: Package{Name: "foo", Version: "1.0.0-r0"}},
+		{Package: Package{Name: "lib", Version: "1.0.0-r0"}},
+		{Package: Package{Name: "qux", Version: "0.5.0-r0"}},
+		{Package: Package{Name: "old", Version: "1.0.0-r0"}},
+	}
+	names := func(pkgs []*InstalledPackage) []string {
+		var out []string
+		for _, pkg := range pkgs {
+			out = append(out, pkg.Name+"-"+pkg.Version)
+		}
+		return out
+	}
+	changes := func(changes []PackageChange) []string {
+		var out []string
+		for _, c := range changes {
+			out = append(out, c.From.Name+"-"+c.From.Version+" -> "+c.To.Repository().URI+"/"+c.To.Filename())
+		}
+		return out
+	}
+
+	t.Run("keeps installed versions", func(t *testing.T) {
+		resolver := NewPkgResolver(context.Background(), indexes)
+		delta, err := resolver.ResolveWithInstalled(context.Background(), []string{"foo", "baz", "qux"}, installed)
+		require.NoError(t, err)
+		require.Len(t, delta.Install, 1)
+		require.Equal(t, "baz-1.0.0-r0.apk", delta.Install[0].Filename())
+		require.Equal(t, []string{"qux-0.5.0-r0 -> https://main.example.com/qux-1.0.0-r0.apk"}, changes(delta.Upgrade))
+		require.ElementsMatch(t, []string{"foo-1.0.0-r0", "lib-1.0.0-r0"}, names(delta.Keep))
+		require.Equal(t, []string{"old-1.0.0-r0"}, names(delta.Remove))
+		require.Len(t, delta.Packages, 4)
+	})
+	t.Run("upgrades when constrained", func(t *testing.T) {
+		resolver := NewPkgResolver(context.Background(), indexes)
+		delta, err := resolver.ResolveWithInstalled(context.Background(), []string{"foo>2", "lib>=2", "qux", "old"}, installed)
+		require.NoError(t, err)
+		require.Empty(t, delta.Install)
+		require.ElementsMatch(t, []string{
+			"foo-1.0.0-r0 -> https://main.example.com/foo-2.0.0-r0.apk",
+			"lib-1.0.0-r0 -> https://main.example.com/lib-2.0.0-r0.apk",
+			"qux-0.5.0-r0 -> https://main.example.com/qux-1.0.0-r0.apk",
+		}, changes(delta.Upgrade))
+		require.Equal(t, []string{"old-1.0.0-r0"}, names(delta.Keep))
+		require.Empty(t, delta.Remove)
+	})
+	t.Run("moves to tagged repository", func(t *testing.T) {
+		resolver := NewPkgResolver(context.Background(), indexes)
+		delta, err := resolver.ResolveWithInstalled(context.Background(), []string{"foo@edge"}, installed)
+		require.NoError(t, err)
+		require.Equal(t, []string{"foo-1.0.0-r0 -> https://edge.example.com/foo-3.0.0-r0.apk"}, changes(delta.Upgrade))
+		require.Equal(t, []string{"lib-1.0.0-r0"}, names(delta.Keep))
+		require.Equal(t, []string{"qux-0.5.0-r0", "old-1.0.0-r0"}, names(delta.Remove))
+	})
+	t.Run("reinstalls other builds with available", func(t *testing.T) {
+		rebuilt := []NamedIndex{
+			NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+				Packages: []*Package{
+					{Name: "foo", Version: "1.0.0-r0", Dependencies: []string{"lib"}, Checksum: []byte{1}},
+					{Name: "lib", Version: "1.0.0-r0", Checksum: []byte{2}},
+				},
+			})),
+		}
+		installed := []*InstalledPackage{
+			{Package: Package{Name: "foo", Version: "1.0.0-r0", Checksum: []byte{9}}},
+			{Package: Package{Name: "lib", Version: "1.0.0-r0", Checksum: []byte{2}}},
+		}
+		resolver := NewPkgResolver(context.Background(), rebuilt)
+		delta, err := resolver.ResolveWithInstalled(context.Background(), []string{"foo"}, installed)
+		require.NoError(t, err)
+		require.Empty(t, delta.Upgrade)
+		require.ElementsMatch(t, []string{"foo-1.0.0-r0", "lib-1.0.0-r0"}, names(delta.Keep))
+
+		delta, err = resolver.ResolveWithInstalled(context.Background(), []string{"foo"}, installed, WithUpgradeAvailable(true))
+		require.NoError(t, err)
+		require.Equal(t, []string{"foo-1.0.0-r0 -> https://main.example.com/foo-1.0.0-r0.apk"}, changes(delta.Upgrade))
+		require.Equal(t, []string{"lib-1.0.0-r0"}, names(delta.Keep))
+	})
+}
+
+func TestWhoDependsOn(t *testing.T) {
+	providers := map[string][]string{
+		"ld-linux=2.38-r10": {"so:ld-linux-aarch64.so.1=1.0"},
+		"ld-linux=2.38-r11": {"so:ld-linux-aarch64.so.1=1.1"},
+	}
+	dependers := map[string][]string{
+		"glibc=2.38-r10":   {"so:ld-linux-aarch64.so.1"},
+		"foo=1.0-r0":       {"ld-linux>2.38-r11"},
+		"bar=1.0-r0":       {"ld-linux>=2.38-r11"},
+		"baz=1.0-r0":       {"!ld-linux"},
+		"qux=1.0-r0":       {"so:ld-linux-aarch64.so.1>1.1"},
+		"glibc-dev=1.0-r0": {"glibc"},
+	}
+
+	resolver := makeResolver(providers, dependers)
+	var got []string
+	for _, pkg := range resolver.WhoDependsOn("ld-linux") {
+		got = append(got, pkg.Name)
+	}
+	require.ElementsMatch(t, []string{"glibc", "bar"}, got)
+	require.Empty(t, resolver.WhoDependsOn("notreal123"))
+}
+
 func testNamedRepositoryFromIndexes(indexes []*RepositoryWithIndex) (named []NamedIndex) {
 	for _, index := range indexes {
 		named = append(named, NewNamedRepositoryWithIndex("", index))
@@ -999,3 +1796,95 @@ func makeResolver(provs, deps map[string][]string) *PkgResolver {
 	})
 	return NewPkgResolver(context.Background(), testNamedRepositoryFromIndexes([]*RepositoryWithIndex{repoWithIndex}))
 }
+
+func TestCacheKeyNormalization(t *testing.T) {
+	// Reset etag cache so we have isolated tests.
+	globalEtagCache, globalIndexCache = &etagCache{}, &indexCache{}
+
+	// a bucket that serves pre-signed URLs, which are only signed for a GET
+	var gets atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("X-Amz-Signature") == "" || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		gets.Add(1)
+		fmt.Fprintf(w, "index of version %s", r.URL.Query().Get("versionId"))
+	}))
+	defer srv.Close()
+
+	tmpDir := t.TempDir()
+	c := cache{dir: tmpDir, keys: &cacheKeys{query: []string{"versionId"}}}
+	get := func(query string) string {
+		t.Helper()
+		resp, err := c.client(srv.Client(), true).Get(srv.URL + "/repo/x86_64/APKINDEX.tar.gz?" + query)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	require.Equal(t, "index of version ", get("X-Amz-Signature=one"))
+	require.Equal(t, "index of version ", get("X-Amz-Signature=two#latest"), "volatile query should share the key")
+	require.Equal(t, int32(1), gets.Load())
+
+	require.Equal(t, "index of version 2", get("X-Amz-Signature=three&versionId=2"), "kept query should not share the key")
+	require.Equal(t, int32(2), gets.Load())
+
+	// another process revalidates by downloading, as the HEAD is refused, into the same file
+	globalEtagCache = &etagCache{}
+	require.Equal(t, "index of version ", get("X-Amz-Signature=four"))
+	require.Equal(t, int32(3), gets.Load())
+
+	u, err := url.Parse(srv.URL + "/repo/x86_64/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	unversioned, err := cachePath(tmpDir, c.keys, *u)
+	require.NoError(t, err)
+	u.RawQuery = "versionId=2&X-Amz-Signature=five"
+	versioned, err := cachePath(tmpDir, c.keys, *u)
+	require.NoError(t, err)
+	require.NotEqual(t, unversioned, versioned)
+	for _, f := range []string{unversioned, versioned} {
+		entries, err := os.ReadDir(cacheDirFromFile(f))
+		require.NoError(t, err)
+		// each cached index has its provenance next to it
+		entries = slices.DeleteFunc(entries, func(e os.DirEntry) bool { return strings.HasSuffix(e.Name(), provenanceExt) })
+		require.Len(t, entries, 1, "expected a single cached index in %s", cacheDirFromFile(f))
+	}
+}
+
+func TestResolveDeterministic(t *testing.T) {
+	// a meta package with many dependencies, each of which triggers install_if packages, and names with many
+	// providers, so that any map iteration in the resolver would show up in the order. The -extra packages are
+	// only installed because the -doc packages are.
+	var pkgs []*Package
+	meta := &Package{Name: "meta", Version: "1.0-r0"}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("lib%02d", i)
+		meta.Dependencies = append(meta.Dependencies, name, fmt.Sprintf("so:%s.so", name))
+		pkgs = append(pkgs,
+			&Package{Name: name, Version: "1.0-r0", Provides: []string{fmt.Sprintf("so:%s.so=1", name)}},
+			&Package{Name: name + "-compat", Version: "1.0-r0", Provides: []string{fmt.Sprintf("so:%s.so=1", name)}},
+			&Package{Name: name + "-doc", Version: "1.0-r0", InstallIf: []string{name}},
+			&Package{Name: name + "-extra", Version: "1.0-r0", InstallIf: []string{name, name + "-doc"}},
+		)
+	}
+	pkgs = append(pkgs, meta)
+	indexes := testNamedRepositoryFromIndexes([]*RepositoryWithIndex{(&Repository{}).WithIndex(&APKIndex{Packages: pkgs})})
+
+	resolve := func() []string {
+		resolution, err := NewPkgResolver(context.Background(), indexes).Resolve(context.Background(), []string{"meta"})
+		require.NoError(t, err)
+		var names []string
+		for _, pkg := range resolution.Packages {
+			names = append(names, pkg.Filename())
+		}
+		return names
+	}
+	want := resolve()
+	require.Len(t, want, 151)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, want, resolve())
+	}
+}
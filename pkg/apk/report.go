@@ -0,0 +1,145 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"golang.org/x/exp/slices"
+)
+
+// InstallReport is what Install did.
+type InstallReport struct {
+	// Installed are the packages that were installed, in the order they were installed, as their .PKGINFO
+	// has them. Packages that already were installed are not in it.
+	Installed []*Package
+	// Replaced are the installed packages that were replaced by another version or build of them in Installed.
+	Replaced []*InstalledPackage
+	// Downloaded is the number of bytes of packages that were downloaded, not counting those found in the
+	// cache.
+	Downloaded int64
+	// Phases are how long each phase of the install took.
+	Phases InstallPhases
+}
+
+// InstallPhases are how long each phase of Install took. Packages are installed as they are fetched, so
+// Fetch and Extract are both from when the first package started being fetched, and overlap.
+type InstallPhases struct {
+	// Resolve is how long fetching the indexes and resolving the world took.
+	Resolve time.Duration
+	// Fetch is how long until every package was fetched and expanded, or read from the cache.
+	Fetch time.Duration
+	// Extract is how long until the files of every package were installed.
+	Extract time.Duration
+	// Commit is how long updating the installed database took.
+	Commit time.Duration
+	// Total is how long Install took, from start to end.
+	Total time.Duration
+}
+
+// Install adds packages to the world, and installs everything the world needs, as apk add does, for callers
+// that do not need the control that SetWorld, ResolveWorld and InstallPackages give. The root must have been
+// initialized, see InitDB, and have repositories, see SetRepositories. The world is only written once the
+// packages are installed, so that a failed install does not leave it asking for what is not there.
+func (a *APK) Install(ctx context.Context, packages []string) (_ *InstallReport, err error) {
+	start := time.Now()
+	ctx, cancel := withTimeout(ctx, a.timeouts.Total, "installing packages")
+	defer cancel()
+	defer func() { err = timedOut(ctx, err) }()
+
+	ctx, span := otel.Tracer("go-apk").Start(ctx, "Install")
+	defer span.End()
+
+	if _, err := a.fs.Stat(a.layoutPath(installedFilePath)); err != nil {
+		return nil, fmt.Errorf("the apk database is not initialized, see InitDB: %w", err)
+	}
+	repos, err := a.GetRepositories()
+	if err != nil {
+		return nil, fmt.Errorf("reading repositories: %w", err)
+	}
+	repos = slices.DeleteFunc(repos, func(repo string) bool { return strings.TrimSpace(repo) == "" })
+	if len(repos) == 0 {
+		return nil, errors.New("no repositories to install from, see SetRepositories")
+	}
+
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, fmt.Errorf("reading world: %w", err)
+	}
+	for _, pkg := range packages {
+		if !slices.Contains(world, pkg) {
+			world = append(world, pkg)
+		}
+	}
+
+	report := &InstallReport{}
+	indexes, err := a.worldIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pkgs, conflicts, err := a.resolve(ctx, indexes, world)
+	if err != nil {
+		return nil, fmt.Errorf("error getting package dependencies: %w", err)
+	}
+	report.Phases.Resolve = time.Since(start)
+	for _, pkg := range conflicts {
+		isInstalled, err := a.isInstalledPackage(pkg)
+		if err != nil {
+			return nil, fmt.Errorf("error checking if package %s is installed: %w", pkg, err)
+		}
+		if isInstalled {
+			return nil, fmt.Errorf("cannot install due to conflict with %s", pkg)
+		}
+	}
+
+	instPkgs := make([]InstallablePackage, len(pkgs))
+	for i, pkg := range pkgs {
+		instPkgs[i] = pkg
+	}
+	if err := a.installPackages(ctx, nil, instPkgs, report); err != nil {
+		return nil, err
+	}
+	if err := a.SetWorld(ctx, world); err != nil {
+		return nil, fmt.Errorf("writing world: %w", err)
+	}
+
+	report.Phases.Total = time.Since(start)
+	return report, nil
+}
+
+// downloadCounter counts the bytes of packages downloaded while it is in the context.
+type downloadCounter struct {
+	n atomic.Int64
+}
+
+type downloadCounterKey struct{}
+
+// withDownloadCounter returns ctx with a new downloadCounter, and the counter.
+func withDownloadCounter(ctx context.Context) (context.Context, *downloadCounter) {
+	c := &downloadCounter{}
+	return context.WithValue(ctx, downloadCounterKey{}, c), c
+}
+
+// downloadCounterFrom returns the downloadCounter of ctx, or nil if there is none.
+func downloadCounterFrom(ctx context.Context) *downloadCounter {
+	c, _ := ctx.Value(downloadCounterKey{}).(*downloadCounter)
+	return c
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestInstall(t *testing.T) {
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+
+	// a repository with a single package without dependencies, and its unsigned index
+	repoDir := t.TempDir()
+	b, err := os.ReadFile("testdata/replaces/replaces-0.0.1-r0.apk")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "replaces-0.0.1-r0.apk"), b, 0o644))
+	pkg, err := ParsePackage(ctx, bytes.NewReader(b))
+	require.NoError(t, err)
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{pkg}})
+	require.NoError(t, err)
+	index, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "APKINDEX.tar.gz"), index, 0o644))
+
+	newAPK := func(t *testing.T) *APK {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(ignoreMknodErrors),
+			WithNoSignatureIndexes("https://example.com/repo"))
+		require.NoError(t, err, "unable to create APK")
+		a.SetClient(&http.Client{Transport: &testLocalTransport{root: repoDir, basenameOnly: true}})
+		return a
+	}
+
+	t.Run("not initialized", func(t *testing.T) {
+		_, err := newAPK(t).Install(ctx, []string{"replaces"})
+		require.ErrorContains(t, err, "not initialized")
+	})
+	t.Run("no repositories", func(t *testing.T) {
+		a := newAPK(t)
+		require.NoError(t, a.InitDB(ctx))
+		_, err := a.Install(ctx, []string{"replaces"})
+		require.ErrorContains(t, err, "no repositories")
+	})
+	t.Run("installed", func(t *testing.T) {
+		a := newAPK(t)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/repo"}))
+
+		report, err := a.Install(ctx, []string{"replaces"})
+		require.NoError(t, err)
+		require.Len(t, report.Installed, 1)
+		require.Equal(t, "replaces", report.Installed[0].Name)
+		require.Equal(t, "0.0.1-r0", report.Installed[0].Version)
+		require.Equal(t, int64(len(b)), report.Downloaded)
+		require.Positive(t, report.Phases.Resolve)
+		require.Positive(t, report.Phases.Fetch)
+		require.GreaterOrEqual(t, report.Phases.Extract, report.Phases.Fetch)
+		require.GreaterOrEqual(t, report.Phases.Total, report.Phases.Resolve+report.Phases.Extract)
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Equal(t, []string{"replaces"}, world)
+
+		// nothing is left to install the second time
+		report, err = a.Install(ctx, []string{"replaces"})
+		require.NoError(t, err)
+		require.Empty(t, report.Installed)
+		require.Zero(t, report.Downloaded)
+	})
+	t.Run("unresolvable", func(t *testing.T) {
+		a := newAPK(t)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/repo"}))
+
+		_, err := a.Install(ctx, []string{"nothere"})
+		require.Error(t, err)
+		world, err := a.GetWorld()
+		require.NoError(t, err)
+		require.Empty(t, world, "the world is only written once the packages are installed")
+	})
+}
@@ -70,6 +70,17 @@ func (r *RepositoryWithIndex) RepoAbbr() string {
 type RepositoryPackage struct {
 	*Package
 	repository *RepositoryWithIndex
+	// url is where the package is fetched from, when it is not in its repository, see URL
+	url string
+}
+
+// Materialize parses the fields of the package that lazy parsing of its index deferred, see
+// APKIndex.Materialize.
+func (rp *RepositoryPackage) Materialize() error {
+	if rp.repository == nil || rp.repository.index == nil {
+		return nil
+	}
+	return rp.repository.index.Materialize(rp.Package)
 }
 
 func NewRepositoryPackage(pkg *Package, repo *RepositoryWithIndex) *RepositoryPackage {
@@ -79,7 +90,13 @@ func NewRepositoryPackage(pkg *Package, repo *RepositoryWithIndex) *RepositoryPa
 	}
 }
 
+// URL returns where the package is fetched from, its file in its repository, or the file it was read from
+// for a world entry that is an .apk file. It is the exact URL that FetchPackage fetches, for tools that
+// download packages themselves; see PkgResolver.PackageURL to find it for a constraint.
 func (rp *RepositoryPackage) URL() string {
+	if rp.url != "" {
+		return rp.url
+	}
 	return fmt.Sprintf("%s/%s", rp.repository.URI, rp.Filename())
 }
 
@@ -0,0 +1,103 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/version"
+)
+
+// Requirement is an entry of the world, or a dependency of a package, as a name with a constraint on its
+// version and a pin, e.g. name@edge>=1.2.3, or a conflict with a name, e.g. !name. It is a convenience for
+// reading and writing such entries: the world and the resolver keep them as strings, so a Requirement is
+// resolved as its String, and parsed again there.
+type Requirement struct {
+	// Name is the name of a package, or of something that packages provide, e.g. so:libc.musl-x86_64.so.1.
+	Name string
+	// Op and Version are the constraint on the version, or on the checksum for version.Checksum. Any
+	// version satisfies version.Any, with an empty Version.
+	Op      version.Operator
+	Version string
+	// Pin is the name of the repository to install from, if any.
+	Pin string
+	// Conflict is whether nothing may be installed that satisfies the rest of the requirement.
+	Conflict bool
+	// Optional is whether the requirement is only installed if it can be resolved, see
+	// PkgResolver.SetOptional. The world has no way to mark it, so String does not include it.
+	Optional bool
+}
+
+// ParseRequirement parses a requirement as it is written in the world or a dependency, such as
+// name@edge>=1.2.3 or !name.
+func ParseRequirement(s string) (Requirement, error) {
+	var r Requirement
+	atom, conflict := strings.CutPrefix(s, "!")
+	parsed := resolvePackageNameVersionPin(atom)
+	if parsed.name == "" || strings.ContainsAny(parsed.name, "@=><~! \t\n") {
+		return r, fmt.Errorf("invalid requirement %q", s)
+	}
+	return requirementFromConstraint(parsed, conflict), nil
+}
+
+// ParseRequirements parses each of entries with ParseRequirement, such as the packages of the world.
+func ParseRequirements(entries []string) ([]Requirement, error) {
+	reqs := make([]Requirement, 0, len(entries))
+	for _, entry := range entries {
+		r, err := ParseRequirement(entry)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// FormatRequirements returns the String of each of reqs, as SetWorld and the resolver take them.
+func FormatRequirements(reqs []Requirement) []string {
+	entries := make([]string, len(reqs))
+	for i, r := range reqs {
+		entries[i] = r.String()
+	}
+	return entries
+}
+
+// String returns the requirement as apk-tools writes it to the world, with the pin before the constraint,
+// e.g. name@edge>=1.2.3.
+func (r Requirement) String() string {
+	var b strings.Builder
+	if r.Conflict {
+		b.WriteByte('!')
+	}
+	b.WriteString(r.Name)
+	if r.Pin != "" {
+		b.WriteByte('@')
+		b.WriteString(r.Pin)
+	}
+	if r.Op != versionAny {
+		b.WriteString(r.Op.String())
+		b.WriteString(r.Version)
+	}
+	return b.String()
+}
+
+func requirementFromConstraint(c parsedConstraint, conflict bool) Requirement {
+	r := Requirement{Name: c.name, Op: c.dep, Pin: c.pin, Conflict: conflict}
+	if c.dep != versionAny {
+		r.Version = c.version
+	}
+	return r
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/version"
+)
+
+func TestParseRequirement(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Requirement
+		str  string
+	}{
+		{"agetty", Requirement{Name: "agetty"}, "agetty"},
+		{"so:libc.musl-x86_64.so.1", Requirement{Name: "so:libc.musl-x86_64.so.1"}, "so:libc.musl-x86_64.so.1"},
+		{"name@edge>=1.2.3", Requirement{Name: "name", Op: version.GreaterEqual, Version: "1.2.3", Pin: "edge"}, "name@edge>=1.2.3"},
+		{"name>=1.2.3@edge", Requirement{Name: "name", Op: version.GreaterEqual, Version: "1.2.3", Pin: "edge"}, "name@edge>=1.2.3"},
+		{"name~1.4", Requirement{Name: "name", Op: version.Tilde, Version: "1.4"}, "name~1.4"},
+		{"name><Q1abc=", Requirement{Name: "name", Op: version.Checksum, Version: "Q1abc="}, "name><Q1abc="},
+		{"!name<2", Requirement{Name: "name", Op: version.Less, Version: "2", Conflict: true}, "!name<2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseRequirement(tt.s)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.str, got.String())
+		})
+	}
+
+	for _, s := range []string{"", "!", "name=", "name@bad-pin", "@pin", "name@a@b", "two names"} {
+		_, err := ParseRequirement(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestWorldRequirements(t *testing.T) {
+	ctx := context.Background()
+	src := apkfs.NewMemFS()
+	require.NoError(t, src.MkdirAll("etc/apk", 0o755))
+	a, err := New(WithFS(src), WithIgnoreMknodErrors(ignoreMknodErrors))
+	require.NoError(t, err)
+
+	reqs, err := ParseRequirements([]string{"foo>=1.0@edge", "bar"})
+	require.NoError(t, err)
+	require.NoError(t, a.SetWorldRequirements(ctx, reqs))
+	world, err := src.ReadFile("etc/apk/world")
+	require.NoError(t, err)
+	require.Equal(t, "bar\nfoo@edge>=1.0\n", string(world))
+
+	got, err := a.GetWorldRequirements()
+	require.NoError(t, err)
+	require.ElementsMatch(t, reqs, got)
+
+	require.NoError(t, a.SetWorld(ctx, []string{"foo@bad-pin"}))
+	_, err = a.GetWorldRequirements()
+	require.Error(t, err)
+}
+
+func TestResolveRequirements(t *testing.T) {
+	resolver := makeResolver(nil, map[string][]string{
+		"foo=1.0-r0": nil,
+		"foo=2.0-r0": nil,
+		"bar=1.0-r0": nil,
+	})
+	resolution, err := resolver.ResolveRequirements(context.Background(), []Requirement{
+		{Name: "foo", Op: version.Less, Version: "2.0"},
+		{Name: "bar"},
+	})
+	require.NoError(t, err)
+	var names []string
+	for _, pkg := range resolution.Packages {
+		names = append(names, pkg.Filename())
+	}
+	require.ElementsMatch(t, []string{"foo-1.0-r0.apk", "bar-1.0-r0.apk"}, names)
+}
@@ -24,6 +24,7 @@ import (
 // Reader has been modified to read only a single byte at a time to workaround the issue.
 type noReadAheadApkReader struct {
 	io.Reader
+	buf [1]byte
 }
 
 func newNoReadAheadApkReader(r io.Reader) *noReadAheadApkReader {
@@ -33,12 +34,11 @@ func newNoReadAheadApkReader(r io.Reader) *noReadAheadApkReader {
 }
 
 func (r *noReadAheadApkReader) Read(b []byte) (int, error) {
-	buf := make([]byte, 1)
-	n, err := r.Reader.Read(buf)
+	n, err := r.Reader.Read(r.buf[:])
 	if err != nil && err != io.EOF {
 		err = fmt.Errorf("expandApkReader.Read: %w", err)
 	} else {
-		b[0] = buf[0]
+		b[0] = r.buf[0]
 	}
 	return n, err
 }
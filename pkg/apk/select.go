@@ -0,0 +1,120 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"fmt"
+)
+
+// SelectOption is an option for SelectCandidate.
+type SelectOption func(*selectOptions)
+
+type selectOptions struct {
+	installed      []*RepositoryPackage
+	holds          []string
+	strictVersions bool
+	arch           string
+}
+
+// WithSelectInstalled selects as if installed were installed, so that the installed version of a package is
+// preferred over a newer one, as when resolving the world of a root.
+func WithSelectInstalled(installed ...*RepositoryPackage) SelectOption {
+	return func(o *selectOptions) {
+		o.installed = append(o.installed, installed...)
+	}
+}
+
+// WithSelectHolds selects as if packages were held at versions, see PkgResolver.SetHolds.
+func WithSelectHolds(holds ...string) SelectOption {
+	return func(o *selectOptions) {
+		o.holds = append(o.holds, holds...)
+	}
+}
+
+// WithSelectArch only selects packages that can be installed on arch, see PkgResolver.SetArch.
+func WithSelectArch(arch string) SelectOption {
+	return func(o *selectOptions) {
+		o.arch = arch
+	}
+}
+
+// WithSelectStrictVersions compares versions strictly, see PkgResolver.SetStrictVersions.
+func WithSelectStrictVersions(strict bool) SelectOption {
+	return func(o *selectOptions) {
+		o.strictVersions = strict
+	}
+}
+
+// SelectCandidate returns the package that resolving constraint would pick from indexes, such as foo>=1.2,
+// foo@edge or so:libssl.so.3, without resolving its dependencies. It filters and orders the candidates as
+// the resolver does, so the package is the one that a world of just constraint would install. When there is
+// no such package, the error is ErrPackageNotFound; when there are some but none satisfy constraint, it is a
+// ConstraintError with the reason for each, which is also ErrPackageHeld if holds excluded any.
+//
+// Each call indexes all of the packages of indexes, so to select for many constraints, use the
+// ResolvePackage of a PkgResolver instead.
+func SelectCandidate(indexes []NamedIndex, constraint string, opts ...SelectOption) (*RepositoryPackage, error) {
+	o := &selectOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	p := NewPkgResolver(context.Background(), indexes)
+	p.SetStrictVersions(o.strictVersions)
+	p.SetArch(o.arch)
+	if err := p.SetHolds(o.holds...); err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*RepositoryPackage, len(o.installed))
+	for _, pkg := range o.installed {
+		existing[pkg.Name] = pkg
+	}
+	return p.selectCandidate(constraint, existing)
+}
+
+// PackageURL returns the URL that the package resolving constraint would pick is fetched from, with its
+// pin and repository selected as for SelectCandidate, e.g.
+// https://dl-cdn.alpinelinux.org/alpine/edge/main/x86_64/busybox-1.36.1-r0.apk for busybox@edge. It is
+// the URL of RepositoryPackage, so it is a path for a repository that is a directory. A virtual package, see
+// NewVirtualPackage, has no URL, and is an error.
+func (p *PkgResolver) PackageURL(constraint string) (string, error) {
+	pkg, err := p.selectCandidate(constraint, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := isVirtual(pkg); ok {
+		return "", fmt.Errorf("%s resolves to the virtual package %s, which is not fetched", constraint, pkg)
+	}
+	return pkg.URL(), nil
+}
+
+// selectCandidate returns the package that resolving constraint picks, with existing installed.
+func (p *PkgResolver) selectCandidate(constraint string, existing map[string]*RepositoryPackage) (*RepositoryPackage, error) {
+	dq := map[*RepositoryPackage]string{}
+	if err := p.constrain([]string{constraint}, dq); err != nil {
+		return nil, fmt.Errorf("constraining %s: %w", constraint, err)
+	}
+	p.applyArch(dq)
+	p.applyHolds(dq)
+	pkg, err := p.resolvePackage(constraint, existing, dq)
+	if err != nil {
+		return nil, err
+	}
+	if err := pkg.Materialize(); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
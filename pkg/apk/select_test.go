@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectCandidate(t *testing.T) {
+	main := Repository{URI: "https://main.example.com"}
+	edge := Repository{URI: "https://edge.example.com"}
+	indexes := []NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc", Version: "12.3.0-r0", Provides: []string{"cmd:gcc=12.3.0-r0"}},
+				{Name: "gcc", Version: "13.2.1-r0", Provides: []string{"cmd:gcc=13.2.1-r0"}},
+			},
+		})),
+		NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc", Version: "14.1.0-r0", Provides: []string{"cmd:gcc=14.1.0-r0"}},
+			},
+		})),
+	}
+	selected := func(constraint string, opts ...SelectOption) string {
+		pkg, err := SelectCandidate(indexes, constraint, opts...)
+		require.NoError(t, err, constraint)
+		return pkg.Filename() + " " + pkg.Repository().URI
+	}
+
+	require.Equal(t, "gcc-13.2.1-r0.apk https://main.example.com", selected("gcc"))
+	require.Equal(t, "gcc-13.2.1-r0.apk https://main.example.com", selected("cmd:gcc"))
+	require.Equal(t, "gcc-12.3.0-r0.apk https://main.example.com", selected("gcc<13"))
+	require.Equal(t, "gcc-14.1.0-r0.apk https://edge.example.com", selected("gcc@edge"))
+	require.Equal(t, "gcc-12.3.0-r0.apk https://main.example.com", selected("gcc", WithSelectInstalled(indexes[0].Packages()[0])))
+	require.Equal(t, "gcc-12.3.0-r0.apk https://main.example.com", selected("gcc", WithSelectHolds("gcc<13")))
+
+	_, err := SelectCandidate(indexes, "clang")
+	require.ErrorIs(t, err, ErrPackageNotFound)
+	_, err = SelectCandidate(indexes, "gcc>14")
+	var constraintErr *ConstraintError
+	require.ErrorAs(t, err, &constraintErr)
+	_, err = SelectCandidate(indexes, "gcc>=13", WithSelectHolds("gcc<13"))
+	require.ErrorIs(t, err, ErrPackageHeld)
+}
+
+func TestPackageURL(t *testing.T) {
+	main := Repository{URI: "https://main.example.com/x86_64"}
+	edge := Repository{URI: "https://edge.example.com/x86_64"}
+	resolver := NewPkgResolver(context.Background(), []NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+			Packages: []*Package{{Name: "busybox", Version: "1.36.1-r0", Provides: []string{"cmd:sh"}}},
+		})),
+		NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{
+			Packages: []*Package{{Name: "busybox", Version: "1.37.0-r0", Provides: []string{"cmd:sh"}}},
+		})),
+	})
+
+	for constraint, want := range map[string]string{
+		"busybox":      "https://main.example.com/x86_64/busybox-1.36.1-r0.apk",
+		"cmd:sh":       "https://main.example.com/x86_64/busybox-1.36.1-r0.apk",
+		"busybox@edge": "https://edge.example.com/x86_64/busybox-1.37.0-r0.apk",
+	} {
+		got, err := resolver.PackageURL(constraint)
+		require.NoError(t, err, constraint)
+		require.Equal(t, want, got, constraint)
+	}
+	// the newer version is only in the tagged repository
+	_, err := resolver.PackageURL("busybox>1.36.1-r0")
+	require.Error(t, err)
+}
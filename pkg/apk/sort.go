@@ -0,0 +1,114 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"golang.org/x/exp/slices"
+)
+
+// SortOption is an option for SortPackagesByVersion.
+type SortOption func(*sortOptions)
+
+type sortOptions struct {
+	name      string
+	indexes   []NamedIndex
+	pin       string
+	installed []*RepositoryPackage
+	strict    bool
+}
+
+// WithSortName sorts the packages by the version of name that they have or provide, as resolving name does,
+// rather than by their own versions, e.g. so:libssl.so.3 or cmd:sh.
+func WithSortName(name string) SortOption {
+	return func(o *sortOptions) {
+		o.name = name
+	}
+}
+
+// WithSortIndexes sets the indexes that the packages are from, so that they are preferred by the pin of their
+// index, see WithSortPin, and equal packages by the priority and order of their indexes, as the resolver does.
+// Without them, equal packages stay in the order they were in.
+func WithSortIndexes(indexes []NamedIndex) SortOption {
+	return func(o *sortOptions) {
+		o.indexes = indexes
+	}
+}
+
+// WithSortPin prefers the packages of the indexes named pin, e.g. edge for busybox@edge, over the others. See
+// WithSortIndexes for the names of the indexes; without a pin, the packages of untagged indexes are preferred.
+func WithSortPin(pin string) SortOption {
+	return func(o *sortOptions) {
+		o.pin = pin
+	}
+}
+
+// WithSortInstalled prefers the packages that are installed, those with the name and version of any of
+// installed, over the others.
+func WithSortInstalled(installed ...*RepositoryPackage) SortOption {
+	return func(o *sortOptions) {
+		o.installed = append(o.installed, installed...)
+	}
+}
+
+// WithSortStrictVersions compares versions strictly, see PkgResolver.SetStrictVersions, so that the order
+// agrees with a resolver that does.
+func WithSortStrictVersions(strict bool) SortOption {
+	return func(o *sortOptions) {
+		o.strict = strict
+	}
+}
+
+// SortPackagesByVersion sorts pkgs in place, best first, as the resolver prefers candidates when choosing
+// between them: the installed ones first, then those of the pin, then by provider priority, and then by
+// descending version. Tools that order candidates themselves can use it to agree with the resolver.
+func SortPackagesByVersion(pkgs []*RepositoryPackage, opts ...SortOption) {
+	o := &sortOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	type from struct {
+		pin             string
+		priority, order int
+	}
+	froms := map[*Package]from{}
+	for i, index := range o.indexes {
+		priority := indexPriority(index)
+		for _, pkg := range index.Packages() {
+			if _, ok := froms[pkg.Package]; !ok {
+				froms[pkg.Package] = from{pin: index.Name(), priority: priority, order: i}
+			}
+		}
+	}
+	existing := make(map[string]*RepositoryPackage, len(o.installed))
+	for _, pkg := range o.installed {
+		existing[pkg.Name] = pkg
+	}
+
+	wrapped := make([]*repositoryPackage, len(pkgs))
+	for i, pkg := range pkgs {
+		f, ok := froms[pkg.Package]
+		if !ok {
+			// after those of the indexes, in the order they came in
+			f.order = len(o.indexes)
+		}
+		wrapped[i] = &repositoryPackage{RepositoryPackage: pkg, pinnedName: f.pin, priority: f.priority, order: f.order}
+	}
+	p := newPkgResolver(nil, o.strict)
+	slices.SortStableFunc(wrapped, p.comparePackages(nil, o.name, existing, nil, o.pin))
+	for i, pkg := range wrapped {
+		pkgs[i] = pkg.RepositoryPackage
+	}
+}
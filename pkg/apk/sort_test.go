@@ -0,0 +1,91 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortPackagesByVersion(t *testing.T) {
+	main := Repository{URI: "https://main.example.com"}
+	edge := Repository{URI: "https://edge.example.com"}
+	indexes := []NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc-12", Version: "12.3.0-r0", Provides: []string{"cmd:gcc=12.3.0-r0"}},
+				{Name: "gcc", Version: "13.2.1-r0", Provides: []string{"cmd:gcc=13.2.1-r0", "cmd:cc=13.2.1-r0"}},
+				{Name: "fakecc", Version: "1.0-r0", Provides: []string{"cmd:gcc"}, ProviderPriority: 10},
+			},
+		})),
+		NewPrioritizedIndex(NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc", Version: "14.1.0-r0", Provides: []string{"cmd:gcc=14.1.0-r0"}},
+			},
+		})), 5),
+	}
+	var all []*RepositoryPackage
+	for _, index := range indexes {
+		all = append(all, index.Packages()...)
+	}
+	sorted := func(opts ...SortOption) []string {
+		pkgs := append([]*RepositoryPackage{}, all...)
+		SortPackagesByVersion(pkgs, opts...)
+		var names []string
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Filename())
+		}
+		return names
+	}
+
+	require.Equal(t, []string{"fakecc-1.0-r0.apk", "gcc-14.1.0-r0.apk", "gcc-13.2.1-r0.apk", "gcc-12-12.3.0-r0.apk"}, sorted())
+
+	// the same order as the resolver gives the providers
+	var providers []string
+	for _, p := range NewPkgResolver(context.Background(), indexes).Providers("cmd:gcc") {
+		providers = append(providers, p.Package.Filename())
+	}
+	require.Equal(t, providers, sorted(WithSortName("cmd:gcc"), WithSortIndexes(indexes)))
+
+	require.Equal(t, []string{"gcc-14.1.0-r0.apk", "fakecc-1.0-r0.apk", "gcc-13.2.1-r0.apk", "gcc-12-12.3.0-r0.apk"},
+		sorted(WithSortName("cmd:gcc"), WithSortIndexes(indexes), WithSortPin("edge")))
+	require.Equal(t, []string{"gcc-12-12.3.0-r0.apk", "fakecc-1.0-r0.apk", "gcc-14.1.0-r0.apk", "gcc-13.2.1-r0.apk"},
+		sorted(WithSortInstalled(all[0])))
+}
+
+func TestSortPackagesByVersionStrict(t *testing.T) {
+	repo := Repository{URI: "https://main.example.com"}
+	index := NewNamedRepositoryWithIndex("", repo.WithIndex(&APKIndex{
+		Packages: []*Package{
+			{Name: "foo", Version: "1.0-r0"},
+			{Name: "foo", Version: "1.2a3-r0"},
+		},
+	}))
+	pkgs := index.Packages()
+	SortPackagesByVersion(pkgs)
+	require.Equal(t, "1.2a3-r0", pkgs[0].Version)
+
+	// strictly, 1.2a3 is not a version, so it comes after every package with one, as the resolver ranks it
+	SortPackagesByVersion(pkgs, WithSortStrictVersions(true))
+	require.Equal(t, "1.0-r0", pkgs[0].Version)
+
+	p := NewPkgResolver(context.Background(), []NamedIndex{index})
+	p.SetStrictVersions(true)
+	got, err := p.ResolvePackage("foo", nil)
+	require.NoError(t, err)
+	require.Equal(t, "1.0-r0", got[0].Version)
+}
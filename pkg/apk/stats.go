@@ -0,0 +1,66 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+// IndexStats are summary statistics over the packages of indexes, see IndexStatistics.
+type IndexStats struct {
+	// Packages is the number of packages, counting each version of a package in each index.
+	Packages int
+	// Size is the total size of the packages, and InstalledSize the total size of their contents once
+	// installed, as the indexes have them.
+	Size          uint64
+	InstalledSize uint64
+	// Latest is the latest version of each package name. A version that does not parse is only the latest
+	// if no version of the package parses.
+	Latest map[string]string
+	// Arches is the number of packages for each architecture.
+	Arches map[string]int
+	// Origins is the number of packages built from each origin, see OriginName.
+	Origins map[string]int
+}
+
+// IndexStatistics returns summary statistics over the packages of indexes.
+func IndexStatistics(indexes []NamedIndex) *IndexStats {
+	stats := &IndexStats{
+		Latest:  map[string]string{},
+		Arches:  map[string]int{},
+		Origins: map[string]int{},
+	}
+	// the parsed latest version of each name, absent for a name with no version that parses
+	latest := map[string]Version{}
+	for _, index := range indexes {
+		for _, pkg := range index.Packages() {
+			stats.Packages++
+			stats.Size += pkg.Size
+			stats.InstalledSize += pkg.InstalledSize
+			stats.Arches[pkg.Arch]++
+			stats.Origins[OriginName(pkg.Package)]++
+
+			v, err := ParseVersion(pkg.Version)
+			if err != nil {
+				if _, ok := stats.Latest[pkg.Name]; !ok {
+					stats.Latest[pkg.Name] = pkg.Version
+				}
+				continue
+			}
+			if current, ok := latest[pkg.Name]; ok && CompareVersions(v, current) <= 0 {
+				continue
+			}
+			latest[pkg.Name] = v
+			stats.Latest[pkg.Name] = pkg.Version
+		}
+	}
+	return stats
+}
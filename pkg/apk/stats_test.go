@@ -0,0 +1,55 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexStatistics(t *testing.T) {
+	main := Repository{URI: "https://main.example.com"}
+	edge := Repository{URI: "https://edge.example.com"}
+	stats := IndexStatistics([]NamedIndex{
+		NewNamedRepositoryWithIndex("", main.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc", Version: "13.2.1-r0", Arch: "x86_64", Size: 100, InstalledSize: 1000},
+				{Name: "gcc-doc", Version: "13.2.1-r0", Arch: "x86_64", Origin: "gcc", Size: 10, InstalledSize: 20},
+				{Name: "odd", Version: "1.0f7-r0", Arch: "noarch", Size: 1},
+				{Name: "odd", Version: "0.9-r0", Arch: "noarch", Size: 1},
+				{Name: "broken", Version: "x", Arch: "noarch"},
+			},
+		})),
+		NewNamedRepositoryWithIndex("edge", edge.WithIndex(&APKIndex{
+			Packages: []*Package{
+				{Name: "gcc", Version: "14.1.0-r0", Arch: "x86_64", Size: 200, InstalledSize: 2000},
+				{Name: "gcc", Version: "12.3.0-r0", Arch: "aarch64", Size: 90, InstalledSize: 900},
+			},
+		})),
+	})
+	require.Equal(t, &IndexStats{
+		Packages:      7,
+		Size:          402,
+		InstalledSize: 3920,
+		Latest:        map[string]string{"gcc": "14.1.0-r0", "gcc-doc": "13.2.1-r0", "odd": "0.9-r0", "broken": "x"},
+		Arches:        map[string]int{"x86_64": 3, "aarch64": 1, "noarch": 3},
+		Origins:       map[string]int{"gcc": 4, "odd": 2, "broken": 1},
+	}, stats)
+
+	empty := IndexStatistics(nil)
+	require.Zero(t, empty.Packages)
+	require.Empty(t, empty.Latest)
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Timeouts bound how long installing packages, and each phase of it, may take, so that a mirror that stops
+// responding fails the install rather than hanging it. A duration of 0 is no timeout.
+type Timeouts struct {
+	// Total bounds each FixateWorld, InstallPackages and Prefetch as a whole.
+	Total time.Duration
+	// IndexFetch bounds fetching the indexes of the repositories.
+	IndexFetch time.Duration
+	// PackageFetch bounds fetching each package, until all of it has been read. Packages are expanded
+	// as they are fetched, so this bounds expanding them too.
+	PackageFetch time.Duration
+	// Extraction bounds installing the files of each package into the root.
+	Extraction time.Duration
+}
+
+// timeoutError is the cause of a context that a phase of Timeouts timed out.
+type timeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s took longer than %s", e.phase, e.timeout)
+}
+
+// Unwrap returns context.DeadlineExceeded, as the Err of the context that timed out is.
+func (e *timeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// withTimeout returns ctx bounded by timeout, for phase, or ctx itself if there is no timeout.
+func withTimeout(ctx context.Context, timeout time.Duration, phase string) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, timeout, &timeoutError{phase: phase, timeout: timeout})
+}
+
+// timedOut returns err with ErrTimeout and the phase that timed out, if it is because ctx timed out for
+// a phase of Timeouts.
+func timedOut(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	var timeout *timeoutError
+	if !errors.As(context.Cause(ctx), &timeout) {
+		return err
+	}
+	return withKind(ErrTimeout, fmt.Errorf("%v: %w", timeout, err))
+}
+
+// timeoutReader is the body of a package fetched with a timeout, which it releases once it is closed.
+type timeoutReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	return n, timedOut(r.ctx, err)
+}
+
+func (r *timeoutReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
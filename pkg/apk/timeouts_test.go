@@ -0,0 +1,93 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// hangingServer is a mirror that sends the start of every response and then stops responding.
+func hangingServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte{0x1f})
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestTimeouts(t *testing.T) {
+	ctx := context.Background()
+	s := hangingServer(t)
+	newAPK := func(t *testing.T, timeouts Timeouts) *APK {
+		a, err := New(WithFS(apkfs.NewMemFS()), WithArch("x86_64"), WithTimeouts(timeouts))
+		require.NoError(t, err)
+		require.NoError(t, a.InitDB(ctx))
+		require.NoError(t, a.SetRepositories(ctx, []string{s.URL}))
+		require.NoError(t, a.SetWorld(ctx, []string{"hello"}))
+		return a
+	}
+
+	t.Run("index fetch", func(t *testing.T) {
+		a := newAPK(t, Timeouts{IndexFetch: 100 * time.Millisecond})
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.ErrorIs(t, err, ErrTimeout)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.ErrorContains(t, err, "fetching indexes took longer than 100ms")
+	})
+
+	t.Run("package fetch", func(t *testing.T) {
+		a := newAPK(t, Timeouts{PackageFetch: 100 * time.Millisecond})
+		repo := Repository{URI: s.URL}
+		pkg := NewRepositoryPackage(&testPkg, repo.WithIndex(&APKIndex{Packages: []*Package{&testPkg}}))
+		rc, err := a.FetchPackage(ctx, pkg)
+		require.NoError(t, err)
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		require.ErrorIs(t, err, ErrTimeout)
+		require.ErrorContains(t, err, "fetching "+testPkg.Name+" took longer than 100ms")
+	})
+
+	t.Run("total", func(t *testing.T) {
+		a := newAPK(t, Timeouts{Total: 100 * time.Millisecond})
+		start := time.Now()
+		err := a.FixateWorld(ctx, nil)
+		require.ErrorIs(t, err, ErrTimeout)
+		require.ErrorContains(t, err, "installing the world took longer than 100ms")
+		require.Less(t, time.Since(start), 10*time.Second)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		a := newAPK(t, Timeouts{})
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		_, err := a.GetRepositoryIndexes(ctx, true)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrTimeout), "a deadline of the caller is not one of the Timeouts")
+	})
+}
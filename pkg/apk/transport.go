@@ -19,7 +19,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 )
 
 type rangeRetryTransport struct {
@@ -27,6 +29,51 @@ type rangeRetryTransport struct {
 	ctx    context.Context
 }
 
+// wrapClient returns a copy of client with its transport, or the default one, wrapped by each of wrappers in
+// turn, or client itself if there are no wrappers.
+func wrapClient(client *http.Client, wrappers []func(http.RoundTripper) http.RoundTripper) *http.Client {
+	if len(wrappers) == 0 || client == nil {
+		return client
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	for _, wrap := range wrappers {
+		transport = wrap(transport)
+	}
+	wrapped := *client
+	wrapped.Transport = transport
+	return &wrapped
+}
+
+// dialClient returns a copy of client with a copy of its transport, or of the default one, that proxies with
+// proxy and dials with dial, those that are not nil, or client itself if both are nil or the transport is not
+// an http.Transport.
+func dialClient(client *http.Client, proxy func(*http.Request) (*url.URL, error), dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	if (proxy == nil && dial == nil) || client == nil {
+		return client
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		return client
+	}
+	t = t.Clone()
+	if proxy != nil {
+		t.Proxy = proxy
+	}
+	if dial != nil {
+		t.DialContext = dial
+	}
+	dialed := *client
+	dialed.Transport = t
+	return &dialed
+}
+
 func newRangeRetryTransport(ctx context.Context, client *http.Client) *rangeRetryTransport {
 	return &rangeRetryTransport{
 		client: client,
@@ -82,7 +129,8 @@ func (r *rangeRetryReader) reset(oerr error) (*http.Response, error) {
 		r.total = resp.ContentLength
 	}
 
-	if resp.StatusCode == http.StatusOK {
+	// A delta of an index, see WithIndexDeltaDir, is the whole of the delta as a 200 is of the index.
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusIMUsed {
 		// If the upstream doesn't support Range requests for some reason and only returns 200,
 		// we need to discard anything we've already Read().
 		if r.progress != 0 {
@@ -19,10 +19,19 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path"
+	"path/filepath"
+	"sync"
 	"testing"
 	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 )
 
 type testReader struct {
@@ -197,3 +206,117 @@ func TestTransport(t *testing.T) {
 		})
 	}
 }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTransportWrapper(t *testing.T) {
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+
+	_, src, err := testGetTestAPK()
+	require.NoError(t, err)
+	require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+	require.NoError(t, src.WriteFile(archFilePath, []byte(testArch+"\n"), 0o644))
+	require.NoError(t, src.WriteFile(reposFilePath, []byte(testAlpineRepos), 0o644))
+
+	var (
+		mu    sync.Mutex
+		order []string
+		files []string
+	)
+	record := func(name string) func(http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mu.Lock()
+				order = append(order, name)
+				if name == "outer" {
+					files = append(files, path.Base(req.URL.Path))
+				}
+				mu.Unlock()
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	a, err := New(WithFS(src), WithTransportWrapper(record("inner")), WithTransportWrapper(record("outer")))
+	require.NoError(t, err)
+	// the wrappers wrap whatever client is set
+	a.SetClient(&http.Client{Transport: &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}})
+
+	indexes, err := a.GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	pkgs, err := NewPkgResolver(ctx, indexes).ResolvePackage(testPkg.Name, nil)
+	require.NoError(t, err)
+	rc, err := a.FetchPackage(ctx, pkgs[0])
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	require.Equal(t, []string{"outer", "inner", "outer", "inner"}, order)
+	require.Equal(t, []string{indexFilename, pkgs[0].Filename()}, files)
+}
+
+func TestProxyAndDialContext(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu        sync.Mutex
+		requested []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Host+r.URL.Path)
+		mu.Unlock()
+		http.ServeFile(w, r, filepath.Join(testPrimaryPkgDir, path.Base(r.URL.Path)))
+	}))
+	defer srv.Close()
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name string
+		opt  Option
+	}{{
+		name: "proxy",
+		opt:  WithProxy(http.ProxyURL(srvURL)),
+	}, {
+		name: "dial",
+		opt: WithDialContext(func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srvURL.Host)
+		}),
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+			requested = nil
+
+			_, src, err := testGetTestAPK()
+			require.NoError(t, err)
+			require.NoError(t, src.MkdirAll(keysDirPath, 0o755))
+			require.NoError(t, src.WriteFile(archFilePath, []byte(testArch+"\n"), 0o644))
+			require.NoError(t, src.WriteFile(reposFilePath, []byte("http://repo.invalid/alpine/v3.16/main"), 0o644))
+			a, err := New(WithFS(src), tt.opt)
+			require.NoError(t, err)
+
+			indexes, err := a.GetRepositoryIndexes(ctx, true)
+			require.NoError(t, err)
+			pkgs, err := NewPkgResolver(ctx, indexes).ResolvePackage(testPkg.Name, nil)
+			require.NoError(t, err)
+			rc, err := a.FetchPackage(ctx, pkgs[0])
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+
+			require.Equal(t, []string{
+				"repo.invalid/alpine/v3.16/main/" + testArch + "/" + indexFilename,
+				"repo.invalid/alpine/v3.16/main/" + testArch + "/" + pkgs[0].Filename(),
+			}, requested)
+		})
+	}
+
+	t.Run("other transports are left alone", func(t *testing.T) {
+		transport := &testLocalTransport{root: testPrimaryPkgDir, basenameOnly: true}
+		a, err := New(WithFS(apkfs.NewMemFS()), WithProxy(http.ProxyURL(srvURL)))
+		require.NoError(t, err)
+		a.SetClient(&http.Client{Transport: transport})
+		require.Same(t, transport, a.client.Transport)
+	})
+}
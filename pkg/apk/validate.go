@@ -0,0 +1,174 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"crypto/sha1" //nolint:gosec // the checksums of packages are SHA1 digests
+	"fmt"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/version"
+)
+
+// IndexProblem is a problem with an entry of an index, found by ValidateIndex.
+type IndexProblem struct {
+	// Package is the entry with the problem.
+	Package *Package
+	// Field is the index field with the problem, such as V for the version or p for the provides.
+	Field string
+	// Problem describes what is wrong with the field.
+	Problem string
+}
+
+func (p *IndexProblem) Error() string {
+	return fmt.Sprintf("%s-%s: %s: %s", p.Package.Name, p.Package.Version, p.Field, p.Problem)
+}
+
+// IndexValidationError is returned by ValidateIndex with every problem it found in an index.
+type IndexValidationError struct {
+	Problems []*IndexProblem
+}
+
+func (e *IndexValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.Error())
+	}
+	return fmt.Sprintf("%d problems in index: %s", len(e.Problems), strings.Join(msgs, "; "))
+}
+
+func (e *IndexValidationError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		errs = append(errs, p)
+	}
+	return errs
+}
+
+// ValidateIndex checks the entries of idx for what apk would reject or misread, so that an index can be
+// checked before it is published: entries without a name, version, architecture or checksum, versions that
+// do not parse, more than one entry for the same name and version, dependencies, provides and install_if
+// that do not parse, and checksums that are not SHA1 digests. It returns an *IndexValidationError with all
+// the problems it found, or nil if there are none.
+func ValidateIndex(idx *APKIndex) error {
+	v := &indexValidator{seen: map[string]bool{}}
+	for _, pkg := range idx.Packages {
+		v.validate(pkg)
+	}
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &IndexValidationError{Problems: v.problems}
+}
+
+type indexValidator struct {
+	// seen has the name-version of each entry so far
+	seen     map[string]bool
+	problems []*IndexProblem
+}
+
+func (v *indexValidator) problem(pkg *Package, field, format string, args ...any) {
+	v.problems = append(v.problems, &IndexProblem{Package: pkg, Field: field, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (v *indexValidator) validate(pkg *Package) {
+	if pkg.Name == "" {
+		v.problem(pkg, "P", "no name")
+	} else if strings.ContainsAny(pkg.Name, "=<>~@! ") {
+		v.problem(pkg, "P", "invalid name %q", pkg.Name)
+	}
+	if pkg.Version == "" {
+		v.problem(pkg, "V", "no version")
+	} else if _, err := ParseVersion(pkg.Version); err != nil {
+		v.problem(pkg, "V", "%v", err)
+	}
+	if pkg.Arch == "" {
+		v.problem(pkg, "A", "no architecture")
+	}
+	switch {
+	case len(pkg.Checksum) == 0:
+		v.problem(pkg, "C", "no checksum, or not a Q1 one")
+	case len(pkg.Checksum) != sha1.Size:
+		v.problem(pkg, "C", "checksum of %d bytes, not the %d of a SHA1 digest", len(pkg.Checksum), sha1.Size)
+	}
+
+	if pkg.Name != "" && pkg.Version != "" {
+		key := pkg.Name + "-" + pkg.Version
+		if v.seen[key] {
+			v.problem(pkg, "P", "more than one entry for %s", key)
+		}
+		v.seen[key] = true
+	}
+
+	for _, dep := range pkg.Dependencies {
+		if err := validateDependency(dep); err != nil {
+			v.problem(pkg, "D", "%v", err)
+		}
+	}
+	for _, dep := range pkg.InstallIf {
+		if err := validateDependency(dep); err != nil {
+			v.problem(pkg, "i", "%v", err)
+		}
+	}
+	for _, provide := range pkg.Provides {
+		if err := validateProvide(provide); err != nil {
+			v.problem(pkg, "p", "%v", err)
+		}
+	}
+}
+
+// validateDependency checks dep, a dependency or install_if, which is a name, such as so:libc.so.6, with an
+// optional ! for a conflict, constraint on the version and @pin.
+func validateDependency(dep string) error {
+	name, _ := strings.CutPrefix(dep, "!")
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		pin := name[i+1:]
+		if pin == "" || strings.IndexFunc(pin, func(r rune) bool { return !isAlphanumeric(r) }) >= 0 {
+			return fmt.Errorf("dependency %q: invalid pin %q", dep, pin)
+		}
+		name = name[:i]
+	}
+	if i := strings.IndexAny(name, "=<>~"); i >= 0 {
+		if _, err := version.ParseConstraint(name[i:]); err != nil {
+			return fmt.Errorf("dependency %q: %w", dep, err)
+		}
+		name = name[:i]
+	}
+	if name == "" {
+		return fmt.Errorf("dependency %q: no name", dep)
+	}
+	return nil
+}
+
+// validateProvide checks provide, which is a name with an optional =version, e.g. cmd:busybox=1.36.1-r2.
+func validateProvide(provide string) error {
+	name, ver, versioned := strings.Cut(provide, "=")
+	if name == "" {
+		return fmt.Errorf("provides %q: no name", provide)
+	}
+	if strings.ContainsAny(name, "<>~@! ") {
+		return fmt.Errorf("provides %q: invalid name %q, only = may follow the name of a provides", provide, name)
+	}
+	if !versioned {
+		return nil
+	}
+	if ver == "" {
+		return fmt.Errorf("provides %q: = without a version", provide)
+	}
+	if _, err := ParseVersion(ver); err != nil {
+		return fmt.Errorf("provides %q: %w", provide, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIndex(t *testing.T) {
+	file, err := os.Open("testdata/alpine-317/APKINDEX.tar.gz")
+	require.NoError(t, err)
+	index, err := IndexFromArchive(file)
+	require.NoError(t, err)
+	// even the indexes of Alpine have a few versions that apk itself does not parse
+	require.EqualError(t, ValidateIndex(index), "3 problems in index: "+
+		"aspell-ru-0.99f7-r1: V: invalid version 0.99f7-r1, could not parse; "+
+		`jemalloc-dev-5.3.0-r1: p: provides "pc:jemalloc=5.3.0_": invalid version 5.3.0_, suffix _ is not valid; `+
+		`rtmpdump-dev-2.4_git20190330-r2: p: provides "pc:librtmp=v2.4": invalid version v2.4, could not parse`)
+
+	checksum := make([]byte, 20)
+	valid := func(name, version string) *Package {
+		return &Package{Name: name, Version: version, Arch: "x86_64", Checksum: checksum}
+	}
+	index = &APKIndex{Packages: []*Package{
+		valid("ok", "1.0-r0"),
+		{Name: "missing", Version: "1.0-r0"},
+		valid("bad-version", "1.0-r0-r1"),
+		valid("dup", "1.0-r0"),
+		valid("dup", "1.0-r0"),
+		valid("dup", "1.0-r1"),
+		{Name: "short-checksum", Version: "1.0-r0", Arch: "x86_64", Checksum: checksum[:10]},
+		{Name: "deps", Version: "1.0-r0", Arch: "x86_64", Checksum: checksum, Dependencies: []string{
+			"so:libc.so.6", "!conflict", "foo>=1.2", "bar@edge", "baz>=", "=1.0", "qux@", "quux=1.0-r0-r1",
+		}},
+		{Name: "provides", Version: "1.0-r0", Arch: "x86_64", Checksum: checksum, Provides: []string{
+			"cmd:ok=1.0-r0", "so:libok.so.1", "dangling=", "=1.0", "ranged>=1.0", "bad=1..0",
+		}},
+		{Name: "install-if", Version: "1.0-r0", Arch: "x86_64", Checksum: checksum, InstallIf: []string{
+			"foo", "bar=1.0", "baz<",
+		}},
+	}}
+
+	err = ValidateIndex(index)
+	var verr *IndexValidationError
+	require.True(t, errors.As(err, &verr))
+	var got []string
+	for _, p := range verr.Problems {
+		got = append(got, p.Error())
+	}
+	require.Equal(t, []string{
+		"missing-1.0-r0: A: no architecture",
+		"missing-1.0-r0: C: no checksum, or not a Q1 one",
+		`bad-version-1.0-r0-r1: V: invalid version 1.0-r0-r1, could not parse`,
+		"dup-1.0-r0: P: more than one entry for dup-1.0-r0",
+		"short-checksum-1.0-r0: C: checksum of 10 bytes, not the 20 of a SHA1 digest",
+		`deps-1.0-r0: D: dependency "baz>=": invalid constraint ">=", no version`,
+		`deps-1.0-r0: D: dependency "=1.0": no name`,
+		`deps-1.0-r0: D: dependency "qux@": invalid pin ""`,
+		`deps-1.0-r0: D: dependency "quux=1.0-r0-r1": invalid constraint "=1.0-r0-r1": invalid version 1.0-r0-r1, could not parse`,
+		`provides-1.0-r0: p: provides "dangling=": = without a version`,
+		`provides-1.0-r0: p: provides "=1.0": no name`,
+		`provides-1.0-r0: p: provides "ranged>=1.0": invalid name "ranged>", only = may follow the name of a provides`,
+		`provides-1.0-r0: p: provides "bad=1..0": invalid version 1..0, could not parse`,
+		`install-if-1.0-r0: i: dependency "baz<": invalid constraint "<", no version`,
+	}, got)
+}
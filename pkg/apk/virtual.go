@@ -0,0 +1,54 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"time"
+)
+
+// virtualRepository is the repository of the packages of VirtualIndex, which have no files to fetch.
+var virtualRepository = &Repository{URI: "virtual"}
+
+// NewVirtualPackage returns a virtual package, as apk add --virtual creates: a package without files, named
+// name, that depends on depends, e.g. .build-deps with the packages needed to build something. With the
+// virtual package in the world rather than its dependencies, they can be removed all at once by removing it from
+// the world. The version defaults to the current time, as apk-tools has it, e.g. 20240102.150405.
+func NewVirtualPackage(name, version string, depends ...string) *Package {
+	if version == "" {
+		version = time.Now().UTC().Format("20060102.150405")
+	}
+	return &Package{
+		Name:         name,
+		Version:      version,
+		Arch:         NoArch,
+		Description:  "virtual meta package",
+		Dependencies: depends,
+	}
+}
+
+// VirtualIndex returns an index of virtual packages, see NewVirtualPackage, to resolve them with a
+// PkgResolver along with the indexes of repositories. See WithVirtualPackages to install them.
+func VirtualIndex(pkgs ...*Package) NamedIndex {
+	return NewNamedRepositoryWithIndex("", virtualRepository.WithIndex(&APKIndex{Packages: pkgs}))
+}
+
+// isVirtual returns whether pkg is a virtual package of VirtualIndex, which has nothing to fetch or extract.
+func isVirtual(pkg InstallablePackage) (*Package, bool) {
+	rp, ok := pkg.(*RepositoryPackage)
+	if !ok || rp.repository == nil || rp.repository.Repository != virtualRepository {
+		return nil, false
+	}
+	return rp.Package, true
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+func TestVirtualPackages(t *testing.T) {
+	// Reset caches so we have isolated tests.
+	globalEtagCache, globalIndexCache, globalApkCache = &etagCache{}, &indexCache{}, &apkCache{}
+	ctx := context.Background()
+
+	repoDir := t.TempDir()
+	b, err := os.ReadFile("testdata/replaces/replaces-0.0.1-r0.apk")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "replaces-0.0.1-r0.apk"), b, 0o644))
+	pkg, err := ParsePackage(ctx, bytes.NewReader(b))
+	require.NoError(t, err)
+	archive, err := ArchiveFromIndex(&APKIndex{Packages: []*Package{pkg}})
+	require.NoError(t, err)
+	index, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "APKINDEX.tar.gz"), index, 0o644))
+
+	virtual := NewVirtualPackage(".build-deps", "", "replaces")
+	require.Regexp(t, `^\d{8}\.\d{6}$`, virtual.Version)
+	a, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithIgnoreMknodErrors(ignoreMknodErrors), WithVirtualPackages(virtual))
+	require.NoError(t, err)
+	a.SetClient(&http.Client{Transport: &testLocalTransport{root: repoDir, basenameOnly: true}})
+	a.ignoreSignatures = true
+	require.NoError(t, a.InitDB(ctx))
+	require.NoError(t, a.SetRepositories(ctx, []string{"https://example.com/repo"}))
+
+	require.NoError(t, a.SetWorld(ctx, []string{".build-deps"}))
+	require.NoError(t, a.FixateWorld(ctx, nil))
+	installed, err := a.GetInstalled()
+	require.NoError(t, err)
+	require.Len(t, installed, 2)
+	require.Equal(t, "replaces", installed[0].Name)
+	require.Equal(t, ".build-deps", installed[1].Name)
+	require.Equal(t, virtual.Version, installed[1].Version)
+	require.Equal(t, []string{"replaces"}, installed[1].Dependencies)
+	require.Empty(t, installed[1].Files)
+
+	// there is nothing to fetch for the virtual package
+	resolved, err := a.ResolveAndCalculateWorld(ctx)
+	require.NoError(t, err)
+	require.Len(t, resolved, 2)
+	require.Equal(t, ".build-deps", resolved[1].Package.Name)
+	require.Zero(t, resolved[1].DataSize)
+	indexes, err := a.GetRepositoryIndexes(ctx, true)
+	require.NoError(t, err)
+	_, err = NewPkgResolver(ctx, append(indexes, VirtualIndex(virtual))).PackageURL(".build-deps")
+	require.Error(t, err)
+	prefetch, err := New(WithFS(apkfs.NewMemFS()), WithArch(testArch), WithCache(t.TempDir(), false), WithVirtualPackages(virtual))
+	require.NoError(t, err)
+	prefetch.SetClient(&http.Client{Transport: &testLocalTransport{root: repoDir, basenameOnly: true}})
+	prefetch.ignoreSignatures = true
+	require.NoError(t, prefetch.InitDB(ctx))
+	require.NoError(t, prefetch.SetRepositories(ctx, []string{"https://example.com/repo"}))
+	require.NoError(t, prefetch.Prefetch(ctx, []string{".build-deps"}))
+
+	// removing the virtual package from the world leaves everything it grouped unneeded
+	require.NoError(t, a.SetWorld(ctx, nil))
+	orphans, err := a.GetOrphans()
+	require.NoError(t, err)
+	var names []string
+	for _, orphan := range orphans {
+		names = append(names, orphan.Name)
+	}
+	require.ElementsMatch(t, []string{".build-deps", "replaces"}, names)
+}
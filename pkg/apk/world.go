@@ -18,18 +18,18 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/chainguard-dev/clog"
+	"golang.org/x/exp/slices"
 )
 
 // GetWorld -  get list of packages that should be installed, according to /etc/apk/world
 func (a *APK) GetWorld() ([]string, error) {
-	worldFile, err := a.fs.Open(worldFilePath)
+	worldFile, err := a.fs.Open(a.layoutPath(worldFilePath))
 	if err != nil {
-		return nil, fmt.Errorf("could not open world file in %s at %s: %w", a.fs, worldFilePath, err)
+		return nil, fmt.Errorf("could not open world file in %s at %s: %w", a.fs, a.layoutPath(worldFilePath), err)
 	}
 	defer worldFile.Close()
 	worldData, err := io.ReadAll(worldFile)
@@ -41,22 +41,55 @@ func (a *APK) GetWorld() ([]string, error) {
 
 // SetWorld sets the list of world packages intended to be installed.
 // The base directory of /etc/apk must already exist, i.e. this only works on an initialized APK database.
+// A package may also be the path or URL of an .apk file, as in apk add ./foo.apk, to install the package of
+// the file, with its dependencies from the repositories. The file is read, and written to the world as the name
+// and checksum of its package, e.g. hello><Q1..., as apk-tools does, which this APK resolves from the file. Other
+// clients of the root resolve it as the package with that checksum, installed or in the repositories.
 func (a *APK) SetWorld(ctx context.Context, packages []string) error {
 	log := clog.FromContext(ctx)
 	log.Debug("setting apk world")
 
 	// sort them before writing
 	copied := make([]string, len(packages))
-	copy(copied, packages)
+	for i, pkg := range packages {
+		if !isPackageFile(pkg) {
+			copied[i] = pkg
+			continue
+		}
+		lf, err := a.readLocalFile(ctx, pkg)
+		if err != nil {
+			return err
+		}
+		copied[i] = lf.entry()
+	}
 	sort.Strings(copied)
+	copied = slices.Compact(copied)
 
 	data := strings.Join(copied, "\n") + "\n"
 
 	// #nosec G306 -- apk world must be publicly readable
-	if err := a.fs.WriteFile(filepath.Join("etc", "apk", "world"),
+	if err := a.fs.WriteFile(a.layoutPath(worldFilePath),
 		[]byte(data), 0o644); err != nil {
 		return fmt.Errorf("failed to write apk world: %w", err)
 	}
 
 	return nil
 }
+
+// GetWorldRequirements is GetWorld, with each package of the world parsed as a Requirement.
+func (a *APK) GetWorldRequirements() ([]Requirement, error) {
+	world, err := a.GetWorld()
+	if err != nil {
+		return nil, err
+	}
+	reqs, err := ParseRequirements(world)
+	if err != nil {
+		return nil, fmt.Errorf("parsing world: %w", err)
+	}
+	return reqs, nil
+}
+
+// SetWorldRequirements is SetWorld, for requirements.
+func (a *APK) SetWorldRequirements(ctx context.Context, reqs []Requirement) error {
+	return a.SetWorld(ctx, FormatRequirements(reqs))
+}
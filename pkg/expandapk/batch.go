@@ -0,0 +1,195 @@
+package expandapk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Source is a package for ExpandAll to expand, which is opened when a worker gets to it.
+type Source struct {
+	Name string
+	Open func(ctx context.Context) (io.ReadCloser, error)
+}
+
+// Expanded is a package that ExpandAll expanded, or the error it failed with.
+type Expanded struct {
+	Name string
+	APK  *APKExpanded
+	Err  error
+}
+
+// BatchOption configures ExpandAll.
+type BatchOption func(*batchOptions)
+
+type batchOptions struct {
+	workers int
+	quota   int64
+	opts    []Option
+}
+
+// WithWorkers sets how many packages ExpandAll expands at once. If workers is 0 or less, it is set to
+// GOMAXPROCS, which is the default.
+func WithWorkers(workers int) BatchOption {
+	return func(o *batchOptions) {
+		if workers <= 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		o.workers = workers
+	}
+}
+
+// WithDiskQuota bounds how much the packages ExpandAll has sent and that have not been closed yet take up
+// in the cache dir, with each package that is being expanded counted as large as the largest one so far.
+// Once they take up quota bytes or more, no other package is started until enough of them are closed, so
+// that the packages being expanded are the only ones that can go over the quota.
+// A quota of 0 or less, the default, is no quota.
+func WithDiskQuota(quota int64) BatchOption {
+	return func(o *batchOptions) {
+		o.quota = quota
+	}
+}
+
+// WithExpandOptions sets the options each package is expanded with.
+func WithExpandOptions(opts ...Option) BatchOption {
+	return func(o *batchOptions) {
+		o.opts = opts
+	}
+}
+
+// ExpandAll expands sources concurrently into temporary directories of cacheDir, as ExpandApk does, and
+// sends each of them on the returned channel as soon as it is done, in the order they finish. The channel
+// is closed once they all are. The receiver must close the APKExpanded of each package it receives, and
+// should keep receiving until the channel is closed; when ctx is done, the packages that were not sent
+// are cleaned up and left out.
+func ExpandAll(ctx context.Context, sources []Source, cacheDir string, opts ...BatchOption) <-chan Expanded {
+	o := batchOptions{workers: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	q := newDiskQuota(ctx, o.quota)
+	results := make(chan Expanded)
+	var g errgroup.Group
+	g.SetLimit(o.workers)
+	go func() {
+		defer close(results)
+		defer q.stop()
+		for _, source := range sources {
+			if ctx.Err() != nil {
+				break
+			}
+			source := source
+			g.Go(func() error {
+				// reserved once the worker has its slot, so that it sees what the others have taken up
+				reserved, ok := q.reserve(ctx)
+				if !ok {
+					return nil
+				}
+				result := Expanded{Name: source.Name}
+				result.APK, result.Err = expandSource(ctx, source, cacheDir, o.opts)
+				if result.APK != nil {
+					q.charge(result.APK, reserved)
+				} else {
+					q.release(reserved)
+				}
+				select {
+				case results <- result:
+				case <-ctx.Done():
+					if result.APK != nil {
+						result.APK.Close()
+					}
+				}
+				return nil
+			})
+		}
+		_ = g.Wait()
+	}()
+	return results
+}
+
+func expandSource(ctx context.Context, source Source, cacheDir string, opts []Option) (*APKExpanded, error) {
+	rc, err := source.Open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", source.Name, err)
+	}
+	defer rc.Close()
+	exp, err := ExpandApk(ctx, rc, cacheDir, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("expanding %s: %w", source.Name, err)
+	}
+	return exp, nil
+}
+
+// diskQuota keeps track of how much the expanded packages that have not been closed take up, and of what
+// is reserved for the packages that are being expanded, whose size is not known until they are done.
+type diskQuota struct {
+	limit   int64
+	mu      sync.Mutex
+	cond    *sync.Cond
+	used    int64
+	largest int64
+	stop    func() bool
+}
+
+func newDiskQuota(ctx context.Context, limit int64) *diskQuota {
+	q := &diskQuota{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	// wake up the waiting once ctx is done
+	q.stop = context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.cond.Broadcast()
+	})
+	return q
+}
+
+// reserve waits for the packages to take up less than the quota, and reserves what another package that
+// is started takes up until it is charged: as much as the largest package so far, and at least a byte, so
+// that a package being expanded counts against the quota. It returns what it reserved, and whether the
+// package can be started, which it cannot once ctx is done.
+func (q *diskQuota) reserve(ctx context.Context) (int64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.limit > 0 && q.used >= q.limit && ctx.Err() == nil {
+		q.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return 0, false
+	}
+	reserved := max(q.largest, 1)
+	q.used += reserved
+	return reserved, true
+}
+
+// release gives back what was reserved for a package that was not expanded.
+func (q *diskQuota) release(reserved int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used -= reserved
+	q.cond.Broadcast()
+}
+
+// charge counts what exp takes up against the quota, instead of what was reserved for it, until it is
+// closed.
+func (q *diskQuota) charge(exp *APKExpanded, reserved int64) {
+	size := exp.Size + exp.PackageUncompressedSize
+	q.mu.Lock()
+	q.used += size - reserved
+	q.largest = max(q.largest, size)
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	exp.Lock()
+	defer exp.Unlock()
+	exp.onClose = func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.used -= size
+		q.cond.Broadcast()
+	}
+}
@@ -0,0 +1,122 @@
+package expandapk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fileSource(name string) Source {
+	return Source{Name: name, Open: func(context.Context) (io.ReadCloser, error) {
+		return os.Open(name)
+	}}
+}
+
+func TestExpandAll(t *testing.T) {
+	sources := []Source{
+		fileSource("../fs/testdata/hello-2.12-r0.apk"),
+		fileSource("../apk/testdata/alpine-316/alpine-baselayout-3.2.0-r23.apk"),
+		fileSource("../apk/testdata/hello-wolfi-2.12.1-r0.apk"),
+		fileSource("testdata/missing.apk"),
+	}
+	for _, opts := range [][]BatchOption{
+		nil,
+		{WithWorkers(1)},
+		// every package is over the quota, so they are expanded one at a time
+		{WithWorkers(4), WithDiskQuota(1), WithExpandOptions(WithDataHashVerification(true))},
+	} {
+		got := map[string]bool{}
+		for result := range ExpandAll(context.Background(), sources, t.TempDir(), opts...) {
+			if result.Name == "testdata/missing.apk" {
+				require.ErrorIs(t, result.Err, os.ErrNotExist)
+				got[result.Name] = true
+				continue
+			}
+			require.NoError(t, result.Err, result.Name)
+			require.NotEmpty(t, result.APK.PackageHash)
+			_, err := os.Stat(result.APK.TarFile)
+			require.NoError(t, err)
+			require.NoError(t, result.APK.Close())
+			got[result.Name] = true
+		}
+		require.Len(t, got, len(sources))
+	}
+}
+
+func TestExpandAllQuota(t *testing.T) {
+	var (
+		mu              sync.Mutex
+		expanding, most int
+		sources         = make([]Source, 4)
+	)
+	for i := range sources {
+		sources[i] = Source{Name: "hello", Open: func(context.Context) (io.ReadCloser, error) {
+			f, err := os.Open("../fs/testdata/hello-2.12-r0.apk")
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			expanding++
+			most = max(most, expanding)
+			mu.Unlock()
+			// long enough for other workers to start, if they could
+			time.Sleep(10 * time.Millisecond)
+			return &closeFunc{ReadCloser: f, close: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				expanding--
+			}}, nil
+		}}
+	}
+
+	// the packages being expanded count against the quota, so with one that fills it, only one is
+	// expanded at a time however many workers there are
+	for result := range ExpandAll(context.Background(), sources, t.TempDir(), WithWorkers(4), WithDiskQuota(1)) {
+		require.NoError(t, result.Err)
+		require.NoError(t, result.APK.Close())
+	}
+	require.Equal(t, 1, most)
+}
+
+type closeFunc struct {
+	io.ReadCloser
+	close func()
+}
+
+func (c *closeFunc) Close() error {
+	c.close()
+	return c.ReadCloser.Close()
+}
+
+func TestExpandAllCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opened := 0
+	sources := make([]Source, 10)
+	for i := range sources {
+		sources[i] = Source{Name: "hello", Open: func(context.Context) (io.ReadCloser, error) {
+			opened++
+			return os.Open("../fs/testdata/hello-2.12-r0.apk")
+		}}
+	}
+
+	// the first package is kept open, so the quota stops the others once ctx is done
+	results := ExpandAll(ctx, sources, t.TempDir(), WithWorkers(1), WithDiskQuota(1))
+	first := <-results
+	require.NoError(t, first.Err)
+	defer first.APK.Close()
+	cancel()
+	for result := range results {
+		require.True(t, errors.Is(result.Err, context.Canceled) || result.Err == nil)
+		if result.APK != nil {
+			result.APK.Close()
+		}
+	}
+	require.Less(t, opened, len(sources))
+}
@@ -2,4 +2,5 @@ package expandapk
 
 const (
 	paxRecordsChecksumKey = "APK-TOOLS.checksum.SHA1"
+	pgzipBlockSize        = 1 << 20
 )
@@ -15,15 +15,17 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 
+	"github.com/chainguard-dev/go-apk/internal/gzpool"
 	"github.com/chainguard-dev/go-apk/internal/tarfs"
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/pgzip"
 
 	"go.opentelemetry.io/otel"
 )
@@ -34,6 +36,12 @@ type APKExpanded struct {
 	// The size in bytes of the entire apk (sum of all tar.gz file sizes)
 	Size int64
 
+	// The sizes in bytes of the signature, control and data sections once decompressed, which are the
+	// sizes of their tars. SignatureUncompressedSize is 0 if the package is not signed.
+	SignatureUncompressedSize int64
+	ControlUncompressedSize   int64
+	PackageUncompressedSize   int64
+
 	// Whether or not the apk contains a signature
 	// Note: currently unused
 	Signed bool
@@ -50,20 +58,28 @@ type APKExpanded struct {
 	// The package data filename in .tar.gz format
 	PackageFile string
 
-	// The package data filename in .tar format.
+	// The package data filename in .tar format, empty if the data section was not expanded to one, as
+	// for a package read from a cache, see PackageReader.
 	TarFile string
 
 	// Expose ControlFile as an indexed FS implementation.
 	ControlFS *tarfs.FS
 
-	// Exposes TarFile as an indexed FS implementation.
+	// Exposes the data section as an indexed FS implementation, of TarFile if there is one.
 	TarFS *tarfs.FS
 
+	// The sha1 of the control section, the Q1 checksum of the package.
 	ControlHash []byte
+	// The sha256 of the data section, as computed while expanding it.
 	PackageHash []byte
+	// The sha256 of the data section that the datahash of .PKGINFO says it should have,
+	// nil if the package does not have one.
+	ExpectedPackageHash []byte
 
 	sync.Mutex
 	controlData []byte
+	// onClose is called the first time the package is closed.
+	onClose func()
 }
 
 const meg = 1 << 20
@@ -78,7 +94,8 @@ func (a *APKExpanded) ControlData() ([]byte, error) {
 		}
 		defer rc.Close()
 
-		zr, err := gzip.NewReader(rc)
+		zr, err := gzpool.GetReader(rc)
+		defer gzpool.PutReader(zr)
 		if err != nil {
 			return nil, err
 		}
@@ -93,6 +110,9 @@ func (a *APKExpanded) ControlData() ([]byte, error) {
 }
 
 func (a *APKExpanded) PackageData() (*os.File, error) {
+	if a.TarFile == "" {
+		return nil, errors.New("package data was not expanded to a tar file")
+	}
 	uf, err := os.Open(a.TarFile)
 	if err == nil {
 		return uf, nil
@@ -114,7 +134,8 @@ func (a *APKExpanded) PackageData() (*os.File, error) {
 	defer f.Close()
 
 	br := bufio.NewReaderSize(f, bufSize)
-	zr, err := gzip.NewReader(br)
+	zr, err := gzpool.GetReader(br)
+	defer gzpool.PutReader(zr)
 	if err != nil {
 		return nil, fmt.Errorf("parsing %q: %w", a.PackageFile, err)
 	}
@@ -124,8 +145,9 @@ func (a *APKExpanded) PackageData() (*os.File, error) {
 		return nil, fmt.Errorf("opening tar file %q: %w", a.TarFile, err)
 	}
 
-	buf := make([]byte, bufSize)
-	if _, err := io.CopyBuffer(uf, zr, buf); err != nil {
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	if _, err := io.CopyBuffer(uf, zr, *buf); err != nil {
 		return nil, fmt.Errorf("decompressing %q: %w", a.PackageFile, err)
 	}
 
@@ -136,6 +158,42 @@ func (a *APKExpanded) PackageData() (*os.File, error) {
 	return os.Open(a.TarFile)
 }
 
+// PackageReader returns the tar of the data section. Without a TarFile, PackageFile is decompressed as it is
+// read, rather than expanded first.
+func (a *APKExpanded) PackageReader() (io.ReadCloser, error) {
+	if a.TarFile != "" {
+		return a.PackageData()
+	}
+
+	f, err := os.Open(a.PackageFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", a.PackageFile, err)
+	}
+	zr, err := gzpool.GetReader(f)
+	if err != nil {
+		gzpool.PutReader(zr)
+		f.Close()
+		return nil, fmt.Errorf("parsing %q: %w", a.PackageFile, err)
+	}
+
+	return &gzipReadCloser{zr: zr, f: f}, nil
+}
+
+// gzipReadCloser reads the gzipped file f through zr, which goes back to the pool when it is closed.
+type gzipReadCloser struct {
+	zr *gzip.Reader
+	f  *os.File
+}
+
+func (g *gzipReadCloser) Read(p []byte) (int, error) {
+	return g.zr.Read(p)
+}
+
+func (g *gzipReadCloser) Close() error {
+	gzpool.PutReader(g.zr)
+	return g.f.Close()
+}
+
 func (a *APKExpanded) APK() (io.ReadCloser, error) {
 	rs := []io.Reader{}
 	cs := []io.Closer{}
@@ -181,6 +239,14 @@ func (a *APKExpanded) Close() error {
 		errs = append(errs, os.RemoveAll(a.tempDir))
 	}
 
+	a.Lock()
+	onClose := a.onClose
+	a.onClose = nil
+	a.Unlock()
+	if onClose != nil {
+		onClose()
+	}
+
 	return errors.Join(errs...)
 }
 
@@ -220,6 +286,12 @@ var _ io.Writer = (*expandApkWriter)(nil)
 
 var errExpandApkWriterMaxStreams = errors.New("expandApkWriter max streams reached")
 
+// ErrChecksumMismatch is when a file in a package does not have the checksum in its header.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrInsufficientSpace is when there is not enough free space to expand a package into, see WithExpectedSize.
+var ErrInsufficientSpace = errors.New("insufficient space")
+
 func (w *expandApkWriter) Next() error {
 	if w.f != nil {
 		if err := w.CloseFile(); err != nil {
@@ -236,7 +308,8 @@ func (w *expandApkWriter) Next() error {
 			return fmt.Errorf("expandApkWriter.Next error 2: %v", err)
 		}
 		defer f.Close()
-		gzipRead, err := gzip.NewReader(f)
+		gzipRead, err := gzpool.GetReader(f)
+		defer gzpool.PutReader(gzipRead)
 		if err != nil {
 			return fmt.Errorf("expandApkWriter.Next error 3: %v", err)
 		}
@@ -285,6 +358,7 @@ func (w expandApkWriter) CloseFile() error {
 type expandApkReader struct {
 	io.Reader
 	fast bool
+	buf  [1]byte
 }
 
 func newExpandApkReader(r io.Reader) *expandApkReader {
@@ -298,12 +372,11 @@ func (r *expandApkReader) Read(b []byte) (int, error) {
 	if r.fast {
 		return r.Reader.Read(b)
 	}
-	buf := make([]byte, 1)
-	n, err := r.Reader.Read(buf)
+	n, err := r.Reader.Read(r.buf[:])
 	if err != nil && err != io.EOF {
 		err = fmt.Errorf("expandApkReader.Read: %w", err)
 	} else {
-		b[0] = buf[0]
+		b[0] = r.buf[0]
 	}
 	return n, err
 }
@@ -325,10 +398,21 @@ func (r *expandApkReader) EnableFastRead() {
 //
 // Returns an APKExpanded struct containing references to the file. You *must* call APKExpanded.Close()
 // when finished to clean up the various files.
-func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpanded, error) {
+func ExpandApk(ctx context.Context, source io.Reader, cacheDir string, opts ...Option) (_ *APKExpanded, err error) {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "ExpandApk")
 	defer span.End()
 
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if cacheDir == "" {
+		cacheDir = o.tempDir
+	}
+	if err := checkSpace(cacheDir, o.expectedSize); err != nil {
+		return nil, err
+	}
 	dir, err := os.MkdirTemp(cacheDir, "expand-apk")
 	if err != nil {
 		return nil, err
@@ -338,15 +422,30 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	if err != nil {
 		return nil, fmt.Errorf("expandApk error 1: %w", err)
 	}
+
+	// Don't leave partially expanded streams behind if we fail or are cancelled.
+	defer func() {
+		if err != nil {
+			if sw.f != nil {
+				sw.f.Close()
+			}
+			os.RemoveAll(dir)
+		}
+	}()
 	exR := newExpandApkReader(source)
 	tr := io.TeeReader(exR, sw)
 	var gzi *gzip.Reader
 	gzipStreams := []string{}
 	hashes := [][]byte{}
+	uncompressedSizes := []int64{}
 	maxStreamsReached := false
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// Control section uses sha1.
-		var h hash.Hash = sha1.New() //nolint:gosec // this is what apk tools is using
+		var h summer = sha1.New() //nolint:gosec // this is what apk tools is using
 
 		if err := sw.Next(); err != nil {
 			if err == errExpandApkWriterMaxStreams {
@@ -355,6 +454,11 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 
 				// Data section uses sha256.
 				h = sha256.New()
+				if o.parallelHash {
+					ah := newAsyncHash(sha256.New())
+					defer ah.Close()
+					h = ah
+				}
 			} else {
 				return nil, fmt.Errorf("expandApk error 5: %w", err)
 			}
@@ -362,8 +466,29 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 
 		hr := io.TeeReader(tr, h)
 
+		if maxStreamsReached && o.parallelBlocks > 0 {
+			// The data section is the last stream, so there is nothing after it to overread into.
+			pgzi, err := pgzip.NewReaderN(hr, pgzipBlockSize, o.parallelBlocks)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("creating parallel gzip reader: %w", err)
+			}
+			defer pgzi.Close()
+
+			size, err := expandData(ctx, pgzi, sw.CurrentName())
+			if err != nil {
+				return nil, err
+			}
+			gzipStreams = append(gzipStreams, sw.CurrentName())
+			hashes = append(hashes, h.Sum(nil))
+			uncompressedSizes = append(uncompressedSizes, size)
+			break
+		}
+
 		if gzi == nil {
-			gzi, err = gzip.NewReader(hr)
+			gzi, err = gzpool.GetReader(hr)
+			defer gzpool.PutReader(gzi)
 		} else {
 			err = gzi.Reset(hr)
 		}
@@ -377,38 +502,22 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		if !maxStreamsReached {
 			gzi.Multistream(false)
 
-			if _, err := io.Copy(io.Discard, gzi); err != nil {
+			size, err := io.Copy(io.Discard, gzi)
+			if err != nil {
 				return nil, fmt.Errorf("expandApk error 3: %w", err)
 			}
 
 			hashes = append(hashes, h.Sum(nil))
 			gzipStreams = append(gzipStreams, sw.CurrentName())
+			uncompressedSizes = append(uncompressedSizes, size)
 		} else {
-			// While we verify checksums, also tee the tar to a separate file.
-			tarfilename := strings.TrimSuffix(sw.CurrentName(), ".gz")
-			tarfile, err := os.Create(tarfilename)
+			size, err := expandData(ctx, gzi, sw.CurrentName())
 			if err != nil {
-				return nil, fmt.Errorf("opening tar file: %w", err)
-			}
-			bw := bufio.NewWriterSize(tarfile, 1<<20)
-			tr := io.TeeReader(gzi, bw)
-
-			if err := checkSums(ctx, tr); err != nil {
-				return nil, fmt.Errorf("checking sums: %w", err)
-			}
-			if _, err := io.Copy(io.Discard, tr); err != nil {
-				return nil, fmt.Errorf("expandApk error 3: %w", err)
-			}
-
-			if err := bw.Flush(); err != nil {
-				return nil, fmt.Errorf("flushing tarfile: %w", err)
-			}
-
-			if err := tarfile.Close(); err != nil {
-				return nil, fmt.Errorf("closing tarfile: %w", err)
+				return nil, err
 			}
 			gzipStreams = append(gzipStreams, sw.CurrentName())
 			hashes = append(hashes, h.Sum(nil))
+			uncompressedSizes = append(uncompressedSizes, size)
 			break
 		}
 	}
@@ -452,9 +561,13 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		ControlHash: hashes[controlDataIndex],
 		PackageFile: gzipStreams[controlDataIndex+1],
 		PackageHash: hashes[controlDataIndex+1],
+
+		ControlUncompressedSize: uncompressedSizes[controlDataIndex],
+		PackageUncompressedSize: uncompressedSizes[controlDataIndex+1],
 	}
 	if signed {
 		expanded.SignatureFile = gzipStreams[0]
+		expanded.SignatureUncompressedSize = uncompressedSizes[0]
 	}
 
 	control, err := expanded.ControlData()
@@ -467,6 +580,18 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 		return nil, fmt.Errorf("indexing %q: %w", expanded.ControlFile, err)
 	}
 
+	pkginfo, err := fs.ReadFile(expanded.ControlFS, ".PKGINFO")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading .PKGINFO: %w", err)
+	}
+	expanded.ExpectedPackageHash, err = dataHashFromPkgInfo(pkginfo)
+	if err != nil {
+		return nil, err
+	}
+	if o.verifyDataHash && expanded.ExpectedPackageHash != nil && !bytes.Equal(expanded.ExpectedPackageHash, expanded.PackageHash) {
+		return nil, fmt.Errorf("%w: data section datahash was %x, computed %x", ErrChecksumMismatch, expanded.ExpectedPackageHash, expanded.PackageHash)
+	}
+
 	expanded.TarFile = strings.TrimSuffix(expanded.PackageFile, ".gz")
 
 	data, err := expanded.PackageData()
@@ -487,6 +612,41 @@ func ExpandApk(ctx context.Context, source io.Reader, cacheDir string) (*APKExpa
 	return &expanded, nil
 }
 
+// expandData verifies the checksums of the files in the decompressed data section r,
+// while also teeing the tar to a file next to the gzip stream in gzipName. It returns the size of the tar.
+func expandData(ctx context.Context, r io.Reader, gzipName string) (int64, error) {
+	tarfilename := strings.TrimSuffix(gzipName, ".gz")
+	tarfile, err := os.Create(tarfilename)
+	if err != nil {
+		return 0, fmt.Errorf("opening tar file: %w", err)
+	}
+	defer tarfile.Close()
+	bw := getBufioWriter(tarfile)
+	defer putBufioWriter(bw)
+	tr := io.TeeReader(r, bw)
+
+	if err := checkSums(ctx, tr); err != nil {
+		return 0, fmt.Errorf("checking sums: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return 0, fmt.Errorf("expandApk error 3: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("flushing tarfile: %w", err)
+	}
+
+	info, err := tarfile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("sizing tarfile: %w", err)
+	}
+
+	if err := tarfile.Close(); err != nil {
+		return 0, fmt.Errorf("closing tarfile: %w", err)
+	}
+	return info.Size(), nil
+}
+
 func checkSums(ctx context.Context, r io.Reader) error {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "checkSums")
 	defer span.End()
@@ -494,6 +654,10 @@ func checkSums(ctx context.Context, r io.Reader) error {
 	tr := tar.NewReader(r)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		header, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break
@@ -523,7 +687,7 @@ func checkSums(ctx context.Context, r io.Reader) error {
 		}
 
 		if want, got := checksum, w.Sum(nil); !bytes.Equal(want, got) {
-			return fmt.Errorf("checksum mismatch: %s header was %x, computed %x", header.Name, want, got)
+			return fmt.Errorf("%w: %s header was %x, computed %x", ErrChecksumMismatch, header.Name, want, got)
 		}
 	}
 
@@ -0,0 +1,94 @@
+package expandapk
+
+import (
+	"hash"
+	"io"
+	"sync"
+)
+
+// summer is the part of hash.Hash that ExpandApk uses to hash the streams of a package.
+type summer interface {
+	io.Writer
+	Sum(b []byte) []byte
+}
+
+// An asyncHash hands what is written to it to its goroutine in chunks of hashChunkSize bytes, and
+// holds up to hashQueueDepth of them ahead of the goroutine before a Write blocks.
+const (
+	hashChunkSize  = meg
+	hashQueueDepth = 4
+)
+
+// asyncHash is a hash that is computed in its own goroutine, so that hashing a stream overlaps with
+// reading and decompressing it. Writes are batched into buffers from bufPool and handed to the goroutine,
+// and Sum waits for it to hash everything written so far. It must be closed, even if Sum is not called.
+type asyncHash struct {
+	h      hash.Hash
+	buf    *[]byte
+	n      int
+	chunks chan hashChunk
+	done   chan struct{}
+	once   sync.Once
+}
+
+type hashChunk struct {
+	buf *[]byte
+	n   int
+}
+
+func newAsyncHash(h hash.Hash) *asyncHash {
+	a := &asyncHash{
+		h:      h,
+		chunks: make(chan hashChunk, hashQueueDepth),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(a.done)
+		for chunk := range a.chunks {
+			a.h.Write((*chunk.buf)[:chunk.n])
+			bufPool.Put(chunk.buf)
+		}
+	}()
+	return a
+}
+
+// Write never fails, as writing to a hash.Hash does not.
+func (a *asyncHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if a.buf == nil {
+			a.buf = bufPool.Get().(*[]byte)
+			a.n = 0
+		}
+		n := copy((*a.buf)[a.n:hashChunkSize], p)
+		a.n += n
+		p = p[n:]
+		if a.n == hashChunkSize {
+			a.flush()
+		}
+	}
+	return written, nil
+}
+
+func (a *asyncHash) flush() {
+	if a.buf == nil {
+		return
+	}
+	a.chunks <- hashChunk{buf: a.buf, n: a.n}
+	a.buf, a.n = nil, 0
+}
+
+// Sum appends the hash of everything written to b. Nothing can be written after it.
+func (a *asyncHash) Sum(b []byte) []byte {
+	a.Close()
+	return a.h.Sum(b)
+}
+
+// Close stops the goroutine of the hash once it has hashed everything written, and waits for it.
+func (a *asyncHash) Close() {
+	a.once.Do(func() {
+		a.flush()
+		close(a.chunks)
+	})
+	<-a.done
+}
@@ -0,0 +1,61 @@
+package expandapk
+
+import "runtime"
+
+// Option configures ExpandApk.
+type Option func(*options)
+
+type options struct {
+	parallelBlocks int
+	verifyDataHash bool
+	parallelHash   bool
+	tempDir        string
+	expectedSize   int64
+}
+
+// WithDataHashVerification fails the expansion with ErrChecksumMismatch if the data section of the
+// package does not have the sha256 in the datahash of its .PKGINFO. Packages without a datahash
+// are not checked.
+func WithDataHashVerification(verify bool) Option {
+	return func(o *options) {
+		o.verifyDataHash = verify
+	}
+}
+
+// WithParallelDecompression decompresses the data section of the package, which is where nearly all
+// of the bytes are, with up to blocks blocks of 1MB being decompressed ahead of the reader in parallel.
+// If blocks is 0 or less, it is set to GOMAXPROCS.
+func WithParallelDecompression(blocks int) Option {
+	return func(o *options) {
+		if blocks <= 0 {
+			blocks = runtime.GOMAXPROCS(0)
+		}
+		o.parallelBlocks = blocks
+	}
+}
+
+// WithParallelHashing computes the sha256 of the data section in its own goroutine, overlapping it with
+// reading and decompressing the package, rather than serially with them.
+func WithParallelHashing(parallel bool) Option {
+	return func(o *options) {
+		o.parallelHash = parallel
+	}
+}
+
+// WithTempDir expands packages into temporary directories of dir when ExpandApk is not given a cache dir,
+// rather than of os.TempDir, e.g. for a scratch disk that is larger than /tmp.
+func WithTempDir(dir string) Option {
+	return func(o *options) {
+		o.tempDir = dir
+	}
+}
+
+// WithExpectedSize checks that the directory the package is expanded into has at least size bytes free
+// before expanding it, and fails with ErrInsufficientSpace if not, rather than filling the disk part way
+// through. The expanded package takes about its size plus its installed size, as in its index. Where the
+// free space cannot be found out, it is not checked.
+func WithExpectedSize(size int64) Option {
+	return func(o *options) {
+		o.expectedSize = size
+	}
+}
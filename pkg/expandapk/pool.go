@@ -0,0 +1,26 @@
+package expandapk
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Pools for the writers and buffers that every package expansion needs, so that installing
+// many packages does not allocate them over and over again. The gzip readers are pooled by gzpool.
+var (
+	bufioWriterPool = sync.Pool{New: func() any { return bufio.NewWriterSize(nil, meg) }}
+	bufPool         = sync.Pool{New: func() any { b := make([]byte, meg); return &b }}
+)
+
+// getBufioWriter returns a buffered writer for w from the pool. It should be returned with putBufioWriter.
+func getBufioWriter(w io.Writer) *bufio.Writer {
+	bw := bufioWriterPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	bufioWriterPool.Put(bw)
+}
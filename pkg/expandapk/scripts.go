@@ -0,0 +1,51 @@
+package expandapk
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Script is a script in the control section of a package, such as .pre-install or .trigger.
+type Script struct {
+	// Name is the name of the script in the control section, e.g. .post-install.
+	Name string
+	// Contents is what would be run.
+	Contents []byte
+}
+
+// Scripts returns the scripts in the control section of the package, in the order they are in it. These
+// are everything but the .PKGINFO, as installing the package would add to scripts.tar, so that they can be
+// inspected before the package is installed.
+func (a *APKExpanded) Scripts() ([]Script, error) {
+	control, err := a.ControlData()
+	if err != nil {
+		return nil, err
+	}
+
+	var scripts []Script
+	tr := tar.NewReader(bytes.NewReader(control))
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading control section: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg || header.Name == ".PKGINFO" {
+			continue
+		}
+
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading script %s: %w", header.Name, err)
+		}
+		scripts = append(scripts, Script{Name: header.Name, Contents: contents})
+	}
+
+	return scripts, nil
+}
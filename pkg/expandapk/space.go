@@ -0,0 +1,24 @@
+package expandapk
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkSpace returns ErrInsufficientSpace if dir, or os.TempDir if it is empty, has less than size bytes free.
+func checkSpace(dir string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	free, ok, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("checking free space in %s: %w", dir, err)
+	}
+	if ok && free < size {
+		return fmt.Errorf("expanding needs %d bytes, but %s has %d free: %w", size, dir, free, ErrInsufficientSpace)
+	}
+	return nil
+}
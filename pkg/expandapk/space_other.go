@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package expandapk
+
+// freeSpace does not know the free space in dir on this OS.
+func freeSpace(string) (int64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package expandapk
+
+import "syscall"
+
+// freeSpace returns the bytes that are free in dir for an unprivileged user.
+func freeSpace(dir string) (int64, bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true, nil //nolint:gosec // block counts fit in an int64
+}
@@ -0,0 +1,38 @@
+package expandapk
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTempDirAndExpectedSize(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	expand := func(opts ...Option) (*APKExpanded, error) {
+		f, err := os.Open("../fs/testdata/hello-2.12-r0.apk")
+		require.NoError(t, err)
+		defer f.Close()
+		return ExpandApk(ctx, f, "", opts...)
+	}
+
+	exp, err := expand(WithTempDir(dir), WithExpectedSize(1<<10))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(exp.TarFile, dir+string(filepath.Separator)), exp.TarFile)
+	require.NoError(t, exp.Close())
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("the free space is not known on", runtime.GOOS)
+	}
+	_, err = expand(WithTempDir(dir), WithExpectedSize(math.MaxInt64))
+	require.ErrorIs(t, err, ErrInsufficientSpace)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "nothing is expanded when there is not enough space")
+}
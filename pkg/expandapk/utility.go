@@ -2,6 +2,8 @@ package expandapk
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -39,3 +41,24 @@ func checksumFromHeader(header *tar.Header) ([]byte, error) {
 
 	return checksum, nil
 }
+
+// dataHashFromPkgInfo returns the datahash in the contents of a .PKGINFO, nil if it has none.
+func dataHashFromPkgInfo(pkginfo []byte) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(pkginfo))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || strings.TrimSpace(key) != "datahash" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return nil, nil
+		}
+		datahash, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("decoding datahash %q from .PKGINFO: %w", value, err)
+		}
+		return datahash, nil
+	}
+	return nil, scanner.Err()
+}
@@ -7,9 +7,12 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
 )
 
@@ -20,47 +23,37 @@ const (
 	APKFSPackage
 )
 
+// APKFS is safe for concurrent use once NewAPKFS returns it: its files and directories are indexed up
+// front, and the expanded package behind them is only read.
 type APKFS struct {
-	path   string
-	files  map[string]*apkFSFile
+	path  string
+	files map[string]*apkFSFile
+	// dirs are the entries of each directory, sorted by name.
+	dirs   map[string][]fs.DirEntry
 	ctx    context.Context
+	mu     sync.Mutex
 	cache  *expandapk.APKExpanded
 	fsType APKFSType
+	// opts are what the package is expanded with, e.g. expandapk.WithTempDir
+	opts []expandapk.Option
 }
 
 func (a *APKFS) acquireCache() (*expandapk.APKExpanded, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	if a.cache == nil {
 		file, err := os.Open(a.path)
 		if err != nil {
 			return nil, err
 		}
 		defer file.Close()
-		a.cache, err = expandapk.ExpandApk(a.ctx, file, "/tmp/")
+		a.cache, err = expandapk.ExpandApk(a.ctx, file, "", a.opts...)
 		if err != nil {
 			return nil, err
 		}
 	}
 	return a.cache, nil
 }
-func (a *APKFS) getTarReader() (*os.File, *tar.Reader, error) {
-	var fileName string
-	if a.fsType == APKFSPackage {
-		fileName = a.cache.PackageFile
-	} else if a.fsType == APKFSControl {
-		fileName = a.cache.ControlFile
-	}
-	file, err := os.Open(fileName)
-
-	if err != nil {
-		return nil, nil, err
-	}
-	gzipStream, err := gzip.NewReader(file)
-	if err != nil {
-		return nil, nil, err
-	}
-	tr := tar.NewReader(gzipStream)
-	return file, tr, nil
-}
 func correctMode(mode fs.FileMode, header *tar.Header) fs.FileMode {
 	switch header.Typeflag {
 	case tar.TypeSymlink:
@@ -70,8 +63,11 @@ func correctMode(mode fs.FileMode, header *tar.Header) fs.FileMode {
 	}
 	return mode
 }
-func NewAPKFS(ctx context.Context, archive string, apkfsType APKFSType) (*APKFS, error) {
-	result := APKFS{archive, make(map[string]*apkFSFile), ctx, nil, apkfsType}
+
+// NewAPKFS returns the control or package section of the .apk file archive as a filesystem. The package is
+// expanded into a temporary directory with opts, so expandapk.WithTempDir sets where.
+func NewAPKFS(ctx context.Context, archive string, apkfsType APKFSType, opts ...expandapk.Option) (*APKFS, error) {
+	result := APKFS{path: archive, files: make(map[string]*apkFSFile), ctx: ctx, fsType: apkfsType, opts: opts}
 
 	file, err := os.Open(archive)
 	if err != nil {
@@ -79,7 +75,7 @@ func NewAPKFS(ctx context.Context, archive string, apkfsType APKFSType) (*APKFS,
 	}
 	defer file.Close()
 
-	apkExpanded, err := expandapk.ExpandApk(ctx, file, "")
+	apkExpanded, err := expandapk.ExpandApk(ctx, file, "", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -133,13 +129,49 @@ func NewAPKFS(ctx context.Context, archive string, apkfsType APKFSType) (*APKFS,
 		createTime: time.Unix(0, 0),
 		linkTarget: "", isDir: true,
 		xattrs: make(map[string][]byte), fs: &result}
-	result.cache, err = result.acquireCache()
-	if err != nil {
+	result.indexDirs()
+	if _, err := result.acquireCache(); err != nil {
 		return nil, err
 	}
 	return &result, nil
 }
+
+// indexDirs lists the entries of each directory once, rather than on every ReadDir.
+func (a *APKFS) indexDirs() {
+	a.dirs = map[string][]fs.DirEntry{}
+	for currentPath, currentFile := range a.files {
+		if currentPath == "/" {
+			continue
+		}
+		parent := currentPath[:strings.LastIndex(currentPath, "/")]
+		if parent == "" {
+			parent = "/"
+		}
+		a.dirs[parent] = append(a.dirs[parent], &apkFSFileInfo{currentFile, currentPath[strings.LastIndex(currentPath, "/"):]})
+	}
+	for _, entries := range a.dirs {
+		slices.SortFunc(entries, func(x, y fs.DirEntry) int {
+			return strings.Compare(x.Name(), y.Name())
+		})
+	}
+}
+
+// TarFS returns the index of the tar behind the APKFS, which tarball uses to copy its entries
+// without reading them through the fs.FS.
+func (a *APKFS) TarFS() (*tarfs.FS, error) {
+	cache, err := a.acquireCache()
+	if err != nil {
+		return nil, err
+	}
+	if a.fsType == APKFSControl {
+		return cache.ControlFS, nil
+	}
+	return cache.TarFS, nil
+}
+
 func (a *APKFS) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	if a.cache == nil {
 		return nil
 	}
@@ -160,47 +192,47 @@ type apkFSFile struct {
 	fs         *APKFS
 	// The following fields are not initialized in the copies held
 	// by the apkfs object.
-	fileDescriptor io.Closer
-	tarReader      *tar.Reader
+	contents *tarfs.File
 }
 
+var (
+	_ io.ReaderAt = (*apkFSFile)(nil)
+	_ io.Seeker   = (*apkFSFile)(nil)
+)
+
 // Users of the api should not handle the copies referred to in the
 // filesystem object.
 func (a *apkFSFile) acquireCopy() *apkFSFile {
 	return &apkFSFile{mode: a.mode, uid: a.uid, gid: a.gid, size: a.size,
 		name: a.name, modTime: a.modTime, createTime: a.createTime, linkTarget: a.linkTarget,
 		linkCount: a.linkCount, xattrs: a.xattrs, isDir: a.isDir, fs: a.fs,
-		fileDescriptor: nil, tarReader: nil}
+		contents: nil}
 }
-func (a *apkFSFile) seekTo(reader *tar.Reader) error {
-	for {
-		header, err := reader.Next()
-		if err == os.ErrNotExist {
-			break
-		} else if err != nil {
-			return err
-		}
-		if header.Name == a.name[1:] {
-			return nil
-		}
+func (a *apkFSFile) Read(b []byte) (int, error) {
+	if a.contents == nil {
+		return 0, io.EOF
 	}
-	return os.ErrNotExist
+	return a.contents.Read(b)
 }
 
-func (a *apkFSFile) Read(b []byte) (int, error) {
-	return a.tarReader.Read(b)
+// ReadAt reads from the expanded data of the package, at off in the file.
+func (a *apkFSFile) ReadAt(b []byte, off int64) (int, error) {
+	if a.contents == nil {
+		return 0, io.EOF
+	}
+	return a.contents.ReadAt(b, off)
+}
+
+func (a *apkFSFile) Seek(offset int64, whence int) (int64, error) {
+	if a.contents == nil {
+		return 0, fs.ErrInvalid
+	}
+	return a.contents.Seek(offset, whence)
 }
 func (a *apkFSFile) Stat() (fs.FileInfo, error) {
 	return &apkFSFileInfo{file: a, name: a.name}, nil
 }
 func (a *apkFSFile) Close() error {
-	if a.fileDescriptor != nil {
-		err := a.fileDescriptor.Close()
-		if err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
 
@@ -237,24 +269,7 @@ func (a *APKFS) ReadDir(path string) ([]fs.DirEntry, error) {
 	if !file.isDir {
 		return nil, fs.ErrInvalid
 	}
-	results := make([]fs.DirEntry, 0)
-	for currentPath, currentFile := range a.files {
-		if path == currentPath {
-			continue
-		}
-		pathPrefix := path
-		if path != "/" {
-			pathPrefix += "/"
-		}
-		if strings.HasPrefix(currentPath, pathPrefix) {
-			if strings.LastIndex(currentPath, "/") > len(path)+1 {
-				// some sub-sub directory, not yet
-				continue
-			}
-			results = append(results, &apkFSFileInfo{currentFile, currentPath[strings.LastIndex(currentPath, "/"):]})
-		}
-	}
-	return results, nil
+	return append([]fs.DirEntry{}, a.dirs[path]...), nil
 }
 
 func (a *APKFS) Open(path string) (fs.File, error) {
@@ -265,12 +280,15 @@ func (a *APKFS) Open(path string) (fs.File, error) {
 	}
 
 	fileCopy := file.acquireCopy()
-	var err error
-	fileCopy.fileDescriptor, fileCopy.tarReader, err = a.getTarReader()
+	// The root is not an entry of the tar.
+	if path == "/" {
+		return fileCopy, nil
+	}
+	tfs, err := a.TarFS()
 	if err != nil {
 		return nil, err
 	}
-	err = fileCopy.seekTo(fileCopy.tarReader)
+	fileCopy.contents, err = tfs.OpenEntry(path[1:])
 	if err != nil {
 		return nil, err
 	}
@@ -2,10 +2,13 @@ package fs
 
 import (
 	"context"
+	"debug/elf"
 	"io"
 	"io/fs"
+	"sync"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -96,6 +99,35 @@ func TestReadAPKFile(t *testing.T) {
 		require.Equal(t, info.Size(), readSoFar)
 		require.Equal(t, info.Name(), ".PKGINFO")
 	})
+	t.Run("read-at", func(t *testing.T) {
+		apkfs, err := NewAPKFS(context.Background(), "testdata/hello-2.12-r0.apk", APKFSPackage)
+		require.Nil(t, err)
+		defer apkfs.Close()
+		file, err := apkfs.Open("/usr/bin/hello")
+		require.Nil(t, err)
+		defer file.Close()
+		contents, err := io.ReadAll(file)
+		require.Nil(t, err)
+
+		ra, ok := file.(io.ReaderAt)
+		require.True(t, ok, "file is not an io.ReaderAt")
+		buffer := make([]byte, 100)
+		_, err = ra.ReadAt(buffer, 1000)
+		require.Nil(t, err)
+		require.Equal(t, contents[1000:1100], buffer)
+
+		seeker, ok := file.(io.Seeker)
+		require.True(t, ok, "file is not an io.Seeker")
+		_, err = seeker.Seek(10, io.SeekStart)
+		require.Nil(t, err)
+		_, err = io.ReadFull(file, buffer)
+		require.Nil(t, err)
+		require.Equal(t, contents[10:110], buffer)
+
+		binary, err := elf.NewFile(ra)
+		require.Nil(t, err)
+		require.NotEmpty(t, binary.Sections)
+	})
 	t.Run("walk-fs", func(t *testing.T) {
 		apkfs, err := NewAPKFS(context.Background(), "testdata/hello-2.12-r0.apk", APKFSPackage)
 		require.Nil(t, err)
@@ -116,3 +148,44 @@ func TestReadAPKFile(t *testing.T) {
 		require.True(t, found)
 	})
 }
+
+func TestAPKFSConcurrentReads(t *testing.T) {
+	apkfs, err := NewAPKFS(context.Background(), "testdata/hello-2.12-r0.apk", APKFSPackage)
+	require.Nil(t, err)
+	defer apkfs.Close()
+	want, err := fs.ReadFile(apkfs, "usr/bin/hello")
+	require.Nil(t, err)
+	tfs, err := apkfs.TarFS()
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				got, err := fs.ReadFile(apkfs, "usr/bin/hello")
+				assert.NoError(t, err)
+				assert.Equal(t, want, got)
+				got, err = fs.ReadFile(tfs, "usr/bin/hello")
+				assert.NoError(t, err)
+				assert.Equal(t, want, got)
+
+				entries, err := apkfs.ReadDir("/usr/bin")
+				assert.NoError(t, err)
+				assert.Len(t, entries, 1)
+				_, err = tfs.ReadDir("usr/bin")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := apkfs.ReadDir("/")
+	require.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"usr", "var"}, names)
+}
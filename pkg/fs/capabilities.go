@@ -0,0 +1,68 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Capabilities are the features that a directory on disk has, for the user this runs as, e.g. Mknod
+// only when running as root on Linux. DirFS keeps what a directory does not support in memory, so it
+// works on any host, such as macOS or Windows, but only what a directory supports can be kept on disk.
+type Capabilities struct {
+	// Mknod is whether device files can be created.
+	Mknod bool
+	// Chown is whether files can be given to other users and groups.
+	Chown bool
+	// Xattr is whether extended attributes can be set on files.
+	Xattr bool
+}
+
+// CapabilitiesFS is a filesystem on disk that reports the capabilities of its directory.
+type CapabilitiesFS interface {
+	Capabilities() Capabilities
+}
+
+// ProbeCapabilities probes which features the directory dir has, by trying each of them on a file that it
+// creates in dir and removes again. A directory that cannot be written to has none.
+func ProbeCapabilities(dir string) Capabilities {
+	var caps Capabilities
+	f, err := os.CreateTemp(dir, "test-dirfs-probe-")
+	if err != nil {
+		return caps
+	}
+	probe := f.Name()
+	_ = f.Close()
+	defer os.Remove(probe)
+
+	caps.Chown = os.Chown(probe, os.Getuid()+1, os.Getgid()+1) == nil
+	caps.Xattr = probeXattr(probe)
+
+	for i := 0; ; i++ {
+		nod := filepath.Join(dir, fmt.Sprintf("test-dirfs-nod-%d", i))
+		if _, err := os.Lstat(nod); err == nil {
+			continue
+		}
+		// the device number of /dev/null
+		if err := mknod(nod, ModeCharDev|0o600, Mkdev(1, 3)); err == nil {
+			caps.Mknod = true
+			_ = os.Remove(nod)
+		}
+		break
+	}
+	return caps
+}
@@ -0,0 +1,38 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+// ModeCharDev is the file type of a character device in the mode given to Mknod, S_IFCHR in Linux. It is
+// the same whatever the OS of the host is, as the filesystems are of Linux images.
+const ModeCharDev uint32 = 0o020000
+
+// Mkdev returns the device number of the device with major and minor as Linux encodes it, as given to
+// Mknod and returned by Readnod. It is the same whatever the OS of the host is.
+func Mkdev(major, minor uint32) int {
+	maj, mnr := uint64(major), uint64(minor)
+	return int((mnr & 0xff) | ((maj & 0xfff) << 8) | ((mnr &^ 0xff) << 12) | ((maj &^ 0xfff) << 32))
+}
+
+// Major returns the major number of the device number dev, see Mkdev.
+func Major(dev int) uint32 {
+	d := uint64(dev)
+	return uint32(((d >> 8) & 0xfff) | ((d >> 32) &^ 0xfff))
+}
+
+// Minor returns the minor number of the device number dev, see Mkdev.
+func Minor(dev int) uint32 {
+	d := uint64(dev)
+	return uint32((d & 0xff) | ((d >> 12) &^ 0xff))
+}
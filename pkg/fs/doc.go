@@ -21,7 +21,9 @@
 // It is up to each implementation to determine how to handle requests for additional
 // capabilities, such as Chown when running as non-root. These can be special
 // files on disk, kept in-memory, or even coloured strips on the computer, as long as the
-// writes and reads are consistent.
+// writes and reads are consistent. DirFS probes which of them the directory supports
+// for the user it runs as, see ProbeCapabilities, and keeps only the rest in memory.
+// Device numbers are always as Linux encodes them, see Mkdev, whatever the host OS.
 // All implementations are expected to be case-sensitive.
 
 package fs
@@ -27,8 +27,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 const (
@@ -336,8 +334,8 @@ func (m *memFS) Mknod(path string, mode uint32, dev int) error {
 		mode:       fs.FileMode(mode) | os.ModeCharDevice | os.ModeDevice,
 		modTime:    time.Now(),
 		createTime: time.Now(),
-		major:      unix.Major(uint64(dev)),
-		minor:      unix.Minor(uint64(dev)),
+		major:      Major(dev),
+		minor:      Minor(dev),
 		xattrs:     map[string][]byte{},
 	}
 
@@ -360,7 +358,7 @@ func (m *memFS) Readnod(path string) (dev int, err error) {
 	if anode.mode&os.ModeDevice != os.ModeDevice || anode.mode&os.ModeCharDevice != os.ModeCharDevice {
 		return 0, fmt.Errorf("not a device")
 	}
-	return int(unix.Mkdev(anode.major, anode.minor)), nil
+	return Mkdev(anode.major, anode.minor), nil
 }
 
 func (m *memFS) Chmod(path string, perm fs.FileMode) error {
@@ -15,6 +15,7 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -24,8 +25,6 @@ import (
 	"sync"
 	"syscall"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 type dirFSOpts struct {
@@ -117,6 +116,7 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 		base:      dir,
 		overrides: m,
 		caseMap:   caseMap,
+		caps:      ProbeCapabilities(dir),
 	}
 	// need to populate the overrides with appropriate info
 	root := os.DirFS(dir)
@@ -145,19 +145,11 @@ func DirFS(dir string, opts ...DirFSOption) FullFS {
 				err = f.overrides.Symlink(target, path)
 			}
 		case fs.ModeCharDevice:
-			var dev int
-			sys := fi.Sys()
-			st1, ok1 := sys.(*syscall.Stat_t)
-			st2, ok2 := sys.(*unix.Stat_t)
-			switch {
-			case ok1:
-				dev = int(st1.Rdev)
-			case ok2:
-				dev = int(st2.Rdev)
-			default:
-				return fmt.Errorf("unsupported type %T", sys)
+			dev, ok := rdev(fi)
+			if !ok {
+				return fmt.Errorf("unsupported type %T", fi.Sys())
 			}
-			err = f.overrides.Mknod(path, uint32(unix.S_IFCHR|mode), dev)
+			err = f.overrides.Mknod(path, ModeCharDev|uint32(perm), dev)
 		default:
 			var memFile File
 			memFile, err = f.overrides.OpenFile(path, os.O_CREATE, perm)
@@ -195,6 +187,13 @@ type dirFS struct {
 	// can exist on disk. Maps the case-sensitive to the case-insensitive variant
 	caseMap      map[string]string
 	caseMapMutex sync.Mutex
+	// caps are what the directory on disk supports, the rest is only kept in overrides.
+	caps Capabilities
+}
+
+// Capabilities returns what the directory on disk supports. Whatever it does not is kept in memory.
+func (f *dirFS) Capabilities() Capabilities {
+	return f.caps
 }
 
 func (f *dirFS) Readlink(name string) (string, error) {
@@ -217,7 +216,7 @@ func (f *dirFS) Open(name string) (fs.File, error) {
 }
 
 func (f *dirFS) open(name string) (*fileImpl, error) {
-	fullpath, err := f.sanitizePath(name)
+	fullpath, err := f.diskPath(name)
 	if err != nil {
 		return nil, err
 	}
@@ -279,14 +278,23 @@ func (f *dirFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error)
 		// do we create it on disk?
 		if f.createOnDisk(name) {
 			_ = file.Close()
-			file, err = os.OpenFile(filepath.Join(f.base, name), flag, perm)
+			fullpath, err := f.diskPath(name)
+			if err != nil {
+				return nil, err
+			}
+			file, err = os.OpenFile(fullpath, flag, perm)
 			if err != nil {
 				return nil, err
 			}
 		}
 	} else {
 		if f.caseSensitiveOnDisk(name) {
-			file, err = os.OpenFile(filepath.Join(f.base, name), flag, perm)
+			var fullpath string
+			fullpath, err = f.diskPath(name)
+			if err != nil {
+				return nil, err
+			}
+			file, err = os.OpenFile(fullpath, flag, perm)
 		} else {
 			file, err = f.overrides.OpenFile(name, flag, perm)
 		}
@@ -311,7 +319,11 @@ func (f *dirFS) Stat(name string) (fs.FileInfo, error) {
 		return nil, err
 	}
 	if f.caseSensitiveOnDisk(name) {
-		fi, err = os.Stat(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return nil, err
+		}
+		fi, err = os.Stat(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -342,7 +354,11 @@ func (f *dirFS) Create(name string) (File, error) {
 	if f.createOnDisk(name) {
 		// close the memory one
 		_ = file.Close()
-		file, err = os.Create(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return nil, err
+		}
+		file, err = os.Create(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -356,7 +372,11 @@ func (f *dirFS) Remove(name string) error {
 		return err
 	}
 	if f.removeOnDisk(name) {
-		return os.Remove(filepath.Join(f.base, name))
+		fullpath, err := f.diskPathNoFollow(name)
+		if err != nil {
+			return err
+		}
+		return os.Remove(fullpath)
 	}
 	return nil
 }
@@ -368,7 +388,11 @@ func (f *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
 		err           error
 	)
 	if f.caseSensitiveOnDisk(name) {
-		onDisk, err = os.ReadDir(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return nil, err
+		}
+		onDisk, err = os.ReadDir(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -406,7 +430,11 @@ func (f *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
 }
 func (f *dirFS) ReadFile(name string) ([]byte, error) {
 	if f.caseSensitiveOnDisk(name) {
-		return os.ReadFile(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(fullpath)
 	}
 	return f.overrides.ReadFile(name)
 }
@@ -415,7 +443,11 @@ func (f *dirFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
 		memContent []byte
 	)
 	if f.createOnDisk(name) {
-		if err := os.WriteFile(filepath.Join(f.base, name), b, mode); err != nil {
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(fullpath, b, mode); err != nil {
 			return err
 		}
 	} else {
@@ -430,7 +462,11 @@ func (f *dirFS) WriteFile(name string, b []byte, mode fs.FileMode) error {
 
 func (f *dirFS) Readnod(name string) (dev int, err error) {
 	if f.caseSensitiveOnDisk(name) {
-		_, err = os.Stat(filepath.Join(f.base, name))
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return 0, err
+		}
+		_, err = os.Stat(fullpath)
 		if err != nil {
 			return 0, err
 		}
@@ -441,13 +477,19 @@ func (f *dirFS) Readnod(name string) (dev int, err error) {
 func (f *dirFS) Link(oldname, newname string) error {
 	// for hardlink, we cannot take target as is, as it might be outside of the base.
 	// So we must sanitize it. It should point to a file that is within the filesystem.
-	target := filepath.Join(f.base, oldname)
-	target = filepath.Clean(target)
+	target, err := f.diskPathNoFollow(oldname)
+	if err != nil {
+		return err
+	}
 	if !strings.HasPrefix(target, f.base) {
 		return fmt.Errorf("hardlink target %s is outside of the filesystem", target)
 	}
 	if f.createOnDisk(newname) {
-		if err := os.Link(target, filepath.Join(f.base, newname)); err != nil {
+		fullpath, err := f.diskPathNoFollow(newname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, fullpath); err != nil {
 			return err
 		}
 	}
@@ -459,7 +501,11 @@ func (f *dirFS) Symlink(oldname, newname string) error {
 	// If it is outside of the base, it will be resolved by Readlink.
 	// This enables proper symlink behaviour.
 	if f.createOnDisk(newname) {
-		if err := os.Symlink(oldname, filepath.Join(f.base, newname)); err != nil {
+		fullpath, err := f.diskPathNoFollow(newname)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(oldname, fullpath); err != nil {
 			return err
 		}
 	}
@@ -470,7 +516,11 @@ func (f *dirFS) MkdirAll(name string, perm fs.FileMode) error {
 	// just in case, because some underlying systems miss this
 	fullPerm := os.ModeDir | perm
 	if f.createOnDisk(name) {
-		if err := os.MkdirAll(filepath.Join(f.base, name), fullPerm); err != nil {
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(fullpath, fullPerm); err != nil {
 			return err
 		}
 	}
@@ -481,7 +531,11 @@ func (f *dirFS) Mkdir(name string, perm fs.FileMode) error {
 	// just in case, because some underlying systems miss this
 	fullPerm := os.ModeDir | perm
 	if f.createOnDisk(name) {
-		if err := os.Mkdir(filepath.Join(f.base, name), fullPerm); err != nil {
+		fullpath, err := f.diskPath(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(fullpath, fullPerm); err != nil {
 			return err
 		}
 	}
@@ -491,24 +545,31 @@ func (f *dirFS) Mkdir(name string, perm fs.FileMode) error {
 func (f *dirFS) Chmod(path string, perm fs.FileMode) error {
 	if f.caseSensitiveOnDisk(path) {
 		// ignore error, as we track it in memory anyways, and disk filesystem might not support it
-		_ = os.Chmod(filepath.Join(f.base, path), perm)
+		if fullpath, err := f.diskPath(path); err == nil {
+			_ = os.Chmod(fullpath, perm)
+		}
 	}
 	return f.overrides.Chmod(path, perm)
 }
 func (f *dirFS) Chown(path string, uid, gid int) error {
-	if f.caseSensitiveOnDisk(path) {
+	if f.caps.Chown && f.caseSensitiveOnDisk(path) {
 		// ignore error, as we track it in memory anyways, and disk filesystem might not support it
-		_ = os.Chown(filepath.Join(f.base, path), uid, gid)
+		if fullpath, err := f.diskPath(path); err == nil {
+			_ = os.Chown(fullpath, uid, gid)
+		}
 	}
 	return f.overrides.Chown(path, uid, gid)
 }
 
 func (f *dirFS) Mknod(name string, mode uint32, dev int) error {
 	if f.caseSensitiveOnDisk(name) {
-		err := unix.Mknod(filepath.Join(f.base, name), mode, dev)
-		// what if we could not create it? Just create a regular file there, and memory will override
+		fullpath, err := f.diskPathNoFollow(name)
 		if err != nil {
-			if err := os.WriteFile(filepath.Join(f.base, name), nil, 0); err != nil {
+			return err
+		}
+		// what if we could not create it? Just create a regular file there, and memory will override
+		if !f.caps.Mknod || mknod(fullpath, mode, dev) != nil {
+			if err := os.WriteFile(fullpath, nil, 0); err != nil {
 				return err
 			}
 		}
@@ -531,17 +592,83 @@ func (f *dirFS) ListXattrs(path string) (map[string][]byte, error) {
 	return f.overrides.ListXattrs(path)
 }
 
-// sanitize ensures that we never go beyond the root of the filesystem
-func (f *dirFS) sanitizePath(p string) (v string, err error) {
-	return sanitizePath(f.base, p)
+// maxSymlinks is the most symlinks followed when resolving a path, as in Linux.
+const maxSymlinks = 255
+
+// diskPath returns the path on disk of name, with every symlink on the way, including name itself,
+// resolved as if f.base were the root. Symlinks that were installed earlier, whether absolute or with
+// "..", cannot make the path escape f.base, as an absolute target is relative to f.base and ".." stops
+// at it. Components that do not exist yet are taken as they are.
+func (f *dirFS) diskPath(name string) (string, error) {
+	return secureJoin(f.base, name)
 }
-func sanitizePath(base, p string) (v string, err error) {
-	v = filepath.Join(base, p)
-	if strings.HasPrefix(filepath.Clean(v), base) {
-		return v, nil
+
+// diskPathNoFollow is like diskPath, but does not resolve name itself if it is a symlink, for
+// operations on the symlink rather than its target.
+func (f *dirFS) diskPathNoFollow(name string) (string, error) {
+	clean := filepath.Join(string(filepath.Separator), name)
+	if clean == string(filepath.Separator) {
+		return f.base, nil
+	}
+	dir, err := secureJoin(f.base, filepath.Dir(clean))
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(dir, filepath.Base(clean)), nil
+}
+
+// secureJoin joins unsafePath to root, resolving symlinks within root in the style of
+// github.com/cyphar/filepath-securejoin.
+func secureJoin(root, unsafePath string) (string, error) {
+	var (
+		current  string
+		symlinks int
+	)
+	unsafePath = filepath.ToSlash(unsafePath)
+	for unsafePath != "" {
+		var part string
+		if i := strings.IndexByte(unsafePath, '/'); i == -1 {
+			part, unsafePath = unsafePath, ""
+		} else {
+			part, unsafePath = unsafePath[:i], unsafePath[i+1:]
+		}
+
+		// joining to the separator first clamps ".." at the root
+		next := filepath.Join(string(filepath.Separator), current, part)
+		if next == string(filepath.Separator) {
+			current = ""
+			continue
+		}
 
-	return "", fmt.Errorf("%s: %s", "content filepath is tainted", p)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				// nothing under here exists on disk, so the rest cannot be a symlink
+				current = next
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		symlinks++
+		if symlinks > maxSymlinks {
+			return "", &fs.PathError{Op: "resolve", Path: filepath.Join(root, next), Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = ""
+		}
+		// current stays the directory holding the symlink, for relative targets
+		unsafePath = filepath.ToSlash(target) + "/" + unsafePath
+	}
+	return filepath.Join(root, filepath.Join(string(filepath.Separator), current)), nil
 }
 
 func (f *dirFS) caseSensitiveOnDisk(p string) bool {
@@ -195,3 +195,80 @@ func TestDirFSConsistentOrdering(t *testing.T) {
 	}
 	// all results should be the same
 }
+
+func TestDirFSSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	dir := t.TempDir()
+	fsys := DirFS(dir)
+	require.NotNil(t, fsys, "fs should be created")
+
+	require.NoError(t, fsys.MkdirAll("usr/lib", 0o755))
+	// symlinks installed by an earlier package, pointing outside the root on the host
+	require.NoError(t, fsys.Symlink(outside, "abs"))
+	require.NoError(t, fsys.Symlink("../../../../../../../../"+outside, "usr/rel"))
+	require.NoError(t, fsys.Symlink(filepath.Join(outside, "file"), "usr/lib/file"))
+	// and one that stays inside it
+	require.NoError(t, fsys.Symlink("/usr/lib", "lib"))
+
+	for _, name := range []string{"abs/file", "usr/rel/file", "usr/lib/file"} {
+		t.Run(name, func(t *testing.T) {
+			_ = fsys.WriteFile(name, []byte("escaped"), 0o644)
+			_, err := os.Stat(filepath.Join(outside, "file"))
+			require.ErrorIs(t, err, fs.ErrNotExist, "file should not be written outside the root")
+		})
+	}
+
+	t.Run("resolved within root", func(t *testing.T) {
+		require.NoError(t, fsys.WriteFile("lib/inside", []byte("inside"), 0o644))
+		b, err := os.ReadFile(filepath.Join(dir, "usr", "lib", "inside"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("inside"), b)
+
+		// the final symlink resolves to a path under the root, so writing through it stays there
+		require.NoError(t, fsys.MkdirAll(outside, 0o755))
+		require.NoError(t, fsys.WriteFile("usr/lib/file", []byte("inside"), 0o644))
+		b, err = os.ReadFile(filepath.Join(dir, outside, "file"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("inside"), b)
+	})
+}
+
+func TestMkdev(t *testing.T) {
+	tests := []struct {
+		major, minor uint32
+		dev          int
+	}{
+		{1, 3, 0x103},
+		{5, 1, 0x501},
+		{0x1234, 0x56789, 0x100056723489},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.dev, Mkdev(tt.major, tt.minor), "Mkdev(%d, %d)", tt.major, tt.minor)
+		require.Equal(t, tt.major, Major(tt.dev), "Major(%#x)", tt.dev)
+		require.Equal(t, tt.minor, Minor(tt.dev), "Minor(%#x)", tt.dev)
+	}
+}
+
+func TestDirFSCapabilities(t *testing.T) {
+	dir := t.TempDir()
+	fsys := DirFS(dir)
+	require.NotNil(t, fsys, "fs should be created")
+	caps := fsys.(CapabilitiesFS).Capabilities()
+	require.Equal(t, ProbeCapabilities(dir), caps)
+
+	// the probes clean up after themselves
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// whatever the directory supports, device files and owners work as they would on Linux
+	require.NoError(t, fsys.Mknod("null", ModeCharDev|0o666, Mkdev(1, 3)))
+	dev, err := fsys.Readnod("null")
+	require.NoError(t, err)
+	require.Equal(t, Mkdev(1, 3), dev)
+	fi, err := fsys.Stat("null")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeCharDevice, fi.Mode()&fs.ModeCharDevice)
+	_, err = os.Lstat(filepath.Join(dir, "null"))
+	require.NoError(t, err, "a device file, or a placeholder for it, should be on disk")
+}
@@ -0,0 +1,32 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package fs
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// mknod cannot create device files on this OS.
+func mknod(path string, _ uint32, _ int) error {
+	return &fs.PathError{Op: "mknod", Path: path, Err: errors.ErrUnsupported}
+}
+
+// rdev cannot tell the device numbers of device files on this OS.
+func rdev(fs.FileInfo) (int, bool) {
+	return 0, false
+}
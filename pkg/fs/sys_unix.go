@@ -0,0 +1,44 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package fs
+
+import (
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates the device file at path, with dev as Linux encodes it, see Mkdev, so the host may
+// encode it differently.
+func mknod(path string, mode uint32, dev int) error {
+	return unix.Mknod(path, mode, int(unix.Mkdev(Major(dev), Minor(dev))))
+}
+
+// rdev returns the device number of the device file with the info fi, as Linux encodes it.
+func rdev(fi fs.FileInfo) (int, bool) {
+	var dev uint64
+	switch st := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		dev = uint64(st.Rdev) //nolint:unconvert // not uint64 on every OS
+	case *unix.Stat_t:
+		dev = uint64(st.Rdev) //nolint:unconvert // not uint64 on every OS
+	default:
+		return 0, false
+	}
+	return Mkdev(unix.Major(dev), unix.Minor(dev)), true
+}
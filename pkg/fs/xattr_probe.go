@@ -0,0 +1,24 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin
+
+package fs
+
+import "golang.org/x/sys/unix"
+
+// probeXattr reports whether an extended attribute in the user namespace can be set on the file at path.
+func probeXattr(path string) bool {
+	return unix.Setxattr(path, "user.go-apk.probe", []byte("probe"), 0) == nil
+}
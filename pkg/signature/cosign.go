@@ -0,0 +1,84 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CosignSignatureExt is the extension of the cosign signature of a file, which is published next to it, as
+// cosign sign-blob --output-signature writes it, e.g. APKINDEX.tar.gz.sig.
+const CosignSignatureExt = ".sig"
+
+var errDigestNotSHA256 = errors.New("digest is not a SHA256 hash")
+
+// CosignVerifySHA256Digest verifies signature, the base64 encoded signature that cosign sign-blob made with
+// a key, over the provided SHA256 hash of the blob. The public key must be an ECDSA or RSA key in the PEM
+// format, as cosign generate-key-pair writes it. Keyless signatures need a certificate and the transparency
+// log to be verified, which is left to verifiers built on sigstore itself.
+func CosignVerifySHA256Digest(sha256Digest, signature, publicKey []byte) error {
+	if len(sha256Digest) != sha256.Size {
+		return errDigestNotSHA256
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("decode cosign signature: %w", err)
+	}
+
+	pub, err := ParseCosignPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, sha256Digest, sig) {
+			return errors.New("verify ECDSA signature: invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sha256Digest, sig); err != nil {
+			return fmt.Errorf("verify PKCS1v15 signature: %w", err)
+		}
+	}
+	return nil
+}
+
+// ParseCosignPublicKey returns the ECDSA or RSA public key in the PEM format of publicKey, which are the
+// keys that CosignVerifySHA256Digest can verify signatures with.
+func ParseCosignPublicKey(publicKey []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return nil, errNoPemBlock
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse PKIX public key: %w", err)
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported cosign key type %T", pub)
+	}
+}
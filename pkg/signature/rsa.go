@@ -5,14 +5,14 @@ package signature
 
 import (
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"os"
 )
 
 var (
@@ -25,52 +25,26 @@ var (
 // RSASignSHA1Digest signs the provided SHA1 message digest. The key file
 // must be in the PEM format and can either be encrypted or not.
 func RSASignSHA1Digest(sha1Digest []byte, keyFile, passphrase string) ([]byte, error) {
-	if len(sha1Digest) != sha1.Size {
-		return nil, errDigestNotSHA1
-	}
-
-	keyFileContent, err := os.ReadFile(keyFile)
-	if err != nil {
-		return nil, fmt.Errorf("reading key file: %w", err)
-	}
-
-	block, _ := pem.Decode(keyFileContent)
-	if block == nil {
-		return nil, errNoPemBlock
-	}
-
-	blockData := block.Bytes
-	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
-		if passphrase == "" {
-			return nil, errNoPassphrase
-		}
-
-		var decryptedBlockData []byte
-
-		decryptedBlockData, err = x509.DecryptPEMBlock(block, []byte(passphrase)) //nolint:staticcheck
-		if err != nil {
-			return nil, fmt.Errorf("decrypt private key PEM block: %w", err)
-		}
-
-		blockData = decryptedBlockData
-	}
-
-	priv, err := x509.ParsePKCS1PrivateKey(blockData)
-	if err != nil {
-		return nil, fmt.Errorf("parse PKCS1 private key: %w", err)
+	var opts []SignerOption
+	if passphrase != "" {
+		opts = append(opts, WithPassphrase(StaticPassphrase(passphrase)))
 	}
-
-	signature, err := priv.Sign(rand.Reader, sha1Digest, crypto.SHA1)
+	signer, err := NewKeySigner(keyFile, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("signing: %w", err)
+		return nil, err
 	}
-
-	return signature, nil
+	return signer.SignSHA1Digest(sha1Digest)
 }
 
 // RSAVerifySHA1Digest is exported for use in tests and verifies a signature over the
 // provided SHA1 hash of a message. The key file must be in the PEM format.
 func RSAVerifySHA1Digest(sha1Digest, signature []byte, publicKey []byte) error {
+	return RSAVerifySHA1DigestWithScheme(sha1Digest, signature, publicKey, SchemePKCS1v15)
+}
+
+// RSAVerifySHA1DigestWithScheme verifies a signature with scheme over the provided SHA1 hash
+// of a message. The key file must be in the PEM format.
+func RSAVerifySHA1DigestWithScheme(sha1Digest, signature []byte, publicKey []byte, scheme Scheme) error {
 	if len(sha1Digest) != sha1.Size {
 		return errDigestNotSHA1
 	}
@@ -90,10 +64,34 @@ func RSAVerifySHA1Digest(sha1Digest, signature []byte, publicKey []byte) error {
 		return errNoRSAKey
 	}
 
-	err = rsa.VerifyPKCS1v15(rsaPub, crypto.SHA1, sha1Digest, signature)
-	if err != nil {
-		return fmt.Errorf("verify PKCS1v15 signature: %w", err)
+	switch scheme {
+	case SchemePKCS1v15:
+		if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA1, sha1Digest, signature); err != nil {
+			return fmt.Errorf("verify PKCS1v15 signature: %w", err)
+		}
+	case SchemePSS:
+		if err := rsa.VerifyPSS(rsaPub, crypto.SHA1, sha1Digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}); err != nil {
+			return fmt.Errorf("verify PSS signature: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid signature scheme %d", scheme)
 	}
 
 	return nil
 }
+
+// KeyFingerprint returns the hex encoded SHA-256 of the DER of the PEM encoded public key,
+// as printed by openssl pkey -pubin -outform DER | sha256sum.
+func KeyFingerprint(publicKey []byte) (string, error) {
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return "", errNoPemBlock
+	}
+
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("parse PKIX public key: %w", err)
+	}
+
+	digest := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(digest[:]), nil
+}
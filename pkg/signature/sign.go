@@ -23,7 +23,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/klauspost/compress/gzip"
@@ -34,61 +33,90 @@ import (
 	"github.com/chainguard-dev/go-apk/pkg/tarball"
 )
 
+// SignIndex signs the APKINDEX at indexFile in place with the RSA private key at signingKey, as
+// apk-tools does. An index that already is signed is left as is.
 func SignIndex(ctx context.Context, signingKey string, indexFile string) error {
-	log := clog.FromContext(ctx)
+	// checked before the key is parsed, so that an index that is signed does not need the key at all
 	is, err := indexIsAlreadySigned(indexFile)
 	if err != nil {
 		return err
 	}
 	if is {
-		log.Infof("index %s is already signed, doing nothing", indexFile)
+		clog.FromContext(ctx).Infof("index %s is already signed, doing nothing", indexFile)
 		return nil
 	}
 
-	log.Infof("signing index %s with key %s", indexFile, signingKey)
-
-	indexData, indexDigest, err := ReadAndHashIndexFile(indexFile)
+	signer, err := NewKeySigner(signingKey)
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to sign index: %w", err)
 	}
+	return signIndex(ctx, []*Signer{signer}, indexFile)
+}
 
-	sigData, err := RSASignSHA1Digest(indexDigest, signingKey, "")
+// SignIndexWithSigner signs the APKINDEX at indexFile in place with signer, which also sets the
+// signature scheme. An index that already is signed is left as is.
+func SignIndexWithSigner(ctx context.Context, signer *Signer, indexFile string) error {
+	return SignIndexWithSigners(ctx, []*Signer{signer}, indexFile)
+}
+
+// SignIndexWithSigners signs the APKINDEX at indexFile in place with each of signers, which all sign
+// the same unsigned index, so that it can be verified with any of their keys, or required to be
+// signed by several of them. An index that already is signed is left as is.
+func SignIndexWithSigners(ctx context.Context, signers []*Signer, indexFile string) error {
+	if len(signers) == 0 {
+		return errors.New("no keys to sign index with")
+	}
+	is, err := indexIsAlreadySigned(indexFile)
 	if err != nil {
-		return fmt.Errorf("unable to sign index: %w", err)
+		return err
+	}
+	if is {
+		clog.FromContext(ctx).Infof("index %s is already signed, doing nothing", indexFile)
+		return nil
 	}
+	return signIndex(ctx, signers, indexFile)
+}
 
-	log.Infof("appending signature to index %s", indexFile)
+// signIndex signs the APKINDEX at indexFile, which is not signed, in place with each of signers.
+func signIndex(ctx context.Context, signers []*Signer, indexFile string) error {
+	log := clog.FromContext(ctx)
 
-	sigFS := memfs.New()
-	if err := sigFS.WriteFile(fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(signingKey)), sigData, 0644); err != nil {
-		return fmt.Errorf("unable to append signature: %w", err)
+	keyNames := make([]string, 0, len(signers))
+	for _, signer := range signers {
+		keyNames = append(keyNames, signer.KeyName())
 	}
+	log.Infof("signing index %s with keys %s", indexFile, strings.Join(keyNames, ", "))
 
-	// prepare control.tar.gz
-	multitarctx, err := tarball.NewContext(
-		tarball.WithOverrideUIDGID(0, 0),
-		tarball.WithOverrideUname("root"),
-		tarball.WithOverrideGname("root"),
-		tarball.WithSkipClose(true),
-	)
+	indexData, indexDigest, err := ReadAndHashIndexFile(indexFile)
 	if err != nil {
-		return fmt.Errorf("unable to build tarball context: %w", err)
+		return err
 	}
 
-	log.Infof("writing signed index to %s", indexFile)
+	sigs := make(map[string][]byte, len(signers))
+	for _, signer := range signers {
+		sigData, err := signer.SignSHA1Digest(indexDigest)
+		if err != nil {
+			return fmt.Errorf("unable to sign index with key %s: %w", signer.KeyName(), err)
+		}
+		sigs[signer.SignatureName()] = sigData
+	}
 
-	var sigBuffer bytes.Buffer
-	if err := multitarctx.WriteTargz(ctx, &sigBuffer, sigFS, sigFS); err != nil {
-		return fmt.Errorf("unable to write signature tarball: %w", err)
+	log.Infof("appending signature to index %s", indexFile)
+
+	sigBuffer, err := signaturesTarGz(ctx, sigs)
+	if err != nil {
+		return err
 	}
 
+	log.Infof("writing signed index to %s", indexFile)
+
 	idx, err := os.Create(indexFile)
 	if err != nil {
 		return fmt.Errorf("unable to open index for writing: %w", err)
 	}
 	defer idx.Close()
 
-	if _, err := io.Copy(idx, &sigBuffer); err != nil {
+	if _, err := io.Copy(idx, sigBuffer); err != nil {
 		return fmt.Errorf("unable to write index signature: %w", err)
 	}
 
@@ -96,11 +124,102 @@ func SignIndex(ctx context.Context, signingKey string, indexFile string) error {
 		return fmt.Errorf("unable to write index data: %w", err)
 	}
 
-	log.Infof("signed index %s with key %s", indexFile, signingKey)
+	log.Infof("signed index %s with keys %s", indexFile, strings.Join(keyNames, ", "))
 
 	return nil
 }
 
+// SignAPK signs a package built from its control and data sections, each a gzipped tar, as apk-tools
+// does: the signature of the control section by signer is prepended to it as another gzipped tar.
+// The control section must not have an end of archive, and its .PKGINFO should have the datahash of
+// the data section. It returns the signed package, which reads the data section as it is read.
+func SignAPK(ctx context.Context, signer *Signer, control, data io.Reader) (io.Reader, error) {
+	var controlBuffer bytes.Buffer
+	digest := sha1.New() //nolint:gosec
+	if _, err := io.Copy(io.MultiWriter(&controlBuffer, digest), control); err != nil {
+		return nil, fmt.Errorf("unable to read control section: %w", err)
+	}
+
+	sigData, err := signer.SignSHA1Digest(digest.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign package: %w", err)
+	}
+
+	sigBuffer, err := signatureTarGz(ctx, signer, sigData)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.MultiReader(sigBuffer, &controlBuffer, data), nil
+}
+
+// DetachedSignatureExt is the extension of the detached signature of a package, which is published next to
+// it, as in foo-1.0-r0.apk.sig.
+const DetachedSignatureExt = ".sig"
+
+// SignDetached writes the detached signature of the package at packageFile by signer to packageFile with
+// DetachedSignatureExt. It is a signature section, as that of a signed package, see SignAPK, over the SHA1
+// digest of the whole package, so that a package that is signed or not can also be verified as it is.
+func SignDetached(ctx context.Context, signer *Signer, packageFile string) error {
+	log := clog.FromContext(ctx)
+	log.Infof("signing package %s with key %s", packageFile, signer.KeyName())
+
+	f, err := os.Open(packageFile)
+	if err != nil {
+		return fmt.Errorf("unable to read package for signing: %w", err)
+	}
+	defer f.Close()
+	digest := sha1.New() //nolint:gosec
+	if _, err := io.Copy(digest, f); err != nil {
+		return fmt.Errorf("unable to read package for signing: %w", err)
+	}
+
+	sigData, err := signer.SignSHA1Digest(digest.Sum(nil))
+	if err != nil {
+		return fmt.Errorf("unable to sign package: %w", err)
+	}
+	sigBuffer, err := signatureTarGz(ctx, signer, sigData)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(packageFile+DetachedSignatureExt, sigBuffer.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("unable to write package signature: %w", err)
+	}
+	return nil
+}
+
+// signatureTarGz returns the signature section with sigData by signer, which is a gzipped tar
+// without an end of archive, so that the signed section follows it.
+func signatureTarGz(ctx context.Context, signer *Signer, sigData []byte) (*bytes.Buffer, error) {
+	return signaturesTarGz(ctx, map[string][]byte{signer.SignatureName(): sigData})
+}
+
+// signaturesTarGz is signatureTarGz with a signature file for each of sigs, by its name.
+func signaturesTarGz(ctx context.Context, sigs map[string][]byte) (*bytes.Buffer, error) {
+	sigFS := memfs.New()
+	for name, sigData := range sigs {
+		if err := sigFS.WriteFile(name, sigData, 0644); err != nil {
+			return nil, fmt.Errorf("unable to append signature: %w", err)
+		}
+	}
+
+	multitarctx, err := tarball.NewContext(
+		tarball.WithOverrideUIDGID(0, 0),
+		tarball.WithOverrideUname("root"),
+		tarball.WithOverrideGname("root"),
+		tarball.WithSkipClose(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build tarball context: %w", err)
+	}
+
+	var sigBuffer bytes.Buffer
+	if err := multitarctx.WriteTargz(ctx, &sigBuffer, sigFS, sigFS); err != nil {
+		return nil, fmt.Errorf("unable to write signature tarball: %w", err)
+	}
+	return &sigBuffer, nil
+}
+
 func indexIsAlreadySigned(indexFile string) (bool, error) {
 	index, err := os.Open(indexFile)
 	if err != nil {
@@ -0,0 +1,104 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/psanford/memfs"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+)
+
+func TestSignAPK(t *testing.T) {
+	ctx := context.Background()
+
+	controlFS := memfs.New()
+	require.NoError(t, controlFS.WriteFile(".PKGINFO", []byte("pkgname = hello\npkgver = 1.0-r0\n"), 0o644))
+	dataFS := memfs.New()
+	require.NoError(t, dataFS.MkdirAll("usr/bin", 0o755))
+	require.NoError(t, dataFS.WriteFile("usr/bin/hello", []byte("hello world"), 0o755))
+
+	controlCtx, err := tarball.NewContext(tarball.WithSkipClose(true))
+	require.NoError(t, err)
+	var control bytes.Buffer
+	require.NoError(t, controlCtx.WriteTargz(ctx, &control, controlFS, controlFS))
+	dataCtx, err := tarball.NewContext()
+	require.NoError(t, err)
+	var data bytes.Buffer
+	require.NoError(t, dataCtx.WriteTargz(ctx, &data, dataFS, dataFS))
+
+	signer, err := NewKeySigner("testdata/test.rsa")
+	require.NoError(t, err)
+	apk, err := SignAPK(ctx, signer, &control, &data)
+	require.NoError(t, err)
+
+	exp, err := expandapk.ExpandApk(ctx, apk, t.TempDir())
+	require.NoError(t, err)
+	defer exp.Close()
+	require.True(t, exp.Signed)
+
+	// the signature is the only file of the signature section
+	f, err := os.Open(exp.SignatureFile)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, signer.SignatureName(), hdr.Name)
+	sig, err := io.ReadAll(tr)
+	require.NoError(t, err)
+
+	pub, err := os.ReadFile("testdata/test.rsa.pub")
+	require.NoError(t, err)
+	require.NoError(t, RSAVerifySHA1Digest(exp.ControlHash, sig, pub))
+}
+
+func TestSignIndex(t *testing.T) {
+	ctx := context.Background()
+
+	indexFS := memfs.New()
+	require.NoError(t, indexFS.WriteFile("APKINDEX", []byte("P:hello\nV:1.0-r0\n\n"), 0o644))
+	tctx, err := tarball.NewContext()
+	require.NoError(t, err)
+	var index bytes.Buffer
+	require.NoError(t, tctx.WriteTargz(ctx, &index, indexFS, indexFS))
+	indexFile := filepath.Join(t.TempDir(), "APKINDEX.tar.gz")
+	require.NoError(t, os.WriteFile(indexFile, index.Bytes(), 0o644))
+
+	require.NoError(t, SignIndex(ctx, "testdata/test.rsa", indexFile))
+	signed, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	is, err := indexIsAlreadySigned(indexFile)
+	require.NoError(t, err)
+	require.True(t, is)
+
+	// an index that is signed is left as is, without reading the key
+	require.NoError(t, SignIndex(ctx, "testdata/does-not-exist.rsa", indexFile))
+	again, err := os.ReadFile(indexFile)
+	require.NoError(t, err)
+	require.Equal(t, signed, again)
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PassphraseFunc returns the passphrase of an encrypted signing key. It is only called when the
+// key is encrypted, so it can prompt for the passphrase, or fetch it from an agent or a KMS.
+type PassphraseFunc func() ([]byte, error)
+
+// StaticPassphrase returns a PassphraseFunc that always returns passphrase.
+func StaticPassphrase(passphrase string) PassphraseFunc {
+	return func() ([]byte, error) {
+		return []byte(passphrase), nil
+	}
+}
+
+// EnvPassphrase returns a PassphraseFunc that reads the passphrase from the environment variable name.
+func EnvPassphrase(name string) PassphraseFunc {
+	return func() ([]byte, error) {
+		passphrase, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(passphrase), nil
+	}
+}
+
+// Scheme is the RSA signature scheme of a signature.
+type Scheme int
+
+const (
+	// SchemePKCS1v15 is RSASSA-PKCS1-v1_5, which is what apk-tools signs and verifies.
+	SchemePKCS1v15 Scheme = iota
+	// SchemePSS is RSASSA-PSS, with a salt as long as the hash. Signatures with it are named
+	// .SIGN.RSA-PSS.<key>.pub, and are not understood by apk-tools.
+	SchemePSS
+)
+
+func (s Scheme) String() string {
+	switch s {
+	case SchemePKCS1v15:
+		return "PKCS1v15"
+	case SchemePSS:
+		return "PSS"
+	default:
+		return "unknown"
+	}
+}
+
+// signaturePrefix is the prefix of the name of a signature file with the scheme.
+func (s Scheme) signaturePrefix() string {
+	if s == SchemePSS {
+		return ".SIGN.RSA-PSS."
+	}
+	return ".SIGN.RSA."
+}
+
+// SignatureName returns the name of the file in the signature section of an index or package that
+// holds a signature with scheme by the key keyName, e.g. .SIGN.RSA.foo.rsa.pub for foo.rsa.
+func SignatureName(scheme Scheme, keyName string) string {
+	return scheme.signaturePrefix() + keyName + ".pub"
+}
+
+// ParseSignatureName returns the name of the public key and the scheme of the signature file name,
+// e.g. foo.rsa.pub for .SIGN.RSA.foo.rsa.pub, and false if name is not a signature file name.
+func ParseSignatureName(name string) (string, Scheme, bool) {
+	// the longer prefix first, as both start with .SIGN.RSA
+	for _, scheme := range []Scheme{SchemePSS, SchemePKCS1v15} {
+		if key, ok := strings.CutPrefix(name, scheme.signaturePrefix()); ok && strings.HasSuffix(key, ".rsa.pub") {
+			return key, scheme, true
+		}
+	}
+	return "", 0, false
+}
+
+// Signer signs with an RSA private key, as apk-tools does.
+type Signer struct {
+	key    *rsa.PrivateKey
+	name   string
+	scheme Scheme
+}
+
+type signerOpts struct {
+	passphrase PassphraseFunc
+	scheme     Scheme
+}
+
+// SignerOption is an option for NewKeySigner.
+type SignerOption func(*signerOpts) error
+
+// WithPassphrase sets how to get the passphrase if the key is encrypted.
+func WithPassphrase(passphrase PassphraseFunc) SignerOption {
+	return func(o *signerOpts) error {
+		o.passphrase = passphrase
+		return nil
+	}
+}
+
+// WithScheme sets the signature scheme. Default is SchemePKCS1v15.
+func WithScheme(scheme Scheme) SignerOption {
+	return func(o *signerOpts) error {
+		switch scheme {
+		case SchemePKCS1v15, SchemePSS:
+		default:
+			return fmt.Errorf("invalid signature scheme %d", scheme)
+		}
+		o.scheme = scheme
+		return nil
+	}
+}
+
+// NewKeySigner reads the PEM encoded RSA private key in keyFile, either PKCS#1 or PKCS#8, which
+// may be encrypted. Keys encrypted as PKCS#8 with PBES2 are supported as well as the legacy PEM
+// encryption of PKCS#1 keys. The name of the key is the base name of keyFile.
+func NewKeySigner(keyFile string, opts ...SignerOption) (*Signer, error) {
+	var o signerOpts
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	keyFileContent, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	key, err := parsePrivateKey(keyFileContent, o.passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{key: key, name: filepath.Base(keyFile), scheme: o.scheme}, nil
+}
+
+// KeyName is the name of the key, which the public key is expected to be installed as with a .pub
+// suffix, and which the signature of an index or package is named after.
+func (s *Signer) KeyName() string {
+	return s.name
+}
+
+// Scheme is the signature scheme the signer signs with.
+func (s *Signer) Scheme() Scheme {
+	return s.scheme
+}
+
+// SignatureName is the name of the file that holds signatures by the signer.
+func (s *Signer) SignatureName() string {
+	return SignatureName(s.scheme, s.name)
+}
+
+// Public returns the public key of the signer.
+func (s *Signer) Public() *rsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+// SignSHA1Digest signs the provided SHA1 message digest.
+func (s *Signer) SignSHA1Digest(sha1Digest []byte) ([]byte, error) {
+	if len(sha1Digest) != sha1.Size {
+		return nil, errDigestNotSHA1
+	}
+
+	var signerOpts crypto.SignerOpts = crypto.SHA1
+	if s.scheme == SchemePSS {
+		signerOpts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA1}
+	}
+	signature, err := s.key.Sign(rand.Reader, sha1Digest, signerOpts)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return signature, nil
+}
+
+func parsePrivateKey(keyFileContent []byte, passphrase PassphraseFunc) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyFileContent)
+	if block == nil {
+		return nil, errNoPemBlock
+	}
+
+	getPassphrase := func() ([]byte, error) {
+		if passphrase == nil {
+			return nil, errNoPassphrase
+		}
+		p, err := passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("getting passphrase: %w", err)
+		}
+		if len(p) == 0 {
+			return nil, errNoPassphrase
+		}
+		return p, nil
+	}
+
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		p, err := getPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		der, err := decryptPKCS8(block.Bytes, p)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt private key PEM block: %w", err)
+		}
+		return parsePKCS8RSAKey(der)
+	case "PRIVATE KEY":
+		return parsePKCS8RSAKey(block.Bytes)
+	}
+
+	blockData := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
+		p, err := getPassphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		blockData, err = x509.DecryptPEMBlock(block, p) //nolint:staticcheck
+		if err != nil {
+			return nil, fmt.Errorf("decrypt private key PEM block: %w", err)
+		}
+	}
+
+	priv, err := x509.ParsePKCS1PrivateKey(blockData)
+	if err != nil {
+		return nil, fmt.Errorf("parse PKCS1 private key: %w", err)
+	}
+	return priv, nil
+}
+
+func parsePKCS8RSAKey(der []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse PKCS8 private key: %w", err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errNoRSAKey
+	}
+	return priv, nil
+}
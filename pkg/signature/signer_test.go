@@ -0,0 +1,106 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signature
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewKeySigner(t *testing.T) {
+	pub, err := os.ReadFile("testdata/test.rsa.pub")
+	require.NoError(t, err)
+	digest, err := HashData([]byte("hello world"))
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name       string
+		keyFile    string
+		passphrase PassphraseFunc
+		err        error
+	}{
+		{name: "pkcs8", keyFile: "testdata/test.rsa"},
+		{name: "encrypted pkcs8", keyFile: "testdata/test-pkcs8-encrypted.rsa", passphrase: StaticPassphrase("secret")},
+		{name: "encrypted pkcs1", keyFile: "testdata/test-pkcs1-encrypted.rsa", passphrase: StaticPassphrase("secret")},
+		{name: "no passphrase", keyFile: "testdata/test-pkcs8-encrypted.rsa", err: errNoPassphrase},
+		{name: "wrong passphrase", keyFile: "testdata/test-pkcs8-encrypted.rsa", passphrase: StaticPassphrase("wrong"), err: errDecrypt},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []SignerOption
+			if tt.passphrase != nil {
+				opts = append(opts, WithPassphrase(tt.passphrase))
+			}
+			signer, err := NewKeySigner(tt.keyFile, opts...)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+
+			sig, err := signer.SignSHA1Digest(digest)
+			require.NoError(t, err)
+			require.NoError(t, RSAVerifySHA1Digest(digest, sig, pub))
+		})
+	}
+
+	t.Run("passphrase only asked for encrypted keys", func(t *testing.T) {
+		_, err := NewKeySigner("testdata/test.rsa", WithPassphrase(func() ([]byte, error) {
+			return nil, errors.New("should not be called")
+		}))
+		require.NoError(t, err)
+	})
+
+	t.Run("env passphrase", func(t *testing.T) {
+		t.Setenv("TEST_SIGNING_PASSPHRASE", "secret")
+		_, err := NewKeySigner("testdata/test-pkcs8-encrypted.rsa", WithPassphrase(EnvPassphrase("TEST_SIGNING_PASSPHRASE")))
+		require.NoError(t, err)
+	})
+}
+
+func TestSchemes(t *testing.T) {
+	pub, err := os.ReadFile("testdata/test.rsa.pub")
+	require.NoError(t, err)
+	digest, err := HashData([]byte("hello world"))
+	require.NoError(t, err)
+
+	for _, scheme := range []Scheme{SchemePKCS1v15, SchemePSS} {
+		t.Run(scheme.String(), func(t *testing.T) {
+			signer, err := NewKeySigner("testdata/test.rsa", WithScheme(scheme))
+			require.NoError(t, err)
+			sig, err := signer.SignSHA1Digest(digest)
+			require.NoError(t, err)
+			require.NoError(t, RSAVerifySHA1DigestWithScheme(digest, sig, pub, scheme))
+
+			other := SchemePSS
+			if scheme == SchemePSS {
+				other = SchemePKCS1v15
+			}
+			require.Error(t, RSAVerifySHA1DigestWithScheme(digest, sig, pub, other))
+
+			keyName, parsed, ok := ParseSignatureName(signer.SignatureName())
+			require.True(t, ok)
+			require.Equal(t, "test.rsa.pub", keyName)
+			require.Equal(t, scheme, parsed)
+		})
+	}
+
+	_, err = NewKeySigner("testdata/test.rsa", WithScheme(Scheme(42)))
+	require.Error(t, err)
+	_, _, ok := ParseSignatureName(".SIGN.DSA.test.rsa.pub")
+	require.False(t, ok)
+}
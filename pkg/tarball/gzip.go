@@ -0,0 +1,43 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipOSUnknown is the OS of the gzip header for an unknown filesystem, as RFC 1952 has it.
+const gzipOSUnknown = 255
+
+// NewGzipWriter returns a gzip writer to w whose stream only depends on what is written to it, so that
+// the same contents always result in the same bytes: its header has no name, comment or modification
+// time, its OS is unknown rather than that of the host, and it compresses at the default level.
+func NewGzipWriter(w io.Writer) *gzip.Writer {
+	zw, _ := NewGzipWriterLevel(w, gzip.DefaultCompression)
+	return zw
+}
+
+// NewGzipWriterLevel is NewGzipWriter, compressing at level instead, which is one of the levels of
+// compress/gzip, from gzip.HuffmanOnly to gzip.BestCompression.
+func NewGzipWriterLevel(w io.Writer, level int) (*gzip.Writer, error) {
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip compression level %d", level)
+	}
+	zw.Header = gzip.Header{OS: gzipOSUnknown}
+	return zw, nil
+}
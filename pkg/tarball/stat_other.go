@@ -0,0 +1,31 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package tarball
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// hasHardlinks reports no hardlinks, as the number of links of a file is not known on this OS.
+func hasHardlinks(fs.FileInfo) bool {
+	return false
+}
+
+func getInodeFromFileInfo(fs.FileInfo) (uint64, error) {
+	return 0, fmt.Errorf("unable to stat underlying file")
+}
@@ -16,9 +16,21 @@ package tarball
 
 import (
 	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// ErrSkipEntry is returned by an EntryFunc to leave the entry out of the tarball.
+var ErrSkipEntry = errors.New("skip entry")
+
+// EntryFunc is called with the header of each entry just before it is written, after every other
+// override in the Context has been applied. It can change the header in place, e.g. its owner, mode,
+// times or PAX records, return ErrSkipEntry to leave the entry out, or return any other error to
+// stop writing. Skipping a directory does not skip what is in it.
+type EntryFunc func(header *tar.Header) error
+
 type Context struct {
 	SourceDateEpoch time.Time
 	OverrideUIDGID  bool
@@ -31,6 +43,9 @@ type Context struct {
 	remapUIDs       map[int]int
 	remapGIDs       map[int]int
 	overridePerms   map[string]tar.Header
+	entryFunc       EntryFunc
+	// compressionLevel is the gzip level of WriteTargz, or nil for the default one.
+	compressionLevel *int
 }
 
 type Option func(*Context) error
@@ -128,3 +143,23 @@ func WithUseChecksums(useChecksums bool) Option {
 		return nil
 	}
 }
+
+// WithEntryFunc sets a function that can rewrite or skip each entry as it is written.
+func WithEntryFunc(fn EntryFunc) Option {
+	return func(ctx *Context) error {
+		ctx.entryFunc = fn
+		return nil
+	}
+}
+
+// WithCompressionLevel sets the gzip level WriteTargz compresses at, from gzip.HuffmanOnly to
+// gzip.BestCompression, trading the time it takes for the size of the tarball.
+func WithCompressionLevel(level int) Option {
+	return func(ctx *Context) error {
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return fmt.Errorf("invalid gzip compression level %d", level)
+		}
+		ctx.compressionLevel = &level
+		return nil
+	}
+}
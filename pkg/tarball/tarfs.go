@@ -0,0 +1,208 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tarball
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
+)
+
+// tarFSOf returns the tar index behind fsys, if it is one we can copy entries from directly,
+// or nil if fsys has to be walked.
+func tarFSOf(fsys fs.FS) (*tarfs.FS, error) {
+	switch f := fsys.(type) {
+	case *tarfs.FS:
+		return f, nil
+	case interface{ TarFS() (*tarfs.FS, error) }:
+		return f.TarFS()
+	}
+	return nil, nil
+}
+
+// writeTarFromTarFS is the fast path of writeTar for a source that already is a tar, such as an
+// expanded package. The entries are written in the order the walk would write them, with the headers the
+// source tar has and the contents copied straight from it, rather than walking and stat'ing the fs.FS.
+// As in the walk, the first of the regular file and the hardlinks to it that is written has its contents,
+// and the others are hardlinks to that one, so a link is never written to a file that is not.
+func (c *Context) writeTarFromTarFS(ctx context.Context, tw *tar.Writer, tfs *tarfs.FS, users, groups map[int]string) error {
+	buf := make([]byte, 1<<20)
+
+	entries := slices.Clone(tfs.Entries())
+	byName := make(map[string]*tarfs.Entry, len(entries))
+	for _, e := range entries {
+		byName[entryName(e.Header.Name)] = e
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return walkLess(entryName(entries[i].Header.Name), entryName(entries[j].Header.Name))
+	})
+	// the name each regular file, by its name in the source tar, was written with its contents as
+	written := map[string]string{}
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		header := e.Header
+		header.Name = strings.TrimSuffix(header.Name, "/")
+		// skip the root path, superfluous
+		if path.Clean(header.Name) == "." {
+			continue
+		}
+		target, regular := linkTarget(byName, e)
+		if regular {
+			// all of the names of a file share its header, as they do on a filesystem
+			header = target.Header
+			header.Name = strings.TrimSuffix(e.Header.Name, "/")
+			if first, ok := written[target.Header.Name]; ok {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first, 0
+			}
+		}
+		header.PAXRecords = maps.Clone(header.PAXRecords)
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		// the walk never writes these, so neither do we
+		header.Format = tar.FormatUnknown
+		header.Xattrs = nil //nolint:staticcheck
+
+		c.overrideHeader(&header, users, groups)
+
+		if c.UseChecksums {
+			if err := checksumEntry(tfs, &header, buf); err != nil {
+				return err
+			}
+		}
+
+		if c.entryFunc != nil {
+			if err := c.entryFunc(&header); errors.Is(err, ErrSkipEntry) {
+				// the next name of the same file has to carry its contents instead
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if err := tw.WriteHeader(&header); err != nil {
+			return err
+		}
+		if regular && header.Typeflag == tar.TypeReg {
+			written[target.Header.Name] = header.Name
+		}
+
+		if header.Typeflag == tar.TypeReg && header.Size > 0 {
+			data, err := tfs.Open(e.Header.Name)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyBuffer(tw, data, buf)
+			data.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// entryName is the name of an entry of a tar, as the walk has it.
+func entryName(name string) string {
+	return path.Clean(strings.TrimSuffix(name, "/"))
+}
+
+// linkTarget returns the regular file that e is, itself or by the hardlinks to it, and whether e is a regular
+// file or a hardlink to one in the tar.
+func linkTarget(byName map[string]*tarfs.Entry, e *tarfs.Entry) (*tarfs.Entry, bool) {
+	for hops := 0; hops <= len(byName); hops++ {
+		switch e.Header.Typeflag {
+		case tar.TypeReg:
+			return e, true
+		case tar.TypeLink:
+			// hardlink names are relative to the root of the archive
+			next, ok := byName[entryName(strings.TrimPrefix(e.Header.Linkname, "/"))]
+			if !ok {
+				return nil, false
+			}
+			e = next
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// walkLess reports whether the walk of a filesystem visits a before b: by the names of their elements,
+// so that a directory comes before all of its contents, and a/b before a-b.
+func walkLess(a, b string) bool {
+	for {
+		ai, bi := strings.IndexByte(a, '/'), strings.IndexByte(b, '/')
+		ae, be := a, b
+		if ai >= 0 {
+			ae = a[:ai]
+		}
+		if bi >= 0 {
+			be = b[:bi]
+		}
+		if ae != be {
+			return ae < be
+		}
+		if ai < 0 || bi < 0 {
+			// one is the other or a directory it is in
+			return ai < 0 && bi >= 0
+		}
+		a, b = a[ai+1:], b[bi+1:]
+	}
+}
+
+// checksumEntry sets the APK-TOOLS.checksum.SHA1 PAX record of header the same way the walk does,
+// keeping the one from the source tar when it has one.
+func checksumEntry(tfs *tarfs.FS, header *tar.Header, buf []byte) error {
+	const key = "APK-TOOLS.checksum.SHA1"
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		linkDigest := sha1.Sum([]byte(header.Linkname)) //nolint:gosec
+		header.PAXRecords[key] = hex.EncodeToString(linkDigest[:])
+	case tar.TypeReg, tar.TypeLink:
+		if _, ok := header.PAXRecords[key]; ok {
+			return nil
+		}
+		data, err := tfs.Open(header.Name)
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+
+		fileDigest := sha1.New() //nolint:gosec
+		if _, err := io.CopyBuffer(fileDigest, data, buf); err != nil {
+			return err
+		}
+		header.PAXRecords[key] = hex.EncodeToString(fileDigest.Sum(nil))
+	}
+	return nil
+}
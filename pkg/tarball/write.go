@@ -20,14 +20,13 @@ import (
 	"context"
 	"crypto/sha1" //nolint:gosec
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
-	"syscall"
 
 	"go.opentelemetry.io/otel"
-	"golang.org/x/sys/unix"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/chainguard-dev/go-apk/pkg/passwd"
@@ -35,42 +34,56 @@ import (
 
 const xattrTarPAXRecordsPrefix = "SCHILY.xattr."
 
-func hasHardlinks(fi fs.FileInfo) bool {
-	if stat := fi.Sys(); stat != nil {
-		si, ok := stat.(*syscall.Stat_t)
-		if !ok {
-			return false
-		}
+// overrideHeader applies the timestamps, owners and permissions of the Context to header.
+func (c *Context) overrideHeader(header *tar.Header, users, groups map[int]string) {
+	// zero out timestamps for reproducibility
+	header.AccessTime = c.SourceDateEpoch
+	header.ModTime = c.SourceDateEpoch
+	header.ChangeTime = c.SourceDateEpoch
 
-		// if we don't have inodes, we just assume the filesystem
-		// does not support hardlinks
-		if si == nil {
-			return false
-		}
+	if uid, ok := c.remapUIDs[header.Uid]; ok {
+		header.Uid = uid
+	}
 
-		return si.Nlink > 1
+	if gid, ok := c.remapGIDs[header.Gid]; ok {
+		header.Gid = gid
 	}
 
-	return false
-}
+	if name, ok := users[header.Uid]; ok {
+		header.Uname = name
+	}
+	if name, ok := groups[header.Gid]; ok {
+		header.Gname = name
+	}
 
-func getInodeFromFileInfo(fi fs.FileInfo) (uint64, error) {
-	if stat := fi.Sys(); stat != nil {
-		si, ok := stat.(*syscall.Stat_t)
-		if !ok {
-			return 0, fmt.Errorf("unable to stat underlying file")
-		}
+	if c.OverrideUIDGID {
+		header.Uid = c.UID
+		header.Gid = c.GID
+	}
 
-		// if we don't have inodes, we just assume the filesystem
-		// does not support hardlinks
-		if si == nil {
-			return 0, fmt.Errorf("unable to stat underlying file")
-		}
+	if c.OverrideUname != "" {
+		header.Uname = c.OverrideUname
+	}
 
-		return si.Ino, nil
+	if c.OverrideGname != "" {
+		header.Gname = c.OverrideGname
 	}
 
-	return 0, fmt.Errorf("unable to stat underlying file")
+	// look for the override perms with or without the leading /
+	if h, ok := c.overridePerms[header.Name]; ok {
+		header.Mode = h.Mode
+		header.Uid = h.Uid
+		header.Gid = h.Gid
+		header.Uname = h.Uname
+		header.Gname = h.Gname
+	}
+	if h, ok := c.overridePerms["/"+header.Name]; ok {
+		header.Mode = h.Mode
+		header.Uid = h.Uid
+		header.Gid = h.Gid
+		header.Uname = h.Uname
+		header.Gname = h.Gname
+	}
 }
 
 func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, users, groups map[int]string) error { //nolint:gocyclo
@@ -86,6 +99,12 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 		c.overridePerms = map[string]tar.Header{}
 	}
 
+	if tfs, err := tarFSOf(fsys); err != nil {
+		return err
+	} else if tfs != nil {
+		return c.writeTarFromTarFS(ctx, tw, tfs, users, groups)
+	}
+
 	buf := make([]byte, 1<<20)
 
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
@@ -132,8 +151,8 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			if err != nil {
 				return err
 			}
-			major = unix.Major(uint64(dev))
-			minor = unix.Minor(uint64(dev))
+			major = apkfs.Major(dev)
+			minor = apkfs.Minor(dev)
 		}
 
 		header, err := tar.FileInfoHeader(info, link)
@@ -148,58 +167,12 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 		// work around some weirdness, without this we wind up with just the basename
 		header.Name = path
 
-		// zero out timestamps for reproducibility
-		header.AccessTime = c.SourceDateEpoch
-		header.ModTime = c.SourceDateEpoch
-		header.ChangeTime = c.SourceDateEpoch
-
-		if uid, ok := c.remapUIDs[header.Uid]; ok {
-			header.Uid = uid
-		}
-
-		if gid, ok := c.remapGIDs[header.Gid]; ok {
-			header.Gid = gid
-		}
-
-		if name, ok := users[header.Uid]; ok {
-			header.Uname = name
-		}
-		if name, ok := groups[header.Gid]; ok {
-			header.Gname = name
-		}
-
-		if c.OverrideUIDGID {
-			header.Uid = c.UID
-			header.Gid = c.GID
-		}
-
-		if c.OverrideUname != "" {
-			header.Uname = c.OverrideUname
-		}
-
-		if c.OverrideGname != "" {
-			header.Gname = c.OverrideGname
-		}
-
-		// look for the override perms with or without the leading /
-		if h, ok := c.overridePerms[header.Name]; ok {
-			header.Mode = h.Mode
-			header.Uid = h.Uid
-			header.Gid = h.Gid
-			header.Uname = h.Uname
-			header.Gname = h.Gname
-		}
-		if h, ok := c.overridePerms["/"+header.Name]; ok {
-			header.Mode = h.Mode
-			header.Uid = h.Uid
-			header.Gid = h.Gid
-			header.Uname = h.Uname
-			header.Gname = h.Gname
-		}
+		c.overrideHeader(header, users, groups)
 
 		if link != "" {
 			header.Typeflag = tar.TypeSymlink
 		}
+		var firstLink *uint64
 		if !info.IsDir() && hasHardlinks(info) {
 			inode, err := getInodeFromFileInfo(info)
 			if err != nil {
@@ -212,6 +185,7 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 				header.Size = 0
 			} else {
 				seenFiles[inode] = header.Name
+				firstLink = &inode
 			}
 		}
 
@@ -254,6 +228,18 @@ func (c *Context) writeTar(ctx context.Context, tw *tar.Writer, fsys fs.FS, user
 			}
 		}
 
+		if c.entryFunc != nil {
+			if err := c.entryFunc(header); errors.Is(err, ErrSkipEntry) {
+				// the next link to the same file has to carry its contents instead
+				if firstLink != nil {
+					delete(seenFiles, *firstLink)
+				}
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+
 		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
@@ -297,7 +283,14 @@ func (c *Context) WriteTargz(ctx context.Context, dst io.Writer, src fs.FS, user
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "WriteTargz")
 	defer span.End()
 
-	gzw := gzip.NewWriter(dst)
+	level := gzip.DefaultCompression
+	if c.compressionLevel != nil {
+		level = *c.compressionLevel
+	}
+	gzw, err := NewGzipWriterLevel(dst, level)
+	if err != nil {
+		return err
+	}
 	defer gzw.Close()
 
 	return c.WriteTar(ctx, gzw, src, userinfofs)
@@ -308,6 +301,8 @@ func (c *Context) WriteTargz(ctx context.Context, dst io.Writer, src fs.FS, user
 // If you need to get multiple filesystems, merge them prior to calling WriteArchive.
 // userinfosrc should be a fs which can provide an optionally provide an etc/passwd and etc/group file.
 // The etc/passwd and etc/group file provide username and group name mappings for the tar.
+// If src is backed by a tar, such as an fs.APKFS, its entries are copied from the tar directly,
+// in the order of the tar, instead of walking src.
 func (c *Context) WriteTar(ctx context.Context, dst io.Writer, src fs.FS, userinfosrc fs.FS) error {
 	ctx, span := otel.Tracer("go-apk").Start(ctx, "WriteTar")
 	defer span.End()
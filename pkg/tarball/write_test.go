@@ -3,9 +3,13 @@ package tarball
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"io"
 	"testing"
 
+	"github.com/chainguard-dev/go-apk/internal/tarfs"
 	"github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/stretchr/testify/require"
 )
@@ -46,3 +50,223 @@ func TestWriteTar(t *testing.T) {
 	require.Equal(t, file, hdr.Name, "tar file header name mismatch")
 	require.Equal(t, "bar", hdr.PAXRecords[xattrTarPAXRecordsPrefix+"user.file"], "tar header for file xattr mismatch")
 }
+
+func TestWriteTarEntryFunc(t *testing.T) {
+	m := fs.NewMemFS()
+	require.NoError(t, m.MkdirAll("a", 0o755))
+	require.NoError(t, m.WriteFile("a/keep", []byte("hello world"), 0o600))
+	require.NoError(t, m.WriteFile("a/skip", []byte("skipped"), 0o644))
+
+	ctx, err := NewContext(WithEntryFunc(func(header *tar.Header) error {
+		if header.Name == "a/skip" {
+			return ErrSkipEntry
+		}
+		header.Uid, header.Gid = 0, 0
+		header.Mode |= 0o044
+		header.PAXRecords["user.test"] = "set"
+		return nil
+	}))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, ctx.writeTar(context.TODO(), tw, m, nil, nil))
+	require.NoError(t, tw.Close())
+
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		require.Equal(t, "set", hdr.PAXRecords["user.test"], "PAX record not set for %s", hdr.Name)
+		if hdr.Name == "a/keep" {
+			require.Equal(t, int64(0o644), hdr.Mode)
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			require.Equal(t, "hello world", string(data))
+		}
+	}
+	require.Equal(t, []string{"a", "a/keep"}, names)
+
+	t.Run("error", func(t *testing.T) {
+		want := errors.New("stop")
+		ctx, err := NewContext(WithEntryFunc(func(*tar.Header) error { return want }))
+		require.NoError(t, err)
+		err = ctx.writeTar(context.TODO(), tar.NewWriter(io.Discard), m, nil, nil)
+		require.ErrorIs(t, err, want)
+	})
+}
+
+func TestWriteTarFromTarFS(t *testing.T) {
+	var src bytes.Buffer
+	tw := tar.NewWriter(&src)
+	for _, hdr := range []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0o755, Uid: 1000},
+		{Name: "a/b", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1000, Size: int64(len("hello world")), PAXRecords: map[string]string{xattrTarPAXRecordsPrefix + "user.file": "bar"}},
+		{Name: "a/c", Typeflag: tar.TypeLink, Linkname: "a/b", Uid: 1000},
+		{Name: "a/d", Typeflag: tar.TypeSymlink, Linkname: "b", Mode: 0o777, Uid: 1000},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("hello world"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	tfs, err := tarfs.New(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	require.NoError(t, err)
+
+	ctx, err := NewContext(WithOverrideUIDGID(0, 0), WithUseChecksums(true))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	tw = tar.NewWriter(&buf)
+	require.NoError(t, ctx.writeTar(context.TODO(), tw, tfs, nil, nil))
+	require.NoError(t, tw.Close())
+
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		require.Equal(t, 0, hdr.Uid, "uid not overridden for %s", hdr.Name)
+		switch hdr.Name {
+		case "a/b":
+			require.Equal(t, "bar", hdr.PAXRecords[xattrTarPAXRecordsPrefix+"user.file"])
+			require.Equal(t, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", hdr.PAXRecords["APK-TOOLS.checksum.SHA1"])
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			require.Equal(t, "hello world", string(data))
+		case "a/c":
+			require.Equal(t, byte(tar.TypeLink), hdr.Typeflag)
+			require.Equal(t, "a/b", hdr.Linkname)
+			require.Equal(t, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", hdr.PAXRecords["APK-TOOLS.checksum.SHA1"])
+		case "a/d":
+			require.Equal(t, byte(tar.TypeSymlink), hdr.Typeflag)
+			require.Equal(t, "b", hdr.Linkname)
+		}
+	}
+	require.Equal(t, []string{"a", "a/b", "a/c", "a/d"}, names)
+}
+
+func TestWriteTargzReproducible(t *testing.T) {
+	m := fs.NewMemFS()
+	require.NoError(t, m.MkdirAll("a", 0o755))
+	require.NoError(t, m.WriteFile("a/b", []byte("hello world"), 0o644))
+
+	ctx, err := NewContext()
+	require.NoError(t, err)
+	var first, second bytes.Buffer
+	require.NoError(t, ctx.WriteTargz(context.TODO(), &first, m, m))
+	require.NoError(t, ctx.WriteTargz(context.TODO(), &second, m, m))
+	require.Equal(t, first.Bytes(), second.Bytes())
+
+	// the modification time and OS of the gzip header, as RFC 1952 lays it out
+	b := first.Bytes()
+	require.Equal(t, []byte{0, 0, 0, 0}, b[4:8], "gzip header has a modification time")
+	require.Equal(t, byte(gzipOSUnknown), b[9], "gzip header has an OS")
+}
+
+func TestWriteTargzCompressionLevel(t *testing.T) {
+	m := fs.NewMemFS()
+	require.NoError(t, m.WriteFile("a", bytes.Repeat([]byte("hello world "), 1000), 0o644))
+
+	sizes := map[int]int{}
+	for _, level := range []int{gzip.NoCompression, gzip.BestCompression} {
+		ctx, err := NewContext(WithCompressionLevel(level))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, ctx.WriteTargz(context.TODO(), &buf, m, m))
+		sizes[level] = buf.Len()
+	}
+	require.Less(t, sizes[gzip.BestCompression], sizes[gzip.NoCompression])
+
+	_, err := NewContext(WithCompressionLevel(10))
+	require.Error(t, err)
+	_, err = NewGzipWriterLevel(io.Discard, -3)
+	require.Error(t, err)
+}
+
+func TestWriteTarFromTarFSOrder(t *testing.T) {
+	var src bytes.Buffer
+	tw := tar.NewWriter(&src)
+	for _, hdr := range []*tar.Header{
+		{Name: "b/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "b/x", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len("hello world"))},
+		{Name: "a-b", Typeflag: tar.TypeSymlink, Linkname: "b/x", Mode: 0o777},
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "a/link", Typeflag: tar.TypeLink, Linkname: "b/x"},
+		{Name: "c", Typeflag: tar.TypeLink, Linkname: "a/link"},
+	} {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("hello world"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	tfs, err := tarfs.New(bytes.NewReader(src.Bytes()), int64(src.Len()))
+	require.NoError(t, err)
+
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+		data     string
+	}
+	write := func(t *testing.T, skip string) []entry {
+		ctx, err := NewContext(WithEntryFunc(func(header *tar.Header) error {
+			if header.Name == skip {
+				return ErrSkipEntry
+			}
+			return nil
+		}))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, ctx.writeTar(context.TODO(), tw, tfs, nil, nil))
+		require.NoError(t, tw.Close())
+
+		var entries []entry
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			entries = append(entries, entry{hdr.Name, hdr.Typeflag, hdr.Linkname, string(data)})
+		}
+		return entries
+	}
+
+	// as the walk, the first name of the file has its contents, and the others link to it
+	require.Equal(t, []entry{
+		{"a", tar.TypeDir, "", ""},
+		{"a/link", tar.TypeReg, "", "hello world"},
+		{"a-b", tar.TypeSymlink, "b/x", ""},
+		{"b", tar.TypeDir, "", ""},
+		{"b/x", tar.TypeLink, "a/link", ""},
+		{"c", tar.TypeLink, "a/link", ""},
+	}, write(t, ""))
+
+	// a link is never written to a name that is skipped
+	require.Equal(t, []entry{
+		{"a", tar.TypeDir, "", ""},
+		{"a-b", tar.TypeSymlink, "b/x", ""},
+		{"b", tar.TypeDir, "", ""},
+		{"b/x", tar.TypeReg, "", "hello world"},
+		{"c", tar.TypeLink, "b/x", ""},
+	}, write(t, "a/link"))
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import "fmt"
+
+// The tokens of a version, as apk-tools has them, in the order that decides which of two versions that differ
+// in the type of a token is greater.
+const (
+	tokenInvalid = iota - 1
+	tokenDigitOrZero
+	tokenDigit
+	tokenLetter
+	tokenSuffix
+	tokenSuffixNumber
+	tokenRevisionNumber
+	tokenEnd
+)
+
+var (
+	preSuffixes  = []string{"alpha", "beta", "pre", "rc"}
+	postSuffixes = []string{"cvs", "svn", "git", "hg", "p"}
+)
+
+// tokenizer reads the tokens of a version as get_token and next_token of apk-tools do, see
+// https://github.com/alpinelinux/apk-tools/blob/50ab589e9a5a84592ee4c0ac5a49506bb6c552fc/src/version.c
+type tokenizer struct {
+	s   string
+	typ int
+}
+
+// next returns the value of the token of the type the tokenizer is at, and moves to the type of the next.
+func (t *tokenizer) next() int {
+	if len(t.s) == 0 {
+		t.typ = tokenEnd
+		return 0
+	}
+	v, i, nt := 0, 0, tokenInvalid
+	switch t.typ {
+	case tokenDigitOrZero:
+		// leading zeros are a token of their own, less the more there are
+		if t.s[0] == '0' {
+			for i < len(t.s) && t.s[i] == '0' {
+				i++
+			}
+			nt, v = tokenDigit, -i
+			break
+		}
+		fallthrough
+	case tokenDigit, tokenSuffixNumber, tokenRevisionNumber:
+		for i < len(t.s) && isDigit(t.s[i]) {
+			v = v*10 + int(t.s[i]-'0')
+			i++
+		}
+	case tokenLetter:
+		v = int(t.s[0])
+		i++
+	case tokenSuffix:
+		v, i = suffixToken(t.s)
+		if i == 0 {
+			t.typ = tokenInvalid
+			return -1
+		}
+	default:
+		t.typ = tokenInvalid
+		return -1
+	}
+	t.s = t.s[i:]
+	switch {
+	case len(t.s) == 0:
+		t.typ = tokenEnd
+	case nt != tokenInvalid:
+		t.typ = nt
+	default:
+		t.nextType()
+	}
+	return v
+}
+
+// suffixToken returns the value of the suffix s starts with, negative for the pre-release ones, and its
+// length, or 0 if s does not start with a suffix.
+func suffixToken(s string) (value int, length int) {
+	for i, suffix := range preSuffixes {
+		if len(suffix) <= len(s) && s[:len(suffix)] == suffix {
+			return i - len(preSuffixes), len(suffix)
+		}
+	}
+	for i, suffix := range postSuffixes {
+		if len(suffix) <= len(s) && s[:len(suffix)] == suffix {
+			return i, len(suffix)
+		}
+	}
+	return 0, 0
+}
+
+// nextType moves past the separator of the next token, if it has one, to the type of the next token.
+func (t *tokenizer) nextType() {
+	n := tokenInvalid
+	switch {
+	case len(t.s) == 0 || t.s[0] == 0:
+		n = tokenEnd
+	case (t.typ == tokenDigit || t.typ == tokenDigitOrZero) && isLower(t.s[0]):
+		n = tokenLetter
+	case t.typ == tokenLetter && isDigit(t.s[0]):
+		n = tokenDigit
+	case t.typ == tokenSuffix && isDigit(t.s[0]):
+		n = tokenSuffixNumber
+	default:
+		switch t.s[0] {
+		case '.':
+			n = tokenDigitOrZero
+		case '_':
+			n = tokenSuffix
+		case '-':
+			if len(t.s) > 1 && t.s[1] == 'r' {
+				n = tokenRevisionNumber
+				t.s = t.s[1:]
+			}
+		}
+		t.s = t.s[1:]
+	}
+	// tokens only come in the order of their types, except for these
+	if n < t.typ && !(n == tokenDigitOrZero && t.typ == tokenDigit) &&
+		!(n == tokenSuffix && t.typ == tokenSuffixNumber) && !(n == tokenDigit && t.typ == tokenLetter) {
+		n = tokenInvalid
+	}
+	t.typ = n
+}
+
+// ValidAPKTools returns whether apk-tools considers version valid, as apk_version_validate does. It accepts
+// some versions that Parse does not, such as 1.2a3, 1. and 1-r.
+func ValidAPKTools(version string) bool {
+	t := &tokenizer{s: version, typ: tokenDigit}
+	for t.typ != tokenEnd && t.typ != tokenInvalid {
+		t.next()
+	}
+	return t.typ == tokenEnd
+}
+
+// CompareAPKTools compares versions as apk_version_compare of apk-tools does, token by token, returning 1 if
+// actual is greater than required, -1 if it is less, and 0 if they are equal. Unlike Compare, it compares
+// any strings, including versions that are not valid, as apk-tools does: only the tokens up to the first that
+// is not valid are compared.
+func CompareAPKTools(actual, required string) int {
+	return compareTokens(actual, required, false)
+}
+
+// compareTokens compares versions as CompareAPKTools does, and if fuzzy, a version that starts with the tokens
+// of required is equal to it, as for the ~ constraint.
+func compareTokens(actual, required string, fuzzy bool) int {
+	a, b := &tokenizer{s: actual, typ: tokenDigit}, &tokenizer{s: required, typ: tokenDigit}
+	av, bv := 0, 0
+	for a.typ == b.typ && a.typ != tokenEnd && a.typ != tokenInvalid && av == bv {
+		av, bv = a.next(), b.next()
+	}
+	if av < bv {
+		return less
+	}
+	if av > bv {
+		return greater
+	}
+	if a.typ == b.typ || (fuzzy && b.typ == tokenEnd) {
+		return equal
+	}
+	// the tokens so far are equal, so the one that goes on is greater, unless it goes on with a pre-release
+	if a.typ == tokenSuffix && (&tokenizer{s: a.s, typ: a.typ}).next() < 0 {
+		return less
+	}
+	if b.typ == tokenSuffix && (&tokenizer{s: b.s, typ: b.typ}).next() < 0 {
+		return greater
+	}
+	if a.typ > b.typ {
+		return less
+	}
+	if b.typ > a.typ {
+		return greater
+	}
+	return equal
+}
+
+// ParseAPKTools parses version as apk-tools does, accepting any version that ValidAPKTools does. Versions that
+// it parses are compared, by Compare, FuzzyEquals and the constraints, as CompareAPKTools compares them, with
+// each other and with those that Parse parses, so that the order of versions is exactly that of apk-tools.
+func ParseAPKTools(version string) (Version, error) {
+	if version == "" || !ValidAPKTools(version) {
+		return Version{}, fmt.Errorf("invalid version %s, could not parse", version)
+	}
+	// what Parse has of it, for FuzzyEquals at a depth, if Parse parses it at all
+	v, _ := Parse(version)
+	v.apkTools = version
+	return v, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidAPKTools(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		valid   bool
+	}{
+		{"1.2.3_rc1-r2", true},
+		{"6b", true},
+		{"021109", true},
+		{"1.2a3", true},
+		{"1.2a3b", true},
+		{"1.", true},
+		{"1-r", true},
+		{"1.0_alpha_pre2", true},
+		{"1aa", false},
+		{"1a.2", false},
+		{"1-r1.2", false},
+		{"1_illegal", false},
+		{"1_palpha", false},
+		{"1-x", false},
+		{"a.1", false},
+	} {
+		require.Equal(t, tt.valid, ValidAPKTools(tt.version), tt.version)
+		if !tt.valid {
+			_, err := ParseAPKTools(tt.version)
+			require.Error(t, err, tt.version)
+		}
+	}
+
+	t.Run("accepts what Parse does", func(t *testing.T) {
+		for _, v := range testVersions {
+			if _, err := Parse(v); err == nil {
+				require.True(t, ValidAPKTools(v), v)
+			}
+		}
+	})
+}
+
+func TestCompareAPKTools(t *testing.T) {
+	for _, tt := range []struct {
+		versionA string
+		expected int
+		versionB string
+	}{
+		{"6b", greater, "6a"},
+		{"6b", greater, "6"},
+		{"021109", equal, "21109"},
+		{"1.2a3", greater, "1.2a2"},
+		{"1.2a3", greater, "1.2a"},
+		{"1.2a3", less, "1.2b"},
+		// an empty number is 0, and more than the 0 of a leading zero
+		{"1.", greater, "1.0"},
+		{"1.", greater, "1"},
+		{"1-r", equal, "1-r0"},
+		// only the tokens up to the first that is not valid are compared
+		{"1.2_foo", equal, "1.2_bar"},
+		{"1.2_foo", greater, "1.1"},
+		{"1.2-x", greater, "1.2-r0"},
+	} {
+		require.Equal(t, tt.expected, CompareAPKTools(tt.versionA, tt.versionB), "%s %d %s", tt.versionA, tt.expected, tt.versionB)
+		require.Equal(t, -tt.expected, CompareAPKTools(tt.versionB, tt.versionA), "%s %d %s", tt.versionB, -tt.expected, tt.versionA)
+	}
+}
+
+func TestParseAPKTools(t *testing.T) {
+	odd, err := ParseAPKTools("1.2a3")
+	require.NoError(t, err)
+	require.Equal(t, "1.2a3", odd.String())
+	strict, err := Parse("1.2b")
+	require.NoError(t, err)
+	compat, err := ParseAPKTools("1.2b")
+	require.NoError(t, err)
+
+	// either way, versions compare as apk-tools compares them
+	require.Equal(t, less, Compare(odd, strict))
+	require.Equal(t, greater, Compare(strict, odd))
+	require.True(t, strict.Equal(compat))
+	require.True(t, GreaterEqual.Satisfies(compat, strict))
+	require.False(t, Greater.Satisfies(odd, strict))
+
+	within, err := ParseAPKTools("1.2a3-r1")
+	require.NoError(t, err)
+	prefix, err := ParseAPKTools("1.2a")
+	require.NoError(t, err)
+	require.True(t, within.FuzzyEquals(prefix, 0))
+	require.False(t, prefix.FuzzyEquals(within, 0))
+	require.True(t, Tilde.Satisfies(within, prefix))
+
+	_, err = ParseAPKTools("")
+	require.Error(t, err)
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Operator is how a version constraint compares versions, as in the dependencies of a package,
+// e.g. the >= of so:libc.musl-x86_64.so.1>=1.2.
+type Operator int
+
+const (
+	// Any is satisfied by any version.
+	Any Operator = iota
+	// Equal is satisfied by the same version, =.
+	Equal
+	// Greater is satisfied by a greater version, >.
+	Greater
+	// Less is satisfied by a lesser version, <.
+	Less
+	// GreaterEqual is satisfied by the same or a greater version, >=.
+	GreaterEqual
+	// LessEqual is satisfied by the same or a lesser version, <=.
+	LessEqual
+	// Tilde is satisfied by any version that starts with the version, ~, e.g. 1.4.2-r1 for ~1.4.
+	Tilde
+	// GreaterTilde is satisfied by a greater version, or any that starts with the version, >~.
+	GreaterTilde
+	// LessTilde is satisfied by a lesser version, or any that starts with the version, <~.
+	LessTilde
+	// Checksum is satisfied by the package with a checksum, ><, e.g. busybox><Q1D2v3b8Jeq5... for a package
+	// that was installed from a file, as apk-tools writes them to the world. It is not a constraint on a
+	// version, so Satisfies is never satisfied by one.
+	Checksum
+)
+
+var operators = map[string]Operator{
+	"=":  Equal,
+	">":  Greater,
+	"<":  Less,
+	">=": GreaterEqual,
+	"<=": LessEqual,
+	"~":  Tilde,
+	">~": GreaterTilde,
+	"<~": LessTilde,
+	"><": Checksum,
+}
+
+// ParseOperator returns the Operator for s, e.g. >=, and false if s is not an operator.
+func ParseOperator(s string) (Operator, bool) {
+	op, ok := operators[s]
+	return op, ok
+}
+
+func (o Operator) String() string {
+	for s, op := range operators {
+		if op == o {
+			return s
+		}
+	}
+	return ""
+}
+
+// Satisfies returns whether actual satisfies the constraint of o with required.
+func (o Operator) Satisfies(actual, required Version) bool {
+	switch o {
+	case Tilde:
+		return actual.FuzzyEquals(required, 0)
+	case Checksum:
+		return false
+	}
+	c := Compare(actual, required)
+	switch o {
+	case Any:
+		return true
+	case Equal:
+		return c == equal
+	case Greater:
+		return c == greater
+	case Less:
+		return c == less
+	case GreaterEqual:
+		return c == greater || c == equal
+	case LessEqual:
+		return c == less || c == equal
+	case GreaterTilde:
+		return c == greater || actual.FuzzyEquals(required, 0)
+	case LessTilde:
+		return c == less || actual.FuzzyEquals(required, 0)
+	default:
+		return false
+	}
+}
+
+// Constraint is a constraint on a version, such as >=1.2.3, ~1.4 or =1.0.0-r2.
+type Constraint struct {
+	Op      Operator
+	Version Version
+
+	// version as it was parsed, so that String returns it as is
+	version string
+}
+
+// ParseConstraint parses a constraint, an Operator followed by a version, e.g. >=1.2.3. A version
+// without an operator must be equal, and an empty constraint is satisfied by any version. The version
+// of a Checksum constraint is the checksum, which is not parsed.
+func ParseConstraint(s string) (Constraint, error) {
+	if s == "" {
+		return Constraint{Op: Any}, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return !strings.ContainsRune("=<>~", r) })
+	if i < 0 {
+		return Constraint{}, fmt.Errorf("invalid constraint %q, no version", s)
+	}
+	op := Equal
+	if i > 0 {
+		var ok bool
+		op, ok = ParseOperator(s[:i])
+		if !ok {
+			return Constraint{}, fmt.Errorf("invalid constraint %q, unknown operator %s", s, s[:i])
+		}
+	}
+	if op == Checksum {
+		return Constraint{Op: op, version: s[i:]}, nil
+	}
+	v, err := Parse(s[i:])
+	if err != nil {
+		return Constraint{}, fmt.Errorf("invalid constraint %q: %w", s, err)
+	}
+	return Constraint{Op: op, Version: v, version: s[i:]}, nil
+}
+
+// Satisfies returns whether v satisfies the constraint.
+func (c Constraint) Satisfies(v Version) bool {
+	return c.Op.Satisfies(v, c.Version)
+}
+
+func (c Constraint) String() string {
+	return c.Op.String() + c.version
+}
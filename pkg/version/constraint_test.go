@@ -0,0 +1,67 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint  string
+		op          Operator
+		satisfied   []string
+		unsatisfied []string
+	}{
+		{"", Any, []string{"0.1", "1.2.3-r0"}, nil},
+		{"=1.0.0-r2", Equal, []string{"1.0.0-r2"}, []string{"1.0.0-r1", "1.0.0", "1.0.1-r2"}},
+		{"1.0.0-r2", Equal, []string{"1.0.0-r2"}, []string{"1.0.0-r3"}},
+		{">1.2.3", Greater, []string{"1.2.3-r1", "1.3"}, []string{"1.2.3", "1.2.2"}},
+		{"<1.2.3", Less, []string{"1.2.2", "1.2.3_rc1"}, []string{"1.2.3", "1.2.3-r1"}},
+		{">=1.2.3", GreaterEqual, []string{"1.2.3", "2.0"}, []string{"1.2.2-r9"}},
+		{"<=1.2.3", LessEqual, []string{"1.2.3", "1.0"}, []string{"1.2.3-r1"}},
+		{"~1.4", Tilde, []string{"1.4", "1.4.2-r1"}, []string{"1.5", "1.3.9"}},
+		{">~1.4", GreaterTilde, []string{"1.4", "1.4.2-r1", "1.5"}, []string{"1.3.9"}},
+		{"<~1.4", LessTilde, []string{"1.4", "1.4.2-r1", "1.3.9"}, []string{"1.5"}},
+		{"><Q1D2v3b8Jeq5lMsUEDGp6ddvVi1Hs=", Checksum, nil, []string{"1.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			c, err := ParseConstraint(tt.constraint)
+			require.NoError(t, err)
+			require.Equal(t, tt.op, c.Op)
+			if tt.op != Any && tt.constraint[0] != '1' {
+				require.Equal(t, tt.constraint, c.String())
+			}
+			for _, s := range tt.satisfied {
+				v, err := Parse(s)
+				require.NoError(t, err)
+				require.True(t, c.Satisfies(v), "%s satisfies %s", s, tt.constraint)
+			}
+			for _, s := range tt.unsatisfied {
+				v, err := Parse(s)
+				require.NoError(t, err)
+				require.False(t, c.Satisfies(v), "%s does not satisfy %s", s, tt.constraint)
+			}
+		})
+	}
+
+	for _, invalid := range []string{">=", "=>1.0", "~~1", ">=1.a"} {
+		_, err := ParseConstraint(invalid)
+		require.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version parses and compares the versions of apk packages, and the version constraints
+// of their dependencies, as apk-tools does.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// suffixKind is the kind of a suffix of a version, such as _rc or _p. The pre-release suffixes are
+// negative, so that they sort before no suffix, and the others after it, as in apk-tools.
+type suffixKind int
+
+// the order of these matters!
+const (
+	suffixAlpha suffixKind = iota - 4
+	suffixBeta
+	suffixPre
+	suffixRC
+	suffixNone
+	suffixCVS
+	suffixSVN
+	suffixGit
+	suffixHG
+	suffixP
+)
+
+var suffixKinds = map[string]suffixKind{
+	"alpha": suffixAlpha,
+	"beta":  suffixBeta,
+	"pre":   suffixPre,
+	"rc":    suffixRC,
+	"cvs":   suffixCVS,
+	"svn":   suffixSVN,
+	"git":   suffixGit,
+	"hg":    suffixHG,
+	"p":     suffixP,
+}
+
+// suffix is a suffix of a version, e.g. _pre20230101 or _p2.
+type suffix struct {
+	kind   suffixKind
+	number int
+}
+
+// Version is a parsed apk package version.
+type Version struct {
+	numbers []int
+	// leading zeros of each number after the first, nil if none has any, e.g. 1 for the 09 of 4.09
+	zeros  []int
+	letter rune
+	// suffixes in the order of the version, e.g. _alpha and then _pre2 for 1.0_alpha_pre2
+	suffixes []suffix
+	revision int
+	// the version as ParseAPKTools parsed it, to compare as apk-tools does, or empty if Parse parsed it
+	apkTools string
+}
+
+// Parse parses a version string, such as 1.2.3_rc1-r2, into a Version. A version is numbers separated
+// by dots, an optional letter, any number of suffixes, such as _rc1 or _p2, and an optional revision.
+// see https://github.com/alpinelinux/apk-tools/blob/50ab589e9a5a84592ee4c0ac5a49506bb6c552fc/src/version.c#
+func Parse(version string) (Version, error) {
+	// a hand-written scanner, rather than a regex, because we parse the versions of every candidate
+	// package when resolving. parseRegex in the tests is the same as a regex, to check it against.
+	i := 0
+	digits := func() string {
+		start := i
+		for i < len(version) && isDigit(version[i]) {
+			i++
+		}
+		return version[start:i]
+	}
+	invalid := func() (Version, error) {
+		return Version{}, fmt.Errorf("invalid version %s, could not parse", version)
+	}
+
+	// get the first version number
+	first := digits()
+	if first == "" {
+		return invalid()
+	}
+	num, err := strconv.Atoi(first)
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %s, first part is not number: %w", version, err)
+	}
+	numbers := make([]int, 1, 4)
+	numbers[0] = num
+
+	// get any other version numbers
+	var zeros []int
+	for i < len(version) && version[i] == '.' {
+		i++
+		s := digits()
+		if s == "" {
+			return invalid()
+		}
+		num, err := strconv.Atoi(s)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %s, part %d is not number: %w", version, len(numbers), err)
+		}
+		numbers = append(numbers, num)
+		if z := len(s) - len(strings.TrimLeft(s, "0")); z > 0 || zeros != nil {
+			if zeros == nil {
+				zeros = make([]int, len(numbers)-1, cap(numbers))
+			}
+			zeros = append(zeros, z)
+		}
+	}
+
+	var letter rune
+	if i < len(version) && isLower(version[i]) {
+		letter = rune(version[i])
+		i++
+	}
+
+	var suffixes []suffix
+	for i < len(version) && version[i] == '_' {
+		i++
+		start := i
+		for i < len(version) && isLower(version[i]) {
+			i++
+		}
+		name := version[start:i]
+		kind, ok := suffixKinds[name]
+		if !ok {
+			return Version{}, fmt.Errorf("invalid version %s, suffix _%s is not valid", version, name)
+		}
+		var number int
+		if s := digits(); s != "" {
+			number, err = strconv.Atoi(s)
+			if err != nil {
+				return Version{}, fmt.Errorf("invalid version %s, suffix _%s number %s is not number: %w", version, name, s, err)
+			}
+		}
+		suffixes = append(suffixes, suffix{kind: kind, number: number})
+	}
+
+	var revision int
+	if strings.HasPrefix(version[i:], "-r") {
+		i += 2
+		s := digits()
+		if s == "" {
+			return invalid()
+		}
+		revision, err = strconv.Atoi(s)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version %s, revision %s is not number: %w", version, s, err)
+		}
+	}
+
+	if i != len(version) {
+		return invalid()
+	}
+	return Version{
+		numbers:  numbers,
+		zeros:    zeros,
+		letter:   letter,
+		suffixes: suffixes,
+		revision: revision,
+	}, nil
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isLower(c byte) bool { return 'a' <= c && c <= 'z' }
+
+const (
+	greater = 1
+	equal   = 0
+	less    = -1
+)
+
+// Compare compares versions based on https://dev.gentoo.org/~ulm/pms/head/pms.html#x1-250003.2, with the
+// rules of apk-tools for leading zeros and suffixes where they differ, returning 1 if actual is greater than
+// required, -1 if it is less, and 0 if they are equal.
+//
+// If either version was parsed by ParseAPKTools, they are compared as CompareAPKTools compares them instead.
+func Compare(actual, required Version) int {
+	if actual.apkTools != "" || required.apkTools != "" {
+		return CompareAPKTools(actual.String(), required.String())
+	}
+	for i := 0; i < len(actual.numbers) && i < len(required.numbers); i++ {
+		// As apk-tools does, a number with leading zeros, other than the first, is less than any
+		// without, and the more leading zeros the less it is, so 4.09 < 4.5 and 4.009 < 4.09.
+		// Only numbers with as many leading zeros are compared by value.
+		if actualZeros, requiredZeros := actual.leadingZeros(i), required.leadingZeros(i); actualZeros != requiredZeros {
+			if actualZeros < requiredZeros {
+				return greater
+			}
+			return less
+		}
+		if actual.numbers[i] > required.numbers[i] {
+			return greater
+		}
+		if actual.numbers[i] < required.numbers[i] {
+			return less
+		}
+	}
+	// if we made it here, the parts that were the same size are equal
+	if len(actual.numbers) > len(required.numbers) {
+		return greater
+	}
+	if len(actual.numbers) < len(required.numbers) {
+		return less
+	}
+	// same length of numbers, same numbers
+	// compare letters
+	if actual.letter > required.letter {
+		return greater
+	}
+	if actual.letter < required.letter {
+		return less
+	}
+	// same letters
+	// compare suffixes, one by one, as apk-tools does. Where one version has no more suffixes,
+	// its suffix is none, which sorts after the pre-release suffixes of the other, such as _rc,
+	// and before the others, such as _p, so 1.0_rc1 < 1.0 < 1.0_p1.
+	for i := 0; i < len(actual.suffixes) || i < len(required.suffixes); i++ {
+		actualSuffix, requiredSuffix := suffix{kind: suffixNone}, suffix{kind: suffixNone}
+		if i < len(actual.suffixes) {
+			actualSuffix = actual.suffixes[i]
+		}
+		if i < len(required.suffixes) {
+			requiredSuffix = required.suffixes[i]
+		}
+		if actualSuffix.kind > requiredSuffix.kind {
+			return greater
+		}
+		if actualSuffix.kind < requiredSuffix.kind {
+			return less
+		}
+		if actualSuffix.number > requiredSuffix.number {
+			return greater
+		}
+		if actualSuffix.number < requiredSuffix.number {
+			return less
+		}
+	}
+	// same suffixes
+	// compare revisions
+	if actual.revision > required.revision {
+		return greater
+	}
+	if actual.revision < required.revision {
+		return less
+	}
+	return equal
+}
+
+// Equal returns whether v and other are the same version, as Compare has them, e.g. 1.0-r0 and 1.0.
+func (v Version) Equal(other Version) bool {
+	return Compare(v, other) == equal
+}
+
+// String returns v as Parse parses it, in the canonical form of the versions that are equal to it, without
+// any leading zeros that Compare ignores, a zero revision, or the zero number of a suffix, so that 01.2_p0-r0
+// is 1.2_p. The zero Version is the empty string. A version that ParseAPKTools parsed is returned as is.
+func (v Version) String() string {
+	if v.apkTools != "" {
+		return v.apkTools
+	}
+	var b strings.Builder
+	for i, num := range v.numbers {
+		if i == 0 {
+			b.WriteString(strconv.Itoa(num))
+			continue
+		}
+		b.WriteByte('.')
+		b.WriteString(strings.Repeat("0", v.leadingZeros(i)))
+		// Parse counts the zeros of a 0 as all leading
+		if num != 0 || v.leadingZeros(i) == 0 {
+			b.WriteString(strconv.Itoa(num))
+		}
+	}
+	if v.letter != 0 {
+		b.WriteRune(v.letter)
+	}
+	for _, s := range v.suffixes {
+		b.WriteByte('_')
+		for name, kind := range suffixKinds {
+			if kind == s.kind {
+				b.WriteString(name)
+				break
+			}
+		}
+		if s.number != 0 {
+			b.WriteString(strconv.Itoa(s.number))
+		}
+	}
+	if v.revision != 0 {
+		b.WriteString("-r")
+		b.WriteString(strconv.Itoa(v.revision))
+	}
+	return b.String()
+}
+
+// MarshalText returns v as String does.
+func (v Version) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+// UnmarshalText parses text into v as Parse does, or as ParseAPKTools does if Parse cannot parse it, so that
+// what MarshalText returns for a version that ParseAPKTools parsed, such as 1.2a3, is parsed again. Empty text
+// is the zero Version, as MarshalText returns it.
+func (v *Version) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*v = Version{}
+		return nil
+	}
+	parsed, err := Parse(string(text))
+	if err != nil {
+		if parsed, err = ParseAPKTools(string(text)); err != nil {
+			return err
+		}
+	}
+	*v = parsed
+	return nil
+}
+
+// leadingZeros returns the number of leading zeros of the number at i.
+func (v Version) leadingZeros(i int) int {
+	if i < len(v.zeros) {
+		return v.zeros[i]
+	}
+	return 0
+}
+
+// FuzzyEquals returns whether v is within other, as for the ~ constraint, if v starts with the first depth numbers
+// of other, e.g. 1.7.1-r1 is within 1.7. A depth of 0 or less, or at least the count of the numbers of other,
+// uses all of other, so that its letter, suffixes and revision, if any, must match too, e.g. 1.7.1-r1 is not
+// within 1.7.1-r2.
+//
+// If either version was parsed by ParseAPKTools, a depth of 0 or less is as apk-tools has it instead, for which
+// v must start with the tokens of other, see CompareAPKTools.
+func (v Version) FuzzyEquals(other Version, depth int) bool {
+	if (v.apkTools != "" || other.apkTools != "") && (depth <= 0 || depth >= len(other.numbers)) {
+		return compareTokens(v.String(), other.String(), true) == equal
+	}
+	if depth > 0 && depth < len(other.numbers) {
+		prefix := Version{numbers: other.numbers[:depth]}
+		if depth < len(other.zeros) {
+			prefix.zeros = other.zeros[:depth]
+		}
+		other = prefix
+	}
+	return includes(v, other)
+}
+
+// includes returns true if the actual version is a strict subset of the required version
+func includes(actual, required Version) bool {
+	// if more required numbers than actual numbers, than require is more specific,
+	// so no match
+	if len(actual.numbers) < len(required.numbers) {
+		return false
+	}
+	for i := 0; i < len(required.numbers); i++ {
+		if actual.numbers[i] != required.numbers[i] || actual.leadingZeros(i) != required.leadingZeros(i) {
+			return false
+		}
+	}
+	// if length is the same, check the rest of it; if actual is longer, it's ok
+	if len(actual.numbers) > len(required.numbers) {
+		return true
+	}
+	// was there a required letter?
+	if required.letter != 0 && actual.letter != required.letter {
+		return false
+	}
+
+	// were there suffixes
+	if len(actual.suffixes) < len(required.suffixes) {
+		return false
+	}
+	for i, requiredSuffix := range required.suffixes {
+		if actual.suffixes[i].kind != requiredSuffix.kind {
+			return false
+		}
+		if requiredSuffix.number != 0 && actual.suffixes[i].number != requiredSuffix.number {
+			return false
+		}
+	}
+
+	// compare revisions
+	if required.revision != 0 && actual.revision != required.revision {
+		return false
+	}
+	return true
+}